@@ -34,6 +34,10 @@
             # Inject flake-related environment variables
             "-X github.com/saberzero1/omnix/pkg/nix/flake.defaultFlakeSchemas=${envVars.DEFAULT_FLAKE_SCHEMAS}"
             "-X github.com/saberzero1/omnix/pkg/nix/flake.inspectFlake=${envVars.INSPECT_FLAKE}"
+            # Remote hosts run omnix from its own source, copied to them.
+            # Its context is discarded so that the source is not a runtime
+            # dependency of omnix; om checks that it is still in the store.
+            "-X github.com/saberzero1/omnix/pkg/ci.omnixSource=${builtins.unsafeDiscardStringContext src}"
           ];
 
           # Only build the main binary
@@ -95,11 +95,12 @@ func TestRunSubflake_InvalidFlakeURL(t *testing.T) {
 	}
 
 	// This should handle the error gracefully or succeed
-	result, err := runSubflake(ctx, flake, "test", subflake, opts)
+	plan, err := newSubflakePlan(flake, "test", subflake, opts)
 	// Verify it doesn't panic - either succeeds or fails gracefully
 	if err != nil {
 		assert.Error(t, err)
 	} else {
+		result := runSubflake(ctx, plan, opts)
 		assert.Equal(t, "test", result.Subflake)
 	}
 }
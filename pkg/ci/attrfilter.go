@@ -0,0 +1,283 @@
+package ci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/flake"
+)
+
+// attrFilter selects the outputs built by the build step by their
+// attribute paths.
+//
+// Patterns are matched component by component, the components being
+// separated by dots; within a component, * matches any sequence of
+// characters and ? any single one (see path.Match). A pattern also matches
+// everything below the attribute it names, so "packages" matches every
+// package and "packages.*.docs" matches "packages.x86_64-linux.docs".
+type attrFilter struct {
+	include []string
+	exclude []string
+}
+
+// newAttrFilter returns the filter of a build step: --only replaces the
+// include patterns of the configuration, --exclude adds to its excludes
+func newAttrFilter(step BuildStep, opts RunOptions) (attrFilter, error) {
+	filter := attrFilter{include: step.Include}
+	if len(opts.Only) > 0 {
+		filter.include = opts.Only
+	}
+	filter.exclude = append(append([]string{}, step.Exclude...), opts.Exclude...)
+
+	for _, pattern := range append(append([]string{}, filter.include...), filter.exclude...) {
+		if err := validateAttrPattern(pattern); err != nil {
+			return attrFilter{}, err
+		}
+	}
+	return filter, nil
+}
+
+// active reports whether the filter selects anything less than all outputs
+func (f attrFilter) active() bool {
+	return len(f.include) > 0 || len(f.exclude) > 0
+}
+
+// matches reports whether the output with the given attribute path is selected
+func (f attrFilter) matches(attr string) bool {
+	if len(f.include) > 0 && !matchAnyAttrPattern(f.include, attr) {
+		return false
+	}
+	return !matchAnyAttrPattern(f.exclude, attr)
+}
+
+// selectBuildables returns the buildable outputs matching the filter
+func (f attrFilter) selectBuildables(buildables []nix.BuildableAttr) []nix.BuildableAttr {
+	var selected []nix.BuildableAttr
+	for _, buildable := range buildables {
+		if f.matches(buildable.Attr) {
+			selected = append(selected, buildable)
+		}
+	}
+	return selected
+}
+
+// validateAttrPattern checks the syntax of an attribute pattern
+func validateAttrPattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("invalid attribute pattern: empty pattern")
+	}
+	for _, component := range strings.Split(pattern, ".") {
+		if _, err := path.Match(component, ""); err != nil {
+			return fmt.Errorf("invalid attribute pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchAnyAttrPattern reports whether attr matches any of the patterns
+func matchAnyAttrPattern(patterns []string, attr string) bool {
+	for _, pattern := range patterns {
+		if matchAttrPattern(pattern, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAttrPattern reports whether attr, or an attribute it is below,
+// matches pattern
+func matchAttrPattern(pattern, attr string) bool {
+	patternParts := strings.Split(pattern, ".")
+	attrParts := strings.Split(attr, ".")
+	if len(patternParts) > len(attrParts) {
+		return false
+	}
+	for i, part := range patternParts {
+		if ok, _ := path.Match(part, attrParts[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// configurationInstallables maps the types of the configuration outputs to
+// the attribute built for each configuration
+var configurationInstallables = map[flake.Type]string{
+	flake.TypeNixosConfiguration:  "config.system.build.toplevel",
+	flake.TypeDarwinConfiguration: "system",
+	flake.TypeHomeConfiguration:   "activationPackage",
+}
+
+// flakeSchemaCommand returns the `nix eval` arguments evaluating the flake
+// schemas of a flake, which list its outputs, for the build step
+func flakeSchemaCommand(flakeURL nix.FlakeURL, step BuildStep, overrides map[string]string, opts RunOptions) ([]string, error) {
+	// As with devour-flake, no systems means those of the inspect flake
+	var systemsURL string
+	if len(opts.Systems) > 0 {
+		url, err := nix.GetSystemsFlakeURL(opts.Systems)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get systems flake URL: %w", err)
+		}
+		systemsURL = url.String()
+	}
+	return flake.SchemaArgs(flakeURL.String(), systemsURL, &flake.FlakeOptions{
+		OverrideInputs: overrides,
+		Impure:         step.Impure,
+	})
+}
+
+// schemaBuildables returns the buildable outputs of a flake, sorted by
+// attribute path: those its schemas give a derivation, and its NixOS,
+// nix-darwin and Home Manager configurations
+func schemaBuildables(schemas *flake.FlakeSchemas) []nix.BuildableAttr {
+	var buildables []nix.BuildableAttr
+
+	var walk func(path []string, outputs *flake.FlakeOutputs)
+	walk = func(path []string, outputs *flake.FlakeOutputs) {
+		if val := outputs.GetVal(); val != nil {
+			attr := strings.Join(path, ".")
+			if installable, ok := configurationInstallables[val.Type_]; ok {
+				buildables = append(buildables, nix.BuildableAttr{Attr: attr, Installable: attr + "." + installable})
+			} else if val.DerivationName != nil {
+				buildables = append(buildables, nix.BuildableAttr{Attr: attr, Installable: attr})
+			}
+			return
+		}
+		for name, child := range outputs.GetAttrset() {
+			walk(append(path[:len(path):len(path)], name), child)
+		}
+	}
+	if outputs := schemas.ToFlakeOutputs(); outputs != nil {
+		walk(nil, outputs)
+	}
+
+	sort.Slice(buildables, func(i, j int) bool { return buildables[i].Attr < buildables[j].Attr })
+	return buildables
+}
+
+// listBuildables lists the buildable outputs of a flake for the systems of
+// opts, from its flake schemas
+func listBuildables(ctx context.Context, flakeURL nix.FlakeURL, step BuildStep, overrides map[string]string, opts RunOptions) ([]nix.BuildableAttr, error) {
+	args, err := flakeSchemaCommand(flakeURL, step, overrides, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var schemas flake.FlakeSchemas
+	if err := nix.NewCmd().RunJSON(ctx, &schemas, args...); err != nil {
+		return nil, err
+	}
+	return schemaBuildables(&schemas), nil
+}
+
+// buildSelectedOutputs builds the outputs of a flake selected by filter,
+// returning the outcome of each of them
+func buildSelectedOutputs(ctx context.Context, flakeURL nix.FlakeURL, step BuildStep, filter attrFilter, overrides map[string]string, opts RunOptions, out *nix.OutputStream) ([]AttrResult, error) {
+	buildables, err := listBuildables(ctx, flakeURL, step, overrides, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list flake outputs: %w", err)
+	}
+
+	selected := filter.selectBuildables(buildables)
+	out.WriteLine(fmt.Sprintf("Building %d of %d outputs", len(selected), len(buildables)))
+	if len(selected) == 0 {
+		return nil, nil
+	}
+
+	return buildSelected(ctx, flakeURL, step, selected, overrides, out)
+}
+
+// buildSelected builds the selected outputs of a flake all at once, keeping
+// going past failures, and returns the outcome of each of them. When the
+// build fails, the outcome of each output is told from the failed
+// derivations reported in the build log, as for devour-flake.
+func buildSelected(ctx context.Context, flakeURL nix.FlakeURL, step BuildStep, selected []nix.BuildableAttr, overrides map[string]string, out *nix.OutputStream) ([]AttrResult, error) {
+	args := buildSelectedArgs(flakeURL, step, selected, overrides)
+	args = append([]string{"build", "--json"}, args[1:]...)
+
+	failures := &nix.BuildFailures{}
+	stop := out.Watch(failures.AddLine)
+	outPaths, err := buildOutPaths(ctx, nix.NewCmd(), args, out)
+	stop()
+
+	if err == nil {
+		if len(outPaths) != len(selected) {
+			return nil, fmt.Errorf("built %d derivations for %d flake outputs", len(outPaths), len(selected))
+		}
+		results := make([]AttrResult, 0, len(selected))
+		for i, buildable := range selected {
+			results = append(results, builtAttr(buildable.Attr, outPathsOf(outPaths[i:i+1])))
+		}
+		return results, nil
+	}
+	if ctx.Err() != nil || failures.Empty() {
+		return nil, err
+	}
+
+	drvs, drvErr := dryRunBuildables(ctx, flakeURL, step, selected, overrides)
+	if drvErr != nil {
+		out.WriteLine(fmt.Sprintf("Could not tell which outputs failed: %v", drvErr))
+		return nil, err
+	}
+	results := failureResults(ctx, selected, drvs, failures)
+	if buildErr := attrBuildError(results); buildErr != nil {
+		err = buildErr
+	}
+	return results, err
+}
+
+// flakeSchemaCopyArgs returns the `nix copy` arguments copying the inspect
+// and flake-schemas flakes, with which the outputs of a flake are listed, to
+// a remote host
+func flakeSchemaCopyArgs(host string) []string {
+	return []string{"copy", "-v", "--to", "ssh-ng://" + host, flake.GetInspectFlake(), flake.GetDefaultFlakeSchemas()}
+}
+
+// selectRemoteBuildables lists the buildable outputs of a flake on a remote
+// host, returning those selected by filter
+func selectRemoteBuildables(ctx context.Context, ssh SSH, host string, flakeURL nix.FlakeURL, step BuildStep, filter attrFilter, overrides map[string]string, opts RunOptions, out *nix.OutputStream) ([]nix.BuildableAttr, error) {
+	args, err := flakeSchemaCommand(flakeURL, step, overrides, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list flake outputs: %w", err)
+	}
+
+	// The flake schemas are evaluated on the host, which needs the flakes
+	// evaluating them
+	if err := nix.NewCmd().RunStreaming(ctx, out, flakeSchemaCopyArgs(host)...); err != nil {
+		return nil, fmt.Errorf("failed to copy the flake schemas to %s: %w", host, err)
+	}
+
+	output, err := ssh.Output(ctx, host, append([]string{"nix"}, args...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list flake outputs: %w", err)
+	}
+
+	var schemas flake.FlakeSchemas
+	if err := json.Unmarshal([]byte(output), &schemas); err != nil {
+		return nil, fmt.Errorf("failed to parse flake schemas: %w", err)
+	}
+	buildables := schemaBuildables(&schemas)
+
+	selected := filter.selectBuildables(buildables)
+	out.WriteLine(fmt.Sprintf("Building %d of %d outputs", len(selected), len(buildables)))
+	return selected, nil
+}
+
+// buildSelectedArgs returns the nix arguments building the selected outputs
+// of a flake all at once, keeping going past failures
+func buildSelectedArgs(flakeURL nix.FlakeURL, step BuildStep, selected []nix.BuildableAttr, overrides map[string]string) []string {
+	args := []string{"build", "-L", "--no-link", "--keep-going"}
+	if step.Impure {
+		args = append(args, "--impure")
+	}
+	args = append(args, nix.OverrideInputArgs(overrides, "")...)
+	for _, buildable := range selected {
+		args = append(args, buildFlakeURLWithAttr(flakeURL, buildable.Installable))
+	}
+	return args
+}
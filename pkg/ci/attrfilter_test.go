@@ -0,0 +1,219 @@
+package ci
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/flake"
+	"github.com/saberzero1/omnix/pkg/nix/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// testFlakeSchemas is the flake schemas inventory of a flake with a few
+// buildable outputs, as evaluated for x86_64-linux
+const testFlakeSchemas = `{
+  "inventory": {
+    "packages": {"doc": "Packages", "children": {
+      "x86_64-linux": {"children": {
+        "default": {"what": "package", "derivationName": "hello"},
+        "docs": {"what": "package", "derivationName": "hello-docs"}
+      }}
+    }},
+    "checks": {"children": {"x86_64-linux": {"children": {"test": {"what": "CI test", "derivationName": "test"}}}}},
+    "apps": {"children": {"x86_64-linux": {"children": {"default": {"what": "app"}}}}},
+    "nixosModules": {"children": {"default": {"what": "NixOS module"}}},
+    "nixosConfigurations": {"children": {"vm": {"what": "NixOS configuration"}}}
+  }
+}`
+
+// testSchemaCommand is the command listing the outputs of /src for
+// x86_64-linux with the flakes set by setFlakeSchemaEnv
+const testSchemaCommand = "eval --json --no-write-lock-file --override-input flake /src " +
+	"--override-input flake-schemas /nix/store/flake-schemas " +
+	"--override-input systems github:nix-systems/x86_64-linux " +
+	"/nix/store/inspect#contents.excludingOutputPaths --quiet --quiet"
+
+// setFlakeSchemaEnv sets the inspect and flake-schemas flakes with which
+// flake outputs are listed
+func setFlakeSchemaEnv(t *testing.T) {
+	t.Setenv("INSPECT_FLAKE", "/nix/store/inspect")
+	t.Setenv("DEFAULT_FLAKE_SCHEMAS", "/nix/store/flake-schemas")
+}
+
+func TestMatchAttrPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		attr    string
+		want    bool
+	}{
+		{"packages.*.docs", "packages.x86_64-linux.docs", true},
+		{"packages.*.docs", "packages.x86_64-linux.default", false},
+		{"nixosConfigurations.*", "nixosConfigurations.vm", true},
+		{"packages", "packages.x86_64-linux.docs", true},
+		{"packages.x86_64-*", "packages.x86_64-linux.docs", true},
+		{"packages.*-darwin", "packages.x86_64-linux.docs", false},
+		{"*.x86_64-linux.test", "checks.x86_64-linux.test", true},
+		{"checks.x86_64-linux.test.more", "checks.x86_64-linux.test", false},
+		// * does not match across components
+		{"packages.*", "packagesX.x86_64-linux.docs", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.attr, func(t *testing.T) {
+			assert.Equal(t, tt.want, matchAttrPattern(tt.pattern, tt.attr))
+		})
+	}
+}
+
+func TestNewAttrFilter(t *testing.T) {
+	step := BuildStep{Include: []string{"packages"}, Exclude: []string{"packages.*.docs"}}
+
+	filter, err := newAttrFilter(step, RunOptions{})
+	require.NoError(t, err)
+	assert.True(t, filter.active())
+	assert.True(t, filter.matches("packages.x86_64-linux.default"))
+	assert.False(t, filter.matches("packages.x86_64-linux.docs"))
+	assert.False(t, filter.matches("checks.x86_64-linux.test"))
+
+	// --only replaces the included outputs, --exclude adds to the excluded ones
+	filter, err = newAttrFilter(step, RunOptions{Only: []string{"checks", "packages"}, Exclude: []string{"packages.aarch64-darwin"}})
+	require.NoError(t, err)
+	assert.True(t, filter.matches("checks.x86_64-linux.test"))
+	assert.False(t, filter.matches("packages.x86_64-linux.docs"))
+	assert.False(t, filter.matches("packages.aarch64-darwin.default"))
+
+	filter, err = newAttrFilter(BuildStep{}, RunOptions{})
+	require.NoError(t, err)
+	assert.False(t, filter.active())
+
+	_, err = newAttrFilter(BuildStep{Exclude: []string{"packages.[x"}}, RunOptions{})
+	assert.ErrorContains(t, err, `invalid attribute pattern "packages.[x"`)
+}
+
+func TestBuildStep_FiltersYAML(t *testing.T) {
+	var step BuildStep
+	require.NoError(t, yaml.Unmarshal([]byte(`
+enable: true
+include: [packages, checks]
+exclude: ["packages.*.docs"]
+`), &step))
+
+	assert.Equal(t, []string{"packages", "checks"}, step.Include)
+	assert.Equal(t, []string{"packages.*.docs"}, step.Exclude)
+}
+
+func TestSchemaBuildables(t *testing.T) {
+	var schemas flake.FlakeSchemas
+	require.NoError(t, json.Unmarshal([]byte(`{
+  "inventory": {
+    "packages": {"children": {"x86_64-linux": {"children": {"hello": {"what": "package", "derivationName": "hello"}}}}},
+    "formatter": {"children": {"x86_64-linux": {"what": "package", "derivationName": "treefmt"}}},
+    "dockerImages": {"children": {"x86_64-linux": {"children": {"app": {"what": "Docker image", "derivationName": "app.tar.gz"}}}}},
+    "apps": {"children": {"x86_64-linux": {"children": {"default": {"what": "app"}}}}},
+    "templates": {"children": {"default": {"what": "template"}}},
+    "nixosConfigurations": {"children": {"server": {"what": "NixOS configuration"}}},
+    "darwinConfigurations": {"children": {"mac": {"what": "nix-darwin configuration"}}},
+    "homeConfigurations": {"children": {"me": {"what": "Home Manager configuration"}}}
+  }
+}`), &schemas))
+
+	// Every output with a derivation is buildable, whichever schema
+	// defines it, and configurations build their system
+	assert.Equal(t, []nix.BuildableAttr{
+		{Attr: "darwinConfigurations.mac", Installable: "darwinConfigurations.mac.system"},
+		{Attr: "dockerImages.x86_64-linux.app", Installable: "dockerImages.x86_64-linux.app"},
+		{Attr: "formatter.x86_64-linux", Installable: "formatter.x86_64-linux"},
+		{Attr: "homeConfigurations.me", Installable: "homeConfigurations.me.activationPackage"},
+		{Attr: "nixosConfigurations.server", Installable: "nixosConfigurations.server.config.system.build.toplevel"},
+		{Attr: "packages.x86_64-linux.hello", Installable: "packages.x86_64-linux.hello"},
+	}, schemaBuildables(&schemas))
+
+	assert.Empty(t, schemaBuildables(&flake.FlakeSchemas{}))
+}
+
+func TestRunBuildStep_Filters(t *testing.T) {
+	setFlakeSchemaEnv(t)
+	logPath := installFakeNix(t, `case "$*" in
+  eval\ *) echo '`+testFlakeSchemas+`';;
+  build\ --dry-run\ *) echo '[{"drvPath": "/nix/store/ccc-test.drv", "outputs": {"out": "/nix/store/ccc-test"}},
+    {"drvPath": "/nix/store/aaa-hello.drv", "outputs": {"out": "/nix/store/aaa-hello"}}]';;
+  *\#checks.x86_64-linux.test\ *) echo "error: builder for '/nix/store/ccc-test.drv' failed" >&2; exit 1;;
+  *\#nixosConfigurations.vm.config.system.build.toplevel) echo '[{"drvPath": "/nix/store/vvv-vm.drv", "outputs": {"out": "/nix/store/vvv-vm"}}]';;
+esac`)
+
+	flake, err := nix.ParseFlakeURL("/src")
+	require.NoError(t, err)
+	step := BuildStep{Enable: true, Exclude: []string{"nixosConfigurations.*", "packages.*.docs"}}
+	opts := RunOptions{Systems: []string{"x86_64-linux"}}
+
+	out := newTestStream(t)
+	result := runBuildStep(context.Background(), flake, step, nil, opts, "", out)
+	assert.False(t, result.Success)
+	assert.Equal(t, "failed to build 1 of 2 attributes: checks.x86_64-linux.test", result.Error)
+	assert.Contains(t, out.Tail(), "Building 2 of 4 outputs")
+
+	// The selected outputs are built at once, and reported on their own
+	require.Len(t, result.Attributes, 2)
+	assert.Equal(t, "checks.x86_64-linux.test", result.Attributes[0].Attr)
+	assert.False(t, result.Attributes[0].Success)
+	assert.Equal(t, AttrStatusFailed, result.Attributes[0].Status)
+	assert.Equal(t, "/nix/store/ccc-test.drv", result.Attributes[0].DrvPath)
+	assert.Contains(t, result.Attributes[0].Error, "ccc-test.drv")
+	assert.Equal(t, AttrResult{
+		Attr:     "packages.x86_64-linux.default",
+		Success:  true,
+		Status:   AttrStatusBuilt,
+		OutPaths: []store.Path{store.NewPath("/nix/store/aaa-hello")},
+	}, result.Attributes[1])
+	assert.Equal(t, []string{"/nix/store/aaa-hello"}, pathStrings(result.OutPaths))
+
+	assert.Equal(t, []string{
+		testSchemaCommand,
+		"build --json -L --no-link --keep-going /src#checks.x86_64-linux.test /src#packages.x86_64-linux.default",
+		"build --dry-run --json --no-link /src#checks.x86_64-linux.test /src#packages.x86_64-linux.default",
+	}, readFakeNixLog(t, logPath))
+
+	// --only selects the NixOS configuration, which builds its toplevel
+	opts.Only = []string{"nixosConfigurations.vm"}
+	step.Exclude = nil
+	result = runBuildStep(context.Background(), flake, step, nil, opts, "", newTestStream(t))
+	require.True(t, result.Success, result.Error)
+	require.Len(t, result.Attributes, 1)
+	assert.Equal(t, builtAttr("nixosConfigurations.vm", []store.Path{store.NewPath("/nix/store/vvv-vm")}), result.Attributes[0])
+	calls := readFakeNixLog(t, logPath)
+	assert.Equal(t, "build --json -L --no-link --keep-going /src#nixosConfigurations.vm.config.system.build.toplevel", calls[len(calls)-1])
+
+	// Nothing selected is not an error
+	opts.Only = []string{"apps"}
+	result = runBuildStep(context.Background(), flake, step, nil, opts, "", newTestStream(t))
+	assert.True(t, result.Success, result.Error)
+	assert.Empty(t, result.Attributes)
+}
+
+func TestRunBuildStepRemote_Filters(t *testing.T) {
+	setFlakeSchemaEnv(t)
+	logPath := installFakeNix(t, "")
+	ssh := &fakeSSH{output: testFlakeSchemas}
+	flake, err := nix.ParseFlakeURL("/nix/store/abc-source")
+	require.NoError(t, err)
+
+	step := BuildStep{Enable: true, Include: []string{"packages"}, Impure: true}
+	opts := RunOptions{Systems: []string{"x86_64-linux"}, Exclude: []string{"packages.*.docs"}}
+
+	result := runBuildStepRemote(context.Background(), ssh, "user@host", flake, step, nil, opts, newTestStream(t))
+	require.True(t, result.Success, result.Error)
+	assert.Equal(t, []string{"packages.x86_64-linux.default"}, result.Attrs)
+
+	// The flakes listing the outputs are copied to the host first
+	assert.Equal(t, []string{"copy -v --to ssh-ng://user@host /nix/store/inspect /nix/store/flake-schemas"}, readFakeNixLog(t, logPath))
+	assert.Equal(t, []string{
+		"user@host: nix eval --json --impure --no-write-lock-file --override-input flake /nix/store/abc-source " +
+			"--override-input flake-schemas /nix/store/flake-schemas --override-input systems github:nix-systems/x86_64-linux " +
+			"/nix/store/inspect#contents.excludingOutputPaths --quiet --quiet",
+		"user@host: nix build -L --no-link --keep-going --impure /nix/store/abc-source#packages.x86_64-linux.default",
+	}, ssh.commands)
+}
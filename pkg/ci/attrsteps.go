@@ -0,0 +1,274 @@
+package ci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/flake"
+	"github.com/saberzero1/omnix/pkg/nix/store"
+)
+
+// streamingCmd runs the nix commands of the flake package with their output
+// streamed to out
+type streamingCmd struct {
+	cmd *nix.Cmd
+	out *nix.OutputStream
+}
+
+// Run implements flake.Cmd
+func (c streamingCmd) Run(ctx context.Context, args ...string) (string, error) {
+	return c.cmd.RunStreamingStdout(ctx, c.out, args...)
+}
+
+// AttrStatus is the outcome of building one flake output
+type AttrStatus string
+
+const (
+	// AttrStatusBuilt means the output was built
+	AttrStatusBuilt AttrStatus = "built"
+	// AttrStatusFailed means the derivation of the output failed to build
+	AttrStatusFailed AttrStatus = "failed"
+	// AttrStatusDependencyFailed means the output was not built because one
+	// of its dependencies failed to build
+	AttrStatusDependencyFailed AttrStatus = "dependency-failed"
+)
+
+// AttrResult is the outcome of building one flake output attribute
+type AttrResult struct {
+	// Attr is the attribute path of the output, e.g. "packages.x86_64-linux.hello".
+	// When devour-flake built every output successfully, it is the name
+	// devour-flake reports the output under instead.
+	Attr string `json:"attr"`
+
+	// Success indicates if the output was built
+	Success bool `json:"success"`
+
+	// Status is the outcome of the build
+	Status AttrStatus `json:"status"`
+
+	// DrvPath is the derivation that failed to build: the output's own one
+	// if it failed, the failed dependency if a dependency failed, and empty
+	// if that couldn't be told (e.g. on an evaluation error)
+	DrvPath string `json:"drvPath,omitempty"`
+
+	// OutPaths are the store paths built for the output
+	OutPaths []store.Path `json:"outPaths,omitempty"`
+
+	// Error contains the error message if the build failed
+	Error string `json:"error,omitempty"`
+}
+
+// builtAttr returns the result of an output built into outPaths
+func builtAttr(attr string, outPaths []store.Path) AttrResult {
+	return AttrResult{Attr: attr, Success: true, Status: AttrStatusBuilt, OutPaths: outPaths}
+}
+
+// failedAttr returns the result of an output that failed to build, telling
+// from the failures reported by its build whether its own derivation or a
+// dependency failed
+func failedAttr(attr string, failures *nix.BuildFailures, err error) AttrResult {
+	result := AttrResult{Attr: attr, Status: AttrStatusFailed, Error: err.Error()}
+	if len(failures.DependencyFailed) > 0 {
+		result.Status = AttrStatusDependencyFailed
+	}
+	if len(failures.Failed) > 0 {
+		result.DrvPath = failures.Failed[0]
+	}
+	return result
+}
+
+// attrBuildError returns the error of a build step whose outputs failed to
+// build, or nil if all of them were built
+func attrBuildError(results []AttrResult) error {
+	var failed []string
+	for _, result := range results {
+		if !result.Success {
+			failed = append(failed, result.Attr)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to build %d of %d attributes: %s", len(failed), len(results), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// buildAttrs builds the attributes of a build step with its commands (see
+// customStepCommands), one per attribute, returning the outcome of each of
+// them
+func buildAttrs(ctx context.Context, cmd *nix.Cmd, step CustomStep, commands [][]string, out *nix.OutputStream) ([]AttrResult, error) {
+	targets := make([]buildTarget, len(step.Attrs))
+	for i, attr := range step.Attrs {
+		targets[i] = buildTarget{attr: attr, args: commands[i][1:]}
+	}
+	return buildEach(ctx, cmd, targets, out)
+}
+
+// buildTarget is an output built by buildEach
+type buildTarget struct {
+	// attr is the attribute path of the output
+	attr string
+
+	// args are the `nix build --json` arguments building it
+	args []string
+}
+
+// buildEach builds the given outputs one by one. A failed output does not
+// stop the others from building; the error returned lists the failed ones.
+func buildEach(ctx context.Context, cmd *nix.Cmd, targets []buildTarget, out *nix.OutputStream) ([]AttrResult, error) {
+	results := make([]AttrResult, 0, len(targets))
+	for _, target := range targets {
+		failures := &nix.BuildFailures{}
+		stop := out.Watch(failures.AddLine)
+		outPaths, err := buildOutPaths(ctx, cmd, target.args, out)
+		stop()
+		if err != nil {
+			if ctx.Err() != nil {
+				return results, err
+			}
+			out.WriteLine(fmt.Sprintf("failed to build %s: %v", target.attr, err))
+			results = append(results, failedAttr(target.attr, failures, err))
+		} else {
+			results = append(results, builtAttr(target.attr, outPathsOf(outPaths)))
+		}
+	}
+	return results, attrBuildError(results)
+}
+
+// buildOutPaths runs `nix build --json` with args, as flake.Build does,
+// returning the paths built
+func buildOutPaths(ctx context.Context, cmd *nix.Cmd, args []string, out *nix.OutputStream) ([]flake.OutPath, error) {
+	output, err := streamingCmd{cmd, out}.Run(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var outPaths []flake.OutPath
+	if err := json.Unmarshal([]byte(output), &outPaths); err != nil {
+		return nil, fmt.Errorf("failed to parse build output: %w", err)
+	}
+	return outPaths, nil
+}
+
+// attrOutPaths returns the paths built for all attributes
+func attrOutPaths(results []AttrResult) []store.Path {
+	var paths []store.Path
+	for _, result := range results {
+		paths = append(paths, result.OutPaths...)
+	}
+	return paths
+}
+
+// outPathsOf returns the output paths of built derivations, ordered by
+// derivation and output name
+func outPathsOf(outPaths []flake.OutPath) []store.Path {
+	var paths []store.Path
+	for _, outPath := range outPaths {
+		names := make([]string, 0, len(outPath.Outputs))
+		for name := range outPath.Outputs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			// Outputs of content-addressed derivations not built yet
+			// have no known path
+			if outPath.Outputs[name] != "" {
+				paths = append(paths, store.NewPath(outPath.Outputs[name]))
+			}
+		}
+	}
+	return paths
+}
+
+// evalAttr evaluates the attribute of an eval step with its command (see
+// customStepCommands), checking its value against the expected one, if any
+func evalAttr(ctx context.Context, cmd *nix.Cmd, step CustomStep, command []string, out *nix.OutputStream) error {
+	output, err := streamingCmd{cmd, out}.Run(ctx, command[1:]...)
+	if err != nil {
+		return err
+	}
+	return checkEvalOutput(step, output)
+}
+
+// checkEvalOutput parses the `nix eval --json` output of an eval step,
+// checking the value against the expected one
+func checkEvalOutput(step CustomStep, output string) error {
+	var value interface{}
+	if err := json.Unmarshal([]byte(output), &value); err != nil {
+		return fmt.Errorf("failed to parse JSON: %w", err)
+	}
+	return checkEvalResult(step, value)
+}
+
+// checkEvalResult compares the value an eval step evaluated to with the
+// expected one. Both are compared as JSON values, so that e.g. integers
+// from YAML match numbers from nix.
+func checkEvalResult(step CustomStep, value interface{}) error {
+	if step.Expected == nil {
+		return nil
+	}
+
+	expected, err := normalizeJSON(step.Expected)
+	if err != nil {
+		return fmt.Errorf("invalid expected value: %w", err)
+	}
+	actual, err := normalizeJSON(value)
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(expected, actual) {
+		return nil
+	}
+
+	expectedJSON, _ := json.Marshal(expected)
+	actualJSON, _ := json.Marshal(actual)
+	return fmt.Errorf("%s evaluated to %s, expected %s", step.Attr, actualJSON, expectedJSON)
+}
+
+// normalizeJSON converts v to the value decoding its JSON encoding gives
+func normalizeJSON(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var normalized interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+// remoteBuildAttrsArgs returns the nix arguments building the attributes of
+// a build step on a remote host, all at once
+func remoteBuildAttrsArgs(flakeURL nix.FlakeURL, step CustomStep, overrides map[string]string) []string {
+	args := []string{"build", "--no-link", "--keep-going"}
+	args = append(args, nix.OverrideInputArgs(overrides, "")...)
+	for _, attr := range step.Attrs {
+		args = append(args, buildFlakeURLWithAttr(flakeURL, attr))
+	}
+	return args
+}
+
+// remoteEvalAttrArgs returns the nix arguments evaluating the attribute of an
+// eval step on a remote host
+func remoteEvalAttrArgs(flakeURL nix.FlakeURL, step CustomStep, overrides map[string]string) []string {
+	args := []string{"eval", "--json"}
+	args = append(args, nix.OverrideInputArgs(overrides, "")...)
+	return append(args, buildFlakeURLWithAttr(flakeURL, step.Attr), "--quiet", "--quiet")
+}
+
+// evalAttrRemote evaluates the attribute of an eval step on a remote host
+// with its command (see customStepCommands), whose output is captured rather
+// than streamed
+func evalAttrRemote(ctx context.Context, ssh SSH, host string, step CustomStep, command []string, out *nix.OutputStream) error {
+	output, err := ssh.Output(ctx, host, command)
+	if err != nil {
+		return err
+	}
+	out.WriteLine(strings.TrimSpace(output))
+	return checkEvalOutput(step, output)
+}
@@ -0,0 +1,131 @@
+package ci
+
+import (
+	"context"
+	"testing"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestRunCustomStep_Build(t *testing.T) {
+	logPath := installFakeNix(t, `case "$*" in
+  *\#packages.x86_64-linux.hello) echo '[{"drvPath": "/nix/store/aaa-hello.drv", "outputs": {"out": "/nix/store/aaa-hello", "doc": "/nix/store/aaa-hello-doc"}}]';;
+  *\#packages.x86_64-linux.broken) echo "error: builder for '/nix/store/bbb-broken.drv' failed" >&2; exit 1;;
+  *\#packages.x86_64-linux.world) echo '[{"drvPath": "/nix/store/ccc-world.drv", "outputs": {"out": "/nix/store/ccc-world"}}]';;
+esac`)
+
+	flake, err := nix.ParseFlakeURL("/src")
+	require.NoError(t, err)
+	step := CustomStep{
+		Type:  CustomStepTypeBuild,
+		Attrs: []string{"packages.x86_64-linux.hello", "packages.x86_64-linux.world"},
+	}
+
+	result := runCustomStep(context.Background(), flake, "packages", step, nil, newTestStream(t))
+	require.True(t, result.Success, result.Error)
+	assert.Equal(t, step.Attrs, result.Attrs)
+	assert.Equal(t, []string{"/nix/store/aaa-hello-doc", "/nix/store/aaa-hello", "/nix/store/ccc-world"}, pathStrings(result.OutPaths))
+	assert.Equal(t, []string{
+		"build --no-link --json /src#packages.x86_64-linux.hello",
+		"build --no-link --json /src#packages.x86_64-linux.world",
+	}, readFakeNixLog(t, logPath))
+
+	// A failed attribute does not stop the others
+	step.Attrs = []string{"packages.x86_64-linux.broken", "packages.x86_64-linux.world"}
+	out := newTestStream(t)
+	result = runCustomStep(context.Background(), flake, "packages", step, nil, out)
+	assert.False(t, result.Success)
+	assert.Equal(t, "failed to build 1 of 2 attributes: packages.x86_64-linux.broken", result.Error)
+	assert.Equal(t, []string{"/nix/store/ccc-world"}, pathStrings(result.OutPaths))
+	assert.Contains(t, out.Tail(), "failed to build packages.x86_64-linux.broken")
+
+	result = runCustomStep(context.Background(), flake, "packages", CustomStep{Type: CustomStepTypeBuild}, nil, newTestStream(t))
+	assert.Equal(t, "build step has no attrs", result.Error)
+}
+
+func TestRunCustomStep_Eval(t *testing.T) {
+	logPath := installFakeNix(t, `echo '{"enable": true, "port": 8080}'`)
+
+	flake, err := nix.ParseFlakeURL("/src")
+	require.NoError(t, err)
+	step := CustomStep{
+		Type:     CustomStepTypeEval,
+		Attr:     "nixosConfigurations.server.config.services.web",
+		Expected: map[string]interface{}{"enable": true, "port": 8080},
+	}
+
+	out := newTestStream(t)
+	result := runCustomStep(context.Background(), flake, "web", step, nil, out)
+	require.True(t, result.Success, result.Error)
+	assert.Equal(t, []string{step.Attr}, result.Attrs)
+	assert.Contains(t, out.Tail(), `"port": 8080`)
+	assert.Equal(t, []string{
+		"eval --json /src#nixosConfigurations.server.config.services.web --quiet --quiet",
+	}, readFakeNixLog(t, logPath))
+
+	step.Expected = map[string]interface{}{"enable": false}
+	result = runCustomStep(context.Background(), flake, "web", step, nil, newTestStream(t))
+	assert.False(t, result.Success)
+	assert.Equal(t, `nixosConfigurations.server.config.services.web evaluated to {"enable":true,"port":8080}, expected {"enable":false}`, result.Error)
+
+	// Without an expected value, evaluating is enough
+	step.Expected = nil
+	result = runCustomStep(context.Background(), flake, "web", step, nil, newTestStream(t))
+	assert.True(t, result.Success, result.Error)
+}
+
+func TestRunCustomStepRemote_BuildAndEval(t *testing.T) {
+	ssh := &fakeSSH{output: `"/nix/store/xxx-nixos-system"` + "\n"}
+	flake, err := nix.ParseFlakeURL("/nix/store/abc-source")
+	require.NoError(t, err)
+
+	build := CustomStep{Type: CustomStepTypeBuild, Attrs: []string{"packages.x86_64-linux.a", "packages.x86_64-linux.b"}}
+	result := runCustomStepRemote(context.Background(), ssh, "user@host", flake, "packages", build, nil, newTestStream(t))
+	require.True(t, result.Success, result.Error)
+	assert.Equal(t, build.Attrs, result.Attrs)
+
+	eval := CustomStep{
+		Type:     CustomStepTypeEval,
+		Attr:     "nixosConfigurations.server.config.system.build.toplevel",
+		Expected: "/nix/store/xxx-nixos-system",
+	}
+	result = runCustomStepRemote(context.Background(), ssh, "user@host", flake, "toplevel", eval, nil, newTestStream(t))
+	require.True(t, result.Success, result.Error)
+
+	assert.Equal(t, []string{
+		"user@host: nix build --no-link --keep-going /nix/store/abc-source#packages.x86_64-linux.a /nix/store/abc-source#packages.x86_64-linux.b",
+		"user@host: nix eval --json /nix/store/abc-source#nixosConfigurations.server.config.system.build.toplevel --quiet --quiet",
+	}, ssh.commands)
+
+	eval.Expected = "/nix/store/yyy-nixos-system"
+	result = runCustomStepRemote(context.Background(), ssh, "user@host", flake, "toplevel", eval, nil, newTestStream(t))
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Error, `evaluated to "/nix/store/xxx-nixos-system", expected "/nix/store/yyy-nixos-system"`)
+}
+
+func TestCheckEvalResult_YAMLNumbers(t *testing.T) {
+	// YAML decodes integers as int, JSON as float64
+	step := CustomStep{Attr: "a", Expected: []interface{}{1, "two"}}
+	assert.NoError(t, checkEvalResult(step, []interface{}{float64(1), "two"}))
+	assert.Error(t, checkEvalResult(step, []interface{}{float64(2), "two"}))
+}
+
+func TestCustomStep_BuildAndEvalYAML(t *testing.T) {
+	var steps map[string]CustomStep
+	require.NoError(t, yaml.Unmarshal([]byte(`
+hello:
+  type: build
+  attrs: [packages.x86_64-linux.hello]
+stateVersion:
+  type: eval
+  attr: nixosConfigurations.server.config.system.stateVersion
+  expected: "24.05"
+`), &steps))
+
+	assert.Equal(t, CustomStep{Type: CustomStepTypeBuild, Attrs: []string{"packages.x86_64-linux.hello"}}, steps["hello"])
+	assert.Equal(t, CustomStepTypeEval, steps["stateVersion"].Type)
+	assert.Equal(t, "24.05", steps["stateVersion"].Expected)
+}
@@ -0,0 +1,135 @@
+package ci
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/flake"
+	"github.com/saberzero1/omnix/pkg/nix/store"
+)
+
+// devourAttrResults returns the result of each output built by devour-flake,
+// keyed by the name devour-flake reports it under, sorted by name
+func devourAttrResults(output *nix.DevourFlakeOutput) []AttrResult {
+	names := make([]string, 0, len(output.ByName))
+	for name := range output.ByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]AttrResult, 0, len(names))
+	for _, name := range names {
+		results = append(results, builtAttr(name, []store.Path{output.ByName[name]}))
+	}
+	return results
+}
+
+// devourFailureResults tells the outcome of each output of a flake whose
+// devour-flake build failed, from the failed derivations reported in the
+// build log. The outputs are listed and their derivations evaluated without
+// building anything; those neither failed nor depending on a failure were
+// built, since the build keeps going past failures.
+func devourFailureResults(ctx context.Context, flakeURL nix.FlakeURL, step BuildStep, failures *nix.BuildFailures, overrides map[string]string, opts RunOptions) ([]AttrResult, error) {
+	buildables, err := listBuildables(ctx, flakeURL, step, overrides, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list flake outputs: %w", err)
+	}
+	if len(buildables) == 0 {
+		return nil, nil
+	}
+
+	drvs, err := dryRunBuildables(ctx, flakeURL, step, buildables, overrides)
+	if err != nil {
+		return nil, err
+	}
+	return failureResults(ctx, buildables, drvs, failures), nil
+}
+
+// failureResults tells the outcome of each of the given outputs, whose
+// derivations are drvs, from the failures reported by a build that kept going
+// past them
+func failureResults(ctx context.Context, buildables []nix.BuildableAttr, drvs []flake.OutPath, failures *nix.BuildFailures) []AttrResult {
+	failed := make(map[string]bool, len(failures.Failed))
+	for _, drv := range failures.Failed {
+		failed[drv] = true
+	}
+	dependencyFailed := make(map[string]bool, len(failures.DependencyFailed))
+	for _, drv := range failures.DependencyFailed {
+		dependencyFailed[drv] = true
+	}
+
+	results := make([]AttrResult, 0, len(buildables))
+	for i, buildable := range buildables {
+		drv := drvs[i].DrvPath
+		switch {
+		case failed[drv]:
+			results = append(results, AttrResult{
+				Attr:    buildable.Attr,
+				Status:  AttrStatusFailed,
+				DrvPath: drv,
+				Error:   fmt.Sprintf("builder for %s failed", drv),
+			})
+		case dependencyFailed[drv]:
+			result := AttrResult{
+				Attr:   buildable.Attr,
+				Status: AttrStatusDependencyFailed,
+				Error:  "a dependency failed to build",
+			}
+			if dep := failedDependency(ctx, drv, failures.Failed); dep != "" {
+				result.DrvPath = dep
+				result.Error = fmt.Sprintf("dependency %s failed to build", dep)
+			}
+			results = append(results, result)
+		default:
+			results = append(results, builtAttr(buildable.Attr, outPathsOf(drvs[i:i+1])))
+		}
+	}
+	return results
+}
+
+// dryRunBuildables evaluates the derivations of the given outputs without
+// building them, returning them in the same order
+func dryRunBuildables(ctx context.Context, flakeURL nix.FlakeURL, step BuildStep, buildables []nix.BuildableAttr, overrides map[string]string) ([]flake.OutPath, error) {
+	args := []string{"build", "--dry-run", "--json", "--no-link"}
+	if step.Impure {
+		args = append(args, "--impure")
+	}
+	args = append(args, nix.OverrideInputArgs(overrides, "")...)
+	for _, buildable := range buildables {
+		args = append(args, buildFlakeURLWithAttr(flakeURL, buildable.Installable))
+	}
+
+	var drvs []flake.OutPath
+	if err := nix.NewCmd().RunJSON(ctx, &drvs, args...); err != nil {
+		return nil, fmt.Errorf("failed to evaluate flake outputs: %w", err)
+	}
+	if len(drvs) != len(buildables) {
+		return nil, fmt.Errorf("evaluated %d derivations for %d flake outputs", len(drvs), len(buildables))
+	}
+	return drvs, nil
+}
+
+// failedDependency returns the first of the failed derivations that drv
+// depends on, or "" if none can be found
+func failedDependency(ctx context.Context, drv string, failed []string) string {
+	if len(failed) == 1 {
+		return failed[0]
+	}
+
+	requisites, err := store.NewStoreCmd().QueryRequisites(ctx, []string{drv}, false)
+	if err != nil {
+		return ""
+	}
+	inClosure := make(map[string]bool, len(requisites))
+	for _, path := range requisites {
+		inClosure[path.String()] = true
+	}
+	for _, dep := range failed {
+		if inClosure[dep] {
+			return dep
+		}
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package ci
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunBuildStep_DevourByName(t *testing.T) {
+	devourOutput := filepath.Join(t.TempDir(), "devour-output.json")
+	require.NoError(t, os.WriteFile(devourOutput, []byte(`{
+  "outPaths": ["/nix/store/aaa-hello", "/nix/store/bbb-test"],
+  "byName": {"test": "/nix/store/bbb-test", "hello": "/nix/store/aaa-hello"}
+}`), 0644))
+	logPath := installFakeNix(t, "echo "+devourOutput)
+
+	flake, err := nix.ParseFlakeURL("/src")
+	require.NoError(t, err)
+	result := runBuildStep(context.Background(), flake, BuildStep{Enable: true}, nil, RunOptions{}, "", newTestStream(t))
+	require.True(t, result.Success, result.Error)
+
+	assert.Equal(t, []AttrResult{
+		{Attr: "hello", Success: true, Status: AttrStatusBuilt, OutPaths: []store.Path{store.NewPath("/nix/store/aaa-hello")}},
+		{Attr: "test", Success: true, Status: AttrStatusBuilt, OutPaths: []store.Path{store.NewPath("/nix/store/bbb-test")}},
+	}, result.Attributes)
+	assert.Contains(t, readFakeNixLog(t, logPath)[0], "--keep-going")
+}
+
+func TestRunBuildStep_DevourFailures(t *testing.T) {
+	setFlakeSchemaEnv(t)
+	logPath := installFakeNix(t, `case "$*" in
+  build\ *#json*)
+    echo "error: builder for '/nix/store/ccc-test.drv' failed with exit code 1;" >&2
+    echo "error: 1 dependencies of derivation '/nix/store/ddd-docs.drv' failed to build" >&2
+    echo "error: 2 dependencies of derivation '/nix/store/eee-devour-output.drv' failed to build" >&2
+    exit 1;;
+  eval\ *) echo '`+testFlakeSchemas+`';;
+  build\ --dry-run*) echo '[
+    {"drvPath": "/nix/store/ccc-test.drv", "outputs": {"out": "/nix/store/ccc-test"}},
+    {"drvPath": "/nix/store/fff-vm.drv", "outputs": {"out": "/nix/store/fff-vm"}},
+    {"drvPath": "/nix/store/aaa-hello.drv", "outputs": {"out": "/nix/store/aaa-hello", "man": "/nix/store/aaa-hello-man"}},
+    {"drvPath": "/nix/store/ddd-docs.drv", "outputs": {"out": null}}
+  ]';;
+esac`)
+
+	flake, err := nix.ParseFlakeURL("/src")
+	require.NoError(t, err)
+	opts := RunOptions{Systems: []string{"x86_64-linux"}}
+	out := newTestStream(t)
+	result := runBuildStep(context.Background(), flake, BuildStep{Enable: true}, nil, opts, "", out)
+	assert.False(t, result.Success)
+	assert.Equal(t, "failed to build 2 of 4 attributes: checks.x86_64-linux.test, packages.x86_64-linux.docs", result.Error)
+
+	assert.Equal(t, []AttrResult{
+		{
+			Attr:    "checks.x86_64-linux.test",
+			Status:  AttrStatusFailed,
+			DrvPath: "/nix/store/ccc-test.drv",
+			Error:   "builder for /nix/store/ccc-test.drv failed",
+		},
+		{
+			Attr:     "nixosConfigurations.vm",
+			Success:  true,
+			Status:   AttrStatusBuilt,
+			OutPaths: []store.Path{store.NewPath("/nix/store/fff-vm")},
+		},
+		{
+			Attr:     "packages.x86_64-linux.default",
+			Success:  true,
+			Status:   AttrStatusBuilt,
+			OutPaths: []store.Path{store.NewPath("/nix/store/aaa-hello-man"), store.NewPath("/nix/store/aaa-hello")},
+		},
+		{
+			Attr:    "packages.x86_64-linux.docs",
+			Status:  AttrStatusDependencyFailed,
+			DrvPath: "/nix/store/ccc-test.drv",
+			Error:   "dependency /nix/store/ccc-test.drv failed to build",
+		},
+	}, result.Attributes)
+	assert.Len(t, result.OutPaths, 3)
+
+	calls := readFakeNixLog(t, logPath)
+	require.Len(t, calls, 3)
+	assert.Contains(t, calls[0], "--keep-going")
+	assert.Equal(t, testSchemaCommand, calls[1])
+	assert.True(t, strings.HasPrefix(calls[2], "build --dry-run --json --no-link /src#checks.x86_64-linux.test /src#nixosConfigurations.vm.config.system.build.toplevel"), calls[2])
+
+	// Without failed derivations in the log, e.g. on an evaluation error,
+	// the outputs aren't looked at
+	logPath = installFakeNix(t, `echo "error: attribute 'x' missing" >&2; exit 1`)
+	result = runBuildStep(context.Background(), flake, BuildStep{Enable: true}, nil, opts, "", newTestStream(t))
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Error, "devour-flake failed")
+	assert.Empty(t, result.Attributes)
+	assert.Len(t, readFakeNixLog(t, logPath), 1)
+}
+
+func TestFailedDependency(t *testing.T) {
+	installFakeCommand(t, "nix-store", `echo /nix/store/ddd-docs.drv; echo /nix/store/bbb-lib.drv; echo /nix/store/xxx-source`)
+
+	ctx := context.Background()
+	failed := []string{"/nix/store/ccc-test.drv", "/nix/store/bbb-lib.drv"}
+	assert.Equal(t, "/nix/store/bbb-lib.drv", failedDependency(ctx, "/nix/store/ddd-docs.drv", failed))
+	assert.Equal(t, "", failedDependency(ctx, "/nix/store/ddd-docs.drv", []string{"/nix/store/ccc-test.drv", "/nix/store/zzz.drv"}))
+	// A single failure needs no lookup
+	assert.Equal(t, "/nix/store/zzz.drv", failedDependency(ctx, "/nix/store/ddd-docs.drv", []string{"/nix/store/zzz.drv"}))
+}
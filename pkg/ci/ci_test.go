@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/saberzero1/omnix/pkg/common"
 	"github.com/saberzero1/omnix/pkg/nix"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -49,6 +50,11 @@ ci:
       steps:
         build:
           enable: true
+        push:
+          enable: true
+          to: s3://my-cache?region=eu-west-1
+          includeAllDependencies: true
+          secretKeyFile: /run/secrets/cache-key
 `
 	err := os.WriteFile(configPath, []byte(configContent), 0644)
 	require.NoError(t, err)
@@ -67,6 +73,12 @@ ci:
 	testsConfig := config.Default["tests"]
 	assert.Equal(t, "tests", testsConfig.Dir)
 	assert.Equal(t, []string{"x86_64-linux"}, testsConfig.Systems)
+	assert.Equal(t, PushStep{
+		Enable:                 true,
+		To:                     "s3://my-cache?region=eu-west-1",
+		IncludeAllDependencies: true,
+		SecretKeyFile:          "/run/secrets/cache-key",
+	}, testsConfig.Steps.Push)
 }
 
 func TestLoadConfig_InvalidYAML(t *testing.T) {
@@ -174,6 +186,14 @@ func TestStepsConfig_GetEnabledSteps(t *testing.T) {
 			},
 			expected: []string{"build", "custom:test"},
 		},
+		{
+			name: "with push",
+			config: StepsConfig{
+				Build: BuildStep{Enable: true},
+				Push:  PushStep{Enable: true, To: "file:///cache"},
+			},
+			expected: []string{"build", "push"},
+		},
 		{
 			name: "no steps enabled",
 			config: StepsConfig{
@@ -317,8 +337,9 @@ func TestRunSubflake_DisabledSteps(t *testing.T) {
 		GitHubOutput: false,
 	}
 
-	result, err := runSubflake(ctx, flake, ".", subflake, opts)
+	plan, err := newSubflakePlan(flake, ".", subflake, opts)
 	require.NoError(t, err)
+	result := runSubflake(ctx, plan, opts)
 	assert.Equal(t, ".", result.Subflake)
 	assert.Empty(t, result.Steps)
 	assert.True(t, result.Success)
@@ -336,3 +357,116 @@ func TestStepResult(t *testing.T) {
 	assert.Equal(t, "test output", result.Output)
 	assert.Empty(t, result.Error)
 }
+
+func TestFromOmConfig(t *testing.T) {
+	tree, err := common.ParseYAMLConfig(`
+ci:
+  default:
+    main:
+      steps:
+        build:
+          enable: true
+  release:
+    main:
+      dir: "."
+    tests:
+      dir: tests
+      steps:
+        flakeCheck:
+          enable: true
+`)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		reference []string
+		expected  []string
+		wantErr   string
+	}{
+		{name: "default config", reference: nil, expected: []string{"main"}},
+		{name: "named config", reference: []string{"release"}, expected: []string{"main", "tests"}},
+		{name: "single subflake", reference: []string{"release", "tests"}, expected: []string{"tests"}},
+		{name: "missing config", reference: []string{"nightly"}, wantErr: "missing configuration attribute"},
+		{name: "missing subflake", reference: []string{"release", "docs"}, wantErr: "missing subflake"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := FromOmConfig(&common.OmConfig{FlakeURL: ".", Reference: tt.reference, Config: tree})
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			var names []string
+			for name, subflake := range config.Default {
+				names = append(names, name)
+				assert.NotEmpty(t, subflake.Dir, "dir default should be applied")
+			}
+			assert.ElementsMatch(t, tt.expected, names)
+		})
+	}
+
+	release, err := FromOmConfig(&common.OmConfig{Reference: []string{"release", "tests"}, Config: tree})
+	require.NoError(t, err)
+	assert.Equal(t, "tests", release.Default["tests"].Dir)
+	assert.True(t, release.Default["tests"].Steps.FlakeCheck.Enable)
+}
+
+func TestFromOmConfig_Pool(t *testing.T) {
+	tree, err := common.ParseYAMLConfig(`
+ci:
+  default:
+    main:
+      dir: "."
+  pool:
+    - store: ssh://builder@x86
+      systems: [x86_64-linux]
+      capacity: 4
+    - store: ssh://builder@arm
+      systems: [aarch64-linux]
+  runners:
+    x86_64-linux:
+      tags: [nix]
+      queue: linux
+`)
+	require.NoError(t, err)
+
+	for _, reference := range [][]string{nil, {"default", "main"}} {
+		config, err := FromOmConfig(&common.OmConfig{Reference: reference, Config: tree})
+		require.NoError(t, err)
+		assert.Equal(t, []Builder{
+			{Store: "ssh://builder@x86", Systems: []string{"x86_64-linux"}, Capacity: 4},
+			{Store: "ssh://builder@arm", Systems: []string{"aarch64-linux"}},
+		}, config.Pool)
+		assert.Equal(t, map[string]Runner{"x86_64-linux": {Tags: []string{"nix"}, Queue: "linux"}}, config.Runners)
+	}
+
+	// The pool and runners are not configurations
+	for _, name := range []string{"pool", "runners"} {
+		_, err = FromOmConfig(&common.OmConfig{Reference: []string{name}, Config: tree})
+		assert.ErrorContains(t, err, "ci."+name+" is reserved and is not a CI configuration")
+	}
+
+	// The same layout works in om.yaml
+	configPath := filepath.Join(t.TempDir(), "om.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`ci:
+  default:
+    main:
+      dir: "."
+  pool:
+    - store: ssh://builder@x86
+      systems: [x86_64-linux]
+`), 0644))
+	config, err := LoadConfig(configPath)
+	require.NoError(t, err)
+	assert.Equal(t, []Builder{{Store: "ssh://builder@x86", Systems: []string{"x86_64-linux"}}}, config.Pool)
+}
+
+func TestFromOmConfig_NoCISection(t *testing.T) {
+	config, err := FromOmConfig(&common.OmConfig{Config: common.NewOmConfigTree()})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), config)
+}
@@ -0,0 +1,358 @@
+package ci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/common"
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/flake"
+	"github.com/saberzero1/omnix/pkg/nix/store"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultClosureSizeTop is the number of largest paths reported for each
+// closure when ClosureSizeStep.Top is not set
+const DefaultClosureSizeTop = 5
+
+// ByteSize is a size in bytes configured as a string such as "60MB" or
+// "1.5GiB", or as a plain number of bytes.
+type ByteSize int64
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return b.set(v)
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	var v interface{}
+	if err := value.Decode(&v); err != nil {
+		return err
+	}
+	return b.set(v)
+}
+
+// set parses a decoded size value
+func (b *ByteSize) set(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		parsed, err := common.ParseBytes(v)
+		if err != nil {
+			return err
+		}
+		*b = ByteSize(parsed)
+	case int:
+		*b = ByteSize(v)
+	case float64:
+		*b = ByteSize(v)
+	default:
+		return fmt.Errorf("invalid size %v: expected a string like \"60MB\" or a number of bytes", v)
+	}
+	return nil
+}
+
+// ClosureSize is the closure size of a flake output measured by the
+// closure size step
+type ClosureSize struct {
+	// Attr is the flake attribute of the output
+	Attr string `json:"attr"`
+
+	// Success indicates the closure was measured and is within its limit
+	Success bool `json:"success"`
+
+	// OutPaths are the store paths built for the output
+	OutPaths []store.Path `json:"outPaths,omitempty"`
+
+	// ClosureSize is the NAR size of the closure of OutPaths, in bytes
+	ClosureSize int64 `json:"closureSize"`
+
+	// NarSize is the NAR size of OutPaths themselves, in bytes
+	NarSize int64 `json:"narSize"`
+
+	// Limit is the maximum closure size, in bytes
+	Limit int64 `json:"limit"`
+
+	// Baseline is the closure size last measured within the limit, if any
+	Baseline int64 `json:"baseline,omitempty"`
+
+	// Delta is ClosureSize minus Baseline, when there is a baseline
+	Delta int64 `json:"delta,omitempty"`
+
+	// Largest are the largest paths of the closure, largest first
+	Largest []PathSize `json:"largest,omitempty"`
+
+	// Error contains the error message if the output could not be measured
+	// or is over its limit
+	Error string `json:"error,omitempty"`
+}
+
+// PathSize is the NAR size of a store path
+type PathSize struct {
+	// Path is the store path
+	Path store.Path `json:"path"`
+
+	// NarSize is the NAR size of the path, in bytes
+	NarSize int64 `json:"narSize"`
+}
+
+// closureMeasurer builds a flake output, returning its output paths and
+// the path info of every path in their closure
+type closureMeasurer func(ctx context.Context, attr string) ([]store.Path, []nix.PathInfo, error)
+
+// localClosureMeasurer measures the closures of flake outputs built locally
+func localClosureMeasurer(flakeURL nix.FlakeURL, overrides map[string]string, out *nix.OutputStream) closureMeasurer {
+	cmd := nix.NewCmd()
+	opts := &flake.CommandOptions{OverrideInputs: overrides}
+	return func(ctx context.Context, attr string) ([]store.Path, []nix.PathInfo, error) {
+		outPaths, err := flake.Build(ctx, streamingCmd{cmd, out}, opts, buildFlakeURLWithAttr(flakeURL, attr))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to build %s: %w", attr, err)
+		}
+		roots := outPathsOf(outPaths)
+		infos, err := cmd.PathInfo(ctx, true, storePathStrings(roots)...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to query the closure of %s: %w", attr, err)
+		}
+		return roots, infos, nil
+	}
+}
+
+// remoteClosureMeasurer measures the closures of flake outputs built on a
+// remote host
+func remoteClosureMeasurer(ssh SSH, host string, flakeURL nix.FlakeURL, overrides map[string]string) closureMeasurer {
+	return func(ctx context.Context, attr string) ([]store.Path, []nix.PathInfo, error) {
+		output, err := ssh.Output(ctx, host, append([]string{"nix"}, remoteClosureBuildArgs(flakeURL, overrides, attr)...))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to build %s: %w", attr, err)
+		}
+		var roots []store.Path
+		for _, path := range strings.Fields(output) {
+			roots = append(roots, store.NewPath(path))
+		}
+
+		output, err = ssh.Output(ctx, host, append([]string{"nix"}, nix.PathInfoArgs(true, storePathStrings(roots)...)...))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to query the closure of %s: %w", attr, err)
+		}
+		infos, err := nix.ParsePathInfo([]byte(output))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to query the closure of %s: %w", attr, err)
+		}
+		return roots, infos, nil
+	}
+}
+
+// remoteClosureBuildArgs returns the nix arguments building a flake output
+// whose closure is measured on a remote host
+func remoteClosureBuildArgs(flakeURL nix.FlakeURL, overrides map[string]string, attr string) []string {
+	args := []string{"build", "--no-link", "--print-out-paths"}
+	args = append(args, nix.OverrideInputArgs(overrides, "")...)
+	return append(args, buildFlakeURLWithAttr(flakeURL, attr))
+}
+
+// runClosureSizeStep builds the outputs listed in the step limits and
+// checks that their closures are within the limits, comparing them with
+// the baselines recorded by earlier runs (unless baselines is nil).
+// Outputs within their limit become the new baselines.
+func runClosureSizeStep(ctx context.Context, measure closureMeasurer, step ClosureSizeStep, baselines *closureBaselines, out *nix.OutputStream) StepResult {
+	start := time.Now()
+	result := StepResult{
+		Name:    "closureSize",
+		Success: true,
+	}
+	fail := func(err string) StepResult {
+		result.Success = false
+		result.Error = err
+		result.Duration = time.Since(start)
+		return result
+	}
+
+	if len(step.Limits) == 0 {
+		return fail("closure size step has no limits")
+	}
+	attrs := make([]string, 0, len(step.Limits))
+	for attr := range step.Limits {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+
+	top := step.Top
+	if top == 0 {
+		top = DefaultClosureSizeTop
+	}
+
+	var failed []string
+	for _, attr := range attrs {
+		size := ClosureSize{Attr: attr, Limit: int64(step.Limits[attr])}
+		roots, infos, err := measure(ctx, attr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return fail(err.Error())
+			}
+			size.Error = err.Error()
+			out.WriteLine(err.Error())
+		} else {
+			size.tally(roots, infos, top)
+			if baseline, ok := baselines.load(attr); ok {
+				size.Baseline = baseline
+				size.Delta = size.ClosureSize - baseline
+			}
+			if size.ClosureSize > size.Limit {
+				size.Error = fmt.Sprintf("closure of %s is %s, over its limit of %s",
+					attr, common.FormatBytes(size.ClosureSize), common.FormatBytes(size.Limit))
+			} else {
+				size.Success = true
+				if err := baselines.save(attr, size.ClosureSize); err != nil {
+					common.Logger().Warn("failed to record closure size baseline", zap.String("attr", attr), zap.Error(err))
+				}
+			}
+			writeClosureSize(out, size)
+		}
+
+		if !size.Success {
+			failed = append(failed, attr)
+		}
+		result.ClosureSizes = append(result.ClosureSizes, size)
+	}
+
+	if len(failed) > 0 {
+		return fail(fmt.Sprintf("closure size check failed for %d of %d attributes: %s", len(failed), len(attrs), strings.Join(failed, ", ")))
+	}
+	result.Duration = time.Since(start)
+	return result
+}
+
+// tally computes the sizes of the closure of roots from the path info of
+// every path in it, keeping the top largest paths
+func (s *ClosureSize) tally(roots []store.Path, infos []nix.PathInfo, top int) {
+	s.OutPaths = roots
+	isRoot := make(map[string]bool, len(roots))
+	for _, root := range roots {
+		isRoot[root.String()] = true
+	}
+
+	// Outputs may share dependencies; every path is counted once
+	paths := make([]PathSize, 0, len(infos))
+	for _, info := range infos {
+		s.ClosureSize += info.NarSize
+		if isRoot[info.Path] {
+			s.NarSize += info.NarSize
+		}
+		paths = append(paths, PathSize{Path: store.NewPath(info.Path), NarSize: info.NarSize})
+	}
+
+	sort.SliceStable(paths, func(i, j int) bool { return paths[i].NarSize > paths[j].NarSize })
+	if top > len(paths) {
+		top = len(paths)
+	}
+	if top > 0 {
+		s.Largest = paths[:top]
+	}
+}
+
+// writeClosureSize writes a measured closure size and its largest paths
+func writeClosureSize(out *nix.OutputStream, size ClosureSize) {
+	line := fmt.Sprintf("%s: closure size %s (limit %s), NAR size %s",
+		size.Attr, common.FormatBytes(size.ClosureSize), common.FormatBytes(size.Limit), common.FormatBytes(size.NarSize))
+	switch {
+	case size.Baseline == 0:
+		line += ", no baseline"
+	case size.Delta > 0:
+		line += fmt.Sprintf(", +%s from baseline", common.FormatBytes(size.Delta))
+	case size.Delta < 0:
+		line += fmt.Sprintf(", %s from baseline", common.FormatBytes(size.Delta))
+	default:
+		line += ", unchanged from baseline"
+	}
+	out.WriteLine(line)
+
+	if size.Error != "" {
+		out.WriteLine(size.Error)
+	}
+	if len(size.Largest) > 0 {
+		out.WriteLine("Largest paths in the closure:")
+		for _, path := range size.Largest {
+			out.WriteLine(fmt.Sprintf("  %10s  %s", common.FormatBytes(path.NarSize), path.Path))
+		}
+	}
+}
+
+// closureBaselines records the last closure size within budget of each
+// output of a subflake, as <dir>/<attr>.json
+type closureBaselines struct {
+	dir string
+}
+
+// closureBaseline is a closure size recorded as a baseline
+type closureBaseline struct {
+	ClosureSize int64     `json:"closureSize"`
+	RecordedAt  time.Time `json:"recordedAt"`
+}
+
+// newClosureBaselines returns the baselines of a subflake, kept in the CI
+// state directory. It returns nil, recording no baselines, when there is no
+// state directory.
+func newClosureBaselines(opts RunOptions, subflake string) *closureBaselines {
+	stateDir := opts.StateDir
+	if stateDir == "" {
+		var err error
+		if stateDir, err = DefaultStateDir(); err != nil {
+			common.Logger().Warn("Cannot compare closure sizes with their baselines", zap.Error(err))
+			return nil
+		}
+	}
+	return &closureBaselines{dir: filepath.Join(stateDir, "closure-size", logFileName(subflake))}
+}
+
+// path returns the file recording the baseline of attr
+func (b *closureBaselines) path(attr string) string {
+	return filepath.Join(b.dir, logFileName(attr)+".json")
+}
+
+// load returns the baseline closure size of attr, if any
+func (b *closureBaselines) load(attr string) (int64, bool) {
+	if b == nil {
+		return 0, false
+	}
+	data, err := os.ReadFile(b.path(attr))
+	if err != nil {
+		return 0, false
+	}
+	var baseline closureBaseline
+	if err := json.Unmarshal(data, &baseline); err != nil || baseline.ClosureSize <= 0 {
+		return 0, false
+	}
+	return baseline.ClosureSize, true
+}
+
+// save records size as the baseline closure size of attr
+func (b *closureBaselines) save(attr string, size int64) error {
+	if b == nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(closureBaseline{ClosureSize: size, RecordedAt: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal closure size baseline: %w", err)
+	}
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create closure size baseline directory: %w", err)
+	}
+
+	// Write atomically; runs for several systems may record the same attribute
+	if err := writeFileAtomic(b.path(attr), data); err != nil {
+		return fmt.Errorf("failed to write closure size baseline: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package ci
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestClosureSizeStep_YAML(t *testing.T) {
+	var steps StepsConfig
+	require.NoError(t, yaml.Unmarshal([]byte(`
+closureSize:
+  enable: true
+  top: 3
+  systems: [x86_64-linux]
+  limits:
+    packages.x86_64-linux.default: 210MB
+    packages.x86_64-linux.small: 1.5GiB
+    packages.x86_64-linux.tiny: 4096
+`), &steps))
+
+	assert.Equal(t, ClosureSizeStep{
+		Enable:  true,
+		Top:     3,
+		Systems: []string{"x86_64-linux"},
+		Limits: map[string]ByteSize{
+			"packages.x86_64-linux.default": 210000000,
+			"packages.x86_64-linux.small":   1610612736,
+			"packages.x86_64-linux.tiny":    4096,
+		},
+	}, steps.ClosureSize)
+	assert.Equal(t, []string{"closureSize"}, steps.GetEnabledSteps())
+
+	err := yaml.Unmarshal([]byte("closureSize: {limits: {default: 12 parsecs}}"), &steps)
+	assert.ErrorContains(t, err, `unknown unit "parsecs"`)
+}
+
+func TestClosureSize_Tally(t *testing.T) {
+	size := ClosureSize{}
+	size.tally(
+		[]store.Path{store.NewPath("/nix/store/aaa-om"), store.NewPath("/nix/store/aaa-om-man")},
+		[]nix.PathInfo{
+			{Path: "/nix/store/aaa-om", NarSize: 20},
+			{Path: "/nix/store/aaa-om-man", NarSize: 5},
+			{Path: "/nix/store/bbb-glibc", NarSize: 30},
+			{Path: "/nix/store/ccc-cacert", NarSize: 1},
+		}, 2)
+
+	assert.Equal(t, int64(56), size.ClosureSize)
+	assert.Equal(t, int64(25), size.NarSize)
+	assert.Equal(t, []PathSize{
+		{Path: store.NewPath("/nix/store/bbb-glibc"), NarSize: 30},
+		{Path: store.NewPath("/nix/store/aaa-om"), NarSize: 20},
+	}, size.Largest)
+}
+
+func TestRunClosureSizeStep_Baseline(t *testing.T) {
+	sizes := map[string]int64{"packages.x86_64-linux.default": 50}
+	measure := func(ctx context.Context, attr string) ([]store.Path, []nix.PathInfo, error) {
+		if attr == "packages.x86_64-linux.broken" {
+			return nil, nil, errors.New("failed to build packages.x86_64-linux.broken")
+		}
+		root := store.NewPath("/nix/store/aaa-" + attr)
+		return []store.Path{root}, []nix.PathInfo{{Path: root.String(), NarSize: sizes[attr]}}, nil
+	}
+	baselines := &closureBaselines{dir: t.TempDir()}
+	step := ClosureSizeStep{Limits: map[string]ByteSize{"packages.x86_64-linux.default": 60}}
+
+	// The first run records the baseline
+	out := newTestStream(t)
+	result := runClosureSizeStep(context.Background(), measure, step, baselines, out)
+	require.True(t, result.Success, result.Error)
+	require.Len(t, result.ClosureSizes, 1)
+	assert.Equal(t, int64(50), result.ClosureSizes[0].ClosureSize)
+	assert.Zero(t, result.ClosureSizes[0].Baseline)
+	assert.Contains(t, out.Tail(), "packages.x86_64-linux.default: closure size 50 B (limit 60 B), NAR size 50 B, no baseline")
+
+	// Growing past the limit fails, and keeps the baseline
+	sizes["packages.x86_64-linux.default"] = 70
+	out = newTestStream(t)
+	result = runClosureSizeStep(context.Background(), measure, step, baselines, out)
+	assert.False(t, result.Success)
+	assert.Equal(t, "closure size check failed for 1 of 1 attributes: packages.x86_64-linux.default", result.Error)
+	assert.Equal(t, int64(50), result.ClosureSizes[0].Baseline)
+	assert.Equal(t, int64(20), result.ClosureSizes[0].Delta)
+	assert.Equal(t, "closure of packages.x86_64-linux.default is 70 B, over its limit of 60 B", result.ClosureSizes[0].Error)
+	assert.Contains(t, out.Tail(), "+20 B from baseline")
+
+	sizes["packages.x86_64-linux.default"] = 40
+	result = runClosureSizeStep(context.Background(), measure, step, baselines, newTestStream(t))
+	require.True(t, result.Success, result.Error)
+	assert.Equal(t, int64(-10), result.ClosureSizes[0].Delta)
+	baseline, ok := baselines.load("packages.x86_64-linux.default")
+	assert.True(t, ok)
+	assert.Equal(t, int64(40), baseline)
+
+	// Outputs that fail to build fail the step, without stopping the others
+	step.Limits["packages.x86_64-linux.broken"] = 60
+	result = runClosureSizeStep(context.Background(), measure, step, nil, newTestStream(t))
+	assert.False(t, result.Success)
+	assert.Equal(t, "closure size check failed for 1 of 2 attributes: packages.x86_64-linux.broken", result.Error)
+	assert.Equal(t, "failed to build packages.x86_64-linux.broken", result.ClosureSizes[0].Error)
+	assert.True(t, result.ClosureSizes[1].Success)
+
+	result = runClosureSizeStep(context.Background(), measure, ClosureSizeStep{}, nil, newTestStream(t))
+	assert.Equal(t, "closure size step has no limits", result.Error)
+}
+
+// closureSizeConfig is a config whose only step checks the closure size of
+// the default package
+func closureSizeConfig() Config {
+	return Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Steps: StepsConfig{
+				ClosureSize: ClosureSizeStep{
+					Enable: true,
+					Top:    1,
+					Limits: map[string]ByteSize{"packages.x86_64-linux.default": 60000000},
+				},
+			}},
+		},
+	}
+}
+
+const closureSizePathInfo = `{"/nix/store/aaa-om": {"narSize": 20000000, "closureSize": 50000000}, "/nix/store/bbb-glibc": {"narSize": 30000000, "closureSize": 30000000}}`
+
+func TestRun_ClosureSize(t *testing.T) {
+	logPath := installFakeNix(t, `case "$1" in
+  build) echo '[{"drvPath": "/nix/store/aaa-om.drv", "outputs": {"out": "/nix/store/aaa-om"}}]';;
+  path-info) echo '`+closureSizePathInfo+`';;
+esac`)
+
+	flake, err := nix.ParseFlakeURL("/src")
+	require.NoError(t, err)
+	stateDir := t.TempDir()
+	results, err := Run(context.Background(), flake, closureSizeConfig(), RunOptions{StateDir: stateDir})
+	require.NoError(t, err)
+
+	step := results[0].Steps["closureSize"]
+	require.True(t, step.Success, step.Error)
+	assert.Equal(t, []ClosureSize{{
+		Attr:        "packages.x86_64-linux.default",
+		Success:     true,
+		OutPaths:    []store.Path{store.NewPath("/nix/store/aaa-om")},
+		ClosureSize: 50000000,
+		NarSize:     20000000,
+		Limit:       60000000,
+		Largest:     []PathSize{{Path: store.NewPath("/nix/store/bbb-glibc"), NarSize: 30000000}},
+	}}, step.ClosureSizes)
+	assert.Equal(t, []string{
+		"build --no-link --json /src#packages.x86_64-linux.default",
+		"path-info --json --recursive /nix/store/aaa-om",
+	}, readFakeNixLog(t, logPath))
+
+	// The next run compares with the baseline recorded in the state directory
+	results, err = Run(context.Background(), flake, closureSizeConfig(), RunOptions{StateDir: stateDir})
+	require.NoError(t, err)
+	assert.Equal(t, int64(50000000), results[0].Steps["closureSize"].ClosureSizes[0].Baseline)
+}
+
+func TestRun_ClosureSizeRemote(t *testing.T) {
+	ssh := &fakeSSH{outputFor: func(command []string) string {
+		switch command[1] {
+		case "build":
+			return "/nix/store/aaa-om\n"
+		case "path-info":
+			return closureSizePathInfo
+		}
+		return ""
+	}}
+
+	flake, err := nix.ParseFlakeURL("/nix/store/abc-source")
+	require.NoError(t, err)
+	results, err := Run(context.Background(), flake, closureSizeConfig(), RunOptions{RemoteHost: "user@host", SSH: ssh, StateDir: t.TempDir()})
+	require.NoError(t, err)
+
+	step := results[0].Steps["closureSize"]
+	require.True(t, step.Success, step.Error)
+	assert.Equal(t, int64(50000000), step.ClosureSizes[0].ClosureSize)
+	assert.Equal(t, []string{
+		"user@host: nix build --no-link --print-out-paths /nix/store/abc-source#packages.x86_64-linux.default",
+		"user@host: nix path-info --json --recursive /nix/store/aaa-om",
+	}, ssh.commands)
+}
@@ -1,10 +1,15 @@
 package ci
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"sort"
+	"strings"
 
+	"github.com/saberzero1/omnix/pkg/common"
+	"github.com/saberzero1/omnix/pkg/nix"
 	"gopkg.in/yaml.v3"
 )
 
@@ -12,6 +17,34 @@ import (
 type Config struct {
 	// Default contains the default subflake configurations
 	Default map[string]SubflakeConfig `yaml:"default" json:"default"`
+
+	// Pool lists the remote builders used by RunPool (`ci.pool` in the om config)
+	Pool []Builder `yaml:"pool,omitempty" json:"pool,omitempty"`
+
+	// Runners maps systems to the runners of the jobs generated by
+	// `om ci matrix` (`ci.runners` in the om config)
+	Runners map[string]Runner `yaml:"runners,omitempty" json:"runners,omitempty"`
+}
+
+// Runner selects where the jobs of a system run in generated pipelines
+type Runner struct {
+	// Tags are the GitLab runner tags of the jobs
+	Tags []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+
+	// Queue is the Buildkite agent queue of the jobs
+	Queue string `yaml:"queue,omitempty" json:"queue,omitempty"`
+}
+
+// Builder is a remote builder in a pool
+type Builder struct {
+	// Store is the store URI of the builder, e.g. "ssh://user@host"
+	Store string `yaml:"store" json:"store"`
+
+	// Systems lists the systems the builder can build for
+	Systems []string `yaml:"systems" json:"systems"`
+
+	// Capacity is the number of subflakes the builder runs at once (0 = 1)
+	Capacity int `yaml:"capacity,omitempty" json:"capacity,omitempty"`
 }
 
 // SubflakeConfig represents configuration for a sub-flake
@@ -43,29 +76,124 @@ type StepsConfig struct {
 	// FlakeCheck controls the flake check step
 	FlakeCheck FlakeCheckStep `yaml:"flakeCheck" json:"flakeCheck"`
 
+	// Push controls the push step
+	Push PushStep `yaml:"push" json:"push"`
+
+	// ClosureSize controls the closure size step
+	ClosureSize ClosureSizeStep `yaml:"closureSize" json:"closureSize"`
+
 	// Custom defines custom steps (map of step name to CustomStep)
 	Custom map[string]CustomStep `yaml:"custom" json:"custom"`
 }
 
+// StepPolicy controls how any step is run: how long it may take, how often
+// it is retried and whether its failure fails the subflake. Its fields are
+// inlined into every step type.
+type StepPolicy struct {
+	// Timeout bounds each attempt of the step, e.g. "30m" (zero = no limit)
+	Timeout Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+
+	// Retries is the number of additional attempts after a failed one
+	Retries int `yaml:"retries,omitempty" json:"retries,omitempty"`
+
+	// RetryBackoff is the delay before the first retry, doubling for each
+	// subsequent one (zero = DefaultRetryBackoff)
+	RetryBackoff Duration `yaml:"retryBackoff,omitempty" json:"retryBackoff,omitempty"`
+
+	// AllowFailure reports a failure of this step as a warning instead of
+	// failing the subflake
+	AllowFailure bool `yaml:"allowFailure,omitempty" json:"allowFailure,omitempty"`
+}
+
 // BuildStep configures the build step
 type BuildStep struct {
+	StepPolicy `yaml:",inline"`
+
 	// Enable controls whether this step is enabled
 	Enable bool `yaml:"enable" json:"enable"`
 
 	// Impure controls whether to pass --impure to nix build
 	Impure bool `yaml:"impure" json:"impure"`
+
+	// Include, if set, restricts the build to the outputs whose attribute
+	// path matches one of these patterns, e.g. "packages.*.default"
+	Include []string `yaml:"include,omitempty" json:"include,omitempty"`
+
+	// Exclude skips the outputs whose attribute path matches one of these
+	// patterns, e.g. "nixosConfigurations.*"
+	Exclude []string `yaml:"exclude,omitempty" json:"exclude,omitempty"`
 }
 
 // LockfileStep configures the lockfile check step
 type LockfileStep struct {
+	StepPolicy `yaml:",inline"`
+
 	// Enable controls whether this step is enabled
 	Enable bool `yaml:"enable" json:"enable"`
 }
 
 // FlakeCheckStep configures the flake check step
 type FlakeCheckStep struct {
+	StepPolicy `yaml:",inline"`
+
+	// Enable controls whether this step is enabled
+	Enable bool `yaml:"enable" json:"enable"`
+}
+
+// PushStep configures the push step, which copies the paths built by the
+// build step to another store, typically a binary cache
+type PushStep struct {
+	StepPolicy `yaml:",inline"`
+
 	// Enable controls whether this step is enabled
 	Enable bool `yaml:"enable" json:"enable"`
+
+	// To is the URI of the destination store, e.g. "s3://my-cache",
+	// "file:///var/cache/nix" or "ssh-ng://user@host"
+	To string `yaml:"to" json:"to"`
+
+	// IncludeAllDependencies pushes the whole closure of the built paths
+	// instead of the built paths only
+	IncludeAllDependencies bool `yaml:"includeAllDependencies,omitempty" json:"includeAllDependencies,omitempty"`
+
+	// SecretKeyFile, if set, is the secret key used to sign the paths
+	// before pushing them
+	SecretKeyFile string `yaml:"secretKeyFile,omitempty" json:"secretKeyFile,omitempty"`
+}
+
+// ClosureSizeStep configures the closure size step, which builds flake
+// outputs and fails when their closure grows past a budget
+type ClosureSizeStep struct {
+	StepPolicy `yaml:",inline"`
+
+	// Enable controls whether this step is enabled
+	Enable bool `yaml:"enable" json:"enable"`
+
+	// Limits maps the flake attributes to measure, e.g.
+	// "packages.x86_64-linux.default", to their maximum closure size
+	Limits map[string]ByteSize `yaml:"limits" json:"limits"`
+
+	// Top is the number of largest paths reported for each closure
+	// (0 = DefaultClosureSizeTop)
+	Top int `yaml:"top,omitempty" json:"top,omitempty"`
+
+	// Systems is an optional whitelist of systems to run on
+	Systems []string `yaml:"systems,omitempty" json:"systems,omitempty"`
+}
+
+// CanRunOn checks if the closure size step can run on any of the given systems
+func (c *ClosureSizeStep) CanRunOn(systems []string) bool {
+	if len(c.Systems) == 0 {
+		return true
+	}
+	for _, sys := range systems {
+		for _, allowed := range c.Systems {
+			if sys == allowed {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // CustomStepType represents the type of custom step
@@ -76,11 +204,17 @@ const (
 	CustomStepTypeApp CustomStepType = "app"
 	// CustomStepTypeDevShell runs a command in a devshell
 	CustomStepTypeDevShell CustomStepType = "devshell"
+	// CustomStepTypeBuild builds flake attributes
+	CustomStepTypeBuild CustomStepType = "build"
+	// CustomStepTypeEval evaluates a flake attribute
+	CustomStepTypeEval CustomStepType = "eval"
 )
 
 // CustomStep defines a custom CI step
 type CustomStep struct {
-	// Type of the custom step (app or devshell)
+	StepPolicy `yaml:",inline"`
+
+	// Type of the custom step (app, devshell, build or eval)
 	Type CustomStepType `yaml:"type" json:"type"`
 
 	// Name of the app or devshell to use (defaults to "default")
@@ -92,8 +226,45 @@ type CustomStep struct {
 	// Command to execute in devshell (only for devshell type)
 	Command []string `yaml:"command,omitempty" json:"command,omitempty"`
 
+	// Attrs are the flake attributes to build, e.g. "packages.x86_64-linux.hello"
+	// (only for build type)
+	Attrs []string `yaml:"attrs,omitempty" json:"attrs,omitempty"`
+
+	// Attr is the flake attribute to evaluate, e.g.
+	// "nixosConfigurations.server.config.system.build.toplevel" (only for eval type)
+	Attr string `yaml:"attr,omitempty" json:"attr,omitempty"`
+
+	// Expected, if set, is the value Attr must evaluate to, compared as JSON
+	// (only for eval type)
+	Expected interface{} `yaml:"expected,omitempty" json:"expected,omitempty"`
+
 	// Systems is an optional whitelist of systems to run on
 	Systems []string `yaml:"systems,omitempty" json:"systems,omitempty"`
+
+	// DependsOn lists steps that must succeed before this one runs: built-in
+	// steps ("build", "lockfile", "flakeCheck", "push", "closureSize") or
+	// other custom steps by name
+	DependsOn []string `yaml:"dependsOn,omitempty" json:"dependsOn,omitempty"`
+
+	// Env sets environment variables for the step
+	Env map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+
+	// Cwd is the working directory of the step, relative to the subflake
+	// directory (local flakes only)
+	Cwd string `yaml:"cwd,omitempty" json:"cwd,omitempty"`
+
+	// Secrets sets environment variables from secrets (map of variable
+	// name to Secret). Their values are redacted from the step output.
+	Secrets map[string]Secret `yaml:"secrets,omitempty" json:"secrets,omitempty"`
+}
+
+// Secret is the source of a secret value: exactly one of File and Env is set
+type Secret struct {
+	// File is a file holding the secret; a trailing newline is ignored
+	File string `yaml:"file,omitempty" json:"file,omitempty"`
+
+	// Env is an environment variable of om holding the secret
+	Env string `yaml:"env,omitempty" json:"env,omitempty"`
 }
 
 // CanRunOn checks if this custom step can run on any of the given systems
@@ -155,15 +326,90 @@ func LoadConfig(path string) (Config, error) {
 		return Config{}, fmt.Errorf("failed to parse config YAML: %w", err)
 	}
 
-	// Apply defaults for each subflake
-	for name, subflake := range wrapper.CI.Default {
+	wrapper.CI.applyDefaults()
+	return wrapper.CI, nil
+}
+
+// LoadFlakeConfig loads the CI configuration of a flake from its `om` output
+// (or om.yaml in the flake root).
+//
+// The flake URL fragment selects the configuration to use: `.#release` uses
+// `ci.release` instead of `ci.default`, and `.#release.tests` further restricts
+// it to the "tests" subflake.
+func LoadFlakeConfig(ctx context.Context, flake nix.FlakeURL) (Config, error) {
+	om, err := common.GetOmConfig(ctx, nix.NewCmd(), flake.String())
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to load om config: %w", err)
+	}
+
+	return FromOmConfig(om)
+}
+
+// reservedConfigNames are the keys of the `ci` section holding settings shared
+// by all configurations, which no named configuration can use
+var reservedConfigNames = []string{"pool", "runners"}
+
+// FromOmConfig extracts the CI configuration referenced by om.Reference.
+// If the om config has no `ci` section, DefaultConfig is returned.
+func FromOmConfig(om *common.OmConfig) (Config, error) {
+	if len(om.Reference) > 0 {
+		for _, name := range reservedConfigNames {
+			if om.Reference[0] == name {
+				return Config{}, fmt.Errorf("ci.%s is reserved and is not a CI configuration", name)
+			}
+		}
+	}
+
+	var subflakes map[string]SubflakeConfig
+	rest, err := om.GetSubConfigUnder("ci", nil, &subflakes)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to get ci config: %w", err)
+	}
+
+	if subflakes == nil {
+		return DefaultConfig(), nil
+	}
+
+	config := Config{Default: subflakes}
+
+	// The builder pool and runners live next to the named configurations, as
+	// `ci.pool` and `ci.runners`
+	var sections map[string]json.RawMessage
+	if err := om.Config.Get("ci", &sections); err != nil {
+		return Config{}, fmt.Errorf("failed to get ci config: %w", err)
+	}
+	if raw, ok := sections["pool"]; ok {
+		if err := json.Unmarshal(raw, &config.Pool); err != nil {
+			return Config{}, fmt.Errorf("failed to parse ci.pool: %w", err)
+		}
+	}
+	if raw, ok := sections["runners"]; ok {
+		if err := json.Unmarshal(raw, &config.Runners); err != nil {
+			return Config{}, fmt.Errorf("failed to parse ci.runners: %w", err)
+		}
+	}
+
+	// Restrict to a single subflake if one is referenced
+	if len(rest) > 0 {
+		subflake, ok := subflakes[rest[0]]
+		if !ok {
+			return Config{}, fmt.Errorf("missing subflake configuration: %s", rest[0])
+		}
+		config.Default = map[string]SubflakeConfig{rest[0]: subflake}
+	}
+
+	config.applyDefaults()
+	return config, nil
+}
+
+// applyDefaults fills in defaults for each subflake
+func (c *Config) applyDefaults() {
+	for name, subflake := range c.Default {
 		if subflake.Dir == "" {
 			subflake.Dir = "."
 		}
-		wrapper.CI.Default[name] = subflake
+		c.Default[name] = subflake
 	}
-
-	return wrapper.CI, nil
 }
 
 // CanRunOn checks if this subflake can run on any of the given systems
@@ -198,6 +444,12 @@ func (s *StepsConfig) GetEnabledSteps() []string {
 	if s.FlakeCheck.Enable {
 		enabled = append(enabled, "flakeCheck")
 	}
+	if s.Push.Enable {
+		enabled = append(enabled, "push")
+	}
+	if s.ClosureSize.Enable {
+		enabled = append(enabled, "closureSize")
+	}
 
 	// Sort custom step names for deterministic order
 	customNames := make([]string, 0, len(s.Custom))
@@ -213,3 +465,40 @@ func (s *StepsConfig) GetEnabledSteps() []string {
 
 	return enabled
 }
+
+// stepPolicy returns the policy of the step with the given key
+// (e.g. "build" or "custom:fmt")
+func (s *StepsConfig) stepPolicy(key string) StepPolicy {
+	switch key {
+	case "build":
+		return s.Build.StepPolicy
+	case "lockfile":
+		return s.Lockfile.StepPolicy
+	case "flakeCheck":
+		return s.FlakeCheck.StepPolicy
+	case "push":
+		return s.Push.StepPolicy
+	case "closureSize":
+		return s.ClosureSize.StepPolicy
+	default:
+		return s.Custom[strings.TrimPrefix(key, "custom:")].StepPolicy
+	}
+}
+
+// stepConfig returns the configuration of the step with the given key
+func (s *StepsConfig) stepConfig(key string) interface{} {
+	switch key {
+	case "build":
+		return s.Build
+	case "lockfile":
+		return s.Lockfile
+	case "flakeCheck":
+		return s.FlakeCheck
+	case "push":
+		return s.Push
+	case "closureSize":
+		return s.ClosureSize
+	default:
+		return s.Custom[strings.TrimPrefix(key, "custom:")]
+	}
+}
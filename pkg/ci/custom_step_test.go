@@ -107,6 +107,17 @@ ci:
             systems:
               - x86_64-linux
               - aarch64-darwin
+          integration:
+            type: devshell
+            command: [just, integration]
+            cwd: tests
+            env:
+              RUST_LOG: debug
+            secrets:
+              API_TOKEN:
+                env: CI_API_TOKEN
+              SSH_KEY:
+                file: /run/secrets/ssh-key
 `
 
 	err := os.WriteFile(configPath, []byte(configContent), 0644)
@@ -119,7 +130,7 @@ ci:
 	assert.Contains(t, config.Default, "omnix")
 	omnix := config.Default["omnix"]
 
-	assert.Len(t, omnix.Steps.Custom, 3)
+	assert.Len(t, omnix.Steps.Custom, 4)
 
 	// Check om-show step
 	omShow, ok := omnix.Steps.Custom["om-show"]
@@ -140,4 +151,14 @@ ci:
 	assert.Equal(t, CustomStepTypeDevShell, cargoTests.Type)
 	assert.Equal(t, []string{"just", "cargo-test"}, cargoTests.Command)
 	assert.Equal(t, []string{"x86_64-linux", "aarch64-darwin"}, cargoTests.Systems)
+
+	// Check integration step
+	integration, ok := omnix.Steps.Custom["integration"]
+	assert.True(t, ok)
+	assert.Equal(t, "tests", integration.Cwd)
+	assert.Equal(t, map[string]string{"RUST_LOG": "debug"}, integration.Env)
+	assert.Equal(t, map[string]Secret{
+		"API_TOKEN": {Env: "CI_API_TOKEN"},
+		"SSH_KEY":   {File: "/run/secrets/ssh-key"},
+	}, integration.Secrets)
 }
@@ -0,0 +1,570 @@
+package dashboard
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/ci"
+	"github.com/saberzero1/omnix/pkg/nix"
+	"golang.org/x/term"
+)
+
+const (
+	// DefaultRefresh is the time between redraws
+	DefaultRefresh = 100 * time.Millisecond
+
+	// DefaultLogLines is the number of lines of output kept per step
+	DefaultLogLines = 500
+)
+
+// Terminal control sequences
+const (
+	enterScreen = "\x1b[?1049h\x1b[?25l"
+	leaveScreen = "\x1b[?25h\x1b[?1049l"
+	cursorHome  = "\x1b[H"
+	clearLine   = "\x1b[K"
+	clearBelow  = "\x1b[J"
+)
+
+// escapePattern matches the terminal control sequences in step output,
+// which would mess up the screen
+var escapePattern = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// spinner animates the icon of running steps
+var spinner = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// statuses lists step statuses in the order the header counts them
+var statuses = []string{ci.StepPassed, ci.StepFailed, ci.StepWarning, ci.StepCancelled, ci.StepSkipped, ci.StepCached}
+
+// Options configure a Dashboard
+type Options struct {
+	// Input is read for key presses if it is a terminal, which is put in
+	// raw mode while the dashboard runs (nil = no keys)
+	Input *os.File
+
+	// Interrupt is called when Ctrl-C is pressed, as a terminal in raw
+	// mode doesn't send SIGINT; it should cancel the run
+	Interrupt func()
+
+	// Refresh is the time between redraws (0 = DefaultRefresh)
+	Refresh time.Duration
+
+	// LogLines is the number of lines of output kept per step, to follow
+	// it (0 = DefaultLogLines)
+	LogLines int
+}
+
+// Dashboard is a ci.ActivityObserver drawing the steps of a CI run on a
+// terminal while they run. It is meant for terminals only; elsewhere,
+// stream step output as plain lines instead (see ci.RunOptions.Output).
+type Dashboard struct {
+	ci.NopObserver
+
+	out  io.Writer
+	opts Options
+	now  func() time.Time
+
+	// mu guards the state below, which events and keys update while the
+	// screen is drawn
+	mu        sync.Mutex
+	started   time.Time
+	rows      []*row
+	index     map[string]*row
+	selected  int
+	following bool
+	frame     int
+
+	restore  func()
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// row is the state of a step
+type row struct {
+	subflake, step string
+
+	running  bool
+	started  time.Time
+	attempts int
+	result   ci.StepResult
+
+	// progress adds up the builds and downloads of the step
+	progress *nix.BuildProgress
+
+	// activities holds the descriptions of the running nix activities, by ID
+	activities map[uint64]string
+
+	// log holds the last lines of output
+	log []string
+}
+
+// New returns a dashboard drawing to out, which should be a terminal
+func New(out io.Writer, opts Options) *Dashboard {
+	if opts.Refresh == 0 {
+		opts.Refresh = DefaultRefresh
+	}
+	if opts.LogLines == 0 {
+		opts.LogLines = DefaultLogLines
+	}
+	return &Dashboard{
+		out:   out,
+		opts:  opts,
+		now:   time.Now,
+		index: make(map[string]*row),
+	}
+}
+
+// Start takes over the screen and starts drawing the dashboard, until Stop
+func (d *Dashboard) Start() error {
+	if in := d.opts.Input; in != nil && term.IsTerminal(int(in.Fd())) {
+		state, err := term.MakeRaw(int(in.Fd()))
+		if err != nil {
+			return fmt.Errorf("failed to read keys from the terminal: %w", err)
+		}
+		d.restore = func() { _ = term.Restore(int(in.Fd()), state) }
+		// The reader is left blocked once the dashboard stops; it only
+		// ends with the process
+		go d.readKeys(in)
+	}
+
+	d.mu.Lock()
+	d.started = d.now()
+	d.mu.Unlock()
+
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+	_, _ = io.WriteString(d.out, enterScreen)
+	go d.loop()
+	return nil
+}
+
+// Stop restores the screen and prints the final status of every step
+func (d *Dashboard) Stop() {
+	d.stopOnce.Do(func() {
+		if d.stop == nil {
+			return
+		}
+		close(d.stop)
+		<-d.done
+		_, _ = io.WriteString(d.out, leaveScreen)
+		if d.restore != nil {
+			d.restore()
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, line := range d.summary() {
+			_, _ = fmt.Fprintln(d.out, line)
+		}
+	})
+}
+
+// loop redraws the screen until the dashboard stops
+func (d *Dashboard) loop() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.opts.Refresh)
+	defer ticker.Stop()
+
+	for {
+		d.draw()
+		select {
+		case <-ticker.C:
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// draw redraws the whole screen. Lines end with \r\n, as a terminal in raw
+// mode doesn't return the cursor on \n.
+func (d *Dashboard) draw() {
+	width, height := d.size()
+
+	d.mu.Lock()
+	lines := d.render(width, height)
+	d.frame++
+	d.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString(cursorHome)
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+		b.WriteString(clearLine)
+	}
+	b.WriteString(clearBelow)
+	_, _ = io.WriteString(d.out, b.String())
+}
+
+// size returns the size of the terminal, or 80x24 if unknown
+func (d *Dashboard) size() (width, height int) {
+	if f, ok := d.out.(*os.File); ok {
+		if width, height, err := term.GetSize(int(f.Fd())); err == nil && width > 0 && height > 0 {
+			return width, height
+		}
+	}
+	return 80, 24
+}
+
+// render returns the lines of the screen; d.mu must be held
+func (d *Dashboard) render(width, height int) []string {
+	// Header and key help take a line each
+	body := height - 2
+	if body < 1 {
+		body = 1
+	}
+
+	lines := []string{d.header()}
+	switch {
+	case len(d.rows) == 0:
+		lines = append(lines, "Waiting for steps to start...")
+
+	case d.following:
+		r := d.rows[d.selected]
+		lines = append(lines, d.renderRow(r, true, len([]rune(r.name()))))
+		tail := r.log
+		if len(tail) > body-1 {
+			tail = tail[len(tail)-(body-1):]
+		}
+		for _, line := range tail {
+			lines = append(lines, "    "+line)
+		}
+
+	default:
+		nameWidth := 0
+		for _, r := range d.rows {
+			nameWidth = max(nameWidth, len([]rune(r.name())))
+		}
+		nameWidth = min(nameWidth, width/3)
+
+		// Scroll to keep the selected step in view
+		first := max(0, d.selected-body+1)
+		for i := first; i < len(d.rows) && i < first+body; i++ {
+			lines = append(lines, d.renderRow(d.rows[i], i == d.selected, nameWidth))
+		}
+	}
+
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	if d.following {
+		lines = append(lines, "enter back to all steps · ↑/↓ select · ctrl-c cancel")
+	} else {
+		lines = append(lines, "↑/↓ select · enter follow log · ctrl-c cancel")
+	}
+
+	for i, line := range lines {
+		lines[i] = truncate(line, width)
+	}
+	return lines
+}
+
+// header sums up the run so far, e.g. "om ci · 1m2s · 2 running, 3 passed"
+func (d *Dashboard) header() string {
+	running := 0
+	counts := make(map[string]int)
+	for _, r := range d.rows {
+		if r.running {
+			running++
+		} else {
+			counts[r.result.Status()]++
+		}
+	}
+
+	parts := []string{fmt.Sprintf("%d running", running)}
+	for _, status := range statuses {
+		if counts[status] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[status], status))
+		}
+	}
+	return fmt.Sprintf("om ci · %s · %s", formatDuration(d.now().Sub(d.started)), strings.Join(parts, ", "))
+}
+
+// renderRow renders the line of a step, with its name padded to nameWidth
+func (d *Dashboard) renderRow(r *row, selected bool, nameWidth int) string {
+	cursor := "  "
+	if selected {
+		cursor = "› "
+	}
+
+	var icon, elapsed string
+	var details []string
+	if r.running {
+		icon = spinner[d.frame%len(spinner)]
+		elapsed = formatDuration(d.now().Sub(r.started))
+		if r.attempts > 0 {
+			details = append(details, fmt.Sprintf("attempt %d", r.attempts+1))
+		}
+		details = append(details, r.activity(), r.last())
+	} else {
+		status := r.result.Status()
+		icon = statusIcon(status)
+		elapsed = formatDuration(r.result.Duration)
+		details = append(details, status, firstLine(r.result.Error))
+	}
+
+	var nonEmpty []string
+	for _, detail := range details {
+		if detail != "" {
+			nonEmpty = append(nonEmpty, detail)
+		}
+	}
+	name := padRight(truncate(r.name(), nameWidth), nameWidth)
+	return fmt.Sprintf("%s%s %s %7s  %s", cursor, icon, name, elapsed, strings.Join(nonEmpty, " · "))
+}
+
+// summary returns the final status of every step, once the run is over
+func (d *Dashboard) summary() []string {
+	nameWidth := 0
+	for _, r := range d.rows {
+		nameWidth = max(nameWidth, len([]rune(r.name())))
+	}
+
+	var lines []string
+	for _, r := range d.rows {
+		lines = append(lines, d.renderRow(r, false, nameWidth))
+	}
+	return lines
+}
+
+// OnStepStart implements ci.Observer
+func (d *Dashboard) OnStepStart(subflake, step string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := d.row(subflake, step)
+	r.running = true
+	r.started = d.now()
+}
+
+// OnStepEnd implements ci.Observer
+func (d *Dashboard) OnStepEnd(subflake, step string, result ci.StepResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := d.row(subflake, step)
+	r.running = false
+	r.result = result
+	r.activities = make(map[uint64]string)
+}
+
+// OnOutput implements ci.Observer
+func (d *Dashboard) OnOutput(subflake, step, line string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Keep what a terminal would show of lines redrawn with \r
+	if i := strings.LastIndex(line, "\r"); i >= 0 {
+		line = line[i+1:]
+	}
+	line = strings.ReplaceAll(escapePattern.ReplaceAllString(line, ""), "\t", "    ")
+
+	r := d.row(subflake, step)
+	r.log = append(r.log, line)
+	if len(r.log) > d.opts.LogLines {
+		r.log = r.log[len(r.log)-d.opts.LogLines:]
+	}
+}
+
+// OnRetry implements ci.Observer
+func (d *Dashboard) OnRetry(subflake, step string, failed ci.StepAttempt, backoff time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.row(subflake, step).attempts++
+}
+
+// OnActivity implements ci.ActivityObserver
+func (d *Dashboard) OnActivity(subflake, step string, event nix.LogEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := d.row(subflake, step)
+	r.progress.Update(event)
+	switch event.Action {
+	case nix.LogActionStart:
+		if event.Text != "" && event.Level <= nix.LogLevelInfo {
+			r.activities[event.ID] = event.Text
+		}
+	case nix.LogActionStop:
+		delete(r.activities, event.ID)
+	}
+}
+
+// row returns the row of a step, adding it if new; d.mu must be held
+func (d *Dashboard) row(subflake, step string) *row {
+	key := subflake + "/" + step
+	r, ok := d.index[key]
+	if !ok {
+		r = &row{
+			subflake:   subflake,
+			step:       step,
+			progress:   nix.NewBuildProgress(),
+			activities: make(map[uint64]string),
+		}
+		d.index[key] = r
+		d.rows = append(d.rows, r)
+	}
+	return r
+}
+
+// readKeys handles the keys pressed on in
+func (d *Dashboard) readKeys(in io.Reader) {
+	buf := make([]byte, 64)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, k := range parseKeys(buf[:n]) {
+			d.key(k)
+		}
+	}
+}
+
+// Keys the dashboard handles
+const (
+	keyUp        = "up"
+	keyDown      = "down"
+	keyEnter     = "enter"
+	keyEscape    = "escape"
+	keyInterrupt = "interrupt"
+)
+
+// parseKeys returns the keys in what the terminal sent, ignoring others
+func parseKeys(input []byte) []string {
+	var keys []string
+	for i := 0; i < len(input); i++ {
+		switch c := input[i]; {
+		case c == 3:
+			keys = append(keys, keyInterrupt)
+		case c == '\r' || c == '\n':
+			keys = append(keys, keyEnter)
+		case c == 'k':
+			keys = append(keys, keyUp)
+		case c == 'j':
+			keys = append(keys, keyDown)
+		case c == 0x1b && i+2 < len(input) && (input[i+1] == '[' || input[i+1] == 'O'):
+			switch input[i+2] {
+			case 'A':
+				keys = append(keys, keyUp)
+			case 'B':
+				keys = append(keys, keyDown)
+			}
+			i += 2
+		case c == 0x1b:
+			keys = append(keys, keyEscape)
+		}
+	}
+	return keys
+}
+
+// key handles a key press
+func (d *Dashboard) key(k string) {
+	if k == keyInterrupt {
+		if d.opts.Interrupt != nil {
+			d.opts.Interrupt()
+		}
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.rows) == 0 {
+		return
+	}
+	switch k {
+	case keyUp:
+		d.selected = max(0, d.selected-1)
+	case keyDown:
+		d.selected = min(len(d.rows)-1, d.selected+1)
+	case keyEnter:
+		d.following = !d.following
+	case keyEscape:
+		d.following = false
+	}
+}
+
+// name returns the name of the step, as subflake/step
+func (r *row) name() string {
+	return r.subflake + "/" + r.step
+}
+
+// activity describes what the nix commands of the step are busy with: the
+// progress of builds and downloads, or else the latest activity running
+func (r *row) activity() string {
+	summary := r.progress.Summary()
+	if summary.ExpectedBuilds > 0 || summary.Downloading > 0 || summary.FetchedBytes > 0 {
+		return summary.String()
+	}
+
+	// Activity IDs increase, so the highest is the latest
+	var latest uint64
+	text := ""
+	for id, t := range r.activities {
+		if id >= latest {
+			latest, text = id, t
+		}
+	}
+	return text
+}
+
+// last returns the last line of output of the step
+func (r *row) last() string {
+	if len(r.log) == 0 {
+		return ""
+	}
+	return r.log[len(r.log)-1]
+}
+
+// statusIcon returns the icon of a finished step
+func statusIcon(status string) string {
+	switch status {
+	case ci.StepPassed:
+		return "✓"
+	case ci.StepCached:
+		return "≡"
+	case ci.StepSkipped:
+		return "○"
+	case ci.StepWarning:
+		return "!"
+	case ci.StepCancelled:
+		return "⊘"
+	default:
+		return "✗"
+	}
+}
+
+// formatDuration rounds d to the second, e.g. "1m2s"
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+// firstLine returns the first line of s
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+// truncate cuts s to width runes, marking the cut with an ellipsis
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	if width <= 1 {
+		return string(runes[:max(width, 0)])
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+// padRight pads s with spaces to width runes
+func padRight(s string, width int) string {
+	if n := len([]rune(s)); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
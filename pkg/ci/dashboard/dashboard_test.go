@@ -0,0 +1,154 @@
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/ci"
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDashboard returns a dashboard whose clock is set by the test
+func newTestDashboard(now *time.Time) *Dashboard {
+	d := New(&bytes.Buffer{}, Options{LogLines: 3})
+	d.now = func() time.Time { return *now }
+	d.started = *now
+	return d
+}
+
+func TestDashboard_Render(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	d := newTestDashboard(&now)
+
+	d.OnStepStart("main", "build")
+	d.OnStepStart("docs", "custom:fmt")
+	d.OnActivity("main", "build", nix.LogEvent{Action: nix.LogActionStart, ID: 1, Activity: nix.ActivityBuilds})
+	d.OnActivity("main", "build", nix.LogEvent{Action: nix.LogActionResult, ID: 1, Result: nix.ResultProgress, Fields: []interface{}{2.0, 10.0, 1.0, 0.0}})
+	d.OnOutput("main", "build", "building '/nix/store/aaa-hello.drv'...")
+	d.OnActivity("docs", "custom:fmt", nix.LogEvent{Action: nix.LogActionStart, ID: 7, Level: nix.LogLevelInfo, Text: "copying '/src' to the store"})
+	d.OnStepEnd("docs", "lockfile", ci.StepResult{Skipped: true})
+
+	now = now.Add(62 * time.Second)
+	assert.Equal(t, []string{
+		"om ci · 1m2s · 2 running, 1 skipped",
+		"› ⠋ main/build         1m2s  2/10 derivations built, 1 building · building '/nix/store/aaa-hello.drv'...",
+		"  ⠋ docs/custom:fmt    1m2s  copying '/src' to the store",
+		"  ○ docs/lockfile        0s  skipped",
+		"",
+		"↑/↓ select · enter follow log · ctrl-c cancel",
+	}, d.render(120, 6))
+
+	// Finished steps show their status and error instead
+	d.OnRetry("docs", "custom:fmt", ci.StepAttempt{Error: "flaky"}, time.Second)
+	d.OnStepEnd("docs", "custom:fmt", ci.StepResult{Error: "formatting differs\nin 3 files", Duration: 3 * time.Second})
+	d.frame = 1
+	assert.Equal(t, []string{
+		"om ci · 1m2s · 1 running, 1 failed, 1 skipped",
+		"› ⠙ main/build         1m2s  2/10 derivations built, 1 building · bui…",
+		"  ✗ docs/custom:fmt      3s  failed · formatting differs",
+		"  ○ docs/lockfile        0s  skipped",
+	}, d.render(70, 5)[:4])
+}
+
+func TestDashboard_Follow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	d := newTestDashboard(&now)
+
+	d.OnStepStart("main", "build")
+	d.OnStepStart("main", "flakeCheck")
+	for _, line := range []string{"one", "\x1b[1mtwo\x1b[0m", "three", "progress 10%\rprogress 90%"} {
+		d.OnOutput("main", "flakeCheck", line)
+	}
+
+	d.key(keyDown)
+	d.key(keyDown)
+	d.key(keyEnter)
+	assert.Equal(t, []string{
+		"om ci · 0s · 2 running",
+		"› ⠋ main/flakeCheck      0s  progress 90%",
+		"    three",
+		"    progress 90%",
+		"enter back to all steps · ↑/↓ select · ctrl-c cancel",
+	}, d.render(80, 5))
+	assert.Equal(t, []string{"two", "three", "progress 90%"}, d.rows[1].log)
+
+	d.key(keyEnter)
+	d.key(keyUp)
+	lines := d.render(80, 5)
+	assert.True(t, strings.HasPrefix(lines[1], "› ⠋ main/build"), lines[1])
+}
+
+func TestDashboard_StartStop(t *testing.T) {
+	var out bytes.Buffer
+	d := New(&out, Options{Refresh: time.Millisecond})
+	require.NoError(t, d.Start())
+	d.OnStepStart("main", "build")
+	d.OnStepEnd("main", "build", ci.StepResult{Success: true, Duration: 2 * time.Second})
+	time.Sleep(5 * time.Millisecond)
+	d.Stop()
+	d.Stop()
+
+	// The final status is printed once the screen is restored
+	output := out.String()
+	assert.True(t, strings.HasPrefix(output, enterScreen))
+	_, summary, ok := strings.Cut(output, leaveScreen)
+	require.True(t, ok)
+	assert.Equal(t, "  ✓ main/build      2s  passed\n", summary)
+}
+
+func TestDashboard_RunsPlannedCommands(t *testing.T) {
+	// A fake nix recording its arguments
+	binDir := t.TempDir()
+	logPath := filepath.Join(binDir, "nix.log")
+	script := "#!/bin/sh\necho \"$*\" >> '" + logPath + "'\n"
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "nix"), []byte(script), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	config := ci.Config{Default: map[string]ci.SubflakeConfig{
+		"main": {Dir: ".", Steps: ci.StepsConfig{
+			Lockfile: ci.LockfileStep{Enable: true},
+			Custom: map[string]ci.CustomStep{
+				"fmt": {Type: ci.CustomStepTypeDevShell, Command: []string{"treefmt"}, DependsOn: []string{"lockfile"}},
+			},
+		}},
+	}}
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	// nix reports its activity to the dashboard, as planned
+	opts := ci.RunOptions{Observer: New(&bytes.Buffer{}, Options{})}
+	plan, err := ci.NewPlan(flake, config, opts)
+	require.NoError(t, err)
+	var planned []string
+	for _, step := range plan.Subflakes[0].Steps {
+		for _, command := range step.Commands {
+			assert.Equal(t, []string{"nix", "--log-format", "internal-json"}, command.Args[:3])
+			planned = append(planned, strings.Join(command.Args[1:], " "))
+		}
+	}
+	require.Len(t, planned, 2)
+
+	_, err = ci.RunPlan(context.Background(), plan, opts)
+	require.NoError(t, err)
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	assert.Equal(t, planned, strings.Split(strings.TrimSpace(string(data)), "\n"))
+}
+
+func TestParseKeys(t *testing.T) {
+	assert.Equal(t, []string{keyUp, keyDown, keyUp, keyDown, keyEnter, keyEscape, keyInterrupt},
+		parseKeys([]byte("\x1b[A\x1b[Bkj\r\x1b\x03x")))
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "héllo", truncate("héllo", 5))
+	assert.Equal(t, "hé…", truncate("héllo", 3))
+	assert.Equal(t, "", truncate("héllo", 0))
+}
@@ -0,0 +1,20 @@
+// Package dashboard shows the steps of a CI run live on a terminal.
+//
+// The dashboard takes over the screen while the run goes on, listing every
+// subflake and step with its status, elapsed time, the nix activity it is
+// busy with and its last line of output. The arrow keys (or j and k)
+// select a step, and enter follows its log until pressed again. Once the
+// run is over, the screen is restored and the final status of every step
+// printed.
+//
+// Example usage:
+//
+//	ctx, cancel := context.WithCancel(ctx)
+//	board := dashboard.New(os.Stdout, dashboard.Options{Input: os.Stdin, Interrupt: cancel})
+//	if err := board.Start(); err != nil {
+//		return err
+//	}
+//	opts.Observer = board
+//	results, err := ci.Run(ctx, flake, config, opts)
+//	board.Stop()
+package dashboard
@@ -7,9 +7,12 @@
 //   - Running flake checks
 //   - Custom step execution
 //   - GitHub Actions matrix generation
-//   - Parallel subflake execution
+//   - Parallel subflake and step execution, with step dependencies
+//   - Execution plans listing the commands a run will use, via NewPlan
 //   - Remote build support via SSH
-//   - Results JSON output
+//   - Results JSON output (and JUnit/TAP reports via the report subpackage)
+//   - Live events of a run for embedding tools, via RunOptions.Observer
+//     (and a terminal dashboard built on them in the dashboard subpackage)
 //
 // Example usage:
 //
@@ -17,11 +20,15 @@
 //	    "context"
 //	    "github.com/saberzero1/omnix/pkg/ci"
 //	    "github.com/saberzero1/omnix/pkg/nix"
+//	    "github.com/saberzero1/omnix/pkg/nix/store"
 //	)
 //
 //	// Load configuration
 //	config, _ := ci.LoadConfig("om.yaml")
 //
+//	// ...or from the flake's `om` output, selecting `ci.release`
+//	config, _ = ci.LoadFlakeConfig(ctx, nix.NewFlakeURL("github:org/repo#release"))
+//
 //	// Run CI for a flake
 //	flake, _ := nix.ParseFlakeURL(".")
 //	opts := ci.RunOptions{
@@ -31,6 +38,10 @@
 //	}
 //	result, _ := ci.Run(ctx, flake, config, opts)
 //
+//	// Or copy the flake to a remote store and run CI there
+//	uri, _ := store.ParseURI("ssh://user@remote.host?copy-inputs=true")
+//	result, _ = ci.RunRemote(ctx, uri, flake, ci.RunOptions{})
+//
 // The package supports running CI steps in parallel for improved performance
 // and can execute builds on remote hosts via SSH. It also generates
 // GitHub Actions matrix configurations for cross-platform testing.
@@ -0,0 +1,72 @@
+package ci
+
+import (
+	"context"
+	"strings"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+)
+
+// DefaultFailedLogLines is the number of trailing build log lines kept for
+// each failed derivation
+const DefaultFailedLogLines = 25
+
+// maxFailedDerivations bounds the number of build logs fetched for a step
+const maxFailedDerivations = 10
+
+// FailedDerivation is a derivation whose builder failed during a step
+type FailedDerivation struct {
+	// DrvPath is the path of the derivation
+	DrvPath string `json:"drvPath"`
+
+	// Log holds the last lines of its build log, as printed by `nix log`
+	Log []string `json:"log,omitempty"`
+
+	// LogError explains why the build log could not be fetched, if it couldn't
+	LogError string `json:"logError,omitempty"`
+}
+
+// fetchFailedDerivations fetches the build logs of the failed derivations,
+// on host if it is set, keeping the last lines of each. Log lines are
+// redacted like the step output.
+func fetchFailedDerivations(ctx context.Context, ssh SSH, host string, drvPaths []string, lines int, out *nix.OutputStream) []FailedDerivation {
+	if lines <= 0 {
+		lines = DefaultFailedLogLines
+	}
+	if len(drvPaths) > maxFailedDerivations {
+		drvPaths = drvPaths[:maxFailedDerivations]
+	}
+
+	failed := make([]FailedDerivation, 0, len(drvPaths))
+	for _, drvPath := range drvPaths {
+		failedDrv := FailedDerivation{DrvPath: drvPath}
+
+		var log string
+		var err error
+		if host != "" {
+			log, err = ssh.Output(ctx, host, []string{"nix", "log", drvPath})
+		} else {
+			log, err = nix.NewCmd().Run(ctx, "log", drvPath)
+		}
+		if err != nil {
+			failedDrv.LogError = out.Redacted(err.Error())
+		} else {
+			failedDrv.Log = lastLines(out.Redacted(log), lines)
+		}
+		failed = append(failed, failedDrv)
+	}
+	return failed
+}
+
+// lastLines returns the last n lines of text, ignoring trailing newlines
+func lastLines(text string, n int) []string {
+	text = strings.TrimRight(text, "\n")
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(text, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
@@ -0,0 +1,93 @@
+package ci
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLastLines(t *testing.T) {
+	assert.Equal(t, []string{"c", "d"}, lastLines("a\nb\nc\nd\n", 2))
+	assert.Equal(t, []string{"a", "b"}, lastLines("a\nb", 5))
+	assert.Nil(t, lastLines("\n", 5))
+}
+
+// failingAppConfig is a config whose only step runs an app, which the fake
+// nix makes fail building a derivation
+func failingAppConfig() Config {
+	return Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Dir: ".", Steps: StepsConfig{
+				Custom: map[string]CustomStep{"test": {Type: CustomStepTypeApp}},
+			}},
+		},
+	}
+}
+
+func TestRun_FailedDerivations(t *testing.T) {
+	logPath := installFakeNix(t, `case "$1" in
+  run)
+    echo "error: builder for '/nix/store/aaa-hello.drv' failed with exit code 2" >&2
+    echo "error: 1 dependencies of derivation '/nix/store/bbb-app.drv' failed to build" >&2
+    exit 1;;
+  log)
+    for i in 1 2 3 4 5; do echo "hello> line $i"; done;;
+esac`)
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	results, err := Run(context.Background(), flake, failingAppConfig(), RunOptions{FailedLogLines: 3})
+	require.NoError(t, err)
+
+	step := results[0].Steps["custom:test"]
+	assert.False(t, step.Success)
+	assert.Equal(t, []FailedDerivation{{
+		DrvPath: "/nix/store/aaa-hello.drv",
+		Log:     []string{"hello> line 3", "hello> line 4", "hello> line 5"},
+	}}, step.FailedDerivations)
+
+	// Only the derivation whose builder failed has a log to fetch
+	calls := readFakeNixLog(t, logPath)
+	assert.Equal(t, "log /nix/store/aaa-hello.drv", calls[len(calls)-1])
+	assert.Len(t, calls, 2)
+}
+
+func TestRun_FailedDerivationsLogError(t *testing.T) {
+	installFakeNix(t, `case "$1" in
+  run) echo "error: builder for '/nix/store/aaa-hello.drv' failed" >&2; exit 1;;
+  log) echo "error: build log of '/nix/store/aaa-hello.drv' is not available" >&2; exit 1;;
+esac`)
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	results, err := Run(context.Background(), flake, failingAppConfig(), RunOptions{})
+	require.NoError(t, err)
+
+	failed := results[0].Steps["custom:test"].FailedDerivations
+	require.Len(t, failed, 1)
+	assert.Empty(t, failed[0].Log)
+	assert.Contains(t, failed[0].LogError, "is not available")
+}
+
+func TestRun_FailedDerivationsRemote(t *testing.T) {
+	ssh := &fakeSSH{
+		runErr: errors.New("error: builder for '/nix/store/aaa-hello.drv' failed"),
+		output: "hello> compiling\nhello> error: oops\n",
+	}
+
+	flake, err := nix.ParseFlakeURL("/nix/store/abc-source")
+	require.NoError(t, err)
+	results, err := Run(context.Background(), flake, failingAppConfig(), RunOptions{RemoteHost: "user@host", SSH: ssh})
+	require.NoError(t, err)
+
+	// The log is fetched from the host that ran the build
+	assert.Equal(t, []FailedDerivation{{
+		DrvPath: "/nix/store/aaa-hello.drv",
+		Log:     []string{"hello> compiling", "hello> error: oops"},
+	}}, results[0].Steps["custom:test"].FailedDerivations)
+	assert.Contains(t, ssh.commands, "user@host: nix log /nix/store/aaa-hello.drv")
+}
@@ -0,0 +1,111 @@
+package ci
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SubflakeFailure describes a subflake that failed during a CI run
+type SubflakeFailure struct {
+	// Subflake is the name of the subflake
+	Subflake string
+
+	// System is the system the subflake was run for, when run by RunPool
+	System string
+
+	// FailedSteps lists the keys of the steps that failed or were cancelled
+	FailedSteps []string
+
+	// Err is the error that stopped the subflake from running, if any
+	Err error
+}
+
+// String describes the failure, e.g. "main (build, custom:test)" or
+// "main on x86_64-linux: no builder available"
+func (f SubflakeFailure) String() string {
+	var b strings.Builder
+	b.WriteString(f.Subflake)
+	if f.System != "" {
+		fmt.Fprintf(&b, " on %s", f.System)
+	}
+	if len(f.FailedSteps) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(f.FailedSteps, ", "))
+	}
+	if f.Err != nil {
+		fmt.Fprintf(&b, ": %v", f.Err)
+	}
+	return b.String()
+}
+
+// RunError is returned by Run when subflakes could not be run to completion,
+// because a subflake returned an error or the run was aborted (FailFast or a
+// cancelled context). It lists every failing subflake.
+//
+// Step failures in a run that did complete are only reported in the results.
+type RunError struct {
+	// Failures lists the failing subflakes, in run order
+	Failures []SubflakeFailure
+
+	// Aborted indicates the run was cancelled before all subflakes finished
+	Aborted bool
+}
+
+func (e *RunError) Error() string {
+	failures := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		failures[i] = f.String()
+	}
+
+	msg := fmt.Sprintf("%d subflake(s) failed", len(e.Failures))
+	if e.Aborted {
+		msg = "CI run aborted; " + msg
+	}
+	if len(failures) == 0 {
+		return msg
+	}
+	return msg + ": " + strings.Join(failures, "; ")
+}
+
+// Unwrap returns the errors of the failing subflakes, for errors.Is and errors.As
+func (e *RunError) Unwrap() []error {
+	var errs []error
+	for _, f := range e.Failures {
+		if f.Err != nil {
+			errs = append(errs, f.Err)
+		}
+	}
+	return errs
+}
+
+// newRunError returns a RunError for the given results and subflake errors,
+// keyed by resultKey, or nil if all subflakes ran to completion.
+func newRunError(results []Result, errs map[string]error, aborted bool) error {
+	if len(errs) == 0 && !aborted {
+		return nil
+	}
+
+	runErr := &RunError{Aborted: aborted}
+	for _, result := range results {
+		failure := SubflakeFailure{Subflake: result.Subflake, System: result.System, Err: errs[resultKey(result)]}
+		for _, name := range sortedStepNames(result.Steps) {
+			switch result.Steps[name].Status() {
+			case StepFailed, StepCancelled:
+				failure.FailedSteps = append(failure.FailedSteps, name)
+			}
+		}
+		if failure.Err != nil || len(failure.FailedSteps) > 0 {
+			runErr.Failures = append(runErr.Failures, failure)
+		}
+	}
+
+	return runErr
+}
+
+// resultKey identifies a result within a run: its subflake, qualified by its
+// system when it has one
+func resultKey(result Result) string {
+	if result.System == "" {
+		return result.Subflake
+	}
+	return result.Subflake + "@" + result.System
+}
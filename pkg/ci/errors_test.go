@@ -0,0 +1,145 @@
+package ci
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunError(t *testing.T) {
+	cause := errors.New("boom")
+	results := []Result{
+		{Subflake: "main", Steps: map[string]StepResult{
+			"build":       {Success: false},
+			"custom:test": {Cancelled: true},
+			"lockfile":    {Success: true},
+		}},
+		{Subflake: "docs", Steps: map[string]StepResult{"build": {Success: true}}},
+		{Subflake: "broken"},
+	}
+
+	err := newRunError(results, map[string]error{"broken": cause}, true)
+	require.Error(t, err)
+
+	var runErr *RunError
+	require.True(t, errors.As(err, &runErr))
+	assert.True(t, runErr.Aborted)
+	assert.Equal(t, []SubflakeFailure{
+		{Subflake: "main", FailedSteps: []string{"build", "custom:test"}},
+		{Subflake: "broken", Err: cause},
+	}, runErr.Failures)
+	assert.Equal(t, "CI run aborted; 2 subflake(s) failed: main (build, custom:test); broken: boom", err.Error())
+	assert.ErrorIs(t, err, cause)
+}
+
+func TestNewRunError_Completed(t *testing.T) {
+	// Step failures of a completed run are only reported in the results
+	results := []Result{{Subflake: "main", Steps: map[string]StepResult{"build": {Success: false}}}}
+	assert.NoError(t, newRunError(results, nil, false))
+}
+
+func TestRun_FailFast_Parallel(t *testing.T) {
+	// The "slow" devshell starts a background child and waits; it only ends
+	// when its whole process group is killed. The child writes its pid so
+	// the test can check it was killed too.
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	installFakeNix(t, `case "$*" in
+  *'#slow'*) sleep 30 & echo $! > '`+pidFile+`'; wait;;
+  *'#broken'*) sleep 0.2; exit 1;;
+esac`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"fast": {
+				Dir: ".",
+				Steps: StepsConfig{Custom: map[string]CustomStep{
+					"fail": {Type: CustomStepTypeDevShell, Name: "broken", Command: []string{"false"}},
+				}},
+			},
+			"slow": {
+				Dir: ".",
+				Steps: StepsConfig{Custom: map[string]CustomStep{
+					"wait":  {Type: CustomStepTypeDevShell, Name: "slow", Command: []string{"true"}},
+					"after": {Type: CustomStepTypeDevShell, Command: []string{"true"}, DependsOn: []string{"wait"}},
+				}},
+			},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	start := time.Now()
+	results, err := Run(context.Background(), flake, config, RunOptions{Parallel: true, FailFast: true})
+	assert.Less(t, time.Since(start), 10*time.Second, "in-flight steps were not cancelled")
+
+	var runErr *RunError
+	require.True(t, errors.As(err, &runErr), "expected a RunError, got %v", err)
+	assert.True(t, runErr.Aborted)
+
+	// Partial results are returned for both subflakes
+	require.Len(t, results, 2)
+	byName := map[string]Result{}
+	for _, r := range results {
+		byName[r.Subflake] = r
+	}
+	assert.Equal(t, StepFailed, byName["fast"].Steps["custom:fail"].Status())
+	assert.Equal(t, StepCancelled, byName["slow"].Steps["custom:wait"].Status())
+	assert.Equal(t, StepSkipped, byName["slow"].Steps["custom:after"].Status())
+	assert.False(t, byName["slow"].Success)
+
+	// The background child of the cancelled step was killed with its group
+	data, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return syscall.Kill(pid, 0) != nil
+	}, 5*time.Second, 50*time.Millisecond, "child process %d is still running", pid)
+}
+
+func TestRun_FailFast_Sequential(t *testing.T) {
+	logPath := installFakeNix(t, `case "$*" in
+  *'#broken'*) exit 1;;
+esac`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"a": {
+				Dir: ".",
+				Steps: StepsConfig{Custom: map[string]CustomStep{
+					"fail": {Type: CustomStepTypeDevShell, Name: "broken", Command: []string{"false"}},
+					"next": {Type: CustomStepTypeDevShell, Command: []string{"next"}},
+				}},
+			},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	results, err := Run(context.Background(), flake, config, RunOptions{FailFast: true})
+	require.Error(t, err)
+	require.Len(t, results, 1)
+
+	steps := results[0].Steps
+	assert.Equal(t, StepFailed, steps["custom:fail"].Status())
+	assert.Equal(t, StepSkipped, steps["custom:next"].Status())
+	assert.Equal(t, "skipped because the run was aborted", steps["custom:next"].Output)
+	assert.Len(t, readFakeNixLog(t, logPath), 1)
+
+	// Without fail-fast, every step runs and no error is returned
+	results, err = Run(context.Background(), flake, config, RunOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, StepPassed, results[0].Steps["custom:next"].Status())
+}
@@ -0,0 +1,59 @@
+package ci
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/require"
+)
+
+// installFakeNix puts a fake `nix` executable at the front of PATH for the
+// duration of the test. Every invocation appends its arguments (space
+// separated, one invocation per line) to the returned log file and then runs
+// body, which may be empty, without the --log-format arguments of commands
+// following log events.
+func installFakeNix(t *testing.T, body string) string {
+	t.Helper()
+	return installFakeCommand(t, "nix", `if [ "$1" = --log-format ]; then shift 2; fi
+`+body)
+}
+
+// installFakeCommand is like installFakeNix, for any executable name.
+func installFakeCommand(t *testing.T, name string, body string) string {
+	t.Helper()
+
+	binDir := t.TempDir()
+	logPath := filepath.Join(binDir, name+".log")
+
+	script := "#!/bin/sh\n" +
+		"echo \"$*\" >> '" + logPath + "'\n" +
+		body + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, name), []byte(script), 0755))
+
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return logPath
+}
+
+// readFakeNixLog returns the recorded nix invocations, one per element.
+func readFakeNixLog(t *testing.T, logPath string) []string {
+	t.Helper()
+
+	data, err := os.ReadFile(logPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+}
+
+// newTestStream returns an output stream that only keeps the tail in memory.
+func newTestStream(t *testing.T) *nix.OutputStream {
+	t.Helper()
+
+	out, err := nix.NewOutputStream(nix.StreamOptions{})
+	require.NoError(t, err)
+	return out
+}
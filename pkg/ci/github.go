@@ -0,0 +1,289 @@
+package ci
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InGitHubActions returns true when running inside a GitHub Actions workflow.
+func InGitHubActions() bool {
+	return os.Getenv("GITHUB_ACTIONS") == "true"
+}
+
+// GitHubActions reports CI progress using GitHub Actions workflow commands.
+// See https://docs.github.com/en/actions/writing-workflows/choosing-what-your-workflow-does/workflow-commands-for-github-actions
+//
+// Every subflake gets a log group, folding the output of its steps. It is
+// safe for concurrent use, so parallel subflakes never interleave their log
+// groups.
+type GitHubActions struct {
+	// Writer receives workflow commands such as ::group:: and ::error
+	Writer io.Writer
+
+	// SummaryPath is the job summary file ($GITHUB_STEP_SUMMARY); empty disables it
+	SummaryPath string
+
+	// OutputPath is the step output file ($GITHUB_OUTPUT); empty disables it
+	OutputPath string
+
+	mu sync.Mutex
+}
+
+// NewGitHubActionsFromEnv creates a GitHubActions reporter writing workflow
+// commands to stderr and files to the paths given by the environment.
+func NewGitHubActionsFromEnv() *GitHubActions {
+	return &GitHubActions{
+		Writer:      os.Stderr,
+		SummaryPath: os.Getenv("GITHUB_STEP_SUMMARY"),
+		OutputPath:  os.Getenv("GITHUB_OUTPUT"),
+	}
+}
+
+// BeginSubflake opens the log group of a subflake before its steps run, so
+// that the output streamed while they run lands inside the group. Only use
+// it when subflakes run one at a time; it must be followed by EndSubflake.
+func (g *GitHubActions) BeginSubflake(subflake string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, _ = fmt.Fprintf(g.Writer, "::group::%s\n", subflake)
+}
+
+// BeginStep marks the start of a step in the log group of its subflake
+func (g *GitHubActions) BeginStep(subflake, step string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, _ = fmt.Fprintf(g.Writer, "▶ %s\n", step)
+}
+
+// EndStep prints the status of a finished step in the log group of its
+// subflake, followed by an error annotation if the step failed.
+func (g *GitHubActions) EndStep(subflake, step string, result StepResult) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.writeStep(subflake, step, result)
+}
+
+// EndSubflake closes the log group opened by BeginSubflake
+func (g *GitHubActions) EndSubflake() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, _ = fmt.Fprintln(g.Writer, "::endgroup::")
+}
+
+// ReportSubflake prints a finished subflake as a log group containing its
+// steps, in the given order, with their output. Subflakes running in
+// parallel are reported this way, so that their groups never interleave.
+func (g *GitHubActions) ReportSubflake(result Result, steps []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	status := StepPassed
+	if !result.Success {
+		status = StepFailed
+	}
+	_, _ = fmt.Fprintf(g.Writer, "::group::%s %s (%s)\n",
+		statusIcon(status), result.Subflake, result.Duration.Round(time.Millisecond))
+	for _, step := range steps {
+		stepResult, ok := result.Steps[step]
+		if !ok {
+			continue
+		}
+		_, _ = fmt.Fprintf(g.Writer, "▶ %s\n", step)
+		if stepResult.Output != "" {
+			_, _ = fmt.Fprintln(g.Writer, stepResult.Output)
+		}
+		g.writeStep(result.Subflake, step, stepResult)
+	}
+	_, _ = fmt.Fprintln(g.Writer, "::endgroup::")
+}
+
+// writeStep prints the status of a step with its error, failed derivations
+// and log file, and annotates a failure as an error, or as a warning if it
+// is allowed
+func (g *GitHubActions) writeStep(subflake, step string, result StepResult) {
+	_, _ = fmt.Fprintf(g.Writer, "%s %s (%s)\n",
+		statusIcon(result.Status()), step, result.Duration.Round(time.Millisecond))
+	if result.Error != "" {
+		_, _ = fmt.Fprintln(g.Writer, result.Error)
+	}
+	for _, drv := range result.FailedDerivations {
+		_, _ = fmt.Fprintf(g.Writer, "Build log of %s:\n", drv.DrvPath)
+		for _, line := range drv.Log {
+			_, _ = fmt.Fprintln(g.Writer, line)
+		}
+	}
+	if result.LogFile != "" {
+		_, _ = fmt.Fprintf(g.Writer, "Full log: %s\n", result.LogFile)
+	}
+
+	switch result.Status() {
+	case StepFailed:
+		_, _ = fmt.Fprintf(g.Writer, "::error title=%s::%s\n",
+			escapeProperty(fmt.Sprintf("%s: %s failed", subflake, step)),
+			escapeData(result.Error))
+		// One more annotation per failed derivation, with its build log
+		for _, drv := range result.FailedDerivations {
+			_, _ = fmt.Fprintf(g.Writer, "::error title=%s::%s\n",
+				escapeProperty(fmt.Sprintf("%s: %s: %s failed", subflake, step, drv.DrvPath)),
+				escapeData(failedDerivationText(drv)))
+		}
+	case StepWarning:
+		_, _ = fmt.Fprintf(g.Writer, "::warning title=%s::%s\n",
+			escapeProperty(fmt.Sprintf("%s: %s failed (allowed)", subflake, step)),
+			escapeData(result.Error))
+	}
+}
+
+// WriteResults appends the summary table to SummaryPath and the built
+// outputs to OutputPath. Either is skipped when its path is empty.
+func (g *GitHubActions) WriteResults(results []Result) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.SummaryPath != "" {
+		if err := appendToFile(g.SummaryPath, SummaryMarkdown(results)); err != nil {
+			return fmt.Errorf("failed to write GitHub step summary: %w", err)
+		}
+	}
+
+	if g.OutputPath != "" {
+		if err := appendToFile(g.OutputPath, outputsFileContent(results)); err != nil {
+			return fmt.Errorf("failed to write GitHub output: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// SummaryMarkdown renders the results as a markdown table, one row per step.
+func SummaryMarkdown(results []Result) string {
+	var b strings.Builder
+
+	b.WriteString("## om ci run\n\n")
+	b.WriteString("| Subflake | Step | Status | Duration |\n")
+	b.WriteString("|---|---|---|---|\n")
+
+	for _, result := range results {
+		for _, name := range sortedStepNames(result.Steps) {
+			step := result.Steps[name]
+			status := step.Status()
+			fmt.Fprintf(&b, "| %s | %s | %s %s | %s |\n",
+				result.Subflake, name, statusIcon(status), status, step.Duration.Round(time.Millisecond))
+		}
+	}
+	b.WriteString("\n")
+
+	for _, result := range results {
+		for _, name := range sortedStepNames(result.Steps) {
+			for _, drv := range result.Steps[name].FailedDerivations {
+				fmt.Fprintf(&b, "### %s: %s: `%s` failed\n\n```\n%s\n```\n\n",
+					result.Subflake, name, drv.DrvPath, failedDerivationText(drv))
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// failedDerivationText returns the end of the build log of a failed
+// derivation, or why it could not be fetched
+func failedDerivationText(drv FailedDerivation) string {
+	if len(drv.Log) == 0 && drv.LogError != "" {
+		return "build log unavailable: " + drv.LogError
+	}
+	return strings.Join(drv.Log, "\n")
+}
+
+// outputsFileContent returns the $GITHUB_OUTPUT entries: the overall success
+// and the newline-separated list of all built store paths.
+func outputsFileContent(results []Result) string {
+	success := true
+	var outPaths []string
+	for _, result := range results {
+		success = success && result.Success
+		for _, name := range sortedStepNames(result.Steps) {
+			for _, path := range result.Steps[name].OutPaths {
+				outPaths = append(outPaths, path.String())
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "success=%t\n", success)
+
+	// Multiline values use the heredoc syntax with a delimiter that can't
+	// appear in a store path.
+	delimiter := "OMNIX_EOF"
+	fmt.Fprintf(&b, "out-paths<<%s\n", delimiter)
+	for _, path := range outPaths {
+		b.WriteString(path)
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "%s\n", delimiter)
+
+	return b.String()
+}
+
+// sortedStepNames returns the step names of a result in deterministic order
+func sortedStepNames(steps map[string]StepResult) []string {
+	names := make([]string, 0, len(steps))
+	for name := range steps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// statusIcon returns the icon for a step status
+func statusIcon(status string) string {
+	switch status {
+	case StepPassed:
+		return "✅"
+	case StepSkipped:
+		return "⏭️"
+	case StepCached:
+		return "♻️"
+	case StepWarning:
+		return "⚠️"
+	case StepCancelled:
+		return "🚫"
+	default:
+		return "❌"
+	}
+}
+
+// appendToFile appends content to the file at path, creating it if needed
+func appendToFile(path, content string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// escapeData escapes the message part of a workflow command
+func escapeData(s string) string {
+	s = strings.ReplaceAll(s, "%", "%25")
+	s = strings.ReplaceAll(s, "\r", "%0D")
+	return strings.ReplaceAll(s, "\n", "%0A")
+}
+
+// escapeProperty escapes a property value (e.g. title=) of a workflow command
+func escapeProperty(s string) string {
+	s = escapeData(s)
+	s = strings.ReplaceAll(s, ":", "%3A")
+	return strings.ReplaceAll(s, ",", "%2C")
+}
@@ -0,0 +1,251 @@
+package ci
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInGitHubActions(t *testing.T) {
+	t.Setenv("GITHUB_ACTIONS", "true")
+	assert.True(t, InGitHubActions())
+
+	t.Setenv("GITHUB_ACTIONS", "")
+	assert.False(t, InGitHubActions())
+}
+
+func TestNewGitHubActionsFromEnv(t *testing.T) {
+	t.Setenv("GITHUB_STEP_SUMMARY", "/tmp/summary.md")
+	t.Setenv("GITHUB_OUTPUT", "/tmp/output")
+
+	gh := NewGitHubActionsFromEnv()
+	assert.Equal(t, "/tmp/summary.md", gh.SummaryPath)
+	assert.Equal(t, "/tmp/output", gh.OutputPath)
+	assert.Equal(t, os.Stderr, gh.Writer)
+}
+
+func TestGitHubActions_ReportSubflake(t *testing.T) {
+	var buf bytes.Buffer
+	gh := &GitHubActions{Writer: &buf}
+
+	gh.ReportSubflake(Result{
+		Subflake: "main",
+		Duration: 2 * time.Second,
+		Steps: map[string]StepResult{
+			"build":      {Success: true, Output: "built", Duration: time.Second},
+			"flakeCheck": {Success: false, Error: "50% broken\nsee log", Duration: time.Second},
+		},
+	}, []string{"build", "flakeCheck", "custom:notrun"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, []string{
+		"::group::❌ main (2s)",
+		"▶ build",
+		"built",
+		"✅ build (1s)",
+		"▶ flakeCheck",
+		"❌ flakeCheck (1s)",
+		"50% broken",
+		"see log",
+		"::error title=main%3A flakeCheck failed::50%25 broken%0Asee log",
+		"::endgroup::",
+	}, lines)
+}
+
+func TestGitHubActions_Subflake(t *testing.T) {
+	var buf bytes.Buffer
+	gh := &GitHubActions{Writer: &buf}
+
+	// Sequential runs stream the output of steps between the markers
+	gh.BeginSubflake("main")
+	gh.BeginStep("main", "build")
+	buf.WriteString("building\n")
+	gh.EndStep("main", "build", StepResult{Success: true, Duration: time.Second})
+	gh.EndStep("main", "lockfile", StepResult{Skipped: true})
+	gh.EndSubflake()
+
+	assert.Equal(t, "::group::main\n▶ build\nbuilding\n✅ build (1s)\n⏭️ lockfile (0s)\n::endgroup::\n", buf.String())
+}
+
+func TestGitHubActions_ReportStep_Warning(t *testing.T) {
+	var buf bytes.Buffer
+	gh := &GitHubActions{Writer: &buf}
+
+	gh.EndStep("main", "custom:lint", StepResult{AllowedFailure: true, Error: "lint failed", Duration: time.Second})
+
+	assert.Contains(t, buf.String(), "⚠️ custom:lint (1s)\n")
+	assert.Contains(t, buf.String(), "::warning title=main%3A custom%3Alint failed (allowed)::lint failed\n")
+	assert.NotContains(t, buf.String(), "::error")
+}
+
+func TestGitHubActions_ReportStep_FailedDerivations(t *testing.T) {
+	var buf bytes.Buffer
+	gh := &GitHubActions{Writer: &buf}
+
+	gh.EndStep("main", "build", StepResult{
+		Error:    "devour-flake failed",
+		Duration: time.Second,
+		FailedDerivations: []FailedDerivation{
+			{DrvPath: "/nix/store/aaa-hello.drv", Log: []string{"make: error", "exit 2"}},
+			{DrvPath: "/nix/store/bbb-lib.drv", LogError: "not available"},
+		},
+	})
+
+	assert.Contains(t, buf.String(), "Build log of /nix/store/aaa-hello.drv:\nmake: error\nexit 2\n")
+	assert.Contains(t, buf.String(), "::error title=main%3A build%3A /nix/store/aaa-hello.drv failed::make: error%0Aexit 2\n")
+	assert.Contains(t, buf.String(), "::error title=main%3A build%3A /nix/store/bbb-lib.drv failed::build log unavailable: not available\n")
+
+	summary := SummaryMarkdown([]Result{{Subflake: "main", Steps: map[string]StepResult{"build": {
+		FailedDerivations: []FailedDerivation{{DrvPath: "/nix/store/aaa-hello.drv", Log: []string{"make: error"}}},
+	}}}})
+	assert.Contains(t, summary, "### main: build: `/nix/store/aaa-hello.drv` failed\n\n```\nmake: error\n```\n")
+}
+
+func TestSummaryMarkdown(t *testing.T) {
+	results := []Result{
+		{
+			Subflake: "main",
+			Steps: map[string]StepResult{
+				"lockfile":    {Success: false, Duration: 2 * time.Second},
+				"build":       {Success: true, Duration: time.Second},
+				"custom:test": {Skipped: true},
+			},
+		},
+	}
+
+	summary := SummaryMarkdown(results)
+	assert.Contains(t, summary, "| Subflake | Step | Status | Duration |")
+	// Steps are listed in sorted order
+	assert.Less(t,
+		strings.Index(summary, "| main | build | ✅ passed | 1s |"),
+		strings.Index(summary, "| main | lockfile | ❌ failed | 2s |"))
+	assert.Contains(t, summary, "| main | custom:test | ⏭️ skipped | 0s |")
+}
+
+func TestRun_GitHubOutput(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// devour-flake prints the path of a JSON file listing the built outputs
+	devourJSON := filepath.Join(tmpDir, "devour.json")
+	require.NoError(t, os.WriteFile(devourJSON,
+		[]byte(`{"outPaths": ["/nix/store/abc-hello", "/nix/store/def-world"], "byName": {}}`), 0644))
+	installFakeNix(t, `case "$1" in
+  build) echo '`+devourJSON+`';;
+  flake) echo "lock file needs updating" >&2; exit 1;;
+esac`)
+
+	summaryPath := filepath.Join(tmpDir, "summary.md")
+	outputPath := filepath.Join(tmpDir, "output")
+	t.Setenv("GITHUB_STEP_SUMMARY", summaryPath)
+	t.Setenv("GITHUB_OUTPUT", outputPath)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {
+				Dir: ".",
+				Steps: StepsConfig{
+					Build:    BuildStep{Enable: true},
+					Lockfile: LockfileStep{Enable: true},
+				},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	gh := NewGitHubActionsFromEnv()
+	gh.Writer = &buf
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	results, err := Run(context.Background(), flake, config, RunOptions{GitHubOutput: true, github: gh})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, []store.Path{store.NewPath("/nix/store/abc-hello"), store.NewPath("/nix/store/def-world")},
+		results[0].Steps["build"].OutPaths)
+
+	log := buf.String()
+	// Sequential runs open the group of the subflake before its steps run,
+	// and close it once they are done
+	assert.True(t, strings.HasPrefix(log, "::group::main\n▶ build\n"), log)
+	assert.Contains(t, log, "✅ build (")
+	assert.Contains(t, log, "▶ lockfile\n")
+	assert.Contains(t, log, "❌ lockfile (")
+	assert.Contains(t, log, "::error title=main%3A lockfile failed::flake.lock is out of date")
+	assert.True(t, strings.HasSuffix(log, "::endgroup::\n"), log)
+	assert.Equal(t, 1, strings.Count(log, "::group::"))
+
+	summary, err := os.ReadFile(summaryPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(summary), "| main | build | ✅ passed |")
+	assert.Contains(t, string(summary), "| main | lockfile | ❌ failed |")
+
+	output, err := os.ReadFile(outputPath)
+	require.NoError(t, err)
+	assert.Equal(t,
+		"success=false\nout-paths<<OMNIX_EOF\n/nix/store/abc-hello\n/nix/store/def-world\nOMNIX_EOF\n",
+		string(output))
+}
+
+func TestRun_GitHubOutputDisabled(t *testing.T) {
+	summaryPath := filepath.Join(t.TempDir(), "summary.md")
+	t.Setenv("GITHUB_STEP_SUMMARY", summaryPath)
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	config := Config{Default: map[string]SubflakeConfig{"main": {Dir: "."}}}
+	_, err = Run(context.Background(), flake, config, RunOptions{})
+	require.NoError(t, err)
+
+	_, err = os.Stat(summaryPath)
+	assert.True(t, os.IsNotExist(err), "summary should not be written without GitHubOutput")
+}
+
+func TestRun_GitHubOutputParallel(t *testing.T) {
+	installFakeNix(t, `echo "output of $*"`)
+
+	config := Config{Default: map[string]SubflakeConfig{}}
+	for _, name := range []string{"a", "b", "c"} {
+		config.Default[name] = SubflakeConfig{Dir: ".", Steps: StepsConfig{
+			Custom: map[string]CustomStep{
+				"one": {Type: CustomStepTypeApp, Name: "one"},
+				"two": {Type: CustomStepTypeApp, Name: "two", DependsOn: []string{"one"}},
+			},
+		}}
+	}
+
+	var buf, terminal bytes.Buffer
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	_, err = Run(context.Background(), flake, config, RunOptions{
+		Parallel:     true,
+		GitHubOutput: true,
+		Output:       &terminal,
+		github:       &GitHubActions{Writer: &buf},
+	})
+	require.NoError(t, err)
+
+	// Every subflake is reported as a whole, in a group of its own
+	log := regexp.MustCompile(`\([0-9.]+[µm]?s\)`).ReplaceAllString(buf.String(), "(…)")
+	for _, name := range []string{"a", "b", "c"} {
+		assert.Contains(t, log, "::group::✅ "+name+" (…)\n"+
+			"▶ custom:one\noutput of run .#one\n✅ custom:one (…)\n"+
+			"▶ custom:two\noutput of run .#two\n✅ custom:two (…)\n"+
+			"::endgroup::\n")
+	}
+	assert.Equal(t, 3, strings.Count(log, "::group::"))
+
+	// The output is only shown in the groups
+	assert.Empty(t, terminal.String())
+}
@@ -0,0 +1,258 @@
+package ci
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// builtinSteps are the built-in step names in their default execution order.
+// They can be used as dependency names in CustomStep.DependsOn.
+var builtinSteps = []string{"build", "lockfile", "flakeCheck", "push", "closureSize"}
+
+// stepGraph is the dependency graph of the steps of a single subflake
+type stepGraph struct {
+	// order lists the step keys (e.g. "build", "custom:fmt") in a
+	// deterministic topological order: every step comes after its dependencies
+	order []string
+
+	// deps maps a step key to the keys of the steps it depends on
+	deps map[string][]string
+}
+
+// newStepGraph builds the dependency graph of the enabled steps of a
+// subflake. Dependencies on steps that are disabled, or that don't run on
+// the given systems, are ignored. Unknown dependencies and cycles are errors.
+func newStepGraph(steps StepsConfig, systems []string) (*stepGraph, error) {
+	enabled := map[string]bool{
+		"build":       steps.Build.Enable,
+		"lockfile":    steps.Lockfile.Enable,
+		"flakeCheck":  steps.FlakeCheck.Enable,
+		"push":        steps.Push.Enable,
+		"closureSize": steps.ClosureSize.Enable && steps.ClosureSize.CanRunOn(systems),
+	}
+
+	// The push step pushes what the build step built
+	if enabled["push"] && !enabled["build"] {
+		return nil, fmt.Errorf("step push requires the build step to be enabled")
+	}
+
+	var keys []string
+	for _, name := range builtinSteps {
+		if enabled[name] {
+			keys = append(keys, name)
+		}
+	}
+
+	// Custom steps come from a map; sort them so the order is stable
+	names := make([]string, 0, len(steps.Custom))
+	for name, step := range steps.Custom {
+		if step.CanRunOn(systems) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := "custom:" + name
+		enabled[key] = true
+		keys = append(keys, key)
+	}
+
+	deps := make(map[string][]string)
+	if enabled["push"] {
+		deps["push"] = []string{"build"}
+	}
+	// The build step builds the outputs the closure size step measures, if
+	// both run; measuring them meanwhile would build them twice
+	if enabled["closureSize"] && enabled["build"] {
+		deps["closureSize"] = []string{"build"}
+	}
+	for _, name := range names {
+		key := "custom:" + name
+		for _, dep := range steps.Custom[name].DependsOn {
+			depKey, ok := resolveDependency(steps, dep)
+			if !ok {
+				return nil, fmt.Errorf("step %s depends on unknown step %q", key, dep)
+			}
+			if enabled[depKey] {
+				deps[key] = append(deps[key], depKey)
+			}
+		}
+	}
+
+	order, err := topoOrder(keys, deps)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stepGraph{order: order, deps: deps}, nil
+}
+
+// resolveDependency maps a dependency name to a step key. Built-in step names
+// take precedence; custom steps may be referred to as "name" or "custom:name".
+func resolveDependency(steps StepsConfig, dep string) (string, bool) {
+	for _, name := range builtinSteps {
+		if dep == name {
+			return name, true
+		}
+	}
+
+	name := strings.TrimPrefix(dep, "custom:")
+	if _, ok := steps.Custom[name]; ok {
+		return "custom:" + name, true
+	}
+
+	return "", false
+}
+
+// topoOrder sorts keys so that every key comes after its dependencies,
+// otherwise keeping the given order. It returns an error describing the
+// first cycle found.
+func topoOrder(keys []string, deps map[string][]string) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int, len(keys))
+	order := make([]string, 0, len(keys))
+	var stack []string
+
+	var visit func(key string) error
+	visit = func(key string) error {
+		switch state[key] {
+		case visited:
+			return nil
+		case visiting:
+			// Report the cycle starting from the first occurrence of key
+			for i, k := range stack {
+				if k == key {
+					cycle := append(append([]string{}, stack[i:]...), key)
+					return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+				}
+			}
+		}
+
+		state[key] = visiting
+		stack = append(stack, key)
+		for _, dep := range deps[key] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[key] = visited
+		order = append(order, key)
+
+		return nil
+	}
+
+	for _, key := range keys {
+		if err := visit(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// run executes the steps of the graph, calling done with each step's result.
+// A step whose dependency did not succeed, or that would start after ctx is
+// cancelled, is not run but marked skipped.
+//
+// Sequentially, steps run one at a time in g.order. In parallel, every step
+// starts as soon as its dependencies finish, holding one of slots (if
+// non-nil) while it runs. done may be called concurrently in that case.
+func (g *stepGraph) run(ctx context.Context, parallel bool, slots chan struct{}, runStep func(key string) StepResult, done func(key string, result StepResult)) {
+	var mu sync.Mutex
+	results := make(map[string]StepResult, len(g.order))
+
+	// blockedBy returns the first dependency of key that did not succeed
+	blockedBy := func(key string) (string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, dep := range g.deps[key] {
+			if !results[dep].Success {
+				return dep, true
+			}
+		}
+		return "", false
+	}
+
+	// acquire waits for a free slot, returning false if ctx is cancelled first
+	release := func() {
+		if slots != nil {
+			<-slots
+		}
+	}
+	acquire := func() bool {
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if ctx.Err() != nil {
+			release()
+			return false
+		}
+		return true
+	}
+
+	execute := func(key string) {
+		var result StepResult
+		if dep, blocked := blockedBy(key); blocked {
+			result = StepResult{
+				Name:    key,
+				Skipped: true,
+				Output:  fmt.Sprintf("skipped because %s did not succeed", dep),
+			}
+		} else if !acquire() {
+			result = StepResult{
+				Name:    key,
+				Skipped: true,
+				Output:  "skipped because the run was aborted",
+			}
+		} else {
+			result = runStep(key)
+			release()
+		}
+
+		mu.Lock()
+		results[key] = result
+		mu.Unlock()
+
+		done(key, result)
+	}
+
+	if !parallel {
+		for _, key := range g.order {
+			execute(key)
+		}
+		return
+	}
+
+	finished := make(map[string]chan struct{}, len(g.order))
+	for _, key := range g.order {
+		finished[key] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	for _, key := range g.order {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			defer close(finished[key])
+
+			for _, dep := range g.deps[key] {
+				<-finished[dep]
+			}
+			execute(key)
+		}(key)
+	}
+	wg.Wait()
+}
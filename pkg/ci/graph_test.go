@@ -0,0 +1,270 @@
+package ci
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStepGraph_Order(t *testing.T) {
+	steps := StepsConfig{
+		Build:    BuildStep{Enable: true},
+		Lockfile: LockfileStep{Enable: true},
+		Custom: map[string]CustomStep{
+			"deploy": {Type: CustomStepTypeApp, DependsOn: []string{"test", "lockfile"}},
+			"test":   {Type: CustomStepTypeApp, DependsOn: []string{"build"}},
+			"lint":   {Type: CustomStepTypeApp},
+		},
+	}
+
+	graph, err := newStepGraph(steps, nil)
+	require.NoError(t, err)
+
+	// Built-ins first, then custom steps alphabetically, dependencies first
+	assert.Equal(t, []string{"build", "lockfile", "custom:test", "custom:deploy", "custom:lint"}, graph.order)
+	assert.Equal(t, []string{"custom:test", "lockfile"}, graph.deps["custom:deploy"])
+	assert.Equal(t, []string{"build"}, graph.deps["custom:test"])
+}
+
+func TestNewStepGraph_Push(t *testing.T) {
+	steps := StepsConfig{
+		Build: BuildStep{Enable: true},
+		Push:  PushStep{Enable: true, To: "file:///cache"},
+		Custom: map[string]CustomStep{
+			"announce": {Type: CustomStepTypeApp, DependsOn: []string{"push"}},
+		},
+	}
+
+	graph, err := newStepGraph(steps, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"build", "push", "custom:announce"}, graph.order)
+	assert.Equal(t, []string{"build"}, graph.deps["push"])
+
+	// There is nothing to push without the build step
+	steps.Build.Enable = false
+	_, err = newStepGraph(steps, nil)
+	assert.ErrorContains(t, err, "step push requires the build step")
+}
+
+func TestNewStepGraph_ClosureSize(t *testing.T) {
+	steps := StepsConfig{
+		Build:       BuildStep{Enable: true},
+		ClosureSize: ClosureSizeStep{Enable: true, Systems: []string{"x86_64-linux"}},
+	}
+
+	graph, err := newStepGraph(steps, []string{"x86_64-linux"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"build", "closureSize"}, graph.order)
+	assert.Equal(t, []string{"build"}, graph.deps["closureSize"])
+
+	// Without the build step, the closure size step builds what it measures
+	steps.Build.Enable = false
+	graph, err = newStepGraph(steps, []string{"x86_64-linux"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"closureSize"}, graph.order)
+	assert.Empty(t, graph.deps["closureSize"])
+
+	graph, err = newStepGraph(steps, []string{"aarch64-darwin"})
+	require.NoError(t, err)
+	assert.Empty(t, graph.order)
+}
+
+func TestNewStepGraph_IgnoresDisabledDependencies(t *testing.T) {
+	steps := StepsConfig{
+		Custom: map[string]CustomStep{
+			"test":        {Type: CustomStepTypeApp, DependsOn: []string{"build", "custom:darwin-only"}},
+			"darwin-only": {Type: CustomStepTypeApp, Systems: []string{"aarch64-darwin"}},
+		},
+	}
+
+	graph, err := newStepGraph(steps, []string{"x86_64-linux"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"custom:test"}, graph.order)
+	assert.Empty(t, graph.deps["custom:test"])
+}
+
+func TestNewStepGraph_UnknownDependency(t *testing.T) {
+	steps := StepsConfig{
+		Custom: map[string]CustomStep{
+			"test": {Type: CustomStepTypeApp, DependsOn: []string{"nope"}},
+		},
+	}
+
+	_, err := newStepGraph(steps, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown step "nope"`)
+}
+
+func TestNewStepGraph_Cycle(t *testing.T) {
+	steps := StepsConfig{
+		Custom: map[string]CustomStep{
+			"a": {Type: CustomStepTypeApp, DependsOn: []string{"b"}},
+			"b": {Type: CustomStepTypeApp, DependsOn: []string{"c"}},
+			"c": {Type: CustomStepTypeApp, DependsOn: []string{"a"}},
+		},
+	}
+
+	_, err := newStepGraph(steps, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "dependency cycle: custom:a -> custom:b -> custom:c -> custom:a")
+
+	// A step depending on itself is a cycle too
+	_, err = newStepGraph(StepsConfig{Custom: map[string]CustomStep{
+		"a": {Type: CustomStepTypeApp, DependsOn: []string{"a"}},
+	}}, nil)
+	assert.Error(t, err)
+}
+
+func TestStepGraph_SkipsDependentsOfFailedSteps(t *testing.T) {
+	graph := &stepGraph{
+		order: []string{"build", "custom:test", "custom:deploy", "custom:lint"},
+		deps: map[string][]string{
+			"custom:test":   {"build"},
+			"custom:deploy": {"custom:test"},
+		},
+	}
+
+	for _, parallel := range []bool{false, true} {
+		var mu sync.Mutex
+		var ran []string
+		results := make(map[string]StepResult)
+
+		graph.run(context.Background(), parallel, nil,
+			func(key string) StepResult {
+				mu.Lock()
+				ran = append(ran, key)
+				mu.Unlock()
+				return StepResult{Name: key, Success: key != "build"}
+			},
+			func(key string, result StepResult) {
+				mu.Lock()
+				results[key] = result
+				mu.Unlock()
+			})
+
+		assert.ElementsMatch(t, []string{"build", "custom:lint"}, ran)
+		assert.Equal(t, StepFailed, results["build"].Status())
+		assert.Equal(t, StepSkipped, results["custom:test"].Status())
+		assert.Contains(t, results["custom:test"].Output, "build")
+		// Skipping is transitive
+		assert.Equal(t, StepSkipped, results["custom:deploy"].Status())
+		assert.Equal(t, StepPassed, results["custom:lint"].Status())
+	}
+}
+
+func TestStepGraph_ParallelRespectsDependenciesAndSlots(t *testing.T) {
+	graph := &stepGraph{
+		order: []string{"a", "b", "c", "d"},
+		deps:  map[string][]string{"d": {"a", "b", "c"}},
+	}
+
+	var running, maxRunning int32
+	var mu sync.Mutex
+	finished := make(map[string]bool)
+
+	graph.run(context.Background(), true, make(chan struct{}, 2),
+		func(key string) StepResult {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+
+			if key == "d" {
+				mu.Lock()
+				assert.True(t, finished["a"] && finished["b"] && finished["c"], "d started before its dependencies finished")
+				mu.Unlock()
+			}
+			time.Sleep(20 * time.Millisecond)
+
+			atomic.AddInt32(&running, -1)
+			return StepResult{Name: key, Success: true}
+		},
+		func(key string, _ StepResult) {
+			mu.Lock()
+			finished[key] = true
+			mu.Unlock()
+		})
+
+	assert.Len(t, finished, 4)
+	assert.Equal(t, int32(2), maxRunning)
+}
+
+func TestRun_DependsOn(t *testing.T) {
+	// Every `nix develop` fails for the "broken" devshell
+	logPath := installFakeNix(t, `case "$*" in
+  *'#broken'*) exit 1;;
+esac`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {
+				Dir: ".",
+				Steps: StepsConfig{
+					Custom: map[string]CustomStep{
+						"compile": {Type: CustomStepTypeDevShell, Name: "broken", Command: []string{"make"}},
+						"test":    {Type: CustomStepTypeDevShell, Command: []string{"make", "test"}, DependsOn: []string{"compile"}},
+						"lint":    {Type: CustomStepTypeDevShell, Command: []string{"make", "lint"}},
+					},
+				},
+			},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	results, err := Run(context.Background(), flake, config, RunOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	steps := results[0].Steps
+	assert.False(t, results[0].Success)
+	assert.Equal(t, StepFailed, steps["custom:compile"].Status())
+	assert.Equal(t, StepSkipped, steps["custom:test"].Status())
+	assert.Equal(t, StepPassed, steps["custom:lint"].Status())
+
+	// The skipped step never ran
+	for _, call := range readFakeNixLog(t, logPath) {
+		assert.False(t, strings.HasSuffix(call, "make test"), "unexpected call: %s", call)
+	}
+}
+
+func TestRun_DependencyCycle(t *testing.T) {
+	logPath := installFakeNix(t, "")
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {
+				Dir: ".",
+				Steps: StepsConfig{
+					Build: BuildStep{Enable: true},
+					Custom: map[string]CustomStep{
+						"a": {Type: CustomStepTypeApp, DependsOn: []string{"b"}},
+						"b": {Type: CustomStepTypeApp, DependsOn: []string{"a"}},
+					},
+				},
+			},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	_, err = Run(context.Background(), flake, config, RunOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "dependency cycle")
+
+	// Nothing ran
+	assert.Empty(t, readFakeNixLog(t, logPath))
+}
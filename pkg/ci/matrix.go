@@ -3,6 +3,11 @@ package ci
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"gopkg.in/yaml.v3"
 )
 
 // GitHubMatrixRow represents a single row in the GitHub Actions matrix
@@ -20,12 +25,20 @@ type GitHubMatrix struct {
 	Include []GitHubMatrixRow `json:"include"`
 }
 
-// GenerateMatrix creates a GitHub Actions matrix from systems and subflakes
+// GenerateMatrix creates a GitHub Actions matrix from systems and subflakes.
+// Rows are ordered by system, then by subflake name.
 func GenerateMatrix(systems []string, config Config) GitHubMatrix {
 	var include []GitHubMatrixRow
 
+	names := make([]string, 0, len(config.Default))
+	for name := range config.Default {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
 	for _, system := range systems {
-		for name, subflake := range config.Default {
+		for _, name := range names {
+			subflake := config.Default[name]
 			// Skip if this subflake is marked to skip
 			if subflake.Skip {
 				continue
@@ -59,3 +72,179 @@ func (m *GitHubMatrix) ToJSON() (string, error) {
 func (m *GitHubMatrix) Count() int {
 	return len(m.Include)
 }
+
+// MatrixFormat is an output format of WriteMatrix
+type MatrixFormat string
+
+const (
+	// MatrixFormatGitHub is the GitHub Actions matrix JSON
+	MatrixFormatGitHub MatrixFormat = "github"
+	// MatrixFormatGitLab is a GitLab CI child pipeline
+	MatrixFormatGitLab MatrixFormat = "gitlab"
+	// MatrixFormatBuildkite is a Buildkite dynamic pipeline
+	MatrixFormatBuildkite MatrixFormat = "buildkite"
+	// MatrixFormatJSONL is one JSON object per row
+	MatrixFormatJSONL MatrixFormat = "jsonl"
+)
+
+// MatrixFormats lists the supported matrix formats
+var MatrixFormats = []MatrixFormat{MatrixFormatGitHub, MatrixFormatGitLab, MatrixFormatBuildkite, MatrixFormatJSONL}
+
+// ParseMatrixFormat parses a matrix format name
+func ParseMatrixFormat(name string) (MatrixFormat, error) {
+	for _, format := range MatrixFormats {
+		if string(format) == name {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unknown matrix format %q (supported: github, gitlab, buildkite, jsonl)", name)
+}
+
+// RunnerSystems returns the systems that have a runner configured, sorted
+func (c Config) RunnerSystems() []string {
+	systems := make([]string, 0, len(c.Runners))
+	for system := range c.Runners {
+		systems = append(systems, system)
+	}
+	sort.Strings(systems)
+	return systems
+}
+
+// MatrixJob is a row of the matrix along with how to run it, as written by
+// the jsonl format
+type MatrixJob struct {
+	// System to build on
+	System string `json:"system"`
+
+	// Subflake to build
+	Subflake string `json:"subflake"`
+
+	// Flake is the flake URL selecting the subflake, e.g. ".#default.tests"
+	Flake string `json:"flake"`
+
+	// Command is the shell command running CI for the row
+	Command string `json:"command"`
+
+	// Runner is the runner configured for the system, if any
+	Runner *Runner `json:"runner,omitempty"`
+}
+
+// MatrixJobs returns the jobs of the matrix rows. flakeURL is the flake the
+// jobs run CI on; its fragment selects the configuration, as for `om ci run`.
+func MatrixJobs(matrix GitHubMatrix, flakeURL nix.FlakeURL, runners map[string]Runner) []MatrixJob {
+	jobs := make([]MatrixJob, 0, len(matrix.Include))
+	for _, row := range matrix.Include {
+		flake := subflakeFlakeURL(flakeURL, row.Subflake).String()
+		job := MatrixJob{
+			System:   row.System,
+			Subflake: row.Subflake,
+			Flake:    flake,
+			Command:  shellCommand([]string{"om", "ci", "run", "--systems", row.System, flake}),
+		}
+		if runner, ok := runners[row.System]; ok {
+			job.Runner = &runner
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// WriteMatrix writes the matrix in the given format: the GitHub Actions
+// matrix JSON, a pipeline definition running `om ci run` for every row
+// (GitLab CI or Buildkite), or the jobs as JSON lines.
+func WriteMatrix(w io.Writer, format MatrixFormat, matrix GitHubMatrix, flakeURL nix.FlakeURL, runners map[string]Runner) error {
+	var err error
+	switch format {
+	case MatrixFormatGitHub:
+		var data string
+		if data, err = matrix.ToJSON(); err == nil {
+			_, err = fmt.Fprintln(w, data)
+		}
+	case MatrixFormatGitLab:
+		err = writeGitLabPipeline(w, MatrixJobs(matrix, flakeURL, runners))
+	case MatrixFormatBuildkite:
+		err = writeBuildkitePipeline(w, MatrixJobs(matrix, flakeURL, runners))
+	case MatrixFormatJSONL:
+		enc := json.NewEncoder(w)
+		for _, job := range MatrixJobs(matrix, flakeURL, runners) {
+			if err = enc.Encode(job); err != nil {
+				break
+			}
+		}
+	default:
+		return fmt.Errorf("unknown matrix format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s matrix: %w", format, err)
+	}
+	return nil
+}
+
+// gitlabJob is a job of a GitLab CI pipeline
+type gitlabJob struct {
+	Tags      []string          `yaml:"tags,omitempty"`
+	Variables map[string]string `yaml:"variables,omitempty"`
+	Script    []string          `yaml:"script"`
+}
+
+// writeGitLabPipeline writes a GitLab CI child pipeline with a job per row.
+// GitLab rejects pipelines without jobs, so an empty matrix gets a job
+// that does nothing.
+func writeGitLabPipeline(w io.Writer, jobs []MatrixJob) error {
+	pipeline := make(map[string]gitlabJob, len(jobs))
+	for _, job := range jobs {
+		gitlab := gitlabJob{
+			Variables: map[string]string{"OM_CI_SYSTEM": job.System, "OM_CI_SUBFLAKE": job.Subflake},
+			Script:    []string{job.Command},
+		}
+		if job.Runner != nil {
+			gitlab.Tags = job.Runner.Tags
+		}
+		pipeline[fmt.Sprintf("om-ci %s %s", job.Subflake, job.System)] = gitlab
+	}
+	if len(pipeline) == 0 {
+		pipeline["om-ci"] = gitlabJob{Script: []string{"echo 'om ci: nothing to build'"}}
+	}
+
+	return encodeYAML(w, pipeline)
+}
+
+// buildkiteStep is a command step of a Buildkite pipeline
+type buildkiteStep struct {
+	Label   string            `yaml:"label"`
+	Command string            `yaml:"command"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	Agents  map[string]string `yaml:"agents,omitempty"`
+}
+
+// writeBuildkitePipeline writes a Buildkite pipeline with a step per row, to
+// be uploaded with `buildkite-agent pipeline upload`
+func writeBuildkitePipeline(w io.Writer, jobs []MatrixJob) error {
+	pipeline := struct {
+		Steps []buildkiteStep `yaml:"steps"`
+	}{Steps: []buildkiteStep{}}
+
+	for _, job := range jobs {
+		step := buildkiteStep{
+			Label:   fmt.Sprintf("om ci %s (%s)", job.Subflake, job.System),
+			Command: job.Command,
+			Env:     map[string]string{"OM_CI_SYSTEM": job.System, "OM_CI_SUBFLAKE": job.Subflake},
+		}
+		if job.Runner != nil && job.Runner.Queue != "" {
+			step.Agents = map[string]string{"queue": job.Runner.Queue}
+		}
+		pipeline.Steps = append(pipeline.Steps, step)
+	}
+
+	return encodeYAML(w, pipeline)
+}
+
+// encodeYAML writes v as a YAML document
+func encodeYAML(w io.Writer, v interface{}) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,150 @@
+package ci
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func matrixTestConfig() Config {
+	return Config{
+		Default: map[string]SubflakeConfig{
+			"tests": {Dir: "tests"},
+			"main":  {Dir: "."},
+			"docs":  {Dir: "docs", Systems: []string{"x86_64-linux"}},
+		},
+		Runners: map[string]Runner{
+			"x86_64-linux":   {Tags: []string{"nix", "linux"}, Queue: "linux"},
+			"aarch64-darwin": {Tags: []string{"macos"}},
+		},
+	}
+}
+
+func TestGenerateMatrix_Order(t *testing.T) {
+	matrix := GenerateMatrix([]string{"x86_64-linux", "aarch64-darwin"}, matrixTestConfig())
+	assert.Equal(t, []GitHubMatrixRow{
+		{System: "x86_64-linux", Subflake: "docs"},
+		{System: "x86_64-linux", Subflake: "main"},
+		{System: "x86_64-linux", Subflake: "tests"},
+		{System: "aarch64-darwin", Subflake: "main"},
+		{System: "aarch64-darwin", Subflake: "tests"},
+	}, matrix.Include)
+}
+
+func TestParseMatrixFormat(t *testing.T) {
+	for _, format := range MatrixFormats {
+		parsed, err := ParseMatrixFormat(string(format))
+		require.NoError(t, err)
+		assert.Equal(t, format, parsed)
+	}
+
+	_, err := ParseMatrixFormat("travis")
+	assert.ErrorContains(t, err, `unknown matrix format "travis"`)
+}
+
+func TestMatrixJobs(t *testing.T) {
+	config := matrixTestConfig()
+	matrix := GenerateMatrix([]string{"aarch64-darwin"}, config)
+
+	flake, err := nix.ParseFlakeURL("github:org/repo#release")
+	require.NoError(t, err)
+
+	jobs := MatrixJobs(matrix, flake, config.Runners)
+	require.Len(t, jobs, 2)
+	assert.Equal(t, MatrixJob{
+		System:   "aarch64-darwin",
+		Subflake: "main",
+		Flake:    "github:org/repo#release.main",
+		Command:  "om ci run --systems aarch64-darwin 'github:org/repo#release.main'",
+		Runner:   &Runner{Tags: []string{"macos"}},
+	}, jobs[0])
+
+	// Systems without a runner run anywhere
+	jobs = MatrixJobs(GenerateMatrix([]string{"riscv64-linux"}, config), flake, config.Runners)
+	require.NotEmpty(t, jobs)
+	assert.Nil(t, jobs[0].Runner)
+}
+
+func TestWriteMatrix_GitLab(t *testing.T) {
+	config := matrixTestConfig()
+	matrix := GenerateMatrix([]string{"x86_64-linux", "aarch64-darwin"}, config)
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteMatrix(&buf, MatrixFormatGitLab, matrix, flake, config.Runners))
+
+	var pipeline map[string]gitlabJob
+	require.NoError(t, yaml.Unmarshal(buf.Bytes(), &pipeline))
+	assert.Len(t, pipeline, 5)
+	assert.Equal(t, gitlabJob{
+		Tags:      []string{"nix", "linux"},
+		Variables: map[string]string{"OM_CI_SYSTEM": "x86_64-linux", "OM_CI_SUBFLAKE": "docs"},
+		Script:    []string{"om ci run --systems x86_64-linux '.#default.docs'"},
+	}, pipeline["om-ci docs x86_64-linux"])
+	assert.Equal(t, []string{"macos"}, pipeline["om-ci main aarch64-darwin"].Tags)
+
+	// An empty matrix still makes a valid pipeline
+	buf.Reset()
+	require.NoError(t, WriteMatrix(&buf, MatrixFormatGitLab, GitHubMatrix{}, flake, nil))
+	require.NoError(t, yaml.Unmarshal(buf.Bytes(), &pipeline))
+	assert.Contains(t, pipeline, "om-ci")
+}
+
+func TestWriteMatrix_Buildkite(t *testing.T) {
+	config := matrixTestConfig()
+	matrix := GenerateMatrix([]string{"x86_64-linux", "aarch64-darwin"}, config)
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteMatrix(&buf, MatrixFormatBuildkite, matrix, flake, config.Runners))
+
+	var pipeline struct {
+		Steps []buildkiteStep `yaml:"steps"`
+	}
+	require.NoError(t, yaml.Unmarshal(buf.Bytes(), &pipeline))
+	require.Len(t, pipeline.Steps, 5)
+	assert.Equal(t, buildkiteStep{
+		Label:   "om ci docs (x86_64-linux)",
+		Command: "om ci run --systems x86_64-linux '.#default.docs'",
+		Env:     map[string]string{"OM_CI_SYSTEM": "x86_64-linux", "OM_CI_SUBFLAKE": "docs"},
+		Agents:  map[string]string{"queue": "linux"},
+	}, pipeline.Steps[0])
+
+	// No queue configured, no agent targeting
+	assert.Empty(t, pipeline.Steps[3].Agents)
+
+	buf.Reset()
+	require.NoError(t, WriteMatrix(&buf, MatrixFormatBuildkite, GitHubMatrix{}, flake, nil))
+	assert.Equal(t, "steps: []\n", buf.String())
+}
+
+func TestWriteMatrix_JSONLAndGitHub(t *testing.T) {
+	config := matrixTestConfig()
+	matrix := GenerateMatrix([]string{"x86_64-linux"}, config)
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteMatrix(&buf, MatrixFormatJSONL, matrix, flake, config.Runners))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	var job MatrixJob
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &job))
+	assert.Equal(t, "main", job.Subflake)
+	assert.Equal(t, ".#default.main", job.Flake)
+	assert.Equal(t, "linux", job.Runner.Queue)
+
+	buf.Reset()
+	require.NoError(t, WriteMatrix(&buf, MatrixFormatGitHub, matrix, flake, config.Runners))
+	var gh GitHubMatrix
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &gh))
+	assert.Equal(t, matrix, gh)
+}
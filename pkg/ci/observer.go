@@ -0,0 +1,317 @@
+package ci
+
+import (
+	"sync"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"go.uber.org/zap"
+)
+
+// Observer receives the events of a CI run as they happen, e.g. to report
+// progress while the run goes on (see RunOptions.Observer).
+//
+// Steps are identified by their key, e.g. "build" or "custom:fmt". The
+// events of a step come in order: OnStepStart, OnOutput and OnRetry, then
+// OnStepEnd. Steps that don't run (skipped or cached) only get OnStepEnd.
+// Subflakes run elsewhere (RunRemote, RunPool) only get OnSubflakeEnd, once
+// their results are back.
+//
+// The events of a run are delivered one at a time, even from parallel
+// steps, so implementations need no locking of their own. They should
+// return quickly, as they hold up the step that caused them.
+type Observer interface {
+	// OnSubflakeStart is called before the steps of a subflake run
+	OnSubflakeStart(subflake string)
+
+	// OnSubflakeEnd is called with the result of a subflake once all of
+	// its steps are done
+	OnSubflakeEnd(result Result)
+
+	// OnStepStart is called when a step starts running
+	OnStepStart(subflake, step string)
+
+	// OnStepEnd is called with the final result of a step
+	OnStepEnd(subflake, step string, result StepResult)
+
+	// OnOutput is called for every line of output of a step, with secrets
+	// redacted
+	OnOutput(subflake, step, line string)
+
+	// OnRetry is called when a failed attempt at a step is retried after
+	// backoff
+	OnRetry(subflake, step string, failed StepAttempt, backoff time.Duration)
+}
+
+// ActivityObserver is an Observer also following what the nix commands of
+// steps are doing. Local steps run nix with --log-format internal-json for
+// it, reporting every log event of their commands, e.g. to show the progress
+// of builds (see nix.BuildProgress).
+type ActivityObserver interface {
+	Observer
+
+	// OnActivity is called for every log event of the nix commands of a
+	// step, between OnStepStart and OnStepEnd
+	OnActivity(subflake, step string, event nix.LogEvent)
+}
+
+// NopObserver ignores all events. Embed it to implement only some of the
+// methods of Observer.
+type NopObserver struct{}
+
+// OnSubflakeStart implements Observer
+func (NopObserver) OnSubflakeStart(string) {}
+
+// OnSubflakeEnd implements Observer
+func (NopObserver) OnSubflakeEnd(Result) {}
+
+// OnStepStart implements Observer
+func (NopObserver) OnStepStart(string, string) {}
+
+// OnStepEnd implements Observer
+func (NopObserver) OnStepEnd(string, string, StepResult) {}
+
+// OnOutput implements Observer
+func (NopObserver) OnOutput(string, string, string) {}
+
+// OnRetry implements Observer
+func (NopObserver) OnRetry(string, string, StepAttempt, time.Duration) {}
+
+// MultiObserver delivers every event to each of its observers, in order
+type MultiObserver []Observer
+
+// NewMultiObserver returns an observer delivering events to all of the
+// given observers; nil ones are left out
+func NewMultiObserver(observers ...Observer) MultiObserver {
+	var multi MultiObserver
+	for _, o := range observers {
+		if o != nil {
+			multi = append(multi, o)
+		}
+	}
+	return multi
+}
+
+// OnSubflakeStart implements Observer
+func (m MultiObserver) OnSubflakeStart(subflake string) {
+	for _, o := range m {
+		o.OnSubflakeStart(subflake)
+	}
+}
+
+// OnSubflakeEnd implements Observer
+func (m MultiObserver) OnSubflakeEnd(result Result) {
+	for _, o := range m {
+		o.OnSubflakeEnd(result)
+	}
+}
+
+// OnStepStart implements Observer
+func (m MultiObserver) OnStepStart(subflake, step string) {
+	for _, o := range m {
+		o.OnStepStart(subflake, step)
+	}
+}
+
+// OnStepEnd implements Observer
+func (m MultiObserver) OnStepEnd(subflake, step string, result StepResult) {
+	for _, o := range m {
+		o.OnStepEnd(subflake, step, result)
+	}
+}
+
+// OnOutput implements Observer
+func (m MultiObserver) OnOutput(subflake, step, line string) {
+	for _, o := range m {
+		o.OnOutput(subflake, step, line)
+	}
+}
+
+// OnRetry implements Observer
+func (m MultiObserver) OnRetry(subflake, step string, failed StepAttempt, backoff time.Duration) {
+	for _, o := range m {
+		o.OnRetry(subflake, step, failed, backoff)
+	}
+}
+
+// OnActivity implements ActivityObserver, for the observers implementing it
+func (m MultiObserver) OnActivity(subflake, step string, event nix.LogEvent) {
+	for _, o := range m {
+		if activity, ok := o.(ActivityObserver); ok {
+			activity.OnActivity(subflake, step, event)
+		}
+	}
+}
+
+// LogObserver logs the result of every subflake as it finishes (see
+// LogResult), and retries as they happen
+type LogObserver struct {
+	NopObserver
+	logger *zap.Logger
+}
+
+// NewLogObserver returns a LogObserver logging to logger
+func NewLogObserver(logger *zap.Logger) *LogObserver {
+	return &LogObserver{logger: logger}
+}
+
+// OnSubflakeEnd implements Observer
+func (o *LogObserver) OnSubflakeEnd(result Result) {
+	LogResult(result, o.logger)
+}
+
+// OnRetry implements Observer
+func (o *LogObserver) OnRetry(subflake, step string, failed StepAttempt, backoff time.Duration) {
+	o.logger.Warn("Retrying step",
+		zap.String("subflake", subflake),
+		zap.String("step", step),
+		zap.String("error", failed.Error),
+		zap.Duration("backoff", backoff))
+}
+
+// serialObserver delivers the events of a run to an observer one at a time
+type serialObserver struct {
+	mu       sync.Mutex
+	observer Observer
+}
+
+// OnSubflakeStart implements Observer
+func (s *serialObserver) OnSubflakeStart(subflake string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observer.OnSubflakeStart(subflake)
+}
+
+// OnSubflakeEnd implements Observer
+func (s *serialObserver) OnSubflakeEnd(result Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observer.OnSubflakeEnd(result)
+}
+
+// OnStepStart implements Observer
+func (s *serialObserver) OnStepStart(subflake, step string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observer.OnStepStart(subflake, step)
+}
+
+// OnStepEnd implements Observer
+func (s *serialObserver) OnStepEnd(subflake, step string, result StepResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observer.OnStepEnd(subflake, step, result)
+}
+
+// OnOutput implements Observer
+func (s *serialObserver) OnOutput(subflake, step, line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observer.OnOutput(subflake, step, line)
+}
+
+// OnRetry implements Observer
+func (s *serialObserver) OnRetry(subflake, step string, failed StepAttempt, backoff time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observer.OnRetry(subflake, step, failed, backoff)
+}
+
+// OnActivity implements ActivityObserver, if the observer does
+func (s *serialObserver) OnActivity(subflake, step string, event nix.LogEvent) {
+	if activity, ok := s.observer.(ActivityObserver); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		activity.OnActivity(subflake, step, event)
+	}
+}
+
+// followsActivity returns whether an observer wants the log events of nix
+// commands; MultiObserver and serialObserver implement ActivityObserver
+// whether or not the observers they wrap do.
+func followsActivity(o Observer) bool {
+	switch o := o.(type) {
+	case *serialObserver:
+		return followsActivity(o.observer)
+	case MultiObserver:
+		for _, member := range o {
+			if followsActivity(member) {
+				return true
+			}
+		}
+		return false
+	default:
+		_, ok := o.(ActivityObserver)
+		return ok
+	}
+}
+
+// observeActivity returns the channel to send the log events of the nix
+// commands of a step to, delivering them to the observer, or nil if it
+// doesn't follow activity. The returned function must be called once the
+// commands of the step are done.
+func observeActivity(o Observer, subflake, step string) (chan<- nix.LogEvent, func()) {
+	activity, ok := o.(ActivityObserver)
+	if !ok || !followsActivity(o) {
+		return nil, func() {}
+	}
+
+	events := make(chan nix.LogEvent, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range events {
+			activity.OnActivity(subflake, step, event)
+		}
+	}()
+	return events, func() {
+		close(events)
+		<-done
+	}
+}
+
+// observe returns the observer receiving the events of the run: the
+// serialised RunOptions.Observer, set up by the entry points, or one
+// ignoring them
+func (opts RunOptions) observe() Observer {
+	switch {
+	case opts.observer != nil:
+		return opts.observer
+	case opts.Observer != nil:
+		return opts.Observer
+	default:
+		return NopObserver{}
+	}
+}
+
+// withObserver returns opts with the observer of the run set up, unless it
+// already is
+func (opts RunOptions) withObserver() RunOptions {
+	if opts.observer == nil && opts.Observer != nil {
+		opts.observer = &serialObserver{observer: opts.Observer}
+	}
+	return opts
+}
+
+// recordBuilds feeds the log events of a step to progress, passing them on
+// to events, as returned by observeActivity along with stop, if not nil.
+// The returned function must be called once the commands of the step are
+// done; it stops both.
+func recordBuilds(progress *nix.BuildProgress, events chan<- nix.LogEvent, stop func()) (chan<- nix.LogEvent, func()) {
+	recorded := make(chan nix.LogEvent, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range recorded {
+			progress.Update(event)
+			if events != nil {
+				events <- event
+			}
+		}
+	}()
+	return recorded, func() {
+		close(recorded)
+		<-done
+		stop()
+	}
+}
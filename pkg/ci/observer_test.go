@@ -0,0 +1,277 @@
+package ci
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// recordingObserver records the events it receives as strings. It does no
+// locking, and fails the test if events overlap.
+type recordingObserver struct {
+	t       *testing.T
+	events  []string
+	running int32
+}
+
+func (r *recordingObserver) record(format string, args ...interface{}) {
+	if atomic.AddInt32(&r.running, 1) != 1 {
+		r.t.Errorf("events delivered concurrently")
+	}
+	// Give overlapping events a chance to show up
+	time.Sleep(time.Millisecond)
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+	atomic.AddInt32(&r.running, -1)
+}
+
+func (r *recordingObserver) OnSubflakeStart(subflake string) {
+	r.record("subflake start %s", subflake)
+}
+
+func (r *recordingObserver) OnSubflakeEnd(result Result) {
+	r.record("subflake end %s@%s %v", result.Subflake, result.System, result.Success)
+}
+
+func (r *recordingObserver) OnStepStart(subflake, step string) {
+	r.record("step start %s/%s", subflake, step)
+}
+
+func (r *recordingObserver) OnStepEnd(subflake, step string, result StepResult) {
+	r.record("step end %s/%s %s", subflake, step, result.Status())
+}
+
+func (r *recordingObserver) OnOutput(subflake, step, line string) {
+	r.record("output %s/%s %s", subflake, step, line)
+}
+
+func (r *recordingObserver) OnRetry(subflake, step string, failed StepAttempt, backoff time.Duration) {
+	r.record("retry %s/%s after %s (attempt failed: %v)", subflake, step, backoff, !failed.Success)
+}
+
+// activityRecorder also records the activities started by nix commands
+type activityRecorder struct {
+	recordingObserver
+}
+
+func (r *activityRecorder) OnActivity(subflake, step string, event nix.LogEvent) {
+	if event.Action == nix.LogActionStart {
+		r.record("activity %s/%s %s", subflake, step, event.Text)
+	}
+}
+
+func TestRun_Observer(t *testing.T) {
+	// The test app fails on its first attempt
+	installFakeNix(t, `case "$*" in
+  run*)
+    if [ -e "$0.ran" ]; then echo "second try"; else touch "$0.ran"; echo "first try"; exit 1; fi;;
+esac`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Dir: ".", Steps: StepsConfig{
+				Custom: map[string]CustomStep{
+					"test": {Type: CustomStepTypeApp, StepPolicy: StepPolicy{Retries: 1, RetryBackoff: Duration(time.Millisecond)}},
+				},
+			}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	recorder := &recordingObserver{t: t}
+	_, err = Run(context.Background(), flake, config, RunOptions{Systems: []string{"x86_64-linux"}, Observer: recorder})
+	require.NoError(t, err)
+
+	var events []string
+	for _, event := range recorder.events {
+		if !strings.HasPrefix(event, "output main/custom:test Retrying") {
+			events = append(events, event)
+		}
+	}
+	assert.Equal(t, []string{
+		"subflake start main",
+		"step start main/custom:test",
+		"output main/custom:test first try",
+		"retry main/custom:test after 1ms (attempt failed: true)",
+		"output main/custom:test second try",
+		"step end main/custom:test passed",
+		"subflake end main@ true",
+	}, events)
+}
+
+func TestRun_ObserverParallel(t *testing.T) {
+	installFakeNix(t, `echo "working on $*"`)
+
+	config := Config{Default: map[string]SubflakeConfig{}}
+	for _, name := range []string{"a", "b", "c"} {
+		config.Default[name] = SubflakeConfig{Dir: ".", Steps: StepsConfig{
+			Custom: map[string]CustomStep{
+				"one": {Type: CustomStepTypeApp},
+				"two": {Type: CustomStepTypeApp},
+			},
+		}}
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	recorder := &recordingObserver{t: t}
+	_, err = Run(context.Background(), flake, config, RunOptions{Parallel: true, Observer: recorder})
+	require.NoError(t, err)
+
+	var ends []string
+	for _, event := range recorder.events {
+		if strings.HasPrefix(event, "step end") {
+			ends = append(ends, event)
+		}
+	}
+	sort.Strings(ends)
+	assert.Equal(t, []string{
+		"step end a/custom:one passed", "step end a/custom:two passed",
+		"step end b/custom:one passed", "step end b/custom:two passed",
+		"step end c/custom:one passed", "step end c/custom:two passed",
+	}, ends)
+}
+
+func TestRun_ObserverSkipped(t *testing.T) {
+	installFakeNix(t, `exit 1`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Dir: ".", Steps: StepsConfig{
+				Custom: map[string]CustomStep{
+					"test":   {Type: CustomStepTypeApp},
+					"deploy": {Type: CustomStepTypeApp, DependsOn: []string{"test"}},
+				},
+			}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	recorder := &recordingObserver{t: t}
+	_, err = Run(context.Background(), flake, config, RunOptions{Observer: recorder})
+	require.NoError(t, err)
+
+	// Steps that don't run only end
+	assert.Equal(t, []string{
+		"subflake start main",
+		"step start main/custom:test",
+		"step end main/custom:test failed",
+		"step end main/custom:deploy skipped",
+		"subflake end main@ false",
+	}, recorder.events)
+}
+
+func TestRunPool_Observer(t *testing.T) {
+	installFakeNix(t, `case "$*" in
+  'flake metadata'*) echo '{"path": "/nix/store/aaa-source"}';;
+esac`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{"a": {Dir: "."}},
+		Pool:    []Builder{{Store: "ssh://up", Systems: []string{"x86_64-linux", "aarch64-linux"}}},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	recorder := &recordingObserver{t: t}
+	_, err = RunPool(context.Background(), flake, config, RunOptions{SSH: &fakeSSH{resultsFor: poolResults}, Observer: recorder})
+	require.NoError(t, err)
+
+	// Subflakes run remotely are reported with their system, once done
+	sort.Strings(recorder.events)
+	assert.Equal(t, []string{
+		"subflake end a@aarch64-linux true",
+		"subflake end a@x86_64-linux true",
+	}, recorder.events)
+}
+
+func TestRun_ActivityObserver(t *testing.T) {
+	logPath := installFakeNix(t, `echo '@nix {"action":"start","id":1,"level":3,"text":"building hello","type":105,"fields":["/nix/store/aaa-hello.drv","",1,1]}' >&2
+echo '@nix {"action":"stop","id":1}' >&2`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Dir: ".", Steps: StepsConfig{
+				Custom: map[string]CustomStep{"test": {Type: CustomStepTypeApp}},
+			}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	recorder := &activityRecorder{recordingObserver{t: t}}
+	observer := NewMultiObserver(&recordingObserver{t: t}, recorder)
+	_, err = Run(context.Background(), flake, config, RunOptions{Systems: []string{"x86_64-linux"}, Observer: observer})
+	require.NoError(t, err)
+
+	// Activities are reported alongside the output, and before the step ends
+	require.Len(t, recorder.events, 6)
+	assert.ElementsMatch(t, []string{
+		"activity main/custom:test building hello",
+		"output main/custom:test building hello...",
+	}, recorder.events[2:4])
+	assert.Equal(t, "step end main/custom:test passed", recorder.events[4])
+	assert.Equal(t, []string{"--log-format internal-json run ."}, readFakeNixLog(t, logPath))
+}
+
+func TestFollowsActivity(t *testing.T) {
+	assert.False(t, followsActivity(NopObserver{}))
+	assert.False(t, followsActivity(NewMultiObserver(NopObserver{}, &recordingObserver{})))
+	assert.True(t, followsActivity(NewMultiObserver(NopObserver{}, &activityRecorder{})))
+	assert.True(t, followsActivity(&serialObserver{observer: &activityRecorder{}}))
+	assert.False(t, followsActivity(&serialObserver{observer: NopObserver{}}))
+}
+
+func TestMultiObserver(t *testing.T) {
+	first := &recordingObserver{t: t}
+	second := &recordingObserver{t: t}
+	multi := NewMultiObserver(first, nil, second)
+	require.Len(t, multi, 2)
+
+	multi.OnSubflakeStart("main")
+	multi.OnStepStart("main", "build")
+	multi.OnOutput("main", "build", "building")
+	multi.OnRetry("main", "build", StepAttempt{Error: "flaky"}, time.Second)
+	multi.OnStepEnd("main", "build", StepResult{Success: true})
+	multi.OnSubflakeEnd(Result{Subflake: "main", Success: true})
+
+	expected := []string{
+		"subflake start main",
+		"step start main/build",
+		"output main/build building",
+		"retry main/build after 1s (attempt failed: true)",
+		"step end main/build passed",
+		"subflake end main@ true",
+	}
+	assert.Equal(t, expected, first.events)
+	assert.Equal(t, expected, second.events)
+}
+
+func TestLogObserver(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	var o Observer = NewLogObserver(zap.New(core))
+
+	o.OnStepStart("main", "build")
+	o.OnRetry("main", "build", StepAttempt{Error: "flaky"}, time.Second)
+	o.OnSubflakeEnd(Result{
+		Subflake: "main",
+		Steps:    map[string]StepResult{"build": {Name: "build", Error: "broken"}},
+	})
+
+	var messages []string
+	for _, entry := range logs.All() {
+		messages = append(messages, entry.Message)
+	}
+	assert.Equal(t, []string{"Retrying step", "CI Result", "  Step", "  Step failed"}, messages)
+}
@@ -0,0 +1,82 @@
+package ci
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverrideInputs_AppliedToEveryStep(t *testing.T) {
+	// Fail the devour-flake build right away; we only care about its argv
+	logPath := installFakeNix(t, `case "$1" in build) exit 1;; esac`)
+
+	ctx := context.Background()
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	overrides := map[string]string{
+		"private": "path:/src/private",
+		"nixpkgs": "github:nixos/nixpkgs/nixos-unstable",
+	}
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {
+				Dir:            ".",
+				OverrideInputs: overrides,
+				Steps: StepsConfig{
+					Build:      BuildStep{Enable: true},
+					Lockfile:   LockfileStep{Enable: true},
+					FlakeCheck: FlakeCheckStep{Enable: true},
+					Custom: map[string]CustomStep{
+						"app":   {Type: CustomStepTypeApp, Args: []string{"--version"}},
+						"shell": {Type: CustomStepTypeDevShell, Command: []string{"make", "test"}},
+					},
+				},
+			},
+		},
+	}
+
+	results, err := Run(ctx, flake, config, RunOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	for name, step := range results[0].Steps {
+		assert.Equal(t, overrides, step.OverrideInputs, "step %s", name)
+	}
+
+	calls := readFakeNixLog(t, logPath)
+	require.Len(t, calls, 5)
+	for _, call := range calls {
+		// The build step follows the log events of nix
+		if strings.HasPrefix(call, "--log-format internal-json build ") {
+			assert.Contains(t, call, "--override-input flake/nixpkgs github:nixos/nixpkgs/nixos-unstable --override-input flake/private path:/src/private")
+		} else {
+			assert.Contains(t, call, "--override-input nixpkgs github:nixos/nixpkgs/nixos-unstable --override-input private path:/src/private")
+		}
+	}
+}
+
+func TestOverrideInputs_CommandArgs(t *testing.T) {
+	flake := nix.NewFlakeURL("github:org/repo")
+	overrides := map[string]string{"b": "path:/b", "a": "path:/a"}
+
+	assert.Equal(t,
+		[]string{"flake", "lock", "--no-update-lock-file", "--override-input", "a", "path:/a", "--override-input", "b", "path:/b", "github:org/repo"},
+		lockfileCheckArgs(flake, overrides))
+	assert.Equal(t,
+		[]string{"flake", "check", "--override-input", "a", "path:/a", "--override-input", "b", "path:/b", "github:org/repo"},
+		flakeCheckArgs(flake, overrides))
+	assert.Equal(t,
+		[]string{"run", "--override-input", "a", "path:/a", "--override-input", "b", "path:/b", "github:org/repo#tool", "--", "-x"},
+		flakeAppArgs(flake, CustomStep{Type: CustomStepTypeApp, Name: "tool", Args: []string{"-x"}}, overrides))
+	assert.Equal(t,
+		[]string{"develop", "--override-input", "a", "path:/a", "--override-input", "b", "path:/b", "github:org/repo", "-c", "true"},
+		devShellArgs(flake, CustomStep{Type: CustomStepTypeDevShell, Command: []string{"true"}}, overrides))
+
+	// Without overrides the command lines are unchanged
+	assert.Equal(t, []string{"flake", "check", "github:org/repo"}, flakeCheckArgs(flake, nil))
+}
@@ -0,0 +1,469 @@
+package ci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/flake"
+)
+
+// Plan is what a CI run does: the subflakes it runs, their steps in order,
+// and the commands of every step. Run makes a plan with NewPlan and runs it
+// with RunPlan, so a plan printed beforehand (om ci run --dry-run) is what
+// the run does.
+type Plan struct {
+	// Flake is the flake CI runs on
+	Flake string `json:"flake"`
+
+	// Systems are the systems CI runs for (empty = the current one)
+	Systems []string `json:"systems,omitempty"`
+
+	// Parallel tells whether subflakes and independent steps run in parallel
+	Parallel bool `json:"parallel"`
+
+	// Subflakes are the subflakes that run, sorted by name
+	Subflakes []SubflakePlan `json:"subflakes"`
+}
+
+// SubflakePlan is how a Plan runs a subflake
+type SubflakePlan struct {
+	// Name is the name of the subflake in the configuration
+	Name string `json:"name"`
+
+	// URL is the flake URL the steps run on
+	URL string `json:"url"`
+
+	// Host is the host the steps run on over SSH, if not locally
+	Host string `json:"host,omitempty"`
+
+	// OverrideInputs are the inputs every command overrides
+	OverrideInputs map[string]string `json:"overrideInputs,omitempty"`
+
+	// Steps are the steps to run, every step after its dependencies
+	Steps []StepPlan `json:"steps"`
+
+	// url is URL, parsed
+	url nix.FlakeURL
+
+	// config is the configuration of the subflake
+	config SubflakeConfig
+
+	// activity tells whether nix prints its log events for the observer of
+	// the run (see followsActivity)
+	activity bool
+}
+
+// StepPlan is how a SubflakePlan runs a step
+type StepPlan struct {
+	// Key identifies the step, e.g. "build" or "custom:fmt"
+	Key string `json:"key"`
+
+	// DependsOn lists the steps that must succeed before this one runs
+	DependsOn []string `json:"dependsOn,omitempty"`
+
+	// Commands are the commands the step runs, as far as they are known
+	// before it runs
+	Commands []PlannedCommand `json:"commands,omitempty"`
+
+	// Then describes what the step does with the outcome of its commands,
+	// e.g. building the outputs they list
+	Then []string `json:"then,omitempty"`
+
+	// Error is why the step will fail without running anything
+	Error string `json:"error,omitempty"`
+}
+
+// PlannedCommand is a command run by a step
+type PlannedCommand struct {
+	// Args is the command line, starting with the program. Commands run on
+	// a remote host are the ssh command running Remote.
+	Args []string `json:"args"`
+
+	// Remote is the command run on the remote host, if any
+	Remote []string `json:"remote,omitempty"`
+
+	// Dir is the directory the command runs in, if not the current one
+	Dir string `json:"dir,omitempty"`
+
+	// Env lists the names of the variables set in the environment of the
+	// command; their values, which may be secrets, are left out. Commands
+	// run on a remote host read the secrets among them on their standard
+	// input instead.
+	Env []string `json:"env,omitempty"`
+}
+
+// NewPlan plans running CI on a flake: the subflakes of config that are not
+// skipped and can run on opts.Systems, with their enabled steps in dependency
+// order. Unknown step dependencies and cycles are errors.
+func NewPlan(flakeURL nix.FlakeURL, config Config, opts RunOptions) (Plan, error) {
+	plan := Plan{
+		Flake:    flakeURL.String(),
+		Systems:  opts.Systems,
+		Parallel: opts.Parallel,
+	}
+
+	names := make([]string, 0, len(config.Default))
+	for name := range config.Default {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		subflake := config.Default[name]
+		if subflake.Skip || !subflake.CanRunOn(opts.Systems) {
+			continue
+		}
+
+		subflakePlan, err := newSubflakePlan(flakeURL, name, subflake, opts)
+		if err != nil {
+			return Plan{}, fmt.Errorf("invalid steps in subflake %s: %w", name, err)
+		}
+		plan.Subflakes = append(plan.Subflakes, subflakePlan)
+	}
+	return plan, nil
+}
+
+// newSubflakePlan plans running the steps of a subflake
+func newSubflakePlan(flakeURL nix.FlakeURL, name string, subflake SubflakeConfig, opts RunOptions) (SubflakePlan, error) {
+	// Local flakes get a path, remote ones `?dir=`
+	url := flakeURL
+	if subflake.Dir != "" {
+		url = flakeURL.SubFlakeURL(subflake.Dir)
+	}
+
+	graph, err := newStepGraph(subflake.Steps, opts.Systems)
+	if err != nil {
+		return SubflakePlan{}, err
+	}
+
+	plan := SubflakePlan{
+		Name:           name,
+		URL:            url.String(),
+		Host:           opts.RemoteHost,
+		OverrideInputs: subflake.OverrideInputs,
+		url:            url,
+		config:         subflake,
+		activity:       followsActivity(opts.observe()),
+	}
+	for _, key := range graph.order {
+		step := plan.planStep(key, opts)
+		step.DependsOn = graph.deps[key]
+		plan.Steps = append(plan.Steps, step)
+	}
+	return plan, nil
+}
+
+// graph returns the dependency graph of the planned steps
+func (p SubflakePlan) graph() *stepGraph {
+	graph := &stepGraph{deps: make(map[string][]string)}
+	for _, step := range p.Steps {
+		graph.order = append(graph.order, step.Key)
+		if len(step.DependsOn) > 0 {
+			graph.deps[step.Key] = step.DependsOn
+		}
+	}
+	return graph
+}
+
+// planStep plans the commands of a step, built as the step builds them
+func (p SubflakePlan) planStep(key string, opts RunOptions) StepPlan {
+	step := StepPlan{Key: key}
+	steps := p.config.Steps
+	overrides := p.OverrideInputs
+
+	switch key {
+	case "build":
+		// Steps recording their builds follow the log events of nix
+		build := p
+		build.activity = p.activity || recordsBuilds(p.Host, key)
+		build.planBuildStep(&step, opts)
+	case "lockfile":
+		step.add(p.nixCommand(lockfileCheckArgs(p.url, overrides)))
+	case "flakeCheck":
+		step.add(p.nixCommand(flakeCheckArgs(p.url, overrides)))
+	case "push":
+		p.planPushStep(&step)
+	case "closureSize":
+		attrs := make([]string, 0, len(steps.ClosureSize.Limits))
+		for attr := range steps.ClosureSize.Limits {
+			attrs = append(attrs, attr)
+		}
+		sort.Strings(attrs)
+		if len(attrs) == 0 {
+			step.Error = "closure size step has no limits"
+		}
+		for _, attr := range attrs {
+			if p.Host != "" {
+				step.add(p.nixCommand(remoteClosureBuildArgs(p.url, overrides, attr)))
+			} else {
+				step.add(p.nixCommand(flake.BuildArgs(&flake.CommandOptions{OverrideInputs: overrides}, buildFlakeURLWithAttr(p.url, attr))))
+			}
+		}
+		step.Then = append(step.Then, "measure the closure of every output with nix path-info --recursive")
+	default:
+		p.planCustomStep(&step, strings.TrimPrefix(key, "custom:"))
+	}
+	return step
+}
+
+// planBuildStep plans the build step
+func (p SubflakePlan) planBuildStep(step *StepPlan, opts RunOptions) {
+	build := p.config.Steps.Build
+	filter, err := newAttrFilter(build, opts)
+	if err != nil {
+		step.Error = err.Error()
+		return
+	}
+
+	if filter.active() {
+		args, err := flakeSchemaCommand(p.url, build, p.OverrideInputs, opts)
+		if err != nil {
+			step.Error = err.Error()
+			return
+		}
+		// Locally, the flake schemas are evaluated with their output
+		// captured
+		if p.Host != "" {
+			copyArgs := append([]string{"nix"}, flakeSchemaCopyArgs(p.Host)...)
+			step.add(p.localCommand(copyArgs))
+			step.add(p.nixCommand(args))
+		} else {
+			step.add(PlannedCommand{Args: append([]string{"nix"}, args...)})
+		}
+		step.Then = append(step.Then, "build the selected outputs at once")
+	} else {
+		args, err := nix.DevourFlakeArgs(p.url, nix.DevourFlakeOptions{
+			Systems:        opts.Systems,
+			Impure:         build.Impure,
+			KeepGoing:      true,
+			OverrideInputs: p.OverrideInputs,
+		})
+		if err != nil {
+			step.Error = err.Error()
+			return
+		}
+		step.add(p.nixCommand(args))
+	}
+
+	if p.Host != "" {
+		return
+	}
+	if opts.IncludeAllDependencies {
+		step.Then = append(step.Then, "query the closure of the built outputs")
+	}
+	if dir := gcRootDir(opts, p.Name); dir != "" {
+		step.Then = append(step.Then, "add GC roots for the built outputs in "+dir)
+	}
+}
+
+// planPushStep plans the push step, whose paths are only known once the
+// build step is done
+func (p SubflakePlan) planPushStep(step *StepPlan) {
+	push := p.config.Steps.Push
+	if p.Host != "" {
+		step.Error = "the push step is not supported with --remote"
+		return
+	}
+	if push.To == "" {
+		step.Error = "push step requires a destination store (push.to)"
+		return
+	}
+
+	paths := "the outputs of the build step"
+	if push.IncludeAllDependencies {
+		paths += " and their closure"
+	}
+	if push.SecretKeyFile != "" {
+		step.Then = append(step.Then, fmt.Sprintf("sign %s with %s", paths, push.SecretKeyFile))
+		paths = "them"
+	}
+	step.Then = append(step.Then, fmt.Sprintf("copy %s to %s", paths, push.To))
+}
+
+// planCustomStep plans a custom step, with the commands it runs
+func (p SubflakePlan) planCustomStep(step *StepPlan, name string) {
+	custom := p.config.Steps.Custom[name]
+	commands, dir, err := customStepCommands(p.url, custom, p.OverrideInputs, p.Host)
+	if err != nil {
+		step.Error = err.Error()
+		return
+	}
+	if custom.Type == CustomStepTypeEval && custom.Expected != nil {
+		expected, _ := json.Marshal(custom.Expected)
+		step.Then = append(step.Then, "check that it evaluates to "+string(expected))
+	}
+
+	// Remotely, variables are set by the command, and only secrets are
+	// passed to it
+	var env []string
+	if p.Host == "" {
+		for name := range custom.Env {
+			env = append(env, name)
+		}
+	}
+	for name := range custom.Secrets {
+		env = append(env, name)
+	}
+	sort.Strings(env)
+
+	for _, command := range commands {
+		planned := p.command(command)
+		planned.Dir = dir
+		planned.Env = env
+		step.add(planned)
+	}
+}
+
+// nixCommand plans running nix with args, on the host of the subflake if
+// any (see command)
+func (p SubflakePlan) nixCommand(args []string) PlannedCommand {
+	return p.command(append([]string{"nix"}, args...))
+}
+
+// command plans running command, which starts with nix when run locally, as
+// a step does: over ssh on the host of the subflake, if any, or locally
+// (see localCommand)
+func (p SubflakePlan) command(command []string) PlannedCommand {
+	if p.Host != "" {
+		return PlannedCommand{Args: sshCommand(p.Host, command), Remote: command}
+	}
+	return p.localCommand(command)
+}
+
+// localCommand plans running a nix command locally with its output
+// streamed, as steps run them: nix then prints its log events when the run
+// follows them
+func (p SubflakePlan) localCommand(command []string) PlannedCommand {
+	args := []string{command[0]}
+	if p.activity {
+		args = append(args, nix.LogEventArgs()...)
+	}
+	return PlannedCommand{Args: append(args, command[1:]...)}
+}
+
+// add adds a command to the step
+func (s *StepPlan) add(command PlannedCommand) {
+	s.Commands = append(s.Commands, command)
+}
+
+// String renders the command as a shell command line, e.g.
+// "cd docs && FOO=… nix run .#docs", or for a remote command with secrets
+// "ssh host '…' <<< 'export FOO=…'"
+func (c PlannedCommand) String() string {
+	var parts []string
+	if c.Dir != "" {
+		parts = append(parts, "cd", shellCommand([]string{c.Dir}), "&&")
+	}
+	if c.Remote == nil {
+		for _, name := range c.Env {
+			parts = append(parts, name+"=…")
+		}
+	}
+	parts = append(parts, shellCommand(c.Args))
+	if c.Remote != nil && len(c.Env) > 0 {
+		exports := make([]string, len(c.Env))
+		for i, name := range c.Env {
+			exports[i] = "export " + name + "=…"
+		}
+		parts = append(parts, "<<<", shellCommand([]string{strings.Join(exports, "; ")}))
+	}
+	return strings.Join(parts, " ")
+}
+
+// PlanFormat is an output format of WritePlan
+type PlanFormat string
+
+const (
+	// PlanFormatTable lists the steps of every subflake with their commands
+	PlanFormatTable PlanFormat = "table"
+	// PlanFormatJSON is the Plan as JSON
+	PlanFormatJSON PlanFormat = "json"
+)
+
+// ParsePlanFormat parses a plan format name
+func ParsePlanFormat(name string) (PlanFormat, error) {
+	switch format := PlanFormat(name); format {
+	case PlanFormatTable, PlanFormatJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown plan format %q (supported: table, json)", name)
+}
+
+// WritePlan writes a plan in the given format
+func WritePlan(w io.Writer, format PlanFormat, plan Plan) error {
+	var err error
+	switch format {
+	case PlanFormatTable:
+		err = writePlanTable(w, plan)
+	case PlanFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(plan)
+	default:
+		return fmt.Errorf("unknown plan format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write plan: %w", err)
+	}
+	return nil
+}
+
+// writePlanTable lists the steps of every subflake in order, with their
+// commands, e.g.
+//
+//	main (./.)
+//	  1. build
+//	       nix build …
+func writePlanTable(w io.Writer, plan Plan) error {
+	var b strings.Builder
+
+	systems := "the current system"
+	if len(plan.Systems) > 0 {
+		systems = strings.Join(plan.Systems, ", ")
+	}
+	mode := "sequentially"
+	if plan.Parallel {
+		mode = "in parallel"
+	}
+	fmt.Fprintf(&b, "CI plan for %s on %s, running %s\n", plan.Flake, systems, mode)
+	if len(plan.Subflakes) == 0 {
+		b.WriteString("\nNo subflakes to run\n")
+	}
+
+	for _, subflake := range plan.Subflakes {
+		fmt.Fprintf(&b, "\n%s (%s)", subflake.Name, subflake.URL)
+		if subflake.Host != "" {
+			fmt.Fprintf(&b, " on %s", subflake.Host)
+		}
+		b.WriteString("\n")
+		if len(subflake.Steps) == 0 {
+			b.WriteString("  no steps\n")
+		}
+
+		for i, step := range subflake.Steps {
+			fmt.Fprintf(&b, "  %d. %s", i+1, step.Key)
+			if len(step.DependsOn) > 0 {
+				fmt.Fprintf(&b, " (after %s)", strings.Join(step.DependsOn, ", "))
+			}
+			b.WriteString("\n")
+
+			if step.Error != "" {
+				fmt.Fprintf(&b, "       fails: %s\n", step.Error)
+				continue
+			}
+			for _, command := range step.Commands {
+				fmt.Fprintf(&b, "       %s\n", command)
+			}
+			for _, then := range step.Then {
+				fmt.Fprintf(&b, "       then %s\n", then)
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,296 @@
+package ci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// planCommands returns the commands of a plan in order, without the program
+func planCommands(plan Plan) []string {
+	var commands []string
+	for _, args := range plannedArgs(plan) {
+		commands = append(commands, strings.Join(args[1:], " "))
+	}
+	return commands
+}
+
+// plannedArgs returns the command lines of a plan in order
+func plannedArgs(plan Plan) [][]string {
+	var args [][]string
+	for _, subflake := range plan.Subflakes {
+		for _, step := range subflake.Steps {
+			for _, command := range step.Commands {
+				args = append(args, command.Args)
+			}
+		}
+	}
+	return args
+}
+
+func TestNewPlan(t *testing.T) {
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Dir: ".", Steps: StepsConfig{
+				Lockfile:   LockfileStep{Enable: true},
+				FlakeCheck: FlakeCheckStep{Enable: true},
+				Custom: map[string]CustomStep{
+					"fmt":    {Type: CustomStepTypeDevShell, Command: []string{"treefmt", "--fail-on-change"}},
+					"deploy": {Type: CustomStepTypeApp, Name: "deploy", DependsOn: []string{"fmt"}, Args: []string{"--dry run"}, Env: map[string]string{"CI": "true"}},
+				},
+			}},
+			"docs":    {Dir: "doc", OverrideInputs: map[string]string{"main": "."}},
+			"skipped": {Dir: "skipped", Skip: true},
+			"darwin":  {Dir: "darwin", Systems: []string{"aarch64-darwin"}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	plan, err := NewPlan(flake, config, RunOptions{Systems: []string{"x86_64-linux"}})
+	require.NoError(t, err)
+
+	// Skipped subflakes, and those for other systems, are left out
+	require.Len(t, plan.Subflakes, 2)
+	docs, main := plan.Subflakes[0], plan.Subflakes[1]
+	assert.Equal(t, "docs", docs.Name)
+	assert.Equal(t, "doc", docs.URL)
+	assert.Empty(t, docs.Steps)
+
+	assert.Equal(t, "main", main.Name)
+	var keys []string
+	for _, step := range main.Steps {
+		keys = append(keys, step.Key)
+	}
+	assert.Equal(t, []string{"lockfile", "flakeCheck", "custom:fmt", "custom:deploy"}, keys)
+	assert.Equal(t, []string{"custom:fmt"}, main.Steps[3].DependsOn)
+	assert.Equal(t, []PlannedCommand{{
+		Args: []string{"nix", "run", ".#deploy", "--", "--dry run"},
+		Env:  []string{"CI"},
+	}}, main.Steps[3].Commands)
+	assert.Equal(t, "CI=… nix run '.#deploy' -- '--dry run'", main.Steps[3].Commands[0].String())
+}
+
+func TestNewPlan_Errors(t *testing.T) {
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	// Invalid dependencies fail the plan
+	_, err = NewPlan(flake, Config{Default: map[string]SubflakeConfig{
+		"main": {Steps: StepsConfig{Custom: map[string]CustomStep{
+			"test": {Type: CustomStepTypeApp, DependsOn: []string{"missing"}},
+		}}},
+	}}, RunOptions{})
+	assert.ErrorContains(t, err, "invalid steps in subflake main")
+
+	// Steps that cannot run fail on their own
+	plan, err := NewPlan(flake, Config{Default: map[string]SubflakeConfig{
+		"main": {Steps: StepsConfig{
+			Build: BuildStep{Enable: true},
+			Push:  PushStep{Enable: true},
+			Custom: map[string]CustomStep{
+				"shell": {Type: CustomStepTypeDevShell},
+				"local": {Type: CustomStepTypeDevShell, Command: []string{"make"}, Cwd: "tests"},
+			},
+		}},
+	}}, RunOptions{RemoteHost: "builder"})
+	require.NoError(t, err)
+
+	errors := map[string]string{}
+	for _, step := range plan.Subflakes[0].Steps {
+		errors[step.Key] = step.Error
+	}
+	assert.Equal(t, map[string]string{
+		"build":        "",
+		"push":         "the push step is not supported with --remote",
+		"custom:shell": "devshell step has no command",
+		"custom:local": "cwd on a remote host requires an absolute flake path, not .",
+	}, errors)
+}
+
+func TestWritePlan(t *testing.T) {
+	plan := Plan{
+		Flake:   ".",
+		Systems: []string{"x86_64-linux"},
+		Subflakes: []SubflakePlan{{
+			Name: "main",
+			URL:  ".",
+			Host: "builder",
+			Steps: []StepPlan{
+				{Key: "lockfile", Commands: []PlannedCommand{{
+					Args:   []string{"ssh", "builder", "nix flake lock --no-update-lock-file ."},
+					Remote: []string{"nix", "flake", "lock", "--no-update-lock-file", "."},
+				}}},
+				{Key: "custom:test", DependsOn: []string{"lockfile"}, Commands: []PlannedCommand{{Args: []string{"nix", "run", ".#test"}, Dir: "my tests", Env: []string{"CI"}}}},
+				{Key: "custom:deploy", Commands: []PlannedCommand{{
+					Args:   []string{"ssh", "builder", `sh -c 'eval "$(cat)" && exec "$@"' sh nix run '/src#deploy'`},
+					Remote: []string{"sh", "-c", `eval "$(cat)" && exec "$@"`, "sh", "nix", "run", "/src#deploy"},
+					Env:    []string{"TOKEN"},
+				}}},
+				{Key: "push", Error: "the push step is not supported with --remote"},
+				{Key: "closureSize", Then: []string{"measure the closure"}},
+			},
+		}},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, WritePlan(&out, PlanFormatTable, plan))
+	assert.Equal(t, `CI plan for . on x86_64-linux, running sequentially
+
+main (.) on builder
+  1. lockfile
+       ssh builder 'nix flake lock --no-update-lock-file .'
+  2. custom:test (after lockfile)
+       cd 'my tests' && CI=… nix run '.#test'
+  3. custom:deploy
+       ssh builder 'sh -c '\''eval "$(cat)" && exec "$@"'\'' sh nix run '\''/src#deploy'\''' <<< 'export TOKEN=…'
+  4. push
+       fails: the push step is not supported with --remote
+  5. closureSize
+       then measure the closure
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, WritePlan(&out, PlanFormatJSON, plan))
+	var decoded Plan
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, plan, decoded)
+
+	assert.Error(t, WritePlan(&out, "yaml", plan))
+}
+
+func TestParsePlanFormat(t *testing.T) {
+	format, err := ParsePlanFormat("json")
+	require.NoError(t, err)
+	assert.Equal(t, PlanFormatJSON, format)
+
+	_, err = ParsePlanFormat("yaml")
+	assert.ErrorContains(t, err, "unknown plan format")
+}
+
+func TestRun_FollowsPlan(t *testing.T) {
+	logPath := installFakeNix(t, `echo '{}'`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Dir: ".", OverrideInputs: map[string]string{"b": "./b", "a": "./a"}, Steps: StepsConfig{
+				Lockfile:   LockfileStep{Enable: true},
+				FlakeCheck: FlakeCheckStep{Enable: true},
+				Custom: map[string]CustomStep{
+					"test":  {Type: CustomStepTypeApp, Args: []string{"--verbose"}, DependsOn: []string{"flakeCheck"}},
+					"value": {Type: CustomStepTypeEval, Attr: "checks.value", DependsOn: []string{"custom:test"}},
+				},
+			}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	opts := RunOptions{Systems: []string{"x86_64-linux"}}
+	plan, err := NewPlan(flake, config, opts)
+	require.NoError(t, err)
+
+	require.Len(t, planCommands(plan), 4)
+
+	// The commands that run are the planned ones
+	_, err = RunPlan(context.Background(), plan, opts)
+	require.NoError(t, err)
+	assert.Equal(t, planCommands(plan), readFakeNixLog(t, logPath))
+}
+
+func TestRun_FollowsRemotePlan(t *testing.T) {
+	ssh := &fakeSSH{}
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Dir: ".", Steps: StepsConfig{
+				Lockfile:   LockfileStep{Enable: true},
+				FlakeCheck: FlakeCheckStep{Enable: true},
+				Custom: map[string]CustomStep{
+					"fmt": {Type: CustomStepTypeDevShell, Command: []string{"treefmt"}, DependsOn: []string{"flakeCheck"}},
+				},
+			}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL("/nix/store/abc-source")
+	require.NoError(t, err)
+	opts := RunOptions{RemoteHost: "me@builder", SSH: ssh}
+	plan, err := NewPlan(flake, config, opts)
+	require.NoError(t, err)
+	require.Len(t, plannedArgs(plan), 3)
+	assert.Equal(t, []string{"ssh", "me@builder", "nix flake lock --no-update-lock-file /nix/store/abc-source"}, plannedArgs(plan)[0])
+
+	_, err = RunPlan(context.Background(), plan, opts)
+	require.NoError(t, err)
+	assert.Equal(t, plannedArgs(plan), ssh.sshArgs)
+}
+
+func TestRun_RunsPlannedCustomStep(t *testing.T) {
+	t.Setenv("OM_TEST_TOKEN", "s3cret")
+	step := CustomStep{
+		Type:    CustomStepTypeApp,
+		Name:    "deploy",
+		Args:    []string{"--dry run"},
+		Cwd:     "tests",
+		Env:     map[string]string{"CI": "true"},
+		Secrets: map[string]Secret{"TOKEN": {Env: "OM_TEST_TOKEN"}},
+	}
+	config := Config{Default: map[string]SubflakeConfig{
+		"main": {Steps: StepsConfig{Custom: map[string]CustomStep{"deploy": step}}},
+	}}
+
+	t.Run("local", func(t *testing.T) {
+		logPath := installFakeNix(t, "")
+		dir := t.TempDir()
+		require.NoError(t, os.Mkdir(filepath.Join(dir, "tests"), 0755))
+		flake, err := nix.ParseFlakeURL(dir)
+		require.NoError(t, err)
+
+		// Activity observers get nix to print its log events
+		opts := RunOptions{Observer: &activityRecorder{recordingObserver{t: t}}}
+		plan, err := NewPlan(flake, config, opts)
+		require.NoError(t, err)
+		commands := plan.Subflakes[0].Steps[0].Commands
+		require.Len(t, commands, 1)
+		assert.Equal(t, []string{"nix", "--log-format", "internal-json", "run", dir + "#deploy", "--", "--dry run"}, commands[0].Args)
+		assert.Equal(t, filepath.Join(dir, "tests"), commands[0].Dir)
+		assert.Equal(t, []string{"CI", "TOKEN"}, commands[0].Env)
+
+		results, err := RunPlan(context.Background(), plan, opts)
+		require.NoError(t, err)
+		require.True(t, results[0].Success)
+		assert.Equal(t, []string{strings.Join(commands[0].Args[1:], " ")}, readFakeNixLog(t, logPath))
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		ssh := &fakeSSH{}
+		flake, err := nix.ParseFlakeURL("/nix/store/abc-source")
+		require.NoError(t, err)
+
+		opts := RunOptions{RemoteHost: "me@builder", SSH: ssh}
+		plan, err := NewPlan(flake, config, opts)
+		require.NoError(t, err)
+		commands := plan.Subflakes[0].Steps[0].Commands
+		require.Len(t, commands, 1)
+		assert.Equal(t, []string{
+			"sh", "-c", `eval "$(cat)" && cd -- "$1" && shift && exec "$@"`, "sh", "/nix/store/abc-source/tests",
+			"env", "CI=true", "nix", "run", "/nix/store/abc-source#deploy", "--", "--dry run",
+		}, commands[0].Remote)
+		assert.Equal(t, sshCommand("me@builder", commands[0].Remote), commands[0].Args)
+		assert.Equal(t, []string{"TOKEN"}, commands[0].Env)
+
+		results, err := RunPlan(context.Background(), plan, opts)
+		require.NoError(t, err)
+		require.True(t, results[0].Success)
+		assert.Equal(t, [][]string{commands[0].Args}, ssh.sshArgs)
+		assert.Equal(t, []string{"export TOKEN=s3cret\n"}, ssh.stdins)
+	})
+}
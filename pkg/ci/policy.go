@@ -0,0 +1,144 @@
+package ci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultRetryBackoff is the delay before the first retry of a step when
+// StepPolicy.RetryBackoff is not set.
+const DefaultRetryBackoff = 10 * time.Second
+
+// Duration is a time.Duration configured as a Go duration string such as
+// "90s" or "1h30m", or as a plain number of seconds.
+type Duration time.Duration
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return d.set(v)
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var v interface{}
+	if err := value.Decode(&v); err != nil {
+		return err
+	}
+	return d.set(v)
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// set parses a decoded duration value
+func (d *Duration) set(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		*d = Duration(parsed)
+	case int:
+		*d = Duration(time.Duration(v) * time.Second)
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	default:
+		return fmt.Errorf("invalid duration %v: expected a string like \"30m\" or a number of seconds", v)
+	}
+	return nil
+}
+
+// StepAttempt records a single attempt at running a step
+type StepAttempt struct {
+	// Success indicates if the attempt passed
+	Success bool `json:"success"`
+
+	// Error contains the error message if the attempt failed
+	Error string `json:"error,omitempty"`
+
+	// TimedOut indicates the attempt was killed for exceeding the step timeout
+	TimedOut bool `json:"timedOut,omitempty"`
+
+	// Duration is how long the attempt took
+	Duration time.Duration `json:"duration"`
+}
+
+// runWithPolicy runs a step, bounding each attempt by the policy timeout and
+// retrying failed attempts with exponential backoff, calling onRetry (unless
+// nil) before each retry. Every attempt is recorded in the returned result;
+// a final failure is marked as allowed if the policy says so.
+func runWithPolicy(ctx context.Context, policy StepPolicy, out *nix.OutputStream, onRetry func(failed StepAttempt, backoff time.Duration), step func(ctx context.Context) StepResult) StepResult {
+	start := time.Now()
+
+	backoff := time.Duration(policy.RetryBackoff)
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+
+	var result StepResult
+	var attempts []StepAttempt
+retries:
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if onRetry != nil {
+				onRetry(attempts[len(attempts)-1], backoff)
+			}
+			out.WriteLine(fmt.Sprintf("Retrying in %s (attempt %d of %d)", backoff, attempt+1, policy.Retries+1))
+			select {
+			case <-ctx.Done():
+				// Cancelled while waiting: there is no attempt to make
+				result.Error = fmt.Errorf("%w before retrying: %s", ctx.Err(), result.Error).Error()
+				break retries
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		attemptCtx := ctx
+		cancel := func() {}
+		if policy.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, time.Duration(policy.Timeout))
+		}
+		result = step(attemptCtx)
+		timedOut := !result.Success && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil
+		cancel()
+
+		if timedOut {
+			result.Error = fmt.Sprintf("timed out after %s: %s", time.Duration(policy.Timeout), result.Error)
+		}
+		attempts = append(attempts, StepAttempt{
+			Success:  result.Success,
+			Error:    result.Error,
+			TimedOut: timedOut,
+			Duration: result.Duration,
+		})
+
+		if result.Success || attempt >= policy.Retries || ctx.Err() != nil {
+			break
+		}
+	}
+
+	result.Attempts = attempts
+	result.AllowedFailure = !result.Success && policy.AllowFailure
+	result.Duration = time.Since(start)
+
+	return result
+}
@@ -0,0 +1,228 @@
+package ci
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDuration_Unmarshal(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		json     string
+		expected time.Duration
+	}{
+		{name: "duration string", yaml: `"1h30m"`, json: `"1h30m"`, expected: 90 * time.Minute},
+		{name: "seconds", yaml: `45`, json: `45`, expected: 45 * time.Second},
+		{name: "fractional seconds", yaml: `1.5`, json: `1.5`, expected: 1500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fromYAML, fromJSON Duration
+			require.NoError(t, yaml.Unmarshal([]byte(tt.yaml), &fromYAML))
+			require.NoError(t, json.Unmarshal([]byte(tt.json), &fromJSON))
+			assert.Equal(t, tt.expected, time.Duration(fromYAML))
+			assert.Equal(t, tt.expected, time.Duration(fromJSON))
+		})
+	}
+
+	var d Duration
+	assert.Error(t, json.Unmarshal([]byte(`"soon"`), &d))
+	assert.Error(t, json.Unmarshal([]byte(`true`), &d))
+
+	data, err := json.Marshal(Duration(2 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, `"2m0s"`, string(data))
+}
+
+func TestLoadConfig_StepPolicy(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "om.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`ci:
+  default:
+    main:
+      steps:
+        build:
+          enable: true
+          timeout: 2h
+        custom:
+          integration:
+            type: devshell
+            command: [make, integration]
+            timeout: 10m
+            retries: 2
+            retryBackoff: 30s
+            allowFailure: true
+`), 0644))
+
+	config, err := LoadConfig(configPath)
+	require.NoError(t, err)
+
+	steps := config.Default["main"].Steps
+	assert.Equal(t, Duration(2*time.Hour), steps.Build.Timeout)
+	assert.Equal(t, StepPolicy{
+		Timeout:      Duration(10 * time.Minute),
+		Retries:      2,
+		RetryBackoff: Duration(30 * time.Second),
+		AllowFailure: true,
+	}, steps.stepPolicy("custom:integration"))
+}
+
+func TestCustomStep_PolicyFromJSON(t *testing.T) {
+	// The flake's om output is decoded from JSON
+	var step CustomStep
+	require.NoError(t, json.Unmarshal([]byte(`{"type": "app", "timeout": "5m", "retries": 1, "allowFailure": true}`), &step))
+
+	assert.Equal(t, CustomStepTypeApp, step.Type)
+	assert.Equal(t, Duration(5*time.Minute), step.Timeout)
+	assert.Equal(t, 1, step.Retries)
+	assert.True(t, step.AllowFailure)
+}
+
+func TestRunWithPolicy_Retries(t *testing.T) {
+	out := newTestStream(t)
+
+	calls := 0
+	result := runWithPolicy(context.Background(), StepPolicy{Retries: 3, RetryBackoff: Duration(time.Millisecond)}, out, nil,
+		func(ctx context.Context) StepResult {
+			calls++
+			if calls < 3 {
+				return StepResult{Name: "test", Error: "flaky"}
+			}
+			return StepResult{Name: "test", Success: true}
+		})
+
+	assert.True(t, result.Success)
+	assert.Equal(t, 3, calls)
+	require.Len(t, result.Attempts, 3)
+	assert.False(t, result.Attempts[0].Success)
+	assert.Equal(t, "flaky", result.Attempts[1].Error)
+	assert.True(t, result.Attempts[2].Success)
+	assert.Contains(t, out.Tail(), "Retrying in 1ms (attempt 2 of 4)")
+	assert.Contains(t, out.Tail(), "Retrying in 2ms (attempt 3 of 4)")
+}
+
+func TestRunWithPolicy_GivesUp(t *testing.T) {
+	calls := 0
+	result := runWithPolicy(context.Background(), StepPolicy{Retries: 1, RetryBackoff: Duration(time.Millisecond)}, newTestStream(t), nil,
+		func(ctx context.Context) StepResult {
+			calls++
+			return StepResult{Name: "test", Error: "broken"}
+		})
+
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, StepFailed, result.Status())
+	assert.Len(t, result.Attempts, 2)
+}
+
+func TestRunWithPolicy_CancelledDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	onRetry := func(failed StepAttempt, backoff time.Duration) { cancel() }
+	result := runWithPolicy(ctx, StepPolicy{Retries: 3, RetryBackoff: Duration(time.Minute)}, newTestStream(t), onRetry,
+		func(ctx context.Context) StepResult {
+			calls++
+			return StepResult{Name: "test", Error: "flaky"}
+		})
+
+	// The run stops without another attempt
+	assert.Equal(t, 1, calls)
+	assert.Len(t, result.Attempts, 1)
+	assert.False(t, result.Success)
+	assert.Equal(t, "context canceled before retrying: flaky", result.Error)
+}
+
+func TestRunWithPolicy_Timeout(t *testing.T) {
+	result := runWithPolicy(context.Background(), StepPolicy{Timeout: Duration(20 * time.Millisecond)}, newTestStream(t), nil,
+		func(ctx context.Context) StepResult {
+			<-ctx.Done()
+			return StepResult{Name: "test", Error: "signal: killed"}
+		})
+
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Error, "timed out after 20ms")
+	require.Len(t, result.Attempts, 1)
+	assert.True(t, result.Attempts[0].TimedOut)
+}
+
+func TestRunWithPolicy_AllowFailure(t *testing.T) {
+	result := runWithPolicy(context.Background(), StepPolicy{AllowFailure: true}, newTestStream(t), nil,
+		func(ctx context.Context) StepResult {
+			return StepResult{Name: "test", Error: "broken"}
+		})
+
+	assert.True(t, result.AllowedFailure)
+	assert.Equal(t, StepWarning, result.Status())
+
+	// A passing step is never a warning
+	result = runWithPolicy(context.Background(), StepPolicy{AllowFailure: true}, newTestStream(t), nil,
+		func(ctx context.Context) StepResult {
+			return StepResult{Name: "test", Success: true}
+		})
+	assert.Equal(t, StepPassed, result.Status())
+}
+
+func TestRun_StepPolicies(t *testing.T) {
+	// "hang" never finishes, "broken" always fails
+	installFakeNix(t, `case "$*" in
+  *'#hang'*) exec sleep 30;;
+  *'#broken'*) exit 1;;
+esac`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {
+				Dir: ".",
+				Steps: StepsConfig{
+					Custom: map[string]CustomStep{
+						"hang": {
+							Type:       CustomStepTypeDevShell,
+							Name:       "hang",
+							Command:    []string{"make", "integration"},
+							StepPolicy: StepPolicy{Timeout: Duration(200 * time.Millisecond)},
+						},
+						"lint": {
+							Type:       CustomStepTypeDevShell,
+							Name:       "broken",
+							Command:    []string{"make", "lint"},
+							StepPolicy: StepPolicy{AllowFailure: true},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	start := time.Now()
+	results, err := Run(context.Background(), flake, config, RunOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Less(t, time.Since(start), 10*time.Second, "the hanging step was not killed")
+
+	steps := results[0].Steps
+	assert.Equal(t, StepFailed, steps["custom:hang"].Status())
+	assert.Contains(t, steps["custom:hang"].Error, "timed out")
+	assert.Equal(t, StepWarning, steps["custom:lint"].Status())
+	assert.False(t, results[0].Success)
+
+	// Without the hanging step, the allowed failure alone doesn't fail the subflake
+	delete(config.Default["main"].Steps.Custom, "hang")
+	results, err = Run(context.Background(), flake, config, RunOptions{})
+	require.NoError(t, err)
+	assert.True(t, results[0].Success)
+	assert.Equal(t, StepWarning, results[0].Steps["custom:lint"].Status())
+}
@@ -0,0 +1,328 @@
+package ci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/saberzero1/omnix/pkg/common"
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/store"
+	"go.uber.org/zap"
+)
+
+// poolJob is a subflake to run for a single system on a builder of the pool
+type poolJob struct {
+	subflake string
+	system   string
+}
+
+// poolBuilder is a builder of the pool and its current load
+type poolBuilder struct {
+	Builder
+	uri *store.URI
+
+	// running is the number of jobs running on the builder
+	running int
+
+	// down is set once the builder could not be reached
+	down bool
+}
+
+// builderPool assigns jobs to builders. It is safe for concurrent use.
+type builderPool struct {
+	mu       sync.Mutex
+	builders []*poolBuilder
+
+	// changed is closed, and replaced, whenever a builder is released
+	changed chan struct{}
+}
+
+// newBuilderPool creates a pool of the given builders
+func newBuilderPool(builders []Builder) (*builderPool, error) {
+	if len(builders) == 0 {
+		return nil, fmt.Errorf("no builders in the pool (configure ci.pool)")
+	}
+
+	pool := &builderPool{changed: make(chan struct{})}
+	for _, builder := range builders {
+		uri, err := store.ParseURI(builder.Store)
+		if err != nil {
+			return nil, fmt.Errorf("invalid builder %q: %w", builder.Store, err)
+		}
+		if !uri.IsSSH() {
+			return nil, fmt.Errorf("invalid builder %q: only ssh:// stores can run CI", builder.Store)
+		}
+		if builder.Capacity <= 0 {
+			builder.Capacity = 1
+		}
+		pool.builders = append(pool.builders, &poolBuilder{Builder: builder, uri: uri})
+	}
+
+	return pool, nil
+}
+
+// systems returns the systems supported by the pool, in pool order
+func (p *builderPool) systems() []string {
+	seen := make(map[string]bool)
+	var systems []string
+	for _, builder := range p.builders {
+		for _, system := range builder.Systems {
+			if !seen[system] {
+				seen[system] = true
+				systems = append(systems, system)
+			}
+		}
+	}
+	return systems
+}
+
+// pick returns the least loaded builder for system that has a free slot and
+// isn't in skip, or nil. usable reports whether any builder not in skip
+// supports system at all, busy or not.
+func (p *builderPool) pick(system string, skip map[*poolBuilder]bool) (best *poolBuilder, usable bool) {
+	for _, builder := range p.builders {
+		if builder.down || skip[builder] || !builder.supports(system) {
+			continue
+		}
+		usable = true
+		if builder.running >= builder.Capacity {
+			continue
+		}
+		// Compare the load ratios running/capacity; earlier builders win ties
+		if best == nil || builder.running*best.Capacity < best.running*builder.Capacity {
+			best = builder
+		}
+	}
+	return best, usable
+}
+
+// acquire waits for the least loaded builder for system, skipping the
+// builders in skip. It fails if no builder can run the job.
+func (p *builderPool) acquire(ctx context.Context, system string, skip map[*poolBuilder]bool) (*poolBuilder, error) {
+	for {
+		p.mu.Lock()
+		builder, usable := p.pick(system, skip)
+		if builder != nil {
+			builder.running++
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		if builder != nil {
+			return builder, nil
+		}
+		if !usable {
+			return nil, fmt.Errorf("no builder available for %s", system)
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release frees a slot of builder, taking it out of the pool if it is down
+func (p *builderPool) release(builder *poolBuilder, down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	builder.running--
+	if down {
+		builder.down = true
+	}
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// supports returns whether the builder can build for system
+func (b *poolBuilder) supports(system string) bool {
+	for _, s := range b.Systems {
+		if s == system {
+			return true
+		}
+	}
+	return false
+}
+
+// RunPool runs CI on the pool of remote builders in config.Pool.
+//
+// Every (subflake, system) pair is run with RunRemote on the least loaded
+// builder supporting the system, up to each builder's capacity. A builder
+// that cannot be reached is taken out of the pool and its job moves on to
+// another builder. Without opts.Systems, every system of the pool is built.
+//
+// The flake URL fragment selects the configuration on the builders, as for
+// RunRemote. Results are returned per (subflake, system) pair, with System
+// set and every step annotated with the host that ran it.
+func RunPool(ctx context.Context, flakeURL nix.FlakeURL, config Config, opts RunOptions) ([]Result, error) {
+	pool, err := newBuilderPool(config.Pool)
+	if err != nil {
+		return nil, err
+	}
+
+	systems := opts.Systems
+	if len(systems) == 0 {
+		systems = pool.systems()
+	}
+	jobs := poolJobs(config, systems)
+
+	if opts.FailFast {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		opts.abort = cancel
+	}
+	opts = opts.withObserver()
+
+	jobResults := make([][]Result, len(jobs))
+	jobErrs := make([]error, len(jobs))
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job poolJob) {
+			defer wg.Done()
+			jobFlake := subflakeFlakeURL(flakeURL, job.subflake)
+			results, err := runPoolJob(ctx, pool, jobFlake, job, opts)
+			jobResults[i], jobErrs[i] = poolJobResults(job, results, err), err
+			for _, result := range jobResults[i] {
+				opts.observe().OnSubflakeEnd(result)
+			}
+		}(i, job)
+	}
+	wg.Wait()
+
+	var results []Result
+	errs := make(map[string]error)
+	for i, job := range jobs {
+		for _, result := range jobResults[i] {
+			if jobErrs[i] != nil {
+				errs[resultKey(result)] = fmt.Errorf("failed to run subflake %s on %s: %w", job.subflake, job.system, jobErrs[i])
+			}
+			results = append(results, result)
+		}
+	}
+	err = newRunError(results, errs, ctx.Err() != nil)
+
+	if ghErr := reportFinished(opts, results); ghErr != nil && err == nil {
+		err = ghErr
+	}
+
+	return results, err
+}
+
+// poolJobResults returns the results of a job, marked with its system. A
+// job that never ran gets a result of its own, so that it is reported; the
+// results of a job that failed to run are failed.
+func poolJobResults(job poolJob, results []Result, err error) []Result {
+	if results == nil && err != nil {
+		results = []Result{{Subflake: job.subflake, Steps: map[string]StepResult{}}}
+	}
+	for i := range results {
+		results[i].System = job.system
+		if err != nil {
+			results[i].Success = false
+		}
+	}
+	return results
+}
+
+// subflakeFlakeURL returns the flake URL selecting a single subflake of the
+// configuration selected by the fragment of flakeURL, e.g. ".#default.main"
+func subflakeFlakeURL(flakeURL nix.FlakeURL, subflake string) nix.FlakeURL {
+	configName := "default"
+	if _, attr := flakeURL.SplitAttr(); attr != "" {
+		configName = strings.SplitN(attr, ".", 2)[0]
+	}
+	return flakeURL.WithAttr(configName + "." + subflake)
+}
+
+// poolJobs returns the (subflake, system) pairs to run, sorted by subflake
+func poolJobs(config Config, systems []string) []poolJob {
+	names := make([]string, 0, len(config.Default))
+	for name := range config.Default {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var jobs []poolJob
+	for _, name := range names {
+		subflake := config.Default[name]
+		if subflake.Skip {
+			continue
+		}
+		for _, system := range systems {
+			if subflake.CanRunOn([]string{system}) {
+				jobs = append(jobs, poolJob{subflake: name, system: system})
+			}
+		}
+	}
+
+	return jobs
+}
+
+// runPoolJob runs a job on a builder of the pool, failing over to the next
+// builder when one is unavailable
+func runPoolJob(ctx context.Context, pool *builderPool, flakeURL nix.FlakeURL, job poolJob, opts RunOptions) ([]Result, error) {
+	tried := make(map[*poolBuilder]bool)
+	var failures []error
+
+	for {
+		builder, err := pool.acquire(ctx, job.system, tried)
+		if err != nil {
+			return nil, errors.Join(append(failures, err)...)
+		}
+		tried[builder] = true
+
+		jobOpts := opts
+		jobOpts.Systems = []string{job.system}
+		jobOpts.GitHubOutput = false
+		jobOpts.github = nil
+		// RunPool reports the results once they are marked with their system
+		jobOpts.Observer = nil
+		jobOpts.observer = nil
+		jobOpts.outputPrefix = fmt.Sprintf("[%s/%s@%s] ", job.subflake, job.system, builder.uri.GetSSHURI())
+		if opts.GCRootDir != "" {
+			jobOpts.GCRootDir = filepath.Join(opts.GCRootDir, logFileName(job.system))
+		}
+		if opts.LogDir != "" {
+			jobOpts.LogDir = filepath.Join(opts.LogDir, logFileName(job.subflake), logFileName(job.system))
+		}
+
+		results, err := RunRemote(ctx, builder.uri, flakeURL, jobOpts)
+		unavailable := errors.Is(err, ErrHostUnavailable) && ctx.Err() == nil
+		pool.release(builder, unavailable)
+
+		if !unavailable {
+			if opts.abort != nil && hasFailedStep(results) {
+				opts.abort()
+			}
+			return results, err
+		}
+
+		common.Logger().Warn("Builder unavailable, trying another",
+			zap.String("builder", builder.Store),
+			zap.String("subflake", job.subflake),
+			zap.String("system", job.system),
+			zap.Error(err))
+		failures = append(failures, fmt.Errorf("%s: %w", builder.Store, err))
+	}
+}
+
+// hasFailedStep returns whether any step of results failed
+func hasFailedStep(results []Result) bool {
+	for _, result := range results {
+		for _, step := range result.Steps {
+			if step.Status() == StepFailed {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package ci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilderPool_Pick(t *testing.T) {
+	pool, err := newBuilderPool([]Builder{
+		{Store: "ssh://big", Systems: []string{"x86_64-linux"}, Capacity: 2},
+		{Store: "ssh://small", Systems: []string{"x86_64-linux", "aarch64-linux"}},
+	})
+	require.NoError(t, err)
+	big, small := pool.builders[0], pool.builders[1]
+
+	assert.Equal(t, []string{"x86_64-linux", "aarch64-linux"}, pool.systems())
+	assert.Equal(t, 1, small.Capacity, "capacity defaults to 1")
+
+	// Equally loaded: the first builder wins
+	best, usable := pool.pick("x86_64-linux", nil)
+	assert.True(t, usable)
+	assert.Same(t, big, best)
+
+	// big is half busy, small is idle
+	big.running = 1
+	best, _ = pool.pick("x86_64-linux", nil)
+	assert.Same(t, small, best)
+
+	// small is full, big still has a slot
+	small.running = 1
+	best, _ = pool.pick("x86_64-linux", nil)
+	assert.Same(t, big, best)
+
+	// Everything is busy, but a slot may free up
+	big.running = 2
+	best, usable = pool.pick("x86_64-linux", nil)
+	assert.Nil(t, best)
+	assert.True(t, usable)
+
+	// Builders that are down, skipped or don't support the system can't be used
+	small.down = true
+	_, usable = pool.pick("aarch64-linux", nil)
+	assert.False(t, usable)
+	_, usable = pool.pick("x86_64-linux", map[*poolBuilder]bool{big: true})
+	assert.False(t, usable)
+	_, usable = pool.pick("riscv64-linux", nil)
+	assert.False(t, usable)
+}
+
+func TestNewBuilderPool_Invalid(t *testing.T) {
+	_, err := newBuilderPool(nil)
+	assert.Error(t, err)
+
+	_, err = newBuilderPool([]Builder{{Store: "ftp://builder"}})
+	assert.ErrorContains(t, err, `invalid builder "ftp://builder"`)
+
+	_, err = newBuilderPool([]Builder{{Store: "s3://bucket"}})
+	assert.ErrorContains(t, err, "only ssh:// stores can run CI")
+}
+
+// poolResults returns the results of a remote run of the subflake selected by
+// a "<store path>#default.<subflake>" flake argument
+func poolResults(host, flake string) string {
+	subflake := flake[strings.LastIndex(flake, ".")+1:]
+	return fmt.Sprintf(`[{"subflake": %q, "success": true, "duration": 0, "steps": {
+		"build": {"name": "build", "success": true, "duration": 0}
+	}}]`, subflake)
+}
+
+func TestRunPool(t *testing.T) {
+	installFakeNix(t, `case "$*" in
+  'flake metadata'*) echo '{"path": "/nix/store/aaa-source"}';;
+esac`)
+
+	ssh := &fakeSSH{resultsFor: poolResults, unreachable: map[string]bool{"down": true}}
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"a": {Dir: "."},
+			"b": {Dir: ".", Systems: []string{"x86_64-linux"}},
+		},
+		Pool: []Builder{
+			{Store: "ssh://down", Systems: []string{"x86_64-linux"}, Capacity: 4},
+			{Store: "ssh://up", Systems: []string{"x86_64-linux", "aarch64-linux"}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	results, err := RunPool(context.Background(), flake, config, RunOptions{SSH: ssh})
+	require.NoError(t, err)
+
+	// Jobs sent to the unreachable builder fail over to the other one
+	var jobs []string
+	for _, result := range results {
+		jobs = append(jobs, resultKey(result))
+		assert.True(t, result.Success)
+		assert.Equal(t, "up", result.Steps["build"].Host)
+	}
+	assert.Equal(t, []string{"a@x86_64-linux", "a@aarch64-linux", "b@x86_64-linux"}, jobs)
+
+	for _, command := range ssh.commands {
+		if strings.HasPrefix(command, "up: nix ") {
+			assert.Contains(t, command, "/nix/store/aaa-source#default.")
+		}
+	}
+}
+
+func TestRunPool_NoBuilder(t *testing.T) {
+	installFakeNix(t, `case "$*" in
+  'flake metadata'*) echo '{"path": "/nix/store/aaa-source"}';;
+esac`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{"a": {Dir: "."}},
+		Pool:    []Builder{{Store: "ssh://down", Systems: []string{"x86_64-linux"}}},
+	}
+
+	flake, err := nix.ParseFlakeURL(".#release")
+	require.NoError(t, err)
+
+	ssh := &fakeSSH{resultsFor: poolResults, unreachable: map[string]bool{"down": true}}
+	results, err := RunPool(context.Background(), flake, config, RunOptions{
+		Systems: []string{"x86_64-linux", "riscv64-linux"},
+		SSH:     ssh,
+	})
+
+	var runErr *RunError
+	require.True(t, errors.As(err, &runErr), "expected a RunError, got %v", err)
+	require.Len(t, runErr.Failures, 2)
+	assert.Contains(t, runErr.Failures[0].String(), "a on x86_64-linux: failed to run subflake a on x86_64-linux: ssh://down:")
+	assert.Contains(t, runErr.Failures[0].String(), "no builder available for x86_64-linux")
+	assert.Contains(t, runErr.Failures[1].String(), "no builder available for riscv64-linux")
+	assert.ErrorIs(t, err, ErrHostUnavailable)
+
+	// Jobs that never ran are still reported
+	require.Len(t, results, 2)
+	assert.False(t, results[0].Success)
+	assert.Equal(t, "riscv64-linux", results[1].System)
+
+	// The configuration is selected by the flake URL fragment
+	assert.Contains(t, ssh.commands[0], "/nix/store/aaa-source#release.a")
+}
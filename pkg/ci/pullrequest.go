@@ -0,0 +1,189 @@
+package ci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+)
+
+// DefaultGitHubAPIURL is the base URL of the GitHub REST API
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// PullRequestRef identifies a GitHub pull request
+type PullRequestRef struct {
+	Owner  string
+	Repo   string
+	Number int
+}
+
+// String returns the pull request as owner/repo#number
+func (r PullRequestRef) String() string {
+	return fmt.Sprintf("%s/%s#%d", r.Owner, r.Repo, r.Number)
+}
+
+// ParsePullRequestURL parses a pull request web URL such as
+// https://github.com/owner/repo/pull/123. Sub-pages of the pull request
+// (e.g. /files) are accepted too. It returns false if s is not one.
+func ParsePullRequestURL(s string) (PullRequestRef, bool) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host != "github.com" {
+		return PullRequestRef{}, false
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] == "" || parts[1] == "" || parts[2] != "pull" {
+		return PullRequestRef{}, false
+	}
+	number, err := strconv.Atoi(parts[3])
+	if err != nil || number <= 0 {
+		return PullRequestRef{}, false
+	}
+
+	return PullRequestRef{Owner: parts[0], Repo: parts[1], Number: number}, true
+}
+
+// PullRequest is the part of a GitHub pull request used to build it.
+// See https://docs.github.com/en/rest/pulls/pulls#get-a-pull-request
+type PullRequest struct {
+	Number int    `json:"number"`
+	Title  string `json:"title"`
+	Head   struct {
+		// Ref is the branch of the pull request
+		Ref string `json:"ref"`
+
+		// SHA is the head commit of the pull request
+		SHA string `json:"sha"`
+
+		// Repo is the repository of the branch, a fork or the base
+		// repository itself; nil if the fork was deleted
+		Repo *struct {
+			FullName string `json:"full_name"`
+		} `json:"repo"`
+	} `json:"head"`
+}
+
+// FlakeURL returns the flake URL of the head commit of the pull request,
+// in the repository it was pushed to
+func (pr *PullRequest) FlakeURL() (nix.FlakeURL, error) {
+	if pr.Head.Repo == nil || pr.Head.Repo.FullName == "" {
+		return nix.FlakeURL{}, fmt.Errorf("the head repository of pull request #%d no longer exists", pr.Number)
+	}
+	if pr.Head.SHA == "" {
+		return nix.FlakeURL{}, fmt.Errorf("pull request #%d has no head commit", pr.Number)
+	}
+	return nix.NewFlakeURL(fmt.Sprintf("github:%s/%s", pr.Head.Repo.FullName, pr.Head.SHA)), nil
+}
+
+// GitHubClient is a minimal client of the GitHub REST API
+type GitHubClient struct {
+	// BaseURL is the base URL of the API (empty = DefaultGitHubAPIURL)
+	BaseURL string
+
+	// Token authenticates requests, raising the rate limit and giving
+	// access to private repositories (empty = anonymous)
+	Token string
+
+	// HTTP sends the requests (nil = a client with a 30s timeout)
+	HTTP *http.Client
+}
+
+// NewGitHubClientFromEnv creates a GitHub client using $GITHUB_API_URL as
+// the base URL and $GITHUB_TOKEN (or $GH_TOKEN) as the token, if set.
+func NewGitHubClientFromEnv() *GitHubClient {
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		token = os.Getenv("GH_TOKEN")
+	}
+	return &GitHubClient{
+		BaseURL: os.Getenv("GITHUB_API_URL"),
+		Token:   token,
+	}
+}
+
+// GetPullRequest fetches a pull request
+func (c *GitHubClient) GetPullRequest(ctx context.Context, ref PullRequestRef) (*PullRequest, error) {
+	path := fmt.Sprintf("/repos/%s/%s/pulls/%d", url.PathEscape(ref.Owner), url.PathEscape(ref.Repo), ref.Number)
+
+	var pr PullRequest
+	if err := c.get(ctx, path, &pr); err != nil {
+		return nil, fmt.Errorf("failed to get pull request %s: %w", ref, err)
+	}
+	return &pr, nil
+}
+
+// get sends a GET request for path and decodes the JSON response into v
+func (c *GitHubClient) get(ctx context.Context, path string, v interface{}) error {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultGitHubAPIURL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	req.Header.Set("User-Agent", "omnix")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := c.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		// Errors carry a message, e.g. {"message": "Not Found"}
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		_ = json.Unmarshal(body, &apiErr)
+
+		err := fmt.Errorf("GitHub API returned %s", resp.Status)
+		if apiErr.Message != "" {
+			err = fmt.Errorf("%w: %s", err, apiErr.Message)
+		}
+		if (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests) && c.Token == "" {
+			err = fmt.Errorf("%w (set GITHUB_TOKEN to raise the rate limit)", err)
+		}
+		return err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse GitHub API response: %w", err)
+	}
+	return nil
+}
+
+// ResolveFlakeURL parses the flake argument of `om ci run`. GitHub pull
+// request URLs are resolved with client to the head commit of the pull
+// request; anything else is parsed as a flake URL.
+func ResolveFlakeURL(ctx context.Context, client *GitHubClient, s string) (nix.FlakeURL, error) {
+	ref, ok := ParsePullRequestURL(s)
+	if !ok {
+		return nix.ParseFlakeURL(s)
+	}
+
+	pr, err := client.GetPullRequest(ctx, ref)
+	if err != nil {
+		return nix.FlakeURL{}, err
+	}
+	return pr.FlakeURL()
+}
@@ -0,0 +1,120 @@
+package ci
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePullRequestURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		ref  PullRequestRef
+		isPR bool
+	}{
+		{"https://github.com/srid/emanote/pull/451", PullRequestRef{"srid", "emanote", 451}, true},
+		{"https://github.com/srid/emanote/pull/451/files", PullRequestRef{"srid", "emanote", 451}, true},
+		{"https://github.com/srid/emanote/pull/451/", PullRequestRef{"srid", "emanote", 451}, true},
+		{"https://github.com/srid/emanote/pull/451#issuecomment-1", PullRequestRef{"srid", "emanote", 451}, true},
+		{"https://github.com/srid/emanote/issues/451", PullRequestRef{}, false},
+		{"https://github.com/srid/emanote/pull/abc", PullRequestRef{}, false},
+		{"https://github.com/srid/emanote", PullRequestRef{}, false},
+		{"https://gitlab.com/srid/emanote/pull/451", PullRequestRef{}, false},
+		{"github:srid/emanote", PullRequestRef{}, false},
+		{".", PullRequestRef{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			ref, ok := ParsePullRequestURL(tt.url)
+			assert.Equal(t, tt.isPR, ok)
+			assert.Equal(t, tt.ref, ref)
+		})
+	}
+}
+
+// fakeGitHubAPI serves pull requests by path, recording the last request
+func fakeGitHubAPI(t *testing.T, pulls map[string]string) (*httptest.Server, *http.Request) {
+	t.Helper()
+
+	var last http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last = *r
+		body, ok := pulls[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message": "Not Found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, &last
+}
+
+func TestResolveFlakeURL(t *testing.T) {
+	server, last := fakeGitHubAPI(t, map[string]string{
+		// A pull request from a branch of the repository itself
+		"/repos/srid/emanote/pulls/451": `{"number": 451, "head": {"ref": "fix", "sha": "abc123", "repo": {"full_name": "srid/emanote"}}}`,
+		// A pull request from a fork
+		"/repos/srid/emanote/pulls/452": `{"number": 452, "head": {"ref": "main", "sha": "def456", "repo": {"full_name": "someone/emanote"}}}`,
+		// A pull request whose fork was deleted
+		"/repos/srid/emanote/pulls/453": `{"number": 453, "head": {"ref": "main", "sha": "fff000", "repo": null}}`,
+	})
+	client := &GitHubClient{BaseURL: server.URL, Token: "secret"}
+	ctx := context.Background()
+
+	flake, err := ResolveFlakeURL(ctx, client, "https://github.com/srid/emanote/pull/451")
+	require.NoError(t, err)
+	assert.Equal(t, "github:srid/emanote/abc123", flake.String())
+	assert.Equal(t, "Bearer secret", last.Header.Get("Authorization"))
+	assert.Equal(t, "application/vnd.github+json", last.Header.Get("Accept"))
+
+	flake, err = ResolveFlakeURL(ctx, client, "https://github.com/srid/emanote/pull/452")
+	require.NoError(t, err)
+	assert.Equal(t, "github:someone/emanote/def456", flake.String())
+
+	_, err = ResolveFlakeURL(ctx, client, "https://github.com/srid/emanote/pull/453")
+	assert.ErrorContains(t, err, "head repository of pull request #453 no longer exists")
+
+	_, err = ResolveFlakeURL(ctx, client, "https://github.com/srid/emanote/pull/1")
+	assert.ErrorContains(t, err, "failed to get pull request srid/emanote#1: GitHub API returned 404 Not Found: Not Found")
+
+	// Anything else is a flake URL, resolved without the API
+	*last = http.Request{}
+	flake, err = ResolveFlakeURL(ctx, client, "github:srid/emanote#default.main")
+	require.NoError(t, err)
+	assert.Equal(t, "github:srid/emanote#default.main", flake.String())
+	assert.Nil(t, last.URL)
+}
+
+func TestGitHubClient_RateLimited(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"message": "API rate limit exceeded"}`))
+	}))
+	defer server.Close()
+
+	client := &GitHubClient{BaseURL: server.URL}
+	_, err := client.GetPullRequest(context.Background(), PullRequestRef{"o", "r", 1})
+	assert.ErrorContains(t, err, "API rate limit exceeded (set GITHUB_TOKEN to raise the rate limit)")
+}
+
+func TestNewGitHubClientFromEnv(t *testing.T) {
+	t.Setenv("GITHUB_API_URL", "https://ghe.example.com/api/v3")
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("GH_TOKEN", "from-gh")
+
+	client := NewGitHubClientFromEnv()
+	assert.Equal(t, "https://ghe.example.com/api/v3", client.BaseURL)
+	assert.Equal(t, "from-gh", client.Token)
+
+	t.Setenv("GITHUB_TOKEN", "from-actions")
+	assert.Equal(t, "from-actions", NewGitHubClientFromEnv().Token)
+}
@@ -0,0 +1,167 @@
+package ci
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/store"
+)
+
+// maxPathArgBytes bounds the total length of the paths passed to a single
+// nix or nix-store invocation, by the push step or when adding GC roots,
+// keeping it well under ARG_MAX (at least 256 KiB on Linux and macOS, shared
+// with the environment).
+var maxPathArgBytes = 64 * 1024
+
+// PushedPath records whether a single path was pushed by the push step
+type PushedPath struct {
+	// Path is the store path
+	Path store.Path `json:"path"`
+
+	// Success indicates the path is in the destination store
+	Success bool `json:"success"`
+
+	// Error contains the error message if the path could not be pushed
+	Error string `json:"error,omitempty"`
+}
+
+// runPushStep copies the paths built by the build step (and, with
+// IncludeAllDependencies, their closure) to the store step.To, signing them
+// first if a secret key file is configured. Paths are pushed in batches; when
+// a batch fails, its paths are pushed one by one so that each path's outcome
+// is recorded.
+func runPushStep(ctx context.Context, step PushStep, build StepResult, out *nix.OutputStream) StepResult {
+	start := time.Now()
+	result := StepResult{
+		Name:    "push",
+		Success: true,
+	}
+	fail := func(err string) StepResult {
+		result.Success = false
+		result.Error = err
+		result.Duration = time.Since(start)
+		return result
+	}
+
+	if step.To == "" {
+		return fail("push step requires a destination store (push.to)")
+	}
+	to, err := store.ParseURI(step.To)
+	if err != nil {
+		return fail(fmt.Sprintf("invalid push destination: %v", err))
+	}
+
+	paths, err := pushPaths(ctx, step, build)
+	if err != nil {
+		return fail(err.Error())
+	}
+	if len(paths) == 0 {
+		out.WriteLine("Nothing to push")
+		result.Duration = time.Since(start)
+		return result
+	}
+
+	cmd := nix.NewCmd()
+	batches := batchPaths(paths, maxPathArgBytes)
+
+	if step.SecretKeyFile != "" {
+		out.WriteLine(fmt.Sprintf("Signing %d paths", len(paths)))
+		for _, batch := range batches {
+			if err := nix.Sign(ctx, cmd, step.SecretKeyFile, storePathStrings(batch), out); err != nil {
+				return fail(fmt.Sprintf("failed to sign paths: %v", err))
+			}
+		}
+	}
+
+	out.WriteLine(fmt.Sprintf("Pushing %d paths to %s", len(paths), to))
+	copyOpts := nix.CopyOptions{To: to, Output: out}
+	failed := 0
+	record := func(path store.Path, err error) {
+		pushed := PushedPath{Path: path, Success: err == nil}
+		if err != nil {
+			pushed.Error = err.Error()
+			failed++
+		}
+		result.Pushed = append(result.Pushed, pushed)
+	}
+
+	for _, batch := range batches {
+		err := nix.Copy(ctx, cmd, copyOpts, storePathStrings(batch))
+		if err != nil && len(batch) > 1 && ctx.Err() == nil {
+			out.WriteLine(fmt.Sprintf("Pushing a batch of %d paths failed, retrying them one by one", len(batch)))
+			for _, path := range batch {
+				record(path, nix.CopyPath(ctx, cmd, copyOpts, path.String()))
+			}
+			continue
+		}
+		for _, path := range batch {
+			record(path, err)
+		}
+	}
+
+	if failed > 0 {
+		return fail(fmt.Sprintf("failed to push %d of %d paths", failed, len(paths)))
+	}
+
+	out.WriteLine(fmt.Sprintf("Pushed %d paths to %s", len(paths), to))
+	result.Duration = time.Since(start)
+	return result
+}
+
+// pushPaths returns the paths to push for the build step result. The
+// closure of the build step is reused when it was recorded. Derivations are
+// left out; binary caches serve outputs.
+func pushPaths(ctx context.Context, step PushStep, build StepResult) ([]store.Path, error) {
+	paths := build.OutPaths
+	if step.IncludeAllDependencies {
+		paths = build.Closure
+		if len(paths) == 0 && len(build.OutPaths) > 0 {
+			closure, err := store.NewStoreCmd().FetchAllDeps(ctx, build.OutPaths)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch dependencies: %w", err)
+			}
+			paths = closure
+		}
+	}
+
+	var outputs []store.Path
+	for _, path := range paths {
+		if path.IsOutput() {
+			outputs = append(outputs, path)
+		}
+	}
+	return outputs, nil
+}
+
+// batchPaths splits paths into batches whose arguments add up to at most
+// limit bytes. A path longer than limit gets a batch of its own.
+func batchPaths(paths []store.Path, limit int) [][]store.Path {
+	var batches [][]store.Path
+	var batch []store.Path
+	size := 0
+	for _, path := range paths {
+		// Every argument also takes a terminating NUL byte
+		n := len(path.String()) + 1
+		if len(batch) > 0 && size+n > limit {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, path)
+		size += n
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// storePathStrings converts store paths to strings
+func storePathStrings(paths []store.Path) []string {
+	strs := make([]string, len(paths))
+	for i, path := range paths {
+		strs[i] = path.String()
+	}
+	return strs
+}
@@ -0,0 +1,148 @@
+package ci
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchPaths(t *testing.T) {
+	paths := []store.Path{
+		store.NewPath("/nix/store/aaa-a"), // 17 bytes with the NUL
+		store.NewPath("/nix/store/bbb-b"),
+		store.NewPath("/nix/store/ccc-c"),
+		store.NewPath("/nix/store/ddd-a-very-long-name"),
+	}
+
+	assert.Equal(t, [][]string{
+		{"/nix/store/aaa-a", "/nix/store/bbb-b"},
+		{"/nix/store/ccc-c"},
+		{"/nix/store/ddd-a-very-long-name"},
+	}, batchStrings(batchPaths(paths, 34)))
+
+	assert.Len(t, batchPaths(paths, 1024), 1)
+	assert.Empty(t, batchPaths(nil, 1024))
+}
+
+func TestRun_Push(t *testing.T) {
+	// devour-flake prints the path of a JSON file listing the built outputs
+	devourOut := filepath.Join(t.TempDir(), "devour.json")
+	require.NoError(t, os.WriteFile(devourOut, []byte(`{"outPaths": ["/nix/store/aaa-hello", "/nix/store/bbb-world", "/nix/store/ccc-broken"], "byName": {}}`), 0644))
+	logPath := installFakeNix(t, `case "$*" in
+  build*) echo '`+devourOut+`';;
+  copy*ccc-broken*) echo "cannot copy" >&2; exit 1;;
+esac`)
+
+	// Two paths per batch
+	defer func(limit int) { maxPathArgBytes = limit }(maxPathArgBytes)
+	maxPathArgBytes = 2 * len("/nix/store/aaa-hello/")
+
+	cache := "file://" + t.TempDir()
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			".": {Dir: ".", Steps: StepsConfig{
+				Build: BuildStep{Enable: true},
+				Push:  PushStep{Enable: true, To: cache, SecretKeyFile: "/run/secrets/key"},
+			}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	results, err := Run(context.Background(), flake, config, RunOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	step := results[0].Steps["push"]
+	assert.False(t, step.Success)
+	assert.Equal(t, "failed to push 1 of 3 paths", step.Error)
+	assert.Equal(t, []PushedPath{
+		{Path: store.NewPath("/nix/store/aaa-hello"), Success: true},
+		{Path: store.NewPath("/nix/store/bbb-world"), Success: true},
+		{Path: store.NewPath("/nix/store/ccc-broken"), Error: step.Pushed[2].Error},
+	}, step.Pushed)
+	assert.Contains(t, step.Pushed[2].Error, "nix copy failed")
+
+	// Paths are signed and pushed in batches; a failed batch of one path
+	// is not retried
+	calls := readFakeNixLog(t, logPath)
+	assert.Equal(t, []string{
+		"store sign --key-file /run/secrets/key --recursive /nix/store/aaa-hello /nix/store/bbb-world",
+		"store sign --key-file /run/secrets/key --recursive /nix/store/ccc-broken",
+		"copy -v --to " + cache + " /nix/store/aaa-hello /nix/store/bbb-world",
+		"copy -v --to " + cache + " /nix/store/ccc-broken",
+	}, calls[1:])
+
+	// The outcome of every path is in the results JSON
+	data, err := json.Marshal(results)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"pushed":[{"path":"/nix/store/aaa-hello","success":true}`)
+}
+
+func TestRunPushStep_BatchFallback(t *testing.T) {
+	logPath := installFakeNix(t, `case "$*" in
+  copy*bbb-broken*) exit 1;;
+esac`)
+
+	cache := "file://" + t.TempDir()
+	build := StepResult{
+		Success:  true,
+		OutPaths: []store.Path{store.NewPath("/nix/store/aaa-hello")},
+		Closure: []store.Path{
+			store.NewPath("/nix/store/ddd-hello.drv"),
+			store.NewPath("/nix/store/bbb-broken"),
+			store.NewPath("/nix/store/aaa-hello"),
+		},
+	}
+
+	result := runPushStep(context.Background(), PushStep{To: cache, IncludeAllDependencies: true}, build, newTestStream(t))
+	assert.False(t, result.Success)
+	assert.Equal(t, "failed to push 1 of 2 paths", result.Error)
+	require.Len(t, result.Pushed, 2)
+	assert.False(t, result.Pushed[0].Success)
+	assert.True(t, result.Pushed[1].Success)
+
+	// The closure is pushed without derivations; the failed batch is
+	// retried path by path
+	assert.Equal(t, []string{
+		"copy -v --to " + cache + " /nix/store/bbb-broken /nix/store/aaa-hello",
+		"copy -v --to " + cache + " /nix/store/bbb-broken",
+		"copy -v --to " + cache + " /nix/store/aaa-hello",
+	}, readFakeNixLog(t, logPath))
+}
+
+func TestRunPushStep_Errors(t *testing.T) {
+	logPath := installFakeNix(t, "")
+	build := StepResult{Success: true, OutPaths: []store.Path{store.NewPath("/nix/store/aaa-hello")}}
+
+	result := runPushStep(context.Background(), PushStep{}, build, newTestStream(t))
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Error, "requires a destination store")
+
+	result = runPushStep(context.Background(), PushStep{To: "ftp://cache"}, build, newTestStream(t))
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Error, "invalid push destination")
+
+	// Nothing built, nothing to push
+	result = runPushStep(context.Background(), PushStep{To: "s3://cache"}, StepResult{Success: true}, newTestStream(t))
+	assert.True(t, result.Success)
+	assert.Empty(t, result.Pushed)
+
+	assert.Empty(t, readFakeNixLog(t, logPath))
+}
+
+func batchStrings(batches [][]store.Path) [][]string {
+	strs := make([][]string, len(batches))
+	for i, batch := range batches {
+		strs[i] = pathStrings(batch)
+	}
+	return strs
+}
@@ -0,0 +1,411 @@
+package ci
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/common"
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/flake"
+	"github.com/saberzero1/omnix/pkg/nix/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultOmnixFlake is the flake used to run omnix on remote hosts
+	DefaultOmnixFlake = "github:saberzero1/omnix"
+
+	// remoteCleanupTimeout bounds removing the results of a remote run
+	remoteCleanupTimeout = 30 * time.Second
+)
+
+var (
+	// omnixSource is omnix's own source in the Nix store, empty when not
+	// built with Nix. omnix doesn't depend on it at run time, so it may
+	// have been garbage collected since.
+	// Injected via: -X github.com/saberzero1/omnix/pkg/ci.omnixSource=...
+	omnixSource string
+
+	// storePathExists tells whether a store path is in the local store
+	storePathExists = func(path string) bool {
+		_, err := os.Lstat(path)
+		return err == nil
+	}
+
+	// omnixCommit is the git commit omnix was built from, if known
+	omnixCommit string
+)
+
+// SetOmnixCommit records the git commit omnix was built from. Unknown
+// ("dev") and dirty commits are ignored, as remote hosts cannot fetch them.
+func SetOmnixCommit(commit string) {
+	if commit == "dev" || strings.HasSuffix(commit, "-dirty") {
+		commit = ""
+	}
+	omnixCommit = commit
+}
+
+// OmnixFlakeURL returns the flake used to run omnix on remote hosts, so that
+// they run the same omnix as the local one: omnix's own source when built
+// with Nix, which is copied to the remote store along with the flake being
+// built, or else the commit it was built from. Only development builds,
+// which know neither, use DefaultOmnixFlake.
+func OmnixFlakeURL() string {
+	switch {
+	case omnixSource != "":
+		return omnixSource
+	case omnixCommit != "":
+		return DefaultOmnixFlake + "/" + omnixCommit
+	}
+	return DefaultOmnixFlake
+}
+
+// ErrHostUnavailable is wrapped by errors reaching or using a remote host, as
+// opposed to errors of the command that ran there
+var ErrHostUnavailable = errors.New("host unavailable")
+
+// sshConnectionError is the exit code of ssh when the connection fails
+const sshConnectionError = 255
+
+// SSH runs commands on remote hosts. Errors connecting to the host wrap
+// ErrHostUnavailable.
+type SSH interface {
+	// Run runs command on host, streaming its output to out. If stdin is
+	// non-nil, it is passed to the standard input of the command.
+	Run(ctx context.Context, host string, command []string, stdin io.Reader, out *nix.OutputStream) error
+
+	// Output runs command on host and returns its standard output
+	Output(ctx context.Context, host string, command []string) (string, error)
+}
+
+// OpenSSH runs commands on remote hosts with the ssh executable
+type OpenSSH struct{}
+
+// Run implements SSH
+func (OpenSSH) Run(ctx context.Context, host string, command []string, stdin io.Reader, out *nix.OutputStream) error {
+	args := sshCommand(host, command)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = stdin
+	flush := out.Attach(cmd, nil)
+	err := cmd.Run()
+	flush()
+
+	return wrapSSHError(err)
+}
+
+// Output implements SSH
+func (OpenSSH) Output(ctx context.Context, host string, command []string) (string, error) {
+	var stderr bytes.Buffer
+	args := sshCommand(host, command)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("ssh %s failed: %s: %w", host, strings.TrimSpace(stderr.String()), wrapSSHError(err))
+	}
+	return string(output), nil
+}
+
+// wrapSSHError marks connection failures of ssh with ErrHostUnavailable
+func wrapSSHError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == sshConnectionError {
+		return fmt.Errorf("%w: %w", ErrHostUnavailable, err)
+	}
+	return err
+}
+
+// sshCommand returns the command line OpenSSH runs command on host with
+func sshCommand(host string, command []string) []string {
+	return []string{"ssh", host, shellCommand(command)}
+}
+
+// safeShellArgPattern matches the arguments a POSIX shell takes as they are,
+// wherever they appear in a command
+var safeShellArgPattern = regexp.MustCompile(`^[A-Za-z0-9_@%+:,./-]+$`)
+
+// shellCommand joins command into a single POSIX shell command line, as ssh
+// passes its arguments to the remote shell
+func shellCommand(command []string) string {
+	// Wrap arguments in single quotes unless they are safe as they are,
+	// replacing embedded single quotes with '\'' (end quote, escaped quote,
+	// start quote)
+	parts := make([]string, len(command))
+	for i, part := range command {
+		if safeShellArgPattern.MatchString(part) {
+			parts[i] = part
+		} else {
+			parts[i] = "'" + strings.ReplaceAll(part, "'", "'\\''") + "'"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// sshClient returns opts.SSH, defaulting to OpenSSH
+func (opts RunOptions) sshClient() SSH {
+	if opts.SSH != nil {
+		return opts.SSH
+	}
+	return OpenSSH{}
+}
+
+// executeRemoteCommand executes a command on a remote host via SSH,
+// streaming its output to out and passing it stdin, if non-nil
+func executeRemoteCommand(ctx context.Context, ssh SSH, host string, command []string, stdin io.Reader, out *nix.OutputStream) error {
+	if host == "" {
+		return fmt.Errorf("remote host not specified")
+	}
+
+	return ssh.Run(ctx, host, command, stdin, out)
+}
+
+// RunRemote runs CI for a flake on a remote store.
+//
+// The flake source (and, with the store's copy-inputs option, all of its
+// inputs) is copied to the store, and `om ci run` runs against that copy on
+// the remote host. The flake URL fragment selects the configuration, as for
+// a local run. The remote results are returned; unless opts.GCRootDir is
+// empty, the built paths are copied back and rooted locally.
+//
+// Only ssh:// stores are supported. Step failures are reported in the
+// results; an error is returned when no results could be fetched.
+func RunRemote(ctx context.Context, uri *store.URI, flakeURL nix.FlakeURL, opts RunOptions) ([]Result, error) {
+	if !uri.IsSSH() {
+		return nil, fmt.Errorf("unsupported remote store %s: only ssh:// stores are supported", uri)
+	}
+	host := uri.GetSSHURI().String()
+	ssh := opts.sshClient()
+	cmd := nix.NewCmd()
+	opts = opts.withObserver()
+
+	streamOpts := nix.StreamOptions{Terminal: opts.Output, Prefix: opts.outputPrefix}
+	if opts.LogDir != "" {
+		streamOpts.LogFile = filepath.Join(opts.LogDir, logFileName(host)+".log")
+	}
+	out, err := nix.NewOutputStream(streamOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := out.Close(); err != nil {
+			common.Logger().Warn("failed to close remote log", zap.String("host", host), zap.Error(err))
+		}
+	}()
+
+	// Copy the flake, and omnix itself if it comes from the store
+	paths, err := flakeSourcePaths(ctx, cmd, flakeURL.WithoutAttr(), uri.GetOptions().CopyInputs)
+	if err != nil {
+		return nil, err
+	}
+	omnix := OmnixFlakeURL()
+	if strings.HasPrefix(omnix, "/nix/store/") {
+		if !storePathExists(omnix) {
+			return nil, fmt.Errorf("omnix source %s, which remote hosts run omnix from, is no longer in the Nix store; evaluating omnix's flake again (e.g. with nix build) restores it", omnix)
+		}
+		paths = append(paths, omnix)
+	}
+
+	out.WriteLine(fmt.Sprintf("Copying %d paths to %s", len(paths), uri))
+	if err := nix.Copy(ctx, cmd, nix.CopyOptions{To: uri}, paths); err != nil {
+		return nil, fmt.Errorf("failed to copy flake to %s: %w: %w", uri, ErrHostUnavailable, err)
+	}
+
+	// Run om ci on the copy, writing the results to a file next to it
+	_, attr := flakeURL.SplitAttr()
+	remoteFlake := nix.NewFlakeURL(paths[0]).WithAttr(attr)
+	resultPath, err := remoteResultPath()
+	if err != nil {
+		return nil, err
+	}
+	runErr := ssh.Run(ctx, host, remoteCIArgs(omnix, remoteFlake, resultPath, opts), nil, out)
+
+	// The remote run fails when any step does; that is in the results
+	data, err := ssh.Output(ctx, host, []string{"cat", resultPath})
+	if err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("remote CI run on %s failed: %w", host, runErr)
+		}
+		return nil, fmt.Errorf("failed to fetch results from %s: %w", host, err)
+	}
+	defer func() {
+		// The remote GC roots are no longer needed once the paths are copied
+		// back. Clean up even if the run was cancelled, but don't hang on it.
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), remoteCleanupTimeout)
+		defer cancel()
+		if _, err := ssh.Output(cleanupCtx, host, []string{"rm", "-rf", resultPath, resultPath + ".gcroots"}); err != nil {
+			common.Logger().Warn("failed to clean up remote results", zap.String("host", host), zap.Error(err))
+		}
+	}()
+
+	var results []Result
+	if err := json.Unmarshal([]byte(data), &results); err != nil {
+		return nil, fmt.Errorf("failed to parse results from %s: %w", host, err)
+	}
+	for _, result := range results {
+		for name, step := range result.Steps {
+			step.Host = host
+			result.Steps[name] = step
+		}
+		opts.observe().OnSubflakeEnd(result)
+	}
+
+	if opts.GCRootDir != "" {
+		if err := copyResultsBack(ctx, cmd, uri, results, opts, out); err != nil {
+			return results, err
+		}
+	}
+
+	if err := reportFinished(opts, results); err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
+
+// reportFinished reports the steps of results that ran elsewhere to GitHub
+// Actions, if enabled, and writes the job summary and outputs
+func reportFinished(opts RunOptions, results []Result) error {
+	if !opts.GitHubOutput {
+		return nil
+	}
+
+	github := opts.github
+	if github == nil {
+		github = NewGitHubActionsFromEnv()
+	}
+	for _, result := range results {
+		github.ReportSubflake(result, sortedStepNames(result.Steps))
+	}
+	return github.WriteResults(results)
+}
+
+// flakeSourcePaths returns the store path of the flake source, followed by
+// those of all of its inputs if copyInputs is set
+func flakeSourcePaths(ctx context.Context, cmd *nix.Cmd, flakeURL nix.FlakeURL, copyInputs bool) ([]string, error) {
+	if copyInputs {
+		info, err := flake.Archive(ctx, cmd, flakeURL.String())
+		if err != nil {
+			return nil, err
+		}
+		return info.Paths(), nil
+	}
+
+	metadata, err := flake.GetMetadata(ctx, cmd, flakeURL.String())
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Path == "" {
+		return nil, fmt.Errorf("flake %s has no store path", flakeURL)
+	}
+	return []string{metadata.Path}, nil
+}
+
+// remoteResultPath returns a unique path, relative to the remote user's home
+// directory, for the results of a remote run
+func remoteResultPath() (string, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("failed to generate result path: %w", err)
+	}
+	return "omnix-ci-" + hex.EncodeToString(id[:]) + ".json", nil
+}
+
+// remoteCIArgs returns the command running `om ci run` on a remote host
+func remoteCIArgs(omnix string, flakeURL nix.FlakeURL, resultPath string, opts RunOptions) []string {
+	args := []string{"nix", "--accept-flake-config", "run", omnix, "--", "ci", "run", "--out-link", resultPath}
+
+	if len(opts.Systems) > 0 {
+		args = append(args, "--systems", strings.Join(opts.Systems, ","))
+	}
+	if opts.IncludeAllDependencies {
+		args = append(args, "--include-all-dependencies")
+	}
+	for _, pattern := range opts.Only {
+		args = append(args, "--only", pattern)
+	}
+	for _, pattern := range opts.Exclude {
+		args = append(args, "--exclude", pattern)
+	}
+	if opts.Parallel {
+		args = append(args, "--parallel")
+	}
+	if opts.MaxConcurrency > 0 {
+		args = append(args, "--max-concurrency", strconv.Itoa(opts.MaxConcurrency))
+	}
+	if opts.FailFast {
+		args = append(args, "--fail-fast")
+	}
+	if opts.FailedLogLines > 0 {
+		args = append(args, "--failed-log-lines", strconv.Itoa(opts.FailedLogLines))
+	}
+	if opts.Incremental {
+		args = append(args, "--incremental")
+	}
+
+	return append(args, flakeURL.String())
+}
+
+// copyResultsBack copies the paths built by a remote run to the local store
+// and roots them in opts.GCRootDir
+func copyResultsBack(ctx context.Context, cmd *nix.Cmd, uri *store.URI, results []Result, opts RunOptions, out *nix.OutputStream) error {
+	var paths []string
+	for _, result := range results {
+		for _, path := range builtPaths(result) {
+			paths = append(paths, path.String())
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	out.WriteLine(fmt.Sprintf("Copying %d paths from %s", len(paths), uri))
+	if err := nix.Copy(ctx, cmd, nix.CopyOptions{From: uri}, paths); err != nil {
+		return fmt.Errorf("failed to copy results from %s: %w", uri, err)
+	}
+
+	for _, result := range results {
+		if roots := builtPaths(result); len(roots) > 0 {
+			if err := addGCRoots(ctx, gcRootDir(opts, result.Subflake), roots); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// builtPaths returns the output paths, and their closure when recorded, of
+// the steps of a result, without duplicates
+func builtPaths(result Result) []store.Path {
+	seen := make(map[string]bool)
+	var paths []store.Path
+
+	add := func(list []store.Path) {
+		for _, path := range list {
+			if path.IsOutput() && !seen[path.String()] {
+				seen[path.String()] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	for _, name := range sortedStepNames(result.Steps) {
+		add(result.Steps[name].OutPaths)
+		add(result.Steps[name].Closure)
+	}
+
+	return paths
+}
@@ -1,14 +1,103 @@
 package ci
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/store"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// fakeSSH records the commands run on remote hosts, the ssh command lines
+// OpenSSH would run them with, and the standard input given to Run. Run writes a line of output and returns runErr; `cat` of its
+// out-link returns resultsFor(host, flake) if set, or results (failing if
+// empty); Output returns output for other commands. Every command fails with
+// ErrHostUnavailable on unreachable hosts.
+type fakeSSH struct {
+	mu          sync.Mutex
+	commands    []string
+	sshArgs     [][]string
+	stdins      []string
+	results     string
+	output      string
+	outputFor   func(command []string) string
+	runErr      error
+	resultsFor  func(host, flake string) string
+	unreachable map[string]bool
+	outLinks    map[string]string
+}
+
+func (f *fakeSSH) record(host string, command []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, host+": "+strings.Join(command, " "))
+	f.sshArgs = append(f.sshArgs, sshCommand(host, command))
+	if f.unreachable[host] {
+		return fmt.Errorf("%w: connection refused", ErrHostUnavailable)
+	}
+	return nil
+}
+
+func (f *fakeSSH) Run(ctx context.Context, host string, command []string, stdin io.Reader, out *nix.OutputStream) error {
+	if err := f.record(host, command); err != nil {
+		return err
+	}
+	if stdin != nil {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		f.mu.Lock()
+		f.stdins = append(f.stdins, string(data))
+		f.mu.Unlock()
+	}
+	if f.resultsFor != nil {
+		for i, arg := range command {
+			if arg == "--out-link" {
+				f.mu.Lock()
+				if f.outLinks == nil {
+					f.outLinks = make(map[string]string)
+				}
+				f.outLinks[command[i+1]] = f.resultsFor(host, command[len(command)-1])
+				f.mu.Unlock()
+			}
+		}
+	}
+	out.WriteLine("remote output")
+	return f.runErr
+}
+
+func (f *fakeSSH) Output(ctx context.Context, host string, command []string) (string, error) {
+	if err := f.record(host, command); err != nil {
+		return "", err
+	}
+	if command[0] == "cat" {
+		f.mu.Lock()
+		results, ok := f.outLinks[command[1]]
+		f.mu.Unlock()
+		if ok {
+			return results, nil
+		}
+		if f.results == "" {
+			return "", errors.New("no such file")
+		}
+		return f.results, nil
+	}
+	if f.outputFor != nil {
+		return f.outputFor(command), nil
+	}
+	return f.output, nil
+}
+
 func TestExecuteRemoteCommand(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping SSH test in short mode")
@@ -32,12 +121,11 @@ func TestExecuteRemoteCommand(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			output, err := executeRemoteCommand(ctx, tt.host, tt.command)
+			err := executeRemoteCommand(ctx, OpenSSH{}, tt.host, tt.command, nil, newTestStream(t))
 
 			if tt.shouldError {
 				assert.Error(t, err)
 			} else {
-				_ = output
 				_ = err
 			}
 		})
@@ -51,7 +139,7 @@ func TestExecuteRemoteCommandQuoting(t *testing.T) {
 	command := []string{"echo", "hello world", "--flag=value"}
 
 	// Empty host should return error immediately
-	_, err := executeRemoteCommand(ctx, host, command)
+	err := executeRemoteCommand(ctx, OpenSSH{}, host, command, nil, newTestStream(t))
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "not specified")
 }
@@ -76,7 +164,7 @@ func TestRunBuildStepRemote(t *testing.T) {
 		RemoteHost: "user@remotehost",
 	}
 
-	result := runBuildStepRemote(ctx, opts.RemoteHost, flake, step, opts)
+	result := runBuildStepRemote(ctx, OpenSSH{}, opts.RemoteHost, flake, step, nil, opts, newTestStream(t))
 
 	// Should complete without panic
 	assert.Equal(t, "build", result.Name)
@@ -103,7 +191,7 @@ func TestRunLockfileStepRemote(t *testing.T) {
 		Enable: true,
 	}
 
-	result := runLockfileStepRemote(ctx, "user@host", flake, step)
+	result := runLockfileStepRemote(ctx, OpenSSH{}, "user@host", flake, step, nil, newTestStream(t))
 
 	assert.Equal(t, "lockfile", result.Name)
 	assert.Greater(t, result.Duration.Nanoseconds(), int64(0))
@@ -123,7 +211,7 @@ func TestRunFlakeCheckStepRemote(t *testing.T) {
 		Enable: true,
 	}
 
-	result := runFlakeCheckStepRemote(ctx, "user@host", flake, step)
+	result := runFlakeCheckStepRemote(ctx, OpenSSH{}, "user@host", flake, step, nil, newTestStream(t))
 
 	assert.Equal(t, "flakeCheck", result.Name)
 	assert.Greater(t, result.Duration.Nanoseconds(), int64(0))
@@ -145,7 +233,7 @@ func TestRunCustomStepRemote(t *testing.T) {
 		Command: []string{"echo", "test"},
 	}
 
-	result := runCustomStepRemote(ctx, "user@host", flake, stepName, step)
+	result := runCustomStepRemote(ctx, OpenSSH{}, "user@host", flake, stepName, step, nil, newTestStream(t))
 
 	assert.Equal(t, "custom:custom-test", result.Name)
 	assert.Greater(t, result.Duration.Nanoseconds(), int64(0))
@@ -194,3 +282,161 @@ func TestRunWithRemoteHost(t *testing.T) {
 		assert.Error(t, err)
 	}
 }
+
+func TestShellCommand(t *testing.T) {
+	assert.Equal(t, `echo 'hello world' 'it'\''s'`, shellCommand([]string{"echo", "hello world", "it's"}))
+
+	// Only arguments safe anywhere in a command are left unquoted
+	assert.Equal(t, `nix build /src '/src#default' '$HOME' 'CI=true' '~'`,
+		shellCommand([]string{"nix", "build", "/src", "/src#default", "$HOME", "CI=true", "~"}))
+	assert.Equal(t, `om ci run --systems x86_64-linux '.#default.a b'`, shellCommand([]string{"om", "ci", "run", "--systems", "x86_64-linux", ".#default.a b"}))
+	assert.Equal(t, []string{"ssh", "me@builder", "nix flake check /src"}, sshCommand("me@builder", []string{"nix", "flake", "check", "/src"}))
+}
+
+// setOmnixBuild sets where omnix comes from for the duration of a test, with
+// its source in the store
+func setOmnixBuild(t *testing.T, source, commit string) {
+	oldSource, oldCommit, oldExists := omnixSource, omnixCommit, storePathExists
+	t.Cleanup(func() { omnixSource, omnixCommit, storePathExists = oldSource, oldCommit, oldExists })
+	omnixSource = source
+	SetOmnixCommit(commit)
+	storePathExists = func(path string) bool { return path == source }
+}
+
+func TestOmnixFlakeURL(t *testing.T) {
+	setOmnixBuild(t, "/nix/store/omnix-source", "abc123")
+	assert.Equal(t, "/nix/store/omnix-source", OmnixFlakeURL())
+
+	// Builds without Nix run the commit they were built from
+	setOmnixBuild(t, "", "abc123")
+	assert.Equal(t, "github:saberzero1/omnix/abc123", OmnixFlakeURL())
+
+	for _, commit := range []string{"dev", "abc123-dirty", ""} {
+		setOmnixBuild(t, "", commit)
+		assert.Equal(t, DefaultOmnixFlake, OmnixFlakeURL(), commit)
+	}
+}
+
+func TestRunRemote(t *testing.T) {
+	setOmnixBuild(t, "/nix/store/omnix-source", "")
+	nixLog := installFakeNix(t, `case "$*" in
+  'flake metadata'*) echo '{"path": "/nix/store/aaa-source"}';;
+esac`)
+	storeLog := installFakeCommand(t, "nix-store", "")
+
+	ssh := &fakeSSH{results: `[{"subflake": "main", "success": true, "duration": 0, "steps": {
+		"build": {"name": "build", "success": true, "duration": 0, "outPaths": ["/nix/store/out-hello"]}
+	}}]`}
+
+	uri, err := store.ParseURI("ssh://me@builder")
+	require.NoError(t, err)
+	flake, err := nix.ParseFlakeURL(".#default.main")
+	require.NoError(t, err)
+
+	var terminal bytes.Buffer
+	gcRootDir := t.TempDir()
+	results, err := RunRemote(context.Background(), uri, flake, RunOptions{
+		Systems:     []string{"x86_64-linux"},
+		Parallel:    true,
+		Incremental: true,
+		Exclude:     []string{"nixosConfigurations.*"},
+		GCRootDir:   gcRootDir,
+		SSH:         ssh,
+		Output:      &terminal,
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "main", results[0].Subflake)
+	assert.True(t, results[0].Steps["build"].Success)
+	assert.Contains(t, terminal.String(), "remote output\n")
+
+	// The flake source and omnix are copied over, the built paths back
+	assert.Equal(t, []string{
+		"flake metadata --json .",
+		"copy -v --to ssh://me@builder /nix/store/aaa-source /nix/store/omnix-source",
+		"copy -v --from ssh://me@builder /nix/store/out-hello",
+	}, readFakeNixLog(t, nixLog))
+	assert.Equal(t, []string{
+		"--add-root " + filepath.Join(gcRootDir, "main", "root-0") + " --realise /nix/store/out-hello",
+	}, readFakeNixLog(t, storeLog))
+
+	// om ci runs on the copy, its results are fetched and then removed
+	require.Len(t, ssh.commands, 3)
+	fields := strings.Fields(ssh.commands[0])
+	resultPath := fields[9]
+	assert.Equal(t, "me@builder: nix --accept-flake-config run /nix/store/omnix-source -- ci run --out-link "+resultPath+
+		" --systems x86_64-linux --exclude nixosConfigurations.* --parallel --incremental /nix/store/aaa-source#default.main", ssh.commands[0])
+	assert.Equal(t, "me@builder: cat "+resultPath, ssh.commands[1])
+	assert.Equal(t, "me@builder: rm -rf "+resultPath+" "+resultPath+".gcroots", ssh.commands[2])
+}
+
+func TestRunRemote_MissingOmnixSource(t *testing.T) {
+	setOmnixBuild(t, "/nix/store/omnix-source", "")
+	storePathExists = func(string) bool { return false }
+	installFakeNix(t, `case "$*" in
+  'flake metadata'*) echo '{"path": "/nix/store/aaa-source"}';;
+esac`)
+
+	uri, err := store.ParseURI("ssh://me@builder")
+	require.NoError(t, err)
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	// Nothing runs without the omnix to run
+	ssh := &fakeSSH{}
+	_, err = RunRemote(context.Background(), uri, flake, RunOptions{SSH: ssh})
+	assert.ErrorContains(t, err, "omnix source /nix/store/omnix-source, which remote hosts run omnix from, is no longer in the Nix store")
+	assert.Empty(t, ssh.commands)
+}
+
+func TestRunRemote_CopyInputs(t *testing.T) {
+	setOmnixBuild(t, "", "abc123")
+	nixLog := installFakeNix(t, `case "$*" in
+  'flake archive'*) echo '{"path": "/nix/store/aaa-source", "inputs": {"secret": {"path": "/nix/store/bbb-source"}}}';;
+esac`)
+
+	uri, err := store.ParseURI("ssh://builder?copy-inputs=true")
+	require.NoError(t, err)
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	// Without a GC root directory, nothing is copied back
+	ssh := &fakeSSH{results: `[{"subflake": "main", "success": true, "duration": 0, "steps": {
+		"build": {"name": "build", "success": true, "duration": 0, "outPaths": ["/nix/store/out-hello"]}
+	}}]`}
+	_, err = RunRemote(context.Background(), uri, flake, RunOptions{SSH: ssh})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"flake archive --json .",
+		"copy -v --to ssh://builder /nix/store/aaa-source /nix/store/bbb-source",
+	}, readFakeNixLog(t, nixLog))
+	assert.True(t, strings.HasPrefix(ssh.commands[0], "builder: nix --accept-flake-config run github:saberzero1/omnix/abc123 -- ci run"))
+	assert.True(t, strings.HasSuffix(ssh.commands[0], " /nix/store/aaa-source"))
+}
+
+func TestRunRemote_Failures(t *testing.T) {
+	installFakeNix(t, `case "$*" in
+  'flake metadata'*) echo '{"path": "/nix/store/aaa-source"}';;
+esac`)
+
+	uri, err := store.ParseURI("ssh://builder")
+	require.NoError(t, err)
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	// Failing steps make the remote run fail, but are only reported in the results
+	ssh := &fakeSSH{
+		runErr:  errors.New("exit status 1"),
+		results: `[{"subflake": "main", "success": false, "duration": 0, "steps": {"build": {"name": "build", "success": false, "duration": 0}}}]`,
+	}
+	results, err := RunRemote(context.Background(), uri, flake, RunOptions{SSH: ssh})
+	require.NoError(t, err)
+	assert.Equal(t, StepFailed, results[0].Steps["build"].Status())
+
+	// Without results, the run itself failed
+	ssh = &fakeSSH{runErr: errors.New("connection refused")}
+	_, err = RunRemote(context.Background(), uri, flake, RunOptions{SSH: ssh})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "remote CI run on builder failed: connection refused")
+}
@@ -0,0 +1,17 @@
+// Package report renders CI results in formats understood by other CI systems.
+//
+// Supported formats:
+//   - JUnit XML (GitLab, Jenkins): one testsuite per subflake, one testcase per step
+//   - TAP version 13
+//
+// Example usage:
+//
+//	results, _ := ci.Run(ctx, flake, config, opts)
+//
+//	// Write a single format
+//	report.WriteJUnit(os.Stdout, results)
+//
+//	// Or write the reports requested on the command line
+//	specs, _ := report.ParseSpecs([]string{"junit=junit.xml", "tap=results.tap"})
+//	report.WriteAll(specs, results)
+package report
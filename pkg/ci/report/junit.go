@@ -0,0 +1,125 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/ci"
+)
+
+// junitTestSuites is the root element of a JUnit XML report
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+// junitTestSuite holds the steps of a single subflake
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+// junitTestCase is a single CI step
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+// junitFailure describes why a step failed
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Content string `xml:",chardata"`
+}
+
+// junitSkipped marks a step that did not run
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// WriteJUnit renders results as JUnit XML: one testsuite per subflake and
+// one testcase per step. Skipped and cancelled steps are marked skipped, and
+// allowed failures pass with the error in system-err. Failed steps carry the
+// step error as the failure message and the step output as its body.
+func WriteJUnit(w io.Writer, results []ci.Result) error {
+	root := junitTestSuites{Name: "om ci"}
+	var total time.Duration
+
+	for _, result := range results {
+		suite := junitTestSuite{
+			Name: result.Subflake,
+			Time: seconds(result.Duration),
+		}
+
+		for _, step := range sortedSteps(result) {
+			tc := junitTestCase{
+				Name:      step.Name,
+				ClassName: result.Subflake,
+				Time:      seconds(step.Duration),
+			}
+			switch step.Status() {
+			case ci.StepPassed, ci.StepCached:
+				tc.SystemOut = step.Output
+			case ci.StepWarning:
+				// JUnit has no warnings; keep the test passing but record the error
+				tc.SystemOut = step.Output
+				tc.SystemErr = step.Error
+			case ci.StepSkipped:
+				tc.Skipped = &junitSkipped{Message: step.Output}
+				suite.Skipped++
+			case ci.StepCancelled:
+				tc.Skipped = &junitSkipped{Message: "cancelled: " + step.Error}
+				tc.SystemOut = step.Output
+				suite.Skipped++
+			default:
+				tc.Failure = &junitFailure{
+					Message: step.Error,
+					Type:    "StepFailed",
+					Content: step.Output,
+				}
+				suite.Failures++
+			}
+			suite.TestCases = append(suite.TestCases, tc)
+			suite.Tests++
+		}
+
+		root.Suites = append(root.Suites, suite)
+		root.Tests += suite.Tests
+		root.Failures += suite.Failures
+		root.Skipped += suite.Skipped
+		total += result.Duration
+	}
+	root.Time = seconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(root); err != nil {
+		return fmt.Errorf("failed to encode JUnit XML: %w", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// seconds formats a duration the way JUnit expects (fractional seconds)
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -0,0 +1,101 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/saberzero1/omnix/pkg/ci"
+)
+
+// Format is a report output format
+type Format string
+
+const (
+	// FormatJUnit is JUnit XML
+	FormatJUnit Format = "junit"
+	// FormatTAP is the Test Anything Protocol, version 13
+	FormatTAP Format = "tap"
+)
+
+// Spec requests a report of the given format to be written to Path
+type Spec struct {
+	Format Format
+	Path   string
+}
+
+// ParseSpecs parses report specifications of the form "format=path",
+// e.g. "junit=report.xml".
+func ParseSpecs(values []string) ([]Spec, error) {
+	specs := make([]Spec, 0, len(values))
+	for _, value := range values {
+		format, path, ok := strings.Cut(value, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid report %q: expected format=path", value)
+		}
+
+		switch Format(format) {
+		case FormatJUnit, FormatTAP:
+		default:
+			return nil, fmt.Errorf("unknown report format %q (supported: %s, %s)", format, FormatJUnit, FormatTAP)
+		}
+
+		specs = append(specs, Spec{Format: Format(format), Path: path})
+	}
+	return specs, nil
+}
+
+// Write renders results in the given format
+func Write(w io.Writer, format Format, results []ci.Result) error {
+	switch format {
+	case FormatJUnit:
+		return WriteJUnit(w, results)
+	case FormatTAP:
+		return WriteTAP(w, results)
+	default:
+		return fmt.Errorf("unknown report format %q", format)
+	}
+}
+
+// WriteAll writes one report file per spec
+func WriteAll(specs []Spec, results []ci.Result) error {
+	for _, spec := range specs {
+		if err := writeFile(spec, results); err != nil {
+			return fmt.Errorf("failed to write %s report to %s: %w", spec.Format, spec.Path, err)
+		}
+	}
+	return nil
+}
+
+func writeFile(spec Spec, results []ci.Result) error {
+	f, err := os.Create(spec.Path)
+	if err != nil {
+		return err
+	}
+	if err := Write(f, spec.Format, results); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sortedSteps returns the steps of a result in deterministic order
+func sortedSteps(result ci.Result) []ci.StepResult {
+	names := make([]string, 0, len(result.Steps))
+	for name := range result.Steps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	steps := make([]ci.StepResult, 0, len(names))
+	for _, name := range names {
+		step := result.Steps[name]
+		if step.Name == "" {
+			step.Name = name
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
@@ -0,0 +1,179 @@
+package report
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/ci"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sampleResults() []ci.Result {
+	return []ci.Result{
+		{
+			Subflake: "main",
+			Duration: 3 * time.Second,
+			Steps: map[string]ci.StepResult{
+				"build":    {Name: "build", Success: true, Output: "Built 1 outputs", Duration: 2 * time.Second},
+				"lockfile": {Name: "lockfile", Success: false, Error: "flake.lock is out of date", Output: "input 'nixpkgs' changed", Duration: 1500 * time.Millisecond},
+			},
+		},
+		{
+			Subflake: "docs",
+			Duration: time.Second,
+			Steps: map[string]ci.StepResult{
+				"flakeCheck": {Name: "flakeCheck", Success: true, Duration: time.Second},
+			},
+		},
+	}
+}
+
+func TestParseSpecs(t *testing.T) {
+	specs, err := ParseSpecs([]string{"junit=out/junit.xml", "tap=results.tap"})
+	require.NoError(t, err)
+	assert.Equal(t, []Spec{
+		{Format: FormatJUnit, Path: "out/junit.xml"},
+		{Format: FormatTAP, Path: "results.tap"},
+	}, specs)
+
+	_, err = ParseSpecs([]string{"junit"})
+	assert.Error(t, err)
+
+	_, err = ParseSpecs([]string{"junit="})
+	assert.Error(t, err)
+
+	_, err = ParseSpecs([]string{"html=report.html"})
+	assert.ErrorContains(t, err, "unknown report format")
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteJUnit(&buf, sampleResults()))
+
+	var decoded junitTestSuites
+	require.NoError(t, xml.Unmarshal(buf.Bytes(), &decoded))
+
+	assert.Equal(t, 3, decoded.Tests)
+	assert.Equal(t, 1, decoded.Failures)
+	require.Len(t, decoded.Suites, 2)
+
+	main := decoded.Suites[0]
+	assert.Equal(t, "main", main.Name)
+	assert.Equal(t, 2, main.Tests)
+	assert.Equal(t, 1, main.Failures)
+	require.Len(t, main.TestCases, 2)
+
+	build := main.TestCases[0]
+	assert.Equal(t, "build", build.Name)
+	assert.Equal(t, "main", build.ClassName)
+	assert.Equal(t, "2.000", build.Time)
+	assert.Nil(t, build.Failure)
+
+	lockfile := main.TestCases[1]
+	assert.Equal(t, "lockfile", lockfile.Name)
+	assert.Equal(t, "1.500", lockfile.Time)
+	require.NotNil(t, lockfile.Failure)
+	assert.Equal(t, "flake.lock is out of date", lockfile.Failure.Message)
+	assert.Equal(t, "input 'nixpkgs' changed", lockfile.Failure.Content)
+}
+
+func TestWriteTAP(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteTAP(&buf, sampleResults()))
+
+	assert.Equal(t, `TAP version 13
+1..3
+ok 1 - main: build
+not ok 2 - main: lockfile
+  ---
+  message: flake.lock is out of date
+  output: input 'nixpkgs' changed
+  duration_ms: 1500
+  ...
+ok 3 - docs: flakeCheck
+`, buf.String())
+}
+
+func skippedResults() []ci.Result {
+	return []ci.Result{
+		{
+			Subflake: "main",
+			Steps: map[string]ci.StepResult{
+				"build":       {Name: "build", Success: false, Error: "build failed"},
+				"custom:test": {Name: "custom:test", Skipped: true, Output: "skipped because build did not succeed"},
+				"custom:lint": {Name: "custom:lint", AllowedFailure: true, Error: "lint failed"},
+				"flakeCheck":  {Name: "flakeCheck", Success: true, Cached: true, Output: "cached"},
+			},
+		},
+	}
+}
+
+func TestWriteJUnit_Skipped(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteJUnit(&buf, skippedResults()))
+
+	var decoded junitTestSuites
+	require.NoError(t, xml.Unmarshal(buf.Bytes(), &decoded))
+
+	assert.Equal(t, 1, decoded.Failures)
+	assert.Equal(t, 1, decoded.Skipped)
+
+	// Allowed failures pass, with the error recorded
+	lint := decoded.Suites[0].TestCases[1]
+	assert.Equal(t, "custom:lint", lint.Name)
+	assert.Nil(t, lint.Failure)
+	assert.Equal(t, "lint failed", lint.SystemErr)
+
+	test := decoded.Suites[0].TestCases[2]
+	assert.Equal(t, "custom:test", test.Name)
+	assert.Nil(t, test.Failure)
+	require.NotNil(t, test.Skipped)
+	assert.Equal(t, "skipped because build did not succeed", test.Skipped.Message)
+
+	// Cached steps pass
+	check := decoded.Suites[0].TestCases[3]
+	assert.Nil(t, check.Failure)
+	assert.Nil(t, check.Skipped)
+	assert.Equal(t, "cached", check.SystemOut)
+}
+
+func TestWriteTAP_Skipped(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteTAP(&buf, skippedResults()))
+
+	assert.Contains(t, buf.String(), "not ok 2 - main: custom:lint # TODO allowed failure\n")
+	assert.Contains(t, buf.String(), "ok 3 - main: custom:test # SKIP skipped because build did not succeed\n")
+	assert.Contains(t, buf.String(), "ok 4 - main: flakeCheck # SKIP cached\n")
+}
+
+func TestWriteTAP_Empty(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteTAP(&buf, nil))
+	assert.Equal(t, "TAP version 13\n1..0\n", buf.String())
+}
+
+func TestWriteAll(t *testing.T) {
+	dir := t.TempDir()
+	specs := []Spec{
+		{Format: FormatJUnit, Path: filepath.Join(dir, "junit.xml")},
+		{Format: FormatTAP, Path: filepath.Join(dir, "results.tap")},
+	}
+
+	require.NoError(t, WriteAll(specs, sampleResults()))
+
+	junit, err := os.ReadFile(specs[0].Path)
+	require.NoError(t, err)
+	assert.Contains(t, string(junit), `<testsuite name="main"`)
+
+	tap, err := os.ReadFile(specs[1].Path)
+	require.NoError(t, err)
+	assert.Contains(t, string(tap), "TAP version 13")
+
+	err = WriteAll([]Spec{{Format: FormatTAP, Path: filepath.Join(dir, "missing", "x.tap")}}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,76 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/saberzero1/omnix/pkg/ci"
+	"gopkg.in/yaml.v3"
+)
+
+// tapDiagnostic is the YAML block attached to failed TAP test points
+type tapDiagnostic struct {
+	Message    string `yaml:"message,omitempty"`
+	Output     string `yaml:"output,omitempty"`
+	DurationMS int64  `yaml:"duration_ms"`
+}
+
+// WriteTAP renders results as TAP version 13, one test point per step.
+// Skipped and cancelled steps use the SKIP directive and allowed failures
+// the TODO directive, so that TAP consumers don't count them as failures.
+// Failed steps include a YAML diagnostic block with the error and output.
+func WriteTAP(w io.Writer, results []ci.Result) error {
+	var b strings.Builder
+
+	total := 0
+	for _, result := range results {
+		total += len(result.Steps)
+	}
+
+	b.WriteString("TAP version 13\n")
+	fmt.Fprintf(&b, "1..%d\n", total)
+
+	n := 0
+	for _, result := range results {
+		for _, step := range sortedSteps(result) {
+			n++
+			switch step.Status() {
+			case ci.StepPassed:
+				fmt.Fprintf(&b, "ok %d - %s: %s\n", n, result.Subflake, step.Name)
+				continue
+			case ci.StepSkipped:
+				fmt.Fprintf(&b, "ok %d - %s: %s # SKIP %s\n", n, result.Subflake, step.Name, step.Output)
+				continue
+			case ci.StepCancelled:
+				fmt.Fprintf(&b, "ok %d - %s: %s # SKIP cancelled\n", n, result.Subflake, step.Name)
+				continue
+			case ci.StepCached:
+				fmt.Fprintf(&b, "ok %d - %s: %s # SKIP cached\n", n, result.Subflake, step.Name)
+				continue
+			}
+			if step.Status() == ci.StepWarning {
+				fmt.Fprintf(&b, "not ok %d - %s: %s # TODO allowed failure\n", n, result.Subflake, step.Name)
+			} else {
+				fmt.Fprintf(&b, "not ok %d - %s: %s\n", n, result.Subflake, step.Name)
+			}
+
+			diag, err := yaml.Marshal(tapDiagnostic{
+				Message:    step.Error,
+				Output:     step.Output,
+				DurationMS: step.Duration.Milliseconds(),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to encode TAP diagnostic: %w", err)
+			}
+			b.WriteString("  ---\n")
+			for _, line := range strings.Split(strings.TrimRight(string(diag), "\n"), "\n") {
+				b.WriteString("  " + line + "\n")
+			}
+			b.WriteString("  ...\n")
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
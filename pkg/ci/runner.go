@@ -3,11 +3,17 @@ package ci
 import (
 	"context"
 	"fmt"
-	"os/exec"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/saberzero1/omnix/pkg/common"
 	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/flake"
+	"github.com/saberzero1/omnix/pkg/nix/store"
 	"go.uber.org/zap"
 )
 
@@ -42,17 +48,83 @@ type RunOptions struct {
 	// GitHubOutput controls whether to print GitHub Actions log groups
 	GitHubOutput bool
 
-	// IncludeAllDependencies includes all dependencies in results
+	// IncludeAllDependencies records the full runtime and build-time closure
+	// of the built outputs in the build step result
 	IncludeAllDependencies bool
 
+	// Only restricts the build step to the outputs matching one of these
+	// attribute patterns, replacing BuildStep.Include (--only)
+	Only []string
+
+	// Exclude skips the outputs matching one of these attribute patterns in
+	// the build step, in addition to BuildStep.Exclude (--exclude)
+	Exclude []string
+
+	// GCRootDir is the directory for indirect GC roots of the built paths, as
+	// <GCRootDir>/<subflake>/root* (empty = no GC roots). With
+	// IncludeAllDependencies, the whole closure is rooted.
+	GCRootDir string
+
 	// RemoteHost specifies a remote host for SSH-based builds (e.g., "user@host")
 	RemoteHost string
 
+	// SSH runs commands on remote hosts (nil = OpenSSH)
+	SSH SSH
+
 	// Parallel controls whether to run steps in parallel
 	Parallel bool
 
 	// MaxConcurrency limits the number of parallel steps (0 = unlimited)
 	MaxConcurrency int
+
+	// Output receives step output live, line by line (nil = not echoed).
+	// Lines are prefixed with "[subflake/step]" when running in parallel.
+	Output io.Writer
+
+	// LogDir is the directory for per-step log files (empty = no log files)
+	LogDir string
+
+	// FailFast cancels all running and pending steps after the first failure
+	FailFast bool
+
+	// Observer receives the events of the run as they happen (nil = none)
+	Observer Observer
+
+	// FailedLogLines is the number of build log lines kept for each failed
+	// derivation (0 = DefaultFailedLogLines)
+	FailedLogLines int
+
+	// Incremental skips the steps that passed before with the same flake
+	// source, step configuration and omnix version, reporting them as cached
+	Incremental bool
+
+	// StateDir is the directory recording passed steps for Incremental, and
+	// the baselines of the closure size step (empty = DefaultStateDir())
+	StateDir string
+
+	// OmnixVersion identifies the running omnix in the state of Incremental
+	// runs; steps are not cached across versions
+	OmnixVersion string
+
+	// observer delivers the events of Observer one at a time; set by the
+	// entry points (Run, RunRemote and RunPool)
+	observer Observer
+
+	// github reports progress to GitHub Actions; set by Run when GitHubOutput is enabled
+	github *GitHubActions
+
+	// stepSlots limits the number of steps running at once across all
+	// subflakes; set by Run when running in parallel with MaxConcurrency
+	stepSlots chan struct{}
+
+	// abort cancels the run; set by Run when FailFast is enabled
+	abort context.CancelFunc
+
+	// state records passed steps; set by Run when Incremental is enabled
+	state *stateStore
+
+	// outputPrefix prefixes the output of RunRemote; set by RunPool
+	outputPrefix string
 }
 
 // Result represents the result of a CI run
@@ -60,6 +132,9 @@ type Result struct {
 	// Subflake is the name of the subflake
 	Subflake string `json:"subflake"`
 
+	// System is the system the subflake was built for, when run by RunPool
+	System string `json:"system,omitempty"`
+
 	// Steps contains results for each step
 	Steps map[string]StepResult `json:"steps"`
 
@@ -78,241 +153,514 @@ type StepResult struct {
 	// Success indicates if the step passed
 	Success bool `json:"success"`
 
+	// Skipped indicates the step did not run because a dependency did not succeed
+	Skipped bool `json:"skipped,omitempty"`
+
+	// Cancelled indicates the step was killed because the run was aborted
+	Cancelled bool `json:"cancelled,omitempty"`
+
+	// Cached indicates the step did not run because it passed before with
+	// the same source and configuration (see RunOptions.Incremental)
+	Cached bool `json:"cached,omitempty"`
+
+	// AllowedFailure indicates the step failed, but its allowFailure policy
+	// turns the failure into a warning
+	AllowedFailure bool `json:"allowedFailure,omitempty"`
+
+	// Attempts records every attempt at running the step, including retries
+	Attempts []StepAttempt `json:"attempts,omitempty"`
+
 	// Error contains error message if step failed
 	Error string `json:"error,omitempty"`
 
-	// Output contains step output
+	// Output contains the last lines of step output; see LogFile for all of it
 	Output string `json:"output,omitempty"`
 
+	// LogFile is the path of the file holding the complete step output
+	LogFile string `json:"logFile,omitempty"`
+
 	// Duration is how long the step took
 	Duration time.Duration `json:"duration"`
+
+	// OverrideInputs records the input overrides that were in effect for this step
+	OverrideInputs map[string]string `json:"overrideInputs,omitempty"`
+
+	// Host is the remote host that ran the step, if any
+	Host string `json:"host,omitempty"`
+
+	// Attrs lists the flake attributes built or evaluated by this step
+	// (custom build and eval steps, and build steps with include/exclude
+	// filters on a remote host)
+	Attrs []string `json:"attrs,omitempty"`
+
+	// Attributes records the outcome of each output attribute built by this
+	// step: built, failed or dependency-failed. Only local builds record it.
+	Attributes []AttrResult `json:"attributes,omitempty"`
+
+	// OutPaths lists the store paths built by this step (build step and
+	// custom build steps only)
+	OutPaths []store.Path `json:"outPaths,omitempty"`
+
+	// Closure lists all runtime and build-time dependencies of OutPaths
+	// (build step with IncludeAllDependencies only)
+	Closure []store.Path `json:"closure,omitempty"`
+
+	// Pushed records the outcome of every path pushed (push step only)
+	Pushed []PushedPath `json:"pushed,omitempty"`
+
+	// ClosureSizes records the closure size of every output measured
+	// (closure size step only)
+	ClosureSizes []ClosureSize `json:"closureSizes,omitempty"`
+
+	// FailedDerivations holds the derivations whose builder failed in a
+	// failed step, with the end of their build logs
+	FailedDerivations []FailedDerivation `json:"failedDerivations,omitempty"`
+
+	// DerivationBuilds records how long every derivation built by this step
+	// took, in the order they finished (local build steps only)
+	DerivationBuilds []nix.DerivationBuild `json:"derivationBuilds,omitempty"`
+}
+
+// Step statuses, as returned by StepResult.Status
+const (
+	StepPassed    = "passed"
+	StepFailed    = "failed"
+	StepSkipped   = "skipped"
+	StepWarning   = "warning"
+	StepCancelled = "cancelled"
+	StepCached    = "cached"
+)
+
+// Status returns whether the step passed, failed, was skipped, was
+// cancelled, was cached, or failed with its failure allowed (a warning).
+func (r StepResult) Status() string {
+	switch {
+	case r.Skipped:
+		return StepSkipped
+	case r.Cached:
+		return StepCached
+	case r.Success:
+		return StepPassed
+	case r.Cancelled:
+		return StepCancelled
+	case r.AllowedFailure:
+		return StepWarning
+	default:
+		return StepFailed
+	}
 }
 
-// Run executes the CI pipeline for a flake
+// Run executes the CI pipeline for a flake: it plans the run with NewPlan,
+// and runs the plan with RunPlan.
+//
+// Step failures are reported in the results. A *RunError is returned when
+// subflakes could not run to completion; the results of everything that ran
+// are returned regardless.
 func Run(ctx context.Context, flake nix.FlakeURL, config Config, opts RunOptions) ([]Result, error) {
-	// Collect subflakes to run
-	var subflakes []struct {
-		name   string
-		config SubflakeConfig
+	plan, err := NewPlan(flake, config, opts)
+	if err != nil {
+		return nil, err
 	}
+	return RunPlan(ctx, plan, opts)
+}
 
-	for name, subflake := range config.Default {
-		// Skip if marked to skip
-		if subflake.Skip {
-			continue
-		}
+// RunPlan runs a plan made by NewPlan, with the options it was made with.
+// See Run for the results and errors returned.
+func RunPlan(ctx context.Context, plan Plan, opts RunOptions) ([]Result, error) {
+	opts = opts.withObserver()
 
-		// Skip if can't run on requested systems
-		if !subflake.CanRunOn(opts.Systems) {
-			continue
-		}
+	if opts.Parallel && opts.MaxConcurrency > 0 && opts.stepSlots == nil {
+		opts.stepSlots = make(chan struct{}, opts.MaxConcurrency)
+	}
+
+	if opts.GitHubOutput && opts.github == nil {
+		opts.github = NewGitHubActionsFromEnv()
+	}
 
-		subflakes = append(subflakes, struct {
-			name   string
-			config SubflakeConfig
-		}{name, subflake})
+	if opts.FailFast {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		opts.abort = cancel
+	}
+
+	if opts.Incremental && opts.state == nil {
+		stateDir := opts.StateDir
+		if stateDir == "" {
+			var err error
+			if stateDir, err = DefaultStateDir(); err != nil {
+				return nil, err
+			}
+		}
+		opts.state = newStateStore(stateDir)
 	}
 
 	// Run sequentially or in parallel based on opts
+	var results []Result
 	if opts.Parallel {
-		return runSubflakesParallel(ctx, flake, subflakes, opts)
+		results = runSubflakesParallel(ctx, plan.Subflakes, opts)
+	} else {
+		results = runSubflakesSequential(ctx, plan.Subflakes, opts)
 	}
+	err := newRunError(results, nil, ctx.Err() != nil)
 
-	return runSubflakesSequential(ctx, flake, subflakes, opts)
+	if opts.github != nil {
+		if ghErr := opts.github.WriteResults(results); ghErr != nil && err == nil {
+			err = ghErr
+		}
+	}
+
+	return results, err
 }
 
-// runSubflakesSequential runs subflakes one after another
-func runSubflakesSequential(ctx context.Context, flake nix.FlakeURL, subflakes []struct {
-	name   string
-	config SubflakeConfig
-}, opts RunOptions) ([]Result, error) {
+// runSubflakesSequential runs subflakes one after another, stopping early
+// if the run is aborted. It returns the results of the subflakes that ran.
+func runSubflakesSequential(ctx context.Context, subflakes []SubflakePlan, opts RunOptions) []Result {
 	var results []Result
-
-	for _, sf := range subflakes {
-		result, err := runSubflake(ctx, flake, sf.name, sf.config, opts)
-		if err != nil {
-			return results, fmt.Errorf("failed to run subflake %s: %w", sf.name, err)
+	for _, subflake := range subflakes {
+		if ctx.Err() != nil {
+			break
 		}
-
-		results = append(results, result)
+		results = append(results, runSubflake(ctx, subflake, opts))
 	}
-
-	return results, nil
+	return results
 }
 
-// runSubflakesParallel runs subflakes in parallel
-func runSubflakesParallel(ctx context.Context, flake nix.FlakeURL, subflakes []struct {
-	name   string
-	config SubflakeConfig
-}, opts RunOptions) ([]Result, error) {
+// runSubflakesParallel runs subflakes in parallel. Subflakes that have not
+// started when the run is aborted are left out of the results.
+func runSubflakesParallel(ctx context.Context, subflakes []SubflakePlan, opts RunOptions) []Result {
 	// Determine concurrency limit
 	maxConcurrency := opts.MaxConcurrency
 	if maxConcurrency <= 0 {
 		maxConcurrency = len(subflakes)
 	}
 
-	// Create channels for work distribution
-	type job struct {
-		index  int
-		name   string
-		config SubflakeConfig
-	}
-
 	type jobResult struct {
 		index  int
 		result Result
-		err    error
+		ran    bool
 	}
 
-	jobs := make(chan job, len(subflakes))
+	jobs := make(chan int, len(subflakes))
 	jobResults := make(chan jobResult, len(subflakes))
 
 	// Start worker goroutines
 	for w := 0; w < maxConcurrency; w++ {
 		go func() {
-			for j := range jobs {
-				result, err := runSubflake(ctx, flake, j.name, j.config, opts)
+			for i := range jobs {
+				if ctx.Err() != nil {
+					jobResults <- jobResult{index: i}
+					continue
+				}
 				jobResults <- jobResult{
-					index:  j.index,
-					result: result,
-					err:    err,
+					index:  i,
+					result: runSubflake(ctx, subflakes[i], opts),
+					ran:    true,
 				}
 			}
 		}()
 	}
 
 	// Queue all jobs
-	for i, sf := range subflakes {
-		jobs <- job{
-			index:  i,
-			name:   sf.name,
-			config: sf.config,
-		}
+	for i := range subflakes {
+		jobs <- i
 	}
 	close(jobs)
 
 	// Collect results
-	resultsMap := make(map[int]Result)
-	var firstError error
-
+	resultsMap := make(map[int]jobResult)
 	for i := 0; i < len(subflakes); i++ {
 		jr := <-jobResults
-		if jr.err != nil && firstError == nil {
-			firstError = jr.err
-		}
-		resultsMap[jr.index] = jr.result
-	}
-
-	// Return error if any occurred
-	if firstError != nil {
-		return nil, firstError
+		resultsMap[jr.index] = jr
 	}
 
 	// Sort results by original order
-	results := make([]Result, len(subflakes))
+	var results []Result
 	for i := 0; i < len(subflakes); i++ {
-		results[i] = resultsMap[i]
+		if jr := resultsMap[i]; jr.ran {
+			results = append(results, jr.result)
+		}
 	}
-
-	return results, nil
+	return results
 }
 
-// runSubflake runs CI for a single subflake
-func runSubflake(ctx context.Context, flake nix.FlakeURL, name string, subflake SubflakeConfig, opts RunOptions) (Result, error) {
+// runSubflake runs the planned steps of a subflake
+func runSubflake(ctx context.Context, plan SubflakePlan, opts RunOptions) Result {
 	start := time.Now()
 
+	name, subflake := plan.Name, plan.config
 	result := Result{
 		Subflake: name,
 		Steps:    make(map[string]StepResult),
 		Success:  true,
 	}
+	observer := opts.observe()
+	observer.OnSubflakeStart(name)
+
+	subflakeURL := plan.url
+	host := plan.Host
+	overrides := plan.OverrideInputs
+
+	// Sequential runs stream straight into the log group of the subflake;
+	// parallel runs would interleave groups, so they are reported once
+	// finished.
+	grouped := opts.github != nil && !opts.Parallel
+	if grouped {
+		opts.github.BeginSubflake(name)
+	}
 
-	// Get the subflake URL
-	subflakeURL := flake
-	if subflake.Dir != "." {
-		urlStr := flake.String() + "#" + subflake.Dir
+	// Incremental runs look up steps by the narHash of the subflake source,
+	// and of its local override inputs
+	var narHash string
+	var overrideHashes map[string]string
+	if opts.state != nil {
 		var err error
-		subflakeURL, err = nix.ParseFlakeURL(urlStr)
+		narHash, err = lockedNarHash(ctx, subflakeURL)
+		if err == nil {
+			overrideHashes, err = localOverrideHashes(ctx, overrides)
+		}
 		if err != nil {
-			return result, fmt.Errorf("failed to parse subflake URL: %w", err)
+			narHash = ""
+			common.Logger().Warn("Cannot skip unchanged steps, running all of them",
+				zap.String("subflake", name), zap.Error(err))
 		}
 	}
 
-	// Run build step
-	if subflake.Steps.Build.Enable {
-		var stepResult StepResult
-		if opts.RemoteHost != "" {
-			stepResult = runBuildStepRemote(ctx, opts.RemoteHost, subflakeURL, subflake.Steps.Build, opts)
-		} else {
-			stepResult = runBuildStep(ctx, subflakeURL, subflake.Steps.Build, opts)
-		}
-		result.Steps["build"] = stepResult
-		if !stepResult.Success {
-			result.Success = false
+	// mu guards result, which steps may update concurrently
+	var mu sync.Mutex
+
+	// runStepOnce makes a single attempt at running a step
+	runStepOnce := func(ctx context.Context, key string, out *nix.OutputStream) StepResult {
+		switch key {
+		case "build":
+			if host != "" {
+				return runBuildStepRemote(ctx, opts.sshClient(), host, subflakeURL, subflake.Steps.Build, overrides, opts, out)
+			}
+			return runBuildStep(ctx, subflakeURL, subflake.Steps.Build, overrides, opts, gcRootDir(opts, name), out)
+		case "lockfile":
+			if host != "" {
+				return runLockfileStepRemote(ctx, opts.sshClient(), host, subflakeURL, subflake.Steps.Lockfile, overrides, out)
+			}
+			return runLockfileStep(ctx, subflakeURL, subflake.Steps.Lockfile, overrides, out)
+		case "flakeCheck":
+			if host != "" {
+				return runFlakeCheckStepRemote(ctx, opts.sshClient(), host, subflakeURL, subflake.Steps.FlakeCheck, overrides, out)
+			}
+			return runFlakeCheckStep(ctx, subflakeURL, subflake.Steps.FlakeCheck, overrides, out)
+		case "push":
+			if host != "" {
+				return StepResult{Name: key, Error: "the push step is not supported with --remote"}
+			}
+			// The push step depends on the build step, which has finished
+			mu.Lock()
+			build := result.Steps["build"]
+			mu.Unlock()
+			return runPushStep(ctx, subflake.Steps.Push, build, out)
+		case "closureSize":
+			measure := localClosureMeasurer(subflakeURL, overrides, out)
+			if host != "" {
+				measure = remoteClosureMeasurer(opts.sshClient(), host, subflakeURL, overrides)
+			}
+			return runClosureSizeStep(ctx, measure, subflake.Steps.ClosureSize, newClosureBaselines(opts, name), out)
+		default:
+			stepName := strings.TrimPrefix(key, "custom:")
+			customStep := subflake.Steps.Custom[stepName]
+			if host != "" {
+				return runCustomStepRemote(ctx, opts.sshClient(), host, subflakeURL, stepName, customStep, overrides, out)
+			}
+			return runCustomStep(ctx, subflakeURL, stepName, customStep, overrides, out)
 		}
 	}
 
-	// Run lockfile step
-	if subflake.Steps.Lockfile.Enable {
-		var stepResult StepResult
-		if opts.RemoteHost != "" {
-			stepResult = runLockfileStepRemote(ctx, opts.RemoteHost, subflakeURL, subflake.Steps.Lockfile)
-		} else {
-			stepResult = runLockfileStep(ctx, subflakeURL, subflake.Steps.Lockfile)
+	// runStep executes a step with its output streamed to the terminal and
+	// its log file, keeping only the tail of the output in the result
+	runStep := func(key string) StepResult {
+		var cacheKey stateKey
+		if narHash != "" {
+			cacheKey = newStateKey(narHash, overrideHashes, name, subflake, key, opts)
+			if cached, ok := opts.state.lookup(cacheKey); ok {
+				return cached
+			}
 		}
-		result.Steps["lockfile"] = stepResult
-		if !stepResult.Success {
-			result.Success = false
+
+		observer.OnStepStart(name, key)
+		events, stopEvents := observeActivity(observer, name, key)
+		var progress *nix.BuildProgress
+		if recordsBuilds(host, key) {
+			progress = nix.NewBuildProgress()
+			events, stopEvents = recordBuilds(progress, events, stopEvents)
 		}
-	}
+		out, err := newStepStream(opts, name, key, events)
+		if err != nil {
+			stopEvents()
+			return StepResult{Name: key, Error: err.Error()}
+		}
+		stopObserving := out.Watch(func(line string) {
+			observer.OnOutput(name, key, line)
+		})
 
-	// Run flake check step
-	if subflake.Steps.FlakeCheck.Enable {
-		var stepResult StepResult
-		if opts.RemoteHost != "" {
-			stepResult = runFlakeCheckStepRemote(ctx, opts.RemoteHost, subflakeURL, subflake.Steps.FlakeCheck)
-		} else {
-			stepResult = runFlakeCheckStep(ctx, subflakeURL, subflake.Steps.FlakeCheck)
+		if grouped {
+			opts.github.BeginStep(name, key)
 		}
-		result.Steps["flakeCheck"] = stepResult
-		if !stepResult.Success {
-			result.Success = false
+
+		// Failed derivations are looked for in the whole output, as the
+		// error only quotes its tail
+		failures := &nix.BuildFailures{}
+		stopWatching := out.Watch(failures.AddLine)
+		onRetry := func(failed StepAttempt, backoff time.Duration) {
+			observer.OnRetry(name, key, failed, backoff)
+		}
+		stepResult := runWithPolicy(ctx, subflake.Steps.stepPolicy(key), out, onRetry, func(ctx context.Context) StepResult {
+			return runStepOnce(ctx, key, out)
+		})
+		stopWatching()
+
+		if !stepResult.Success && ctx.Err() != nil {
+			stepResult.Cancelled = true
+		}
+		if !stepResult.Success && !stepResult.Cancelled {
+			for _, line := range strings.Split(stepResult.Error, "\n") {
+				failures.AddLine(line)
+			}
+			if len(failures.Failed) > 0 {
+				stepResult.FailedDerivations = fetchFailedDerivations(ctx, opts.sshClient(), host, failures.Failed, opts.FailedLogLines, out)
+			}
+		}
+
+		// Errors may quote the output, and with it secrets
+		stepResult.Error = out.Redacted(stepResult.Error)
+		for i := range stepResult.Attempts {
+			stepResult.Attempts[i].Error = out.Redacted(stepResult.Attempts[i].Error)
 		}
+		stepResult.Output = out.Tail()
+		stepResult.LogFile = out.LogPath()
+		stopEvents()
+		if progress != nil {
+			stepResult.DerivationBuilds = progress.Builds()
+		}
+		stopObserving()
+		if err := out.Close(); err != nil {
+			common.Logger().Warn("failed to close step log", zap.String("step", key), zap.Error(err))
+		}
+
+		if grouped {
+			opts.github.EndStep(name, key, stepResult)
+		}
+
+		if narHash != "" && stepResult.Status() == StepPassed {
+			if err := opts.state.record(cacheKey, stepResult); err != nil {
+				common.Logger().Warn("failed to record step state", zap.String("step", key), zap.Error(err))
+			}
+		}
+		return stepResult
 	}
 
-	// Run custom steps
-	for name, customStep := range subflake.Steps.Custom {
-		// Check if this step can run on current systems
-		if !customStep.CanRunOn(opts.Systems) {
-			continue
+	// done records a step result; steps may finish concurrently
+	done := func(key string, stepResult StepResult) {
+		if grouped && (stepResult.Skipped || stepResult.Cached) {
+			opts.github.EndStep(name, key, stepResult)
 		}
 
-		var stepResult StepResult
-		if opts.RemoteHost != "" {
-			stepResult = runCustomStepRemote(ctx, opts.RemoteHost, subflakeURL, name, customStep)
-		} else {
-			stepResult = runCustomStep(ctx, subflakeURL, name, customStep)
+		// With FailFast, the first failure cancels everything still running
+		status := stepResult.Status()
+		if status == StepFailed && opts.abort != nil {
+			opts.abort()
 		}
-		result.Steps["custom:"+name] = stepResult
-		if !stepResult.Success {
+
+		observer.OnStepEnd(name, key, stepResult)
+
+		mu.Lock()
+		defer mu.Unlock()
+		result.Steps[key] = stepResult
+		if status == StepFailed || status == StepCancelled {
 			result.Success = false
 		}
 	}
 
+	graph := plan.graph()
+	graph.run(ctx, opts.Parallel, opts.stepSlots, runStep, done)
+
 	result.Duration = time.Since(start)
-	return result, nil
+	if grouped {
+		opts.github.EndSubflake()
+	} else if opts.github != nil {
+		opts.github.ReportSubflake(result, graph.order)
+	}
+	observer.OnSubflakeEnd(result)
+	return result
+}
+
+// recordsBuilds tells whether a step records the derivations it builds
+// (StepResult.DerivationBuilds): local build steps do, following the log
+// events of their nix commands whether or not the observer does
+func recordsBuilds(host, key string) bool {
+	return host == "" && key == "build"
+}
+
+// newStepStream creates the output stream for a step: echoed to opts.Output
+// and written to <LogDir>/<subflake>/<step>.log when a log directory is set.
+// The nix commands of the step send their log events to events, if not nil.
+func newStepStream(opts RunOptions, subflake, step string, events chan<- nix.LogEvent) (*nix.OutputStream, error) {
+	streamOpts := nix.StreamOptions{
+		Terminal:  opts.Output,
+		LogEvents: events,
+	}
+	if opts.Parallel {
+		streamOpts.Prefix = fmt.Sprintf("[%s/%s] ", subflake, step)
+		// The output is reported in the log group of the subflake instead
+		if opts.github != nil {
+			streamOpts.Terminal = nil
+		}
+	}
+	if opts.LogDir != "" {
+		streamOpts.LogFile = filepath.Join(opts.LogDir, logFileName(subflake), logFileName(step)+".log")
+	}
+
+	return nix.NewOutputStream(streamOpts)
+}
+
+// logFileName turns a subflake or step name into a safe file name
+func logFileName(name string) string {
+	if name == "." || name == "" {
+		return "root"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
 }
 
-// runBuildStep executes the build step using devour-flake
-func runBuildStep(ctx context.Context, flake nix.FlakeURL, step BuildStep, opts RunOptions) StepResult {
+// runBuildStep executes the build step using devour-flake. The built paths
+// (and their closure, with IncludeAllDependencies) are rooted in gcRoot
+// unless it is empty.
+func runBuildStep(ctx context.Context, flake nix.FlakeURL, step BuildStep, overrides map[string]string, opts RunOptions, gcRoot string, out *nix.OutputStream) StepResult {
 	start := time.Now()
 	result := StepResult{
-		Name:    "build",
-		Success: true,
+		Name:           "build",
+		Success:        true,
+		OverrideInputs: overrides,
+	}
+
+	filter, err := newAttrFilter(step, opts)
+	if err != nil {
+		result.Success = false
+		result.Error = err.Error()
+		result.Duration = time.Since(start)
+		return result
 	}
 
-	// Use devour-flake to build all outputs
-	output, err := nix.DevourFlake(ctx, flake, opts.Systems, step.Impure)
+	if filter.active() {
+		// Build the selected outputs one by one
+		result.Attributes, err = buildSelectedOutputs(ctx, flake, step, filter, overrides, opts, out)
+		result.OutPaths = attrOutPaths(result.Attributes)
+	} else {
+		// Use devour-flake to build all outputs
+		result.Attributes, result.OutPaths, err = devourBuild(ctx, flake, step, overrides, opts, out)
+	}
 	if err != nil {
 		result.Success = false
 		result.Error = err.Error()
@@ -320,125 +668,300 @@ func runBuildStep(ctx context.Context, flake nix.FlakeURL, step BuildStep, opts
 		return result
 	}
 
-	// Format output paths as string
-	var outPaths []string
-	for _, path := range output.OutPaths {
-		outPaths = append(outPaths, path.String())
+	out.WriteLine(fmt.Sprintf("Built %d outputs:", len(result.OutPaths)))
+	for _, path := range result.OutPaths {
+		out.WriteLine(path.String())
+	}
+
+	roots := result.OutPaths
+	if opts.IncludeAllDependencies {
+		closure, err := store.NewStoreCmd().FetchAllDeps(ctx, result.OutPaths)
+		if err != nil {
+			result.Success = false
+			result.Error = fmt.Sprintf("failed to fetch dependencies: %v", err)
+			result.Duration = time.Since(start)
+			return result
+		}
+		result.Closure = closure
+		roots = closure
+		out.WriteLine(fmt.Sprintf("Closure has %d paths", len(closure)))
+	}
+
+	if gcRoot != "" {
+		if err := addGCRoots(ctx, gcRoot, roots); err != nil {
+			result.Success = false
+			result.Error = err.Error()
+			result.Duration = time.Since(start)
+			return result
+		}
+		out.WriteLine(fmt.Sprintf("Added GC roots in %s", gcRoot))
 	}
-	result.Output = fmt.Sprintf("Built %d outputs:\n%s", len(outPaths), strings.Join(outPaths, "\n"))
 	result.Duration = time.Since(start)
 
 	return result
 }
 
+// devourBuild builds all outputs of a flake with devour-flake, keeping going
+// past failures. When the build fails, the outcome of each output is told
+// from the failed derivations reported in its log.
+func devourBuild(ctx context.Context, flake nix.FlakeURL, step BuildStep, overrides map[string]string, opts RunOptions, out *nix.OutputStream) ([]AttrResult, []store.Path, error) {
+	failures := &nix.BuildFailures{}
+	stop := out.Watch(failures.AddLine)
+	output, err := nix.DevourFlake(ctx, flake, nix.DevourFlakeOptions{
+		Systems:        opts.Systems,
+		Impure:         step.Impure,
+		KeepGoing:      true,
+		OverrideInputs: overrides,
+		Output:         out,
+	})
+	stop()
+	if err == nil {
+		return devourAttrResults(output), output.OutPaths, nil
+	}
+	if ctx.Err() != nil || failures.Empty() {
+		return nil, nil, err
+	}
+
+	attrs, attrsErr := devourFailureResults(ctx, flake, step, failures, overrides, opts)
+	if attrsErr != nil {
+		out.WriteLine(fmt.Sprintf("Could not tell which outputs failed: %v", attrsErr))
+		return nil, nil, err
+	}
+	if buildErr := attrBuildError(attrs); buildErr != nil {
+		err = buildErr
+	}
+	return attrs, attrOutPaths(attrs), err
+}
+
+// gcRootDir returns the GC root directory of a subflake, or "" if GC roots
+// are disabled
+func gcRootDir(opts RunOptions, subflake string) string {
+	if opts.GCRootDir == "" {
+		return ""
+	}
+	return filepath.Join(opts.GCRootDir, logFileName(subflake))
+}
+
+// addGCRoots replaces the GC roots in dir with indirect roots for paths.
+// Derivations are left out, since realising them would build them. Closures
+// may have too many paths for one command line, so they are rooted in
+// batches, at root-0, root-1 and so on.
+func addGCRoots(ctx context.Context, dir string, paths []store.Path) error {
+	var outputs []store.Path
+	for _, path := range paths {
+		if path.IsOutput() {
+			outputs = append(outputs, path)
+		}
+	}
+
+	// Roots from a previous run may be stale
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove old GC roots: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create GC root directory: %w", err)
+	}
+
+	for i, batch := range batchPaths(outputs, maxPathArgBytes) {
+		symlink := filepath.Join(dir, fmt.Sprintf("root-%d", i))
+		if err := store.NewStoreCmd().AddRoot(ctx, symlink, batch); err != nil {
+			return fmt.Errorf("failed to add GC roots: %w", err)
+		}
+	}
+	return nil
+}
+
 // runLockfileStep executes the lockfile check step
-func runLockfileStep(ctx context.Context, flake nix.FlakeURL, _ LockfileStep) StepResult {
+func runLockfileStep(ctx context.Context, flake nix.FlakeURL, _ LockfileStep, overrides map[string]string, out *nix.OutputStream) StepResult {
 	start := time.Now()
 	result := StepResult{
-		Name:    "lockfile",
-		Success: true,
+		Name:           "lockfile",
+		Success:        true,
+		OverrideInputs: overrides,
 	}
 
 	// Check if flake.lock is up to date
 	cmd := nix.NewCmd()
-	output, err := cmd.Run(ctx, "flake", "lock", "--no-update-lock-file", flake.String())
-	if err != nil {
+	if err := cmd.RunStreaming(ctx, out, lockfileCheckArgs(flake, overrides)...); err != nil {
 		result.Success = false
 		result.Error = "flake.lock is out of date"
 	}
-	result.Output = output
 	result.Duration = time.Since(start)
 
 	return result
 }
 
 // runFlakeCheckStep executes the flake check step
-func runFlakeCheckStep(ctx context.Context, flake nix.FlakeURL, _ FlakeCheckStep) StepResult {
+func runFlakeCheckStep(ctx context.Context, flake nix.FlakeURL, _ FlakeCheckStep, overrides map[string]string, out *nix.OutputStream) StepResult {
 	start := time.Now()
 	result := StepResult{
-		Name:    "flakeCheck",
-		Success: true,
+		Name:           "flakeCheck",
+		Success:        true,
+		OverrideInputs: overrides,
 	}
 
 	// Run nix flake check
 	cmd := nix.NewCmd()
-	output, err := cmd.Run(ctx, "flake", "check", flake.String())
-	if err != nil {
+	if err := cmd.RunStreaming(ctx, out, flakeCheckArgs(flake, overrides)...); err != nil {
 		result.Success = false
 		result.Error = err.Error()
 	}
-	result.Output = output
 	result.Duration = time.Since(start)
 
 	return result
 }
 
 // runCustomStep executes a custom step
-func runCustomStep(ctx context.Context, flake nix.FlakeURL, name string, step CustomStep) StepResult {
+func runCustomStep(ctx context.Context, flake nix.FlakeURL, name string, step CustomStep, overrides map[string]string, out *nix.OutputStream) StepResult {
 	start := time.Now()
 	result := StepResult{
-		Name:    "custom:" + name,
-		Success: true,
+		Name:           "custom:" + name,
+		Success:        true,
+		OverrideInputs: overrides,
 	}
 
-	var output string
-	var err error
-
-	switch step.Type {
-	case CustomStepTypeApp:
-		// Run a flake app
-		output, err = runFlakeApp(ctx, flake, step)
-	case CustomStepTypeDevShell:
-		// Run a command in a devshell
-		output, err = runDevShellCommand(ctx, flake, step)
-	default:
+	cmd, err := localCustomStepCmd(step, out)
+	var commands [][]string
+	if err == nil {
+		commands, cmd.Dir, err = customStepCommands(flake, step, overrides, "")
+	}
+	if err != nil {
 		result.Success = false
-		result.Error = fmt.Sprintf("unknown custom step type: %s", step.Type)
+		result.Error = err.Error()
 		result.Duration = time.Since(start)
 		return result
 	}
 
+	switch step.Type {
+	case CustomStepTypeBuild:
+		// Build flake attributes
+		result.Attrs = step.Attrs
+		result.Attributes, err = buildAttrs(ctx, cmd, step, commands, out)
+		result.OutPaths = attrOutPaths(result.Attributes)
+	case CustomStepTypeEval:
+		// Evaluate a flake attribute
+		result.Attrs = []string{step.Attr}
+		err = evalAttr(ctx, cmd, step, commands[0], out)
+	default:
+		// Run a flake app, or a command in a devshell
+		err = cmd.RunStreaming(ctx, out, commands[0][1:]...)
+	}
+
 	if err != nil {
 		result.Success = false
 		result.Error = err.Error()
 	}
-	result.Output = output
 	result.Duration = time.Since(start)
 
 	return result
 }
 
-// runFlakeApp runs a flake app
-func runFlakeApp(ctx context.Context, flake nix.FlakeURL, step CustomStep) (string, error) {
+// customStepCommands returns the commands a custom step runs, and the
+// directory they run in locally. Run locally (host is ""), these are nix
+// commands, whose flake and input overrides are those of
+// customStepLocation. Run on a remote host, they are wrapped by
+// remoteCustomStepCommand. Both the plan and the runner use them, so that a
+// plan shows the commands that run.
+func customStepCommands(flakeURL nix.FlakeURL, step CustomStep, overrides map[string]string, host string) ([][]string, string, error) {
+	var dir string
+	if host == "" {
+		var err error
+		dir, flakeURL, overrides, err = customStepLocation(flakeURL, step, overrides)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	var commands [][]string
+	switch step.Type {
+	case CustomStepTypeApp:
+		commands = append(commands, flakeAppArgs(flakeURL, step, overrides))
+	case CustomStepTypeDevShell:
+		if len(step.Command) == 0 {
+			return nil, "", fmt.Errorf("devshell step has no command")
+		}
+		commands = append(commands, devShellArgs(flakeURL, step, overrides))
+	case CustomStepTypeBuild:
+		if len(step.Attrs) == 0 {
+			return nil, "", fmt.Errorf("build step has no attrs")
+		}
+		if host != "" {
+			commands = append(commands, remoteBuildAttrsArgs(flakeURL, step, overrides))
+			break
+		}
+		for _, attr := range step.Attrs {
+			commands = append(commands, flake.BuildArgs(&flake.CommandOptions{OverrideInputs: overrides}, buildFlakeURLWithAttr(flakeURL, attr)))
+		}
+	case CustomStepTypeEval:
+		if step.Attr == "" {
+			return nil, "", fmt.Errorf("eval step has no attr")
+		}
+		if host == "" {
+			commands = append(commands, flake.EvalArgs(&flake.FlakeOptions{OverrideInputs: overrides}, buildFlakeURLWithAttr(flakeURL, step.Attr)))
+			break
+		}
+		// The output of the evaluation is captured, with no standard
+		// input to pass secrets on
+		if len(step.Secrets) > 0 {
+			return nil, "", fmt.Errorf("eval steps can't use secrets with --remote")
+		}
+		commands = append(commands, remoteEvalAttrArgs(flakeURL, step, overrides))
+	default:
+		return nil, "", fmt.Errorf("unknown custom step type: %s", step.Type)
+	}
+
+	for i, args := range commands {
+		commands[i] = append([]string{"nix"}, args...)
+		if host != "" {
+			command, err := remoteCustomStepCommand(commands[i], flakeURL, step)
+			if err != nil {
+				return nil, "", err
+			}
+			commands[i] = command
+		}
+	}
+	return commands, dir, nil
+}
+
+// lockfileCheckArgs returns the nix arguments for checking that flake.lock is up to date.
+// Overridden inputs are passed along so that they are not reported as stale.
+func lockfileCheckArgs(flake nix.FlakeURL, overrides map[string]string) []string {
+	args := []string{"flake", "lock", "--no-update-lock-file"}
+	args = append(args, nix.OverrideInputArgs(overrides, "")...)
+	return append(args, flake.String())
+}
+
+// flakeCheckArgs returns the nix arguments for running `nix flake check`
+func flakeCheckArgs(flake nix.FlakeURL, overrides map[string]string) []string {
+	args := []string{"flake", "check"}
+	args = append(args, nix.OverrideInputArgs(overrides, "")...)
+	return append(args, flake.String())
+}
+
+// flakeAppArgs returns the nix arguments for running a flake app
+func flakeAppArgs(flake nix.FlakeURL, step CustomStep, overrides map[string]string) []string {
 	appName := getFlakeAttrName(step.Name)
 	appURL := buildFlakeURLWithAttr(flake, appName)
 
-	// Build nix run command
-	args := []string{"run", appURL}
+	args := []string{"run"}
+	args = append(args, nix.OverrideInputArgs(overrides, "")...)
+	args = append(args, appURL)
 	if len(step.Args) > 0 {
 		args = append(args, "--")
 		args = append(args, step.Args...)
 	}
-
-	cmd := nix.NewCmd()
-	return cmd.Run(ctx, args...)
+	return args
 }
 
-// runDevShellCommand runs a command in a devshell
-func runDevShellCommand(ctx context.Context, flake nix.FlakeURL, step CustomStep) (string, error) {
-	if len(step.Command) == 0 {
-		return "", fmt.Errorf("devshell step has no command")
-	}
-
+// devShellArgs returns the nix arguments for running a command in a devshell
+func devShellArgs(flake nix.FlakeURL, step CustomStep, overrides map[string]string) []string {
 	shellName := getFlakeAttrName(step.Name)
 	shellURL := buildFlakeURLWithAttr(flake, shellName)
 
-	// Build nix develop command
-	args := []string{"develop", shellURL, "-c"}
-	args = append(args, step.Command...)
-
-	cmd := nix.NewCmd()
-	return cmd.Run(ctx, args...)
+	args := []string{"develop"}
+	args = append(args, nix.OverrideInputArgs(overrides, "")...)
+	args = append(args, shellURL, "-c")
+	return append(args, step.Command...)
 }
 
 // LogResult logs the CI result using the logger
@@ -451,169 +974,161 @@ func LogResult(result Result, logger *zap.Logger) {
 	for name, stepResult := range result.Steps {
 		logger.Info("  Step",
 			zap.String("name", name),
-			zap.Bool("success", stepResult.Success),
+			zap.String("status", stepResult.Status()),
 			zap.Duration("duration", stepResult.Duration))
 
-		if !stepResult.Success {
+		switch stepResult.Status() {
+		case StepFailed:
 			logger.Error("  Step failed",
 				zap.String("name", name),
 				zap.String("error", stepResult.Error))
+			for _, drv := range stepResult.FailedDerivations {
+				logger.Error("  Derivation failed",
+					zap.String("drv", drv.DrvPath),
+					zap.String("log", failedDerivationText(drv)))
+			}
+		case StepWarning:
+			logger.Warn("  Step failed (allowed)",
+				zap.String("name", name),
+				zap.String("error", stepResult.Error))
 		}
 	}
 }
 
-// executeRemoteCommand executes a command on a remote host via SSH
-func executeRemoteCommand(ctx context.Context, host string, command []string) (string, error) {
-	if host == "" {
-		return "", fmt.Errorf("remote host not specified")
-	}
-
-	// Build SSH command
-	// SSH command format: ssh user@host "command args..."
-	sshArgs := []string{host}
-
-	// Convert command array to shell command string with proper escaping
-	// Use POSIX shell escaping: wrap each argument in single quotes and escape any embedded single quotes
-	cmdParts := make([]string, len(command))
-	for i, part := range command {
-		// Replace single quotes with '\'' (end quote, escaped quote, start quote)
-		escaped := strings.ReplaceAll(part, "'", "'\\''")
-		cmdParts[i] = "'" + escaped + "'"
-	}
-	cmdStr := strings.Join(cmdParts, " ")
-	sshArgs = append(sshArgs, cmdStr)
-
-	// Execute SSH command
-	cmd := exec.CommandContext(ctx, "ssh", sshArgs...)
-	output, err := cmd.CombinedOutput()
-
-	return string(output), err
-}
-
 // runBuildStepRemote executes the build step on a remote host using devour-flake
-func runBuildStepRemote(ctx context.Context, host string, flake nix.FlakeURL, step BuildStep, opts RunOptions) StepResult {
+func runBuildStepRemote(ctx context.Context, ssh SSH, host string, flake nix.FlakeURL, step BuildStep, overrides map[string]string, opts RunOptions, out *nix.OutputStream) StepResult {
 	start := time.Now()
 	result := StepResult{
-		Name:    "build",
-		Success: true,
+		Name:           "build",
+		Success:        true,
+		OverrideInputs: overrides,
 	}
 
-	// Build the devour-flake command
-	devourURL := nix.DevourFlakeURL() + "#json"
-	args := []string{"nix", "build", devourURL, "-L", "--no-link", "--print-out-paths"}
-	if step.Impure {
-		args = append(args, "--impure")
+	filter, err := newAttrFilter(step, opts)
+	if err != nil {
+		result.Success = false
+		result.Error = err.Error()
+		result.Duration = time.Since(start)
+		return result
 	}
-	args = append(args, "--override-input", "flake", flake.String())
 
-	// Add systems filtering if specified
-	if len(opts.Systems) > 0 {
-		systemsFlakeURL, err := nix.GetSystemsFlakeURL(opts.Systems)
-		if err != nil {
-			result.Success = false
-			result.Error = fmt.Sprintf("failed to get systems flake URL: %v", err)
+	var nixArgs []string
+	if filter.active() {
+		// Build the selected outputs, listed on the remote host
+		var selected []nix.BuildableAttr
+		selected, err = selectRemoteBuildables(ctx, ssh, host, flake, step, filter, overrides, opts, out)
+		if err == nil && len(selected) == 0 {
 			result.Duration = time.Since(start)
 			return result
 		}
-		args = append(args, "--override-input", "systems", systemsFlakeURL.String())
+		for _, buildable := range selected {
+			result.Attrs = append(result.Attrs, buildable.Attr)
+		}
+		nixArgs = buildSelectedArgs(flake, step, selected, overrides)
+	} else {
+		// Build the devour-flake command
+		nixArgs, err = nix.DevourFlakeArgs(flake, nix.DevourFlakeOptions{
+			Systems:        opts.Systems,
+			Impure:         step.Impure,
+			KeepGoing:      true,
+			OverrideInputs: overrides,
+		})
 	}
-
-	output, err := executeRemoteCommand(ctx, host, args)
 	if err != nil {
+		result.Success = false
+		result.Error = err.Error()
+		result.Duration = time.Since(start)
+		return result
+	}
+	args := append([]string{"nix"}, nixArgs...)
+
+	if err := executeRemoteCommand(ctx, ssh, host, args, nil, out); err != nil {
 		result.Success = false
 		result.Error = fmt.Sprintf("remote build failed: %v", err)
 	}
-	result.Output = output
 	result.Duration = time.Since(start)
 
 	return result
 }
 
 // runLockfileStepRemote executes the lockfile check step on a remote host
-func runLockfileStepRemote(ctx context.Context, host string, flake nix.FlakeURL, step LockfileStep) StepResult {
+func runLockfileStepRemote(ctx context.Context, ssh SSH, host string, flake nix.FlakeURL, step LockfileStep, overrides map[string]string, out *nix.OutputStream) StepResult {
 	start := time.Now()
 	result := StepResult{
-		Name:    "lockfile",
-		Success: true,
+		Name:           "lockfile",
+		Success:        true,
+		OverrideInputs: overrides,
 	}
 
-	args := []string{"nix", "flake", "lock", "--no-update-lock-file", flake.String()}
-	output, err := executeRemoteCommand(ctx, host, args)
-	if err != nil {
+	args := append([]string{"nix"}, lockfileCheckArgs(flake, overrides)...)
+	if err := executeRemoteCommand(ctx, ssh, host, args, nil, out); err != nil {
 		result.Success = false
 		result.Error = "flake.lock is out of date"
 	}
-	result.Output = output
 	result.Duration = time.Since(start)
 
 	return result
 }
 
 // runFlakeCheckStepRemote executes the flake check step on a remote host
-func runFlakeCheckStepRemote(ctx context.Context, host string, flake nix.FlakeURL, step FlakeCheckStep) StepResult {
+func runFlakeCheckStepRemote(ctx context.Context, ssh SSH, host string, flake nix.FlakeURL, step FlakeCheckStep, overrides map[string]string, out *nix.OutputStream) StepResult {
 	start := time.Now()
 	result := StepResult{
-		Name:    "flakeCheck",
-		Success: true,
+		Name:           "flakeCheck",
+		Success:        true,
+		OverrideInputs: overrides,
 	}
 
-	args := []string{"nix", "flake", "check", flake.String()}
-	output, err := executeRemoteCommand(ctx, host, args)
-	if err != nil {
+	args := append([]string{"nix"}, flakeCheckArgs(flake, overrides)...)
+	if err := executeRemoteCommand(ctx, ssh, host, args, nil, out); err != nil {
 		result.Success = false
 		result.Error = fmt.Sprintf("flake check failed: %v", err)
 	}
-	result.Output = output
 	result.Duration = time.Since(start)
 
 	return result
 }
 
 // runCustomStepRemote executes a custom step on a remote host
-func runCustomStepRemote(ctx context.Context, host string, flake nix.FlakeURL, name string, step CustomStep) StepResult {
+func runCustomStepRemote(ctx context.Context, ssh SSH, host string, flake nix.FlakeURL, name string, step CustomStep, overrides map[string]string, out *nix.OutputStream) StepResult {
 	start := time.Now()
 	result := StepResult{
-		Name:    "custom:" + name,
-		Success: true,
+		Name:           "custom:" + name,
+		Success:        true,
+		OverrideInputs: overrides,
 	}
 
-	var args []string
-
-	switch step.Type {
-	case CustomStepTypeApp:
-		// Run a flake app
-		appName := getFlakeAttrName(step.Name)
-		appURL := buildFlakeURLWithAttr(flake, appName)
-		args = []string{"nix", "run", appURL}
-		if len(step.Args) > 0 {
-			args = append(args, "--")
-			args = append(args, step.Args...)
-		}
-	case CustomStepTypeDevShell:
-		// Run a command in a devshell
-		if len(step.Command) == 0 {
-			result.Success = false
-			result.Error = "devshell step has no command"
-			result.Duration = time.Since(start)
-			return result
-		}
-		shellName := getFlakeAttrName(step.Name)
-		shellURL := buildFlakeURLWithAttr(flake, shellName)
-		args = []string{"nix", "develop", shellURL, "-c"}
-		args = append(args, step.Command...)
-	default:
+	env, err := newStepEnv(step)
+	var commands [][]string
+	if err == nil {
+		out.Redact(env.secretValues...)
+		commands, _, err = customStepCommands(flake, step, overrides, host)
+	}
+	if err != nil {
 		result.Success = false
-		result.Error = fmt.Sprintf("unknown custom step type: %s", step.Type)
+		result.Error = err.Error()
 		result.Duration = time.Since(start)
 		return result
 	}
 
-	output, err := executeRemoteCommand(ctx, host, args)
+	switch step.Type {
+	case CustomStepTypeEval:
+		// Evaluate a flake attribute, whose value is checked here
+		result.Attrs = []string{step.Attr}
+		err = evalAttrRemote(ctx, ssh, host, step, commands[0], out)
+	case CustomStepTypeBuild:
+		// Build flake attributes, all at once
+		result.Attrs = step.Attrs
+		err = executeRemoteCommand(ctx, ssh, host, commands[0], secretExports(env), out)
+	default:
+		// Run a flake app, or a command in a devshell
+		err = executeRemoteCommand(ctx, ssh, host, commands[0], secretExports(env), out)
+	}
+
 	if err != nil {
 		result.Success = false
 		result.Error = fmt.Sprintf("custom step failed: %v", err)
 	}
-	result.Output = output
 	result.Duration = time.Since(start)
 
 	return result
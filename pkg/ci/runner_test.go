@@ -1,10 +1,16 @@
 package ci
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/store"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -28,7 +34,7 @@ func TestRunBuildStep(t *testing.T) {
 		Systems: []string{"x86_64-linux"},
 	}
 
-	result := runBuildStep(ctx, flake, step, opts)
+	result := runBuildStep(ctx, flake, step, nil, opts, "", newTestStream(t))
 	assert.Equal(t, "build", result.Name)
 	// Note: This may fail or succeed depending on the system, just testing it runs
 }
@@ -46,7 +52,7 @@ func TestRunLockfileStep(t *testing.T) {
 		Enable: true,
 	}
 
-	result := runLockfileStep(ctx, flake, step)
+	result := runLockfileStep(ctx, flake, step, nil, newTestStream(t))
 	assert.Equal(t, "lockfile", result.Name)
 }
 
@@ -63,7 +69,7 @@ func TestRunFlakeCheckStep(t *testing.T) {
 		Enable: true,
 	}
 
-	result := runFlakeCheckStep(ctx, flake, step)
+	result := runFlakeCheckStep(ctx, flake, step, nil, newTestStream(t))
 	assert.Equal(t, "flakeCheck", result.Name)
 }
 
@@ -105,7 +111,7 @@ func TestRunCustomStep(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := runCustomStep(ctx, flake, tt.stepName, tt.step)
+			result := runCustomStep(ctx, flake, tt.stepName, tt.step, nil, newTestStream(t))
 			assert.Equal(t, tt.expectedName, result.Name)
 
 			if tt.expectedError {
@@ -165,3 +171,212 @@ func TestRun(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotEmpty(t, results)
 }
+
+func TestRun_StreamsOutput(t *testing.T) {
+	// Print more lines than the tail keeps, so the result only holds the end
+	installFakeNix(t, `i=1
+while [ $i -le 150 ]; do echo "check line $i" >&2; i=$((i+1)); done`)
+
+	logDir := t.TempDir()
+	var terminal bytes.Buffer
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {
+				Dir: ".",
+				Steps: StepsConfig{
+					FlakeCheck: FlakeCheckStep{Enable: true},
+				},
+			},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	results, err := Run(context.Background(), flake, config, RunOptions{
+		Parallel: true,
+		Output:   &terminal,
+		LogDir:   logDir,
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	step := results[0].Steps["flakeCheck"]
+	assert.True(t, step.Success)
+
+	// The terminal sees every line as it is produced, prefixed in parallel mode
+	assert.Contains(t, terminal.String(), "[main/flakeCheck] check line 1\n")
+	assert.Contains(t, terminal.String(), "[main/flakeCheck] check line 150\n")
+
+	// The result keeps a bounded tail
+	tail := strings.Split(step.Output, "\n")
+	assert.Len(t, tail, nix.DefaultTailLines)
+	assert.Equal(t, "check line 150", tail[len(tail)-1])
+
+	// The log file has everything
+	assert.Equal(t, filepath.Join(logDir, "main", "flakeCheck.log"), step.LogFile)
+	data, err := os.ReadFile(step.LogFile)
+	require.NoError(t, err)
+	assert.Equal(t, 150, strings.Count(string(data), "\n"))
+	assert.True(t, strings.HasPrefix(string(data), "check line 1\n"))
+}
+
+func TestLogFileName(t *testing.T) {
+	assert.Equal(t, "root", logFileName("."))
+	assert.Equal(t, "main", logFileName("main"))
+	assert.Equal(t, "custom_fmt", logFileName("custom:fmt"))
+	assert.Equal(t, "a_b", logFileName("a/b"))
+}
+
+func TestRun_IncludeAllDependencies(t *testing.T) {
+	// devour-flake prints the path of a JSON file listing the built outputs
+	devourOut := filepath.Join(t.TempDir(), "devour.json")
+	require.NoError(t, os.WriteFile(devourOut, []byte(`{"outPaths": ["/nix/store/aaa-hello"], "byName": {}}`), 0644))
+	installFakeNix(t, `case "$1" in
+  build) echo '`+devourOut+`';;
+esac`)
+	storeLog := installFakeCommand(t, "nix-store", `case "$*" in
+  *--valid-derivers*) echo /nix/store/ddd-hello.drv;;
+  *--requisites*) printf '%s\n' /nix/store/ddd-hello.drv /nix/store/bbb-glibc /nix/store/aaa-hello;;
+esac`)
+
+	// Roots left over from a previous run are replaced
+	gcRootDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(gcRootDir, "main"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(gcRootDir, "main", "root-9"), nil, 0644))
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Dir: ".", Steps: StepsConfig{Build: BuildStep{Enable: true}}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	results, err := Run(context.Background(), flake, config, RunOptions{
+		IncludeAllDependencies: true,
+		GCRootDir:              gcRootDir,
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	step := results[0].Steps["build"]
+	require.True(t, step.Success, step.Error)
+	assert.Equal(t, []string{"/nix/store/aaa-hello"}, pathStrings(step.OutPaths))
+	assert.Equal(t, []string{"/nix/store/ddd-hello.drv", "/nix/store/bbb-glibc", "/nix/store/aaa-hello"}, pathStrings(step.Closure))
+
+	// Every output in the closure is rooted; derivations are not realised
+	calls := readFakeNixLog(t, storeLog)
+	require.Len(t, calls, 3)
+	assert.Equal(t, "--query --valid-derivers /nix/store/aaa-hello", calls[0])
+	assert.Equal(t, "--query --requisites --include-outputs /nix/store/ddd-hello.drv", calls[1])
+	assert.Equal(t, "--add-root "+filepath.Join(gcRootDir, "main", "root-0")+" --realise /nix/store/bbb-glibc /nix/store/aaa-hello", calls[2])
+	assert.NoFileExists(t, filepath.Join(gcRootDir, "main", "root-9"))
+
+	// The closure is recorded in the results JSON
+	data, err := json.Marshal(results)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"closure":["/nix/store/ddd-hello.drv","/nix/store/bbb-glibc","/nix/store/aaa-hello"]`)
+}
+
+func TestRun_GCRootsWithoutClosure(t *testing.T) {
+	devourOut := filepath.Join(t.TempDir(), "devour.json")
+	require.NoError(t, os.WriteFile(devourOut, []byte(`{"outPaths": ["/nix/store/aaa-hello"], "byName": {}}`), 0644))
+	installFakeNix(t, `case "$1" in
+  build) echo '`+devourOut+`';;
+esac`)
+	storeLog := installFakeCommand(t, "nix-store", "")
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			".": {Dir: ".", Steps: StepsConfig{Build: BuildStep{Enable: true}}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	gcRootDir := t.TempDir()
+	results, err := Run(context.Background(), flake, config, RunOptions{GCRootDir: gcRootDir})
+	require.NoError(t, err)
+
+	step := results[0].Steps["build"]
+	require.True(t, step.Success, step.Error)
+	assert.Empty(t, step.Closure)
+
+	// Only the outputs themselves are rooted
+	assert.Equal(t, []string{
+		"--add-root " + filepath.Join(gcRootDir, "root", "root-0") + " --realise /nix/store/aaa-hello",
+	}, readFakeNixLog(t, storeLog))
+}
+
+func TestRun_RecordsDerivationBuilds(t *testing.T) {
+	devourOut := filepath.Join(t.TempDir(), "devour.json")
+	require.NoError(t, os.WriteFile(devourOut, []byte(`{"outPaths": ["/nix/store/aaa-hello"], "byName": {}}`), 0644))
+	logPath := installFakeNix(t, `case "$1" in
+  build)
+    echo '@nix {"action":"start","id":2,"level":3,"text":"building hello","type":105,"fields":["/nix/store/aaa-hello.drv","",1,1]}' >&2
+    echo '@nix {"action":"stop","id":2}' >&2
+    echo '`+devourOut+`';;
+esac`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Dir: ".", Steps: StepsConfig{Build: BuildStep{Enable: true}}},
+		},
+	}
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	// Without an observer following activity, the build step still
+	// follows the log events of nix, as planned
+	plan, err := NewPlan(flake, config, RunOptions{})
+	require.NoError(t, err)
+	results, err := RunPlan(context.Background(), plan, RunOptions{})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readFakeNixLog(t, logPath)[0], "--log-format internal-json build "))
+	assert.Equal(t, planCommands(plan), readFakeNixLog(t, logPath))
+
+	step := results[0].Steps["build"]
+	require.True(t, step.Success, step.Error)
+	require.Len(t, step.DerivationBuilds, 1)
+	assert.Equal(t, "/nix/store/aaa-hello.drv", step.DerivationBuilds[0].DrvPath)
+
+	data, err := json.Marshal(results)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"derivationBuilds":[{"drvPath":"/nix/store/aaa-hello.drv"`)
+}
+
+func TestAddGCRoots_Batches(t *testing.T) {
+	storeLog := installFakeCommand(t, "nix-store", "")
+
+	// Two paths per batch
+	defer func(limit int) { maxPathArgBytes = limit }(maxPathArgBytes)
+	maxPathArgBytes = 2 * len("/nix/store/aaa-hello/")
+
+	paths := []store.Path{
+		store.NewPath("/nix/store/aaa-hello"),
+		store.NewPath("/nix/store/bbb-glibc"),
+		store.NewPath("/nix/store/ccc-hello.drv"),
+		store.NewPath("/nix/store/ddd-bash"),
+		store.NewPath("/nix/store/eee-zlib"),
+	}
+	dir := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, addGCRoots(context.Background(), dir, paths))
+
+	// Every batch gets a root of its own
+	assert.Equal(t, []string{
+		"--add-root " + filepath.Join(dir, "root-0") + " --realise /nix/store/aaa-hello /nix/store/bbb-glibc",
+		"--add-root " + filepath.Join(dir, "root-1") + " --realise /nix/store/ddd-bash /nix/store/eee-zlib",
+	}, readFakeNixLog(t, storeLog))
+}
+
+func pathStrings(paths []store.Path) []string {
+	strs := make([]string, len(paths))
+	for i, p := range paths {
+		strs[i] = p.String()
+	}
+	return strs
+}
@@ -0,0 +1,252 @@
+package ci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/flake"
+)
+
+// DefaultStateDir returns the default directory of the CI state store,
+// $XDG_CACHE_HOME/omnix/ci (~/.cache/omnix/ci on Linux)
+func DefaultStateDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the cache directory: %w", err)
+	}
+	return filepath.Join(cacheDir, "omnix", "ci"), nil
+}
+
+// stateKey identifies a step run: a step whose key matches that of an
+// earlier successful run need not run again
+type stateKey struct {
+	// NarHash is the locked narHash of the subflake source
+	NarHash string `json:"narHash"`
+
+	// OverrideHashes are the narHashes of the local override inputs, by
+	// input name
+	OverrideHashes map[string]string `json:"overrideHashes,omitempty"`
+
+	// Subflake is the name of the subflake
+	Subflake string `json:"subflake"`
+
+	// Systems are the systems the step ran for, sorted
+	Systems []string `json:"systems"`
+
+	// Step is the step key, e.g. "build" or "custom:fmt"
+	Step string `json:"step"`
+
+	// ConfigHash is the hash of the step configuration and run options
+	ConfigHash string `json:"configHash"`
+
+	// OmnixVersion is the version of omnix that ran the step
+	OmnixVersion string `json:"omnixVersion"`
+}
+
+// hash returns the hex-encoded SHA-256 hash of the key
+func (k stateKey) hash() string {
+	data, _ := json.Marshal(k)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// stateEntry is a successful step run recorded in the state store
+type stateEntry struct {
+	Key        stateKey   `json:"key"`
+	RecordedAt time.Time  `json:"recordedAt"`
+	Result     StepResult `json:"result"`
+}
+
+// stateStore records successful step runs as JSON files named after the
+// hash of their key. It is safe for concurrent use.
+type stateStore struct {
+	dir string
+}
+
+// newStateStore returns the state store in dir
+func newStateStore(dir string) *stateStore {
+	return &stateStore{dir: dir}
+}
+
+// path returns the file recording the step run with the given key
+func (s *stateStore) path(key stateKey) string {
+	return filepath.Join(s.dir, key.hash()+".json")
+}
+
+// lookup returns the recorded result of a successful run matching key,
+// marked as cached. Build results whose outputs were garbage collected
+// since are not returned.
+func (s *stateStore) lookup(key stateKey) (StepResult, bool) {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return StepResult{}, false
+	}
+
+	var entry stateEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Key.hash() != key.hash() {
+		return StepResult{}, false
+	}
+
+	for _, path := range entry.Result.OutPaths {
+		if _, err := os.Lstat(path.String()); err != nil {
+			return StepResult{}, false
+		}
+	}
+
+	result := entry.Result
+	result.Cached = true
+	result.Output = fmt.Sprintf("cached: passed at %s with the same source and configuration", entry.RecordedAt.Format(time.RFC3339))
+	return result, true
+}
+
+// record stores the result of a successful run with the given key
+func (s *stateStore) record(key stateKey, result StepResult) error {
+	// The output and log of the run are not kept
+	result.Output = ""
+	result.LogFile = ""
+	result.Attempts = nil
+	result.Duration = 0
+
+	data, err := json.MarshalIndent(stateEntry{Key: key, RecordedAt: time.Now().UTC(), Result: result}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal CI state: %w", err)
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create CI state directory: %w", err)
+	}
+
+	// Write atomically; parallel runs may record the same key
+	if err := writeFileAtomic(s.path(key), data); err != nil {
+		return fmt.Errorf("failed to write CI state: %w", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to path through a temporary file in the same
+// directory, renamed over path once synced, so that readers see either the
+// previous content or the new one, whole
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// lockedNarHash returns the narHash of the locked flake source
+func lockedNarHash(ctx context.Context, flakeURL nix.FlakeURL) (string, error) {
+	metadata, err := flake.GetMetadata(ctx, nix.NewCmd(), flakeURL.String())
+	if err != nil {
+		return "", err
+	}
+	if metadata.Locked == nil || metadata.Locked.NarHash == "" {
+		return "", fmt.Errorf("flake %s has no locked narHash", flakeURL)
+	}
+	return metadata.Locked.NarHash, nil
+}
+
+// localOverrideHashes returns the narHash of every local override input (a
+// path, or a git+file: repository) by input name. Their content changes
+// without their URL, which is all the configuration hash covers.
+func localOverrideHashes(ctx context.Context, overrides map[string]string) (map[string]string, error) {
+	var hashes map[string]string
+	for name, url := range overrides {
+		var hash string
+		var err error
+		switch {
+		case strings.HasPrefix(url, "git+file:"):
+			hash, err = lockedNarHash(ctx, nix.NewFlakeURL(url))
+		case isLocalPath(url):
+			path, _, _ := strings.Cut(strings.TrimPrefix(url, "path:"), "?")
+			hash, err = nix.NewCmd().Run(ctx, "hash", "path", path)
+			hash = strings.TrimSpace(hash)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash override input %s: %w", name, err)
+		}
+		if hashes == nil {
+			hashes = make(map[string]string)
+		}
+		hashes[name] = hash
+	}
+	return hashes, nil
+}
+
+// isLocalPath tells whether a flake URL is a path on the local filesystem
+func isLocalPath(url string) bool {
+	url = strings.TrimPrefix(url, "path:")
+	return strings.HasPrefix(url, ".") || strings.HasPrefix(url, "/")
+}
+
+// newStateKey returns the state key of a step of a subflake, whose source
+// has the given narHash and local override inputs the given overrideHashes.
+// Besides the step configuration, the configuration hash covers everything
+// else that changes what the step does: the subflake directory, its input
+// overrides and the run options the step depends on.
+func newStateKey(narHash string, overrideHashes map[string]string, name string, subflake SubflakeConfig, key string, opts RunOptions) stateKey {
+	systems := append([]string{}, opts.Systems...)
+	sort.Strings(systems)
+
+	config := struct {
+		Dir                    string            `json:"dir"`
+		OverrideInputs         map[string]string `json:"overrideInputs,omitempty"`
+		Step                   interface{}       `json:"step"`
+		IncludeAllDependencies bool              `json:"includeAllDependencies,omitempty"`
+		Only                   []string          `json:"only,omitempty"`
+		Exclude                []string          `json:"exclude,omitempty"`
+		RemoteHost             string            `json:"remoteHost,omitempty"`
+	}{
+		Dir:            subflake.Dir,
+		OverrideInputs: subflake.OverrideInputs,
+		Step:           subflake.Steps.stepConfig(key),
+		RemoteHost:     opts.RemoteHost,
+	}
+	if key == "build" {
+		config.IncludeAllDependencies = opts.IncludeAllDependencies
+		config.Only = opts.Only
+		config.Exclude = opts.Exclude
+	}
+	data, _ := json.Marshal(config)
+	sum := sha256.Sum256(data)
+
+	return stateKey{
+		NarHash:        narHash,
+		OverrideHashes: overrideHashes,
+		Subflake:       name,
+		Systems:        systems,
+		Step:           key,
+		ConfigHash:     hex.EncodeToString(sum[:]),
+		OmnixVersion:   opts.OmnixVersion,
+	}
+}
@@ -0,0 +1,249 @@
+package ci
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStateKey(t *testing.T) {
+	subflake := SubflakeConfig{
+		Dir: ".",
+		Steps: StepsConfig{
+			Build: BuildStep{Enable: true},
+			Custom: map[string]CustomStep{
+				"test": {Type: CustomStepTypeDevShell, Command: []string{"make", "test"}},
+			},
+		},
+	}
+	opts := RunOptions{Systems: []string{"x86_64-linux", "aarch64-linux"}, OmnixVersion: "1.0.0"}
+
+	key := newStateKey("sha256-abc", nil, "main", subflake, "custom:test", opts)
+	assert.Equal(t, []string{"aarch64-linux", "x86_64-linux"}, key.Systems)
+	assert.Equal(t, key.hash(), newStateKey("sha256-abc", nil, "main", subflake, "custom:test", opts).hash())
+
+	// Anything that changes what the step does changes the key
+	changed := subflake
+	changed.Steps.Custom = map[string]CustomStep{
+		"test": {Type: CustomStepTypeDevShell, Command: []string{"make", "check"}},
+	}
+	assert.NotEqual(t, key.hash(), newStateKey("sha256-abc", nil, "main", changed, "custom:test", opts).hash())
+	assert.NotEqual(t, key.hash(), newStateKey("sha256-def", nil, "main", subflake, "custom:test", opts).hash())
+	assert.NotEqual(t, key.hash(), newStateKey("sha256-abc", nil, "main", subflake, "custom:test", RunOptions{Systems: opts.Systems, OmnixVersion: "1.0.1"}).hash())
+
+	assert.NotEqual(t, key.hash(), newStateKey("sha256-abc", map[string]string{"lib": "sha256-def"}, "main", subflake, "custom:test", opts).hash())
+
+	// Build options only matter to the build step
+	withDeps := opts
+	withDeps.IncludeAllDependencies = true
+	assert.Equal(t, key.hash(), newStateKey("sha256-abc", nil, "main", subflake, "custom:test", withDeps).hash())
+	assert.NotEqual(t,
+		newStateKey("sha256-abc", nil, "main", subflake, "build", opts).hash(),
+		newStateKey("sha256-abc", nil, "main", subflake, "build", withDeps).hash())
+}
+
+func TestStateStore(t *testing.T) {
+	state := newStateStore(filepath.Join(t.TempDir(), "state"))
+	outPath := filepath.Join(t.TempDir(), "aaa-hello")
+	require.NoError(t, os.WriteFile(outPath, nil, 0644))
+
+	key := stateKey{NarHash: "sha256-abc", Subflake: "main", Step: "build"}
+	_, ok := state.lookup(key)
+	assert.False(t, ok)
+
+	require.NoError(t, state.record(key, StepResult{
+		Name:     "build",
+		Success:  true,
+		Output:   "lots of output",
+		LogFile:  "/tmp/build.log",
+		OutPaths: []store.Path{store.NewPath(outPath)},
+	}))
+
+	cached, ok := state.lookup(key)
+	require.True(t, ok)
+	assert.Equal(t, StepCached, cached.Status())
+	assert.Equal(t, []string{outPath}, pathStrings(cached.OutPaths))
+	assert.Empty(t, cached.LogFile)
+	assert.True(t, strings.HasPrefix(cached.Output, "cached: passed at "), cached.Output)
+
+	// Other keys don't match
+	_, ok = state.lookup(stateKey{NarHash: "sha256-def", Subflake: "main", Step: "build"})
+	assert.False(t, ok)
+
+	// Outputs that were garbage collected have to be built again
+	require.NoError(t, os.Remove(outPath))
+	_, ok = state.lookup(key)
+	assert.False(t, ok)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "entry.json")
+
+	require.NoError(t, writeFileAtomic(path, []byte("first")))
+	require.NoError(t, writeFileAtomic(path, []byte("second")))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+
+	// No temporary file is left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	assert.Error(t, writeFileAtomic(filepath.Join(dir, "missing", "entry.json"), nil))
+}
+
+func TestRun_Incremental(t *testing.T) {
+	narHashFile := filepath.Join(t.TempDir(), "narhash")
+	require.NoError(t, os.WriteFile(narHashFile, []byte("sha256-abc"), 0644))
+	logPath := installFakeNix(t, `case "$*" in
+  flake\ metadata*) printf '{"locked": {"narHash": "%s"}}' "$(cat '`+narHashFile+`')";;
+esac`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Dir: ".", Steps: StepsConfig{
+				FlakeCheck: FlakeCheckStep{Enable: true},
+				Custom: map[string]CustomStep{
+					"test": {Type: CustomStepTypeDevShell, Command: []string{"make", "test"}, DependsOn: []string{"flakeCheck"}},
+				},
+			}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	opts := RunOptions{Incremental: true, StateDir: t.TempDir(), OmnixVersion: "1.0.0"}
+
+	// ran returns the steps that ran since the last call
+	seen := 0
+	ran := func() []string {
+		var steps []string
+		calls := readFakeNixLog(t, logPath)
+		for _, call := range calls[seen:] {
+			switch {
+			case strings.HasPrefix(call, "flake check"):
+				steps = append(steps, "flakeCheck")
+			case strings.HasPrefix(call, "develop"):
+				steps = append(steps, "custom:test")
+			}
+		}
+		seen = len(calls)
+		return steps
+	}
+
+	results, err := Run(context.Background(), flake, config, opts)
+	require.NoError(t, err)
+	assert.Equal(t, StepPassed, results[0].Steps["flakeCheck"].Status())
+	assert.Equal(t, []string{"flakeCheck", "custom:test"}, ran())
+
+	// Nothing changed: every step is cached and the subflake passes
+	results, err = Run(context.Background(), flake, config, opts)
+	require.NoError(t, err)
+	assert.True(t, results[0].Success)
+	assert.Equal(t, StepCached, results[0].Steps["flakeCheck"].Status())
+	assert.Equal(t, StepCached, results[0].Steps["custom:test"].Status())
+	assert.Empty(t, ran())
+
+	// A changed step runs again, alone
+	test := config.Default["main"].Steps.Custom["test"]
+	test.Command = []string{"make", "check"}
+	config.Default["main"].Steps.Custom["test"] = test
+	_, err = Run(context.Background(), flake, config, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"custom:test"}, ran())
+
+	// A changed source runs everything again
+	require.NoError(t, os.WriteFile(narHashFile, []byte("sha256-def"), 0644))
+	_, err = Run(context.Background(), flake, config, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"flakeCheck", "custom:test"}, ran())
+
+	// Without --incremental, the state is not used
+	opts.Incremental = false
+	_, err = Run(context.Background(), flake, config, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"flakeCheck", "custom:test"}, ran())
+}
+
+func TestRun_IncrementalLocalOverride(t *testing.T) {
+	libHashFile := filepath.Join(t.TempDir(), "libhash")
+	require.NoError(t, os.WriteFile(libHashFile, []byte("sha256-lib1"), 0644))
+	logPath := installFakeNix(t, `case "$*" in
+  flake\ metadata*) echo '{"locked": {"narHash": "sha256-abc"}}';;
+  hash\ path*) cat '`+libHashFile+`';;
+esac`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {
+				Dir:            ".",
+				OverrideInputs: map[string]string{"lib": "path:./lib", "nixpkgs": "github:nixos/nixpkgs"},
+				Steps:          StepsConfig{FlakeCheck: FlakeCheckStep{Enable: true}},
+			},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	opts := RunOptions{Incremental: true, StateDir: t.TempDir()}
+
+	_, err = Run(context.Background(), flake, config, opts)
+	require.NoError(t, err)
+	results, err := Run(context.Background(), flake, config, opts)
+	require.NoError(t, err)
+	assert.Equal(t, StepCached, results[0].Steps["flakeCheck"].Status())
+
+	// Only the local override is hashed, and a change to it runs the step again
+	require.NoError(t, os.WriteFile(libHashFile, []byte("sha256-lib2"), 0644))
+	results, err = Run(context.Background(), flake, config, opts)
+	require.NoError(t, err)
+	assert.Equal(t, StepPassed, results[0].Steps["flakeCheck"].Status())
+
+	var hashed []string
+	for _, call := range readFakeNixLog(t, logPath) {
+		if strings.HasPrefix(call, "hash") {
+			hashed = append(hashed, call)
+		}
+	}
+	assert.Equal(t, []string{"hash path ./lib", "hash path ./lib", "hash path ./lib"}, hashed)
+}
+
+func TestRun_IncrementalFailuresRerun(t *testing.T) {
+	logPath := installFakeNix(t, `case "$*" in
+  flake\ metadata*) echo '{"locked": {"narHash": "sha256-abc"}}';;
+  flake\ check*) exit 1;;
+esac`)
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Dir: ".", Steps: StepsConfig{FlakeCheck: FlakeCheckStep{Enable: true}}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	opts := RunOptions{Incremental: true, StateDir: t.TempDir()}
+
+	for i := 0; i < 2; i++ {
+		results, err := Run(context.Background(), flake, config, opts)
+		require.NoError(t, err)
+		assert.Equal(t, StepFailed, results[0].Steps["flakeCheck"].Status())
+	}
+
+	checks := 0
+	for _, call := range readFakeNixLog(t, logPath) {
+		if strings.HasPrefix(call, "flake check") {
+			checks++
+		}
+	}
+	assert.Equal(t, 2, checks)
+}
@@ -0,0 +1,232 @@
+package ci
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+)
+
+// envNamePattern matches the environment variable names a step may set
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// resolve reads the value of the secret
+func (s Secret) resolve() (string, error) {
+	switch {
+	case s.File != "" && s.Env != "":
+		return "", fmt.Errorf("only one of file and env can be set")
+	case s.File != "":
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r"), nil
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", s.Env)
+		}
+		return value, nil
+	default:
+		return "", fmt.Errorf("one of file and env must be set")
+	}
+}
+
+// stepEnv is the environment of a custom step, with its secrets resolved
+type stepEnv struct {
+	// vars are the KEY=VALUE variables of CustomStep.Env, sorted
+	vars []string
+
+	// secrets are the KEY=VALUE variables of CustomStep.Secrets, sorted
+	secrets []string
+
+	// secretValues are the values of the secrets, to be redacted
+	secretValues []string
+}
+
+// newStepEnv resolves the environment variables and secrets of a step
+func newStepEnv(step CustomStep) (stepEnv, error) {
+	vars, err := stepEnvVars(step)
+	if err != nil {
+		return stepEnv{}, err
+	}
+	env := stepEnv{vars: vars}
+
+	for name, secret := range step.Secrets {
+		if !envNamePattern.MatchString(name) {
+			return stepEnv{}, fmt.Errorf("invalid secret name %q", name)
+		}
+		if _, ok := step.Env[name]; ok {
+			return stepEnv{}, fmt.Errorf("%s is set both in env and secrets", name)
+		}
+		value, err := secret.resolve()
+		if err != nil {
+			return stepEnv{}, fmt.Errorf("secret %s: %w", name, err)
+		}
+		env.secrets = append(env.secrets, name+"="+value)
+		env.secretValues = append(env.secretValues, value)
+	}
+
+	sort.Strings(env.secrets)
+	return env, nil
+}
+
+// stepEnvVars returns the KEY=VALUE variables of CustomStep.Env, sorted
+func stepEnvVars(step CustomStep) ([]string, error) {
+	var vars []string
+	for name, value := range step.Env {
+		if !envNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid environment variable name %q", name)
+		}
+		vars = append(vars, name+"="+value)
+	}
+	sort.Strings(vars)
+	return vars, nil
+}
+
+// localCustomStepCmd returns the nix command running the commands of a
+// custom step locally with its environment, registering its secrets with
+// out for redaction
+func localCustomStepCmd(step CustomStep, out *nix.OutputStream) (*nix.Cmd, error) {
+	env, err := newStepEnv(step)
+	if err != nil {
+		return nil, err
+	}
+	out.Redact(env.secretValues...)
+
+	cmd := nix.NewCmd()
+	cmd.Env = append(env.vars, env.secrets...)
+	return cmd, nil
+}
+
+// customStepLocation returns the directory a custom step runs in locally, or
+// "" for the current one. When the step has a working directory, the flake
+// and local input overrides returned are made absolute, so that they still
+// resolve from there.
+func customStepLocation(flake nix.FlakeURL, step CustomStep, overrides map[string]string) (string, nix.FlakeURL, map[string]string, error) {
+	if step.Cwd == "" {
+		return "", flake, overrides, nil
+	}
+
+	if filepath.IsAbs(step.Cwd) {
+		return "", flake, overrides, fmt.Errorf("cwd %s must be relative to the subflake directory", step.Cwd)
+	}
+	if !flake.IsLocal() {
+		return "", flake, overrides, fmt.Errorf("cwd is only supported for local flakes, not %s", flake)
+	}
+
+	flake, err := absFlakeURL(flake)
+	if err != nil {
+		return "", flake, overrides, err
+	}
+	dir := filepath.Join(flake.AsLocalPath(), step.Cwd)
+
+	var absOverrides map[string]string
+	if overrides != nil {
+		absOverrides = make(map[string]string, len(overrides))
+	}
+	for input, url := range overrides {
+		absURL, err := absFlakeURL(nix.NewFlakeURL(url))
+		if err != nil {
+			return "", flake, overrides, err
+		}
+		absOverrides[input] = absURL.String()
+	}
+	return dir, flake, absOverrides, nil
+}
+
+// absFlakeURL makes the path of a local flake URL absolute, dropping any
+// query parameters. Other flake URLs are returned as is.
+func absFlakeURL(flake nix.FlakeURL) (nix.FlakeURL, error) {
+	localPath := flake.AsLocalPath()
+	if localPath == "" || filepath.IsAbs(localPath) {
+		return flake, nil
+	}
+
+	absPath, err := filepath.Abs(localPath)
+	if err != nil {
+		return flake, fmt.Errorf("failed to resolve %s: %w", localPath, err)
+	}
+	if _, attr := flake.SplitAttr(); attr != "" {
+		absPath += "#" + attr
+	}
+	return nix.NewFlakeURL(absPath), nil
+}
+
+// remoteCustomStepCommand wraps command, a command of a custom step, to run
+// it on a remote host with the step environment and working directory.
+// Secrets are never part of the command line, which other users of the host
+// may see: the command exports them from a script read on its standard
+// input (see secretExports).
+func remoteCustomStepCommand(command []string, flake nix.FlakeURL, step CustomStep) ([]string, error) {
+	vars, err := stepEnvVars(step)
+	if err != nil {
+		return nil, err
+	}
+
+	var script []string
+	var wrapperArgs []string
+
+	if len(step.Secrets) > 0 {
+		script = append(script, `eval "$(cat)"`)
+	}
+
+	if step.Cwd != "" {
+		dir, err := remoteCustomStepDir(flake, step)
+		if err != nil {
+			return nil, err
+		}
+		script = append(script, `cd -- "$1"`, "shift")
+		wrapperArgs = append(wrapperArgs, dir)
+	}
+
+	if len(vars) > 0 {
+		command = append(append([]string{"env"}, vars...), command...)
+	}
+
+	if len(script) == 0 {
+		return command, nil
+	}
+
+	script = append(script, `exec "$@"`)
+	wrapper := []string{"sh", "-c", strings.Join(script, " && "), "sh"}
+	wrapper = append(wrapper, wrapperArgs...)
+	return append(wrapper, command...), nil
+}
+
+// secretExports returns the script exporting the secrets of a step, which
+// the command of remoteCustomStepCommand reads on its standard input, or
+// nil if the step has no secrets
+func secretExports(env stepEnv) io.Reader {
+	if len(env.secrets) == 0 {
+		return nil
+	}
+
+	var exports bytes.Buffer
+	for _, secret := range env.secrets {
+		name, value, _ := strings.Cut(secret, "=")
+		fmt.Fprintf(&exports, "export %s=%s\n", name, shellCommand([]string{value}))
+	}
+	return &exports
+}
+
+// remoteCustomStepDir returns the directory a custom step with a working
+// directory runs in on a remote host. The flake path is that of the remote
+// host, which must not depend on the directory the command runs in.
+func remoteCustomStepDir(flake nix.FlakeURL, step CustomStep) (string, error) {
+	localPath := flake.AsLocalPath()
+	if path.IsAbs(step.Cwd) {
+		return "", fmt.Errorf("cwd %s must be relative to the subflake directory", step.Cwd)
+	}
+	if !path.IsAbs(localPath) {
+		return "", fmt.Errorf("cwd on a remote host requires an absolute flake path, not %s", flake)
+	}
+	return path.Join(localPath, step.Cwd), nil
+}
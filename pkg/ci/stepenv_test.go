@@ -0,0 +1,223 @@
+package ci
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecret_Resolve(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(file, []byte("from-file\n"), 0600))
+	t.Setenv("OM_TEST_SECRET", "from-env")
+
+	value, err := Secret{File: file}.resolve()
+	require.NoError(t, err)
+	assert.Equal(t, "from-file", value)
+
+	value, err = Secret{Env: "OM_TEST_SECRET"}.resolve()
+	require.NoError(t, err)
+	assert.Equal(t, "from-env", value)
+
+	_, err = Secret{Env: "OM_TEST_UNSET_SECRET"}.resolve()
+	assert.ErrorContains(t, err, "environment variable OM_TEST_UNSET_SECRET is not set")
+
+	_, err = Secret{File: file, Env: "OM_TEST_SECRET"}.resolve()
+	assert.ErrorContains(t, err, "only one of file and env")
+
+	_, err = Secret{}.resolve()
+	assert.ErrorContains(t, err, "one of file and env must be set")
+}
+
+func TestNewStepEnv(t *testing.T) {
+	t.Setenv("OM_TEST_SECRET", "s3cret")
+
+	env, err := newStepEnv(CustomStep{
+		Env:     map[string]string{"B": "2", "A": "1"},
+		Secrets: map[string]Secret{"TOKEN": {Env: "OM_TEST_SECRET"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"A=1", "B=2"}, env.vars)
+	assert.Equal(t, []string{"TOKEN=s3cret"}, env.secrets)
+	assert.Equal(t, []string{"s3cret"}, env.secretValues)
+
+	_, err = newStepEnv(CustomStep{Env: map[string]string{"NOT-VALID": "x"}})
+	assert.ErrorContains(t, err, `invalid environment variable name "NOT-VALID"`)
+
+	_, err = newStepEnv(CustomStep{
+		Env:     map[string]string{"TOKEN": "x"},
+		Secrets: map[string]Secret{"TOKEN": {Env: "OM_TEST_SECRET"}},
+	})
+	assert.ErrorContains(t, err, "TOKEN is set both in env and secrets")
+
+	_, err = newStepEnv(CustomStep{Secrets: map[string]Secret{"TOKEN": {}}})
+	assert.ErrorContains(t, err, "secret TOKEN: one of file and env must be set")
+}
+
+func TestRunCustomStep_EnvCwdAndSecrets(t *testing.T) {
+	// The fake nix reports where it runs and what it sees
+	logPath := installFakeNix(t, `echo "pwd=$(pwd) greeting=$GREETING token=$TOKEN"`)
+
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sub", "tests"), 0755))
+	origDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer func() {
+		_ = os.Chdir(origDir)
+	}()
+	require.NoError(t, os.Chdir(root))
+
+	t.Setenv("OM_TEST_TOKEN", "s3cret")
+	step := CustomStep{
+		Type:    CustomStepTypeDevShell,
+		Command: []string{"make", "test"},
+		Env:     map[string]string{"GREETING": "hello"},
+		Cwd:     "tests",
+		Secrets: map[string]Secret{"TOKEN": {Env: "OM_TEST_TOKEN"}},
+	}
+
+	flake, err := nix.ParseFlakeURL("./sub")
+	require.NoError(t, err)
+	overrides := map[string]string{"dep": "./dep"}
+
+	out := newTestStream(t)
+	result := runCustomStep(context.Background(), flake, "test", step, overrides, out)
+	require.True(t, result.Success, result.Error)
+
+	// Relative paths are made absolute, as the step runs in another directory
+	calls := readFakeNixLog(t, logPath)
+	require.Len(t, calls, 1)
+	assert.Equal(t, "develop --override-input dep "+filepath.Join(root, "dep")+" "+filepath.Join(root, "sub")+" -c make test", calls[0])
+
+	testsDir, err := filepath.EvalSymlinks(filepath.Join(root, "sub", "tests"))
+	require.NoError(t, err)
+	assert.Contains(t, out.Tail(), "greeting=hello token=***")
+	assert.Contains(t, out.Tail(), "pwd="+testsDir)
+	assert.NotContains(t, out.Tail(), "s3cret")
+
+	// The working directory is only known for local flakes
+	remote, err := nix.ParseFlakeURL("github:org/repo")
+	require.NoError(t, err)
+	result = runCustomStep(context.Background(), remote, "test", step, nil, newTestStream(t))
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Error, "cwd is only supported for local flakes")
+}
+
+func TestRun_RedactsSecrets(t *testing.T) {
+	installFakeNix(t, `echo "leaking $TOKEN"; echo "error: bad token $TOKEN" >&2; exit 1`)
+
+	secretFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(secretFile, []byte("s3cret\n"), 0600))
+
+	config := Config{
+		Default: map[string]SubflakeConfig{
+			"main": {Dir: ".", Steps: StepsConfig{
+				Custom: map[string]CustomStep{
+					"deploy": {
+						StepPolicy: StepPolicy{Retries: 1, RetryBackoff: Duration(time.Millisecond)},
+						Type:       CustomStepTypeApp,
+						Secrets:    map[string]Secret{"TOKEN": {File: secretFile}},
+					},
+				},
+			}},
+		},
+	}
+
+	flake, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+
+	logDir := t.TempDir()
+	results, err := Run(context.Background(), flake, config, RunOptions{LogDir: logDir})
+	require.NoError(t, err)
+
+	step := results[0].Steps["custom:deploy"]
+	assert.False(t, step.Success)
+	assert.Contains(t, step.Output, "leaking ***")
+
+	data, err := os.ReadFile(step.LogFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "leaking ***")
+
+	resultJSON, err := json.Marshal(results)
+	require.NoError(t, err)
+	assert.Contains(t, string(resultJSON), "bad token ***")
+
+	for _, text := range []string{step.Output, string(data), string(resultJSON)} {
+		assert.NotContains(t, text, "s3cret")
+	}
+}
+
+func TestRemoteCustomStepCommand(t *testing.T) {
+	flake, err := nix.ParseFlakeURL("/nix/store/abc-source/sub")
+	require.NoError(t, err)
+	args := []string{"nix", "develop", "/nix/store/abc-source/sub#default", "-c", "make", "test"}
+
+	// Nothing to set, nothing to wrap
+	command, err := remoteCustomStepCommand(args, flake, CustomStep{})
+	require.NoError(t, err)
+	assert.Equal(t, args, command)
+
+	// Plain variables are passed with env
+	command, err = remoteCustomStepCommand(args, flake, CustomStep{Env: map[string]string{"CI": "true"}})
+	require.NoError(t, err)
+	assert.Equal(t, append([]string{"env", "CI=true"}, args...), command)
+
+	// Secrets are exported from stdin, never on the command line
+	command, err = remoteCustomStepCommand(args, flake, CustomStep{
+		Cwd:     "tests",
+		Secrets: map[string]Secret{"TOKEN": {Env: "OM_TEST_TOKEN"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, append([]string{
+		"sh", "-c", `eval "$(cat)" && cd -- "$1" && shift && exec "$@"`, "sh", "/nix/store/abc-source/sub/tests",
+	}, args...), command)
+
+	// The remote path must not depend on the login directory
+	relative, err := nix.ParseFlakeURL(".")
+	require.NoError(t, err)
+	_, err = remoteCustomStepCommand(args, relative, CustomStep{Cwd: "tests"})
+	assert.ErrorContains(t, err, "cwd on a remote host requires an absolute flake path")
+}
+
+func TestSecretExports(t *testing.T) {
+	t.Setenv("OM_TEST_TOKEN", "it's s3cret")
+
+	env, err := newStepEnv(CustomStep{Env: map[string]string{"CI": "true"}})
+	require.NoError(t, err)
+	assert.Nil(t, secretExports(env))
+
+	// The script exports the secret verbatim
+	env, err = newStepEnv(CustomStep{Secrets: map[string]Secret{"TOKEN": {Env: "OM_TEST_TOKEN"}}})
+	require.NoError(t, err)
+	stdin := secretExports(env)
+	require.NotNil(t, stdin)
+	data, err := io.ReadAll(stdin)
+	require.NoError(t, err)
+	assert.Equal(t, "export TOKEN='it'\\''s s3cret'\n", string(data))
+}
+
+func TestRunCustomStepRemote_Secrets(t *testing.T) {
+	t.Setenv("OM_TEST_TOKEN", "s3cret")
+	ssh := &fakeSSH{}
+	flake, err := nix.ParseFlakeURL("/nix/store/abc-source")
+	require.NoError(t, err)
+
+	step := CustomStep{
+		Type:    CustomStepTypeApp,
+		Secrets: map[string]Secret{"TOKEN": {Env: "OM_TEST_TOKEN"}},
+	}
+	result := runCustomStepRemote(context.Background(), ssh, "user@host", flake, "deploy", step, nil, newTestStream(t))
+	require.True(t, result.Success, result.Error)
+
+	require.Len(t, ssh.commands, 1)
+	assert.Equal(t, `user@host: sh -c eval "$(cat)" && exec "$@" sh nix run /nix/store/abc-source`, ssh.commands[0])
+	assert.Equal(t, []string{"export TOKEN=s3cret\n"}, ssh.stdins)
+}
@@ -5,10 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"github.com/saberzero1/omnix/pkg/ci"
+	"github.com/saberzero1/omnix/pkg/ci/dashboard"
+	"github.com/saberzero1/omnix/pkg/ci/report"
 	"github.com/saberzero1/omnix/pkg/common"
 	"github.com/saberzero1/omnix/pkg/nix"
+	"github.com/saberzero1/omnix/pkg/nix/store"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
@@ -24,12 +30,13 @@ The ci command provides comprehensive CI/CD automation including:
 - Building all flake outputs
 - Checking flake.lock is up to date  
 - Running flake checks
-- Generating GitHub Actions matrices`,
+- Generating job matrices for GitHub Actions, GitLab CI and Buildkite`,
 	}
 
 	// Add subcommands
 	ciCmd.AddCommand(newCIRunCmd())
 	ciCmd.AddCommand(newCIGHMatrixCmd())
+	ciCmd.AddCommand(newCIMatrixCmd())
 
 	return ciCmd
 }
@@ -40,12 +47,25 @@ func newCIRunCmd() *cobra.Command {
 		ciSystems        []string
 		ciGitHubOutput   bool
 		ciIncludeAllDeps bool
+		ciOnly           []string
+		ciExclude        []string
 		ciConfigPath     string
 		ciOutputPath     string
 		ciNoLink         bool
 		ciRemoteHost     string
+		ciOn             string
+		ciPool           bool
 		ciParallel       bool
 		ciMaxConcurrency int
+		ciReports        []string
+		ciLogDir         string
+		ciFailFast       bool
+		ciFailedLogLines int
+		ciIncremental    bool
+		ciStateDir       string
+		ciDashboard      bool
+		ciDryRun         bool
+		ciPlanFormat     string
 	)
 
 	cmd := &cobra.Command{
@@ -59,13 +79,26 @@ This command executes the configured CI steps from om.yaml including:
 - Flake check step: Runs 'nix flake check'
 - Custom steps: Execute custom commands
 
+A GitHub pull request URL runs CI on the head commit of the pull request,
+looked up with the GitHub API ($GITHUB_TOKEN is used if set).
+
+Configuration is read from the flake's 'om' output, falling back to om.yaml
+in the flake root. A URL fragment selects a named configuration, for
+example '.#release' uses 'ci.release' instead of 'ci.default'.
+
 Example:
   om ci run
   om ci run .
-  om ci run github:saberzero1/omnix`,
+  om ci run github:saberzero1/omnix
+  om ci run github:saberzero1/omnix#release
+  om ci run https://github.com/saberzero1/omnix/pull/42
+  om ci run --dry-run --format json`,
 		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx := context.Background()
+			// Steps run in their own process groups, so Ctrl-C doesn't reach
+			// them directly; cancelling the context kills them instead.
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
 			logger := common.Logger()
 
 			// Get flake URL (default to current directory)
@@ -74,21 +107,58 @@ Example:
 				flakeURL = args[0]
 			}
 
-			// Parse flake URL
-			flake, err := nix.ParseFlakeURL(flakeURL)
+			// Parse flake URL, resolving GitHub pull request URLs to their head commit
+			flake, err := ci.ResolveFlakeURL(ctx, ci.NewGitHubClientFromEnv(), flakeURL)
 			if err != nil {
 				return fmt.Errorf("failed to parse flake URL: %w", err)
 			}
+			if flake.String() != flakeURL {
+				logger.Info("Resolved pull request", zap.String("url", flakeURL), zap.String("flake", flake.String()))
+			}
 
-			// Load configuration
-			config, err := ci.LoadConfig(ciConfigPath)
+			reportSpecs, err := report.ParseSpecs(ciReports)
 			if err != nil {
-				return fmt.Errorf("failed to load config: %w", err)
+				return err
+			}
+			planFormat, err := ci.ParsePlanFormat(ciPlanFormat)
+			if err != nil {
+				return err
+			}
+
+			// A remote run reads the configuration from its copy of the flake
+			var remote *store.URI
+			if ciOn != "" {
+				if ciConfigPath != "" {
+					return fmt.Errorf("--config cannot be used with --on")
+				}
+				remote, err = store.ParseURI(ciOn)
+				if err != nil {
+					return fmt.Errorf("invalid --on store: %w", err)
+				}
+			}
+			// Remote hosts select the configuration with the fragment themselves
+			remoteFlake := flake
+
+			// Load configuration, either from an explicit file or from the flake itself
+			var config ci.Config
+			if remote == nil {
+				if ciConfigPath != "" {
+					config, err = ci.LoadConfig(ciConfigPath)
+				} else {
+					config, err = ci.LoadFlakeConfig(ctx, flake)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
 			}
 
-			// Determine systems to build for
+			// The fragment only selects the configuration; steps run against the flake itself
+			flake = flake.WithoutAttr()
+
+			// Determine systems to build for; a remote run defaults to the
+			// remote system, a pool to every system it supports
 			systems := ciSystems
-			if len(systems) == 0 {
+			if len(systems) == 0 && remote == nil && !ciPool {
 				// Default to current system
 				info, err := nix.GetInfo(ctx)
 				if err != nil {
@@ -99,24 +169,98 @@ Example:
 
 			logger.Info("Running CI", zap.String("flake", flake.String()), zap.Strings("systems", systems))
 
+			// Enable GitHub Actions integration automatically inside workflows
+			if !cmd.Flags().Changed("github-output") && ci.InGitHubActions() {
+				ciGitHubOutput = true
+			}
+
 			// Run CI
 			opts := ci.RunOptions{
 				Systems:                systems,
 				GitHubOutput:           ciGitHubOutput,
 				IncludeAllDependencies: ciIncludeAllDeps,
+				Only:                   ciOnly,
+				Exclude:                ciExclude,
 				RemoteHost:             ciRemoteHost,
 				Parallel:               ciParallel,
 				MaxConcurrency:         ciMaxConcurrency,
+				Output:                 os.Stderr,
+				LogDir:                 ciLogDir,
+				FailFast:               ciFailFast,
+				FailedLogLines:         ciFailedLogLines,
+				Incremental:            ciIncremental,
+				StateDir:               ciStateDir,
+				OmnixVersion:           cmd.Root().Version,
+				Observer:               ci.NewLogObserver(logger),
 			}
 
-			results, err := ci.Run(ctx, flake, config, opts)
-			if err != nil {
-				return fmt.Errorf("CI run failed: %w", err)
+			// Keep the built paths alive for as long as the out-link exists
+			if !ciNoLink && ciOutputPath != "" {
+				outLink, err := filepath.Abs(ciOutputPath)
+				if err != nil {
+					return fmt.Errorf("failed to resolve out-link: %w", err)
+				}
+				opts.GCRootDir = outLink + ".gcroots"
 			}
 
-			// Log results
-			for _, result := range results {
-				ci.LogResult(result, logger)
+			// Parallel runs on a terminal show a live dashboard; elsewhere
+			// their output is streamed as plain, prefixed lines
+			if !cmd.Flags().Changed("dashboard") {
+				ciDashboard = ciParallel && remote == nil && !ciPool && isTerminal()
+			}
+			if ciDashboard && !isTerminal() {
+				logger.Warn("Not showing the dashboard, as stdout is not a terminal")
+				ciDashboard = false
+			}
+			var board *dashboard.Dashboard
+			if ciDashboard {
+				// Ctrl-C reaches the dashboard as a key press instead of SIGINT
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				defer cancel()
+				board = dashboard.New(os.Stdout, dashboard.Options{Input: os.Stdin, Interrupt: cancel})
+				opts.Output = nil
+				opts.Observer = board
+			}
+
+			// A dry run prints what would run, without running anything.
+			// The dashboard is chosen first, as nix reports its activity to
+			// it, which changes the nix commands planned.
+			if ciDryRun {
+				plan, err := ci.NewPlan(flake, config, opts)
+				if err != nil {
+					return err
+				}
+				return ci.WritePlan(cmd.OutOrStdout(), planFormat, plan)
+			}
+
+			if board != nil {
+				if err := board.Start(); err != nil {
+					return err
+				}
+				defer board.Stop()
+			}
+
+			// On error, results still hold everything that ran; write them out first
+			var results []ci.Result
+			var runErr error
+			switch {
+			case remote != nil:
+				logger.Info("Running CI remotely", zap.String("store", remote.String()))
+				results, runErr = ci.RunRemote(ctx, remote, remoteFlake, opts)
+			case ciPool:
+				logger.Info("Running CI on the builder pool", zap.Int("builders", len(config.Pool)))
+				results, runErr = ci.RunPool(ctx, remoteFlake, config, opts)
+			default:
+				results, runErr = ci.Run(ctx, flake, config, opts)
+			}
+
+			// Results are logged once the dashboard gives the screen back
+			if board != nil {
+				board.Stop()
+				for _, result := range results {
+					ci.LogResult(result, logger)
+				}
 			}
 
 			// Write results to file if requested
@@ -133,6 +277,15 @@ Example:
 				logger.Info("Results written", zap.String("path", ciOutputPath))
 			}
 
+			// Write additional reports (JUnit, TAP) if requested
+			if err := report.WriteAll(reportSpecs, results); err != nil {
+				return err
+			}
+
+			if runErr != nil {
+				return fmt.Errorf("CI run failed: %w", runErr)
+			}
+
 			// Check if any results failed
 			hasFailures := false
 			for _, result := range results {
@@ -152,14 +305,31 @@ Example:
 	}
 
 	cmd.Flags().StringSliceVar(&ciSystems, "systems", nil, "Systems to build for (e.g., x86_64-linux,aarch64-darwin)")
-	cmd.Flags().BoolVar(&ciGitHubOutput, "github-output", false, "Print GitHub Actions log groups")
-	cmd.Flags().BoolVar(&ciIncludeAllDeps, "include-all-dependencies", false, "Include all dependencies in results")
-	cmd.Flags().StringVarP(&ciConfigPath, "config", "c", "om.yaml", "Path to om.yaml configuration file")
+	cmd.Flags().BoolVar(&ciGitHubOutput, "github-output", false, "Print GitHub Actions log groups and annotations, and write the job summary and outputs (default: true inside GitHub Actions)")
+	cmd.Flags().BoolVar(&ciIncludeAllDeps, "include-all-dependencies", false, "Record the full runtime and build-time closure in the results, and keep it from being garbage collected")
+	cmd.Flags().StringArrayVar(&ciOnly, "only", nil, "Only build the outputs matching this attribute pattern (e.g. 'packages.*.default'), instead of the build step's include patterns; repeatable")
+	cmd.Flags().StringArrayVar(&ciExclude, "exclude", nil, "Do not build the outputs matching this attribute pattern (e.g. 'nixosConfigurations.*'); repeatable")
+	cmd.Flags().StringVarP(&ciConfigPath, "config", "c", "", "Path to om.yaml configuration file (default: the flake's om config)")
 	cmd.Flags().StringVarP(&ciOutputPath, "out-link", "o", "result.json", "Path to output results JSON")
 	cmd.Flags().BoolVar(&ciNoLink, "no-link", false, "Do not create output results file")
 	cmd.Flags().StringVar(&ciRemoteHost, "remote", "", "Remote host for SSH-based builds (e.g., user@host)")
-	cmd.Flags().BoolVar(&ciParallel, "parallel", false, "Run subflakes in parallel")
-	cmd.Flags().IntVar(&ciMaxConcurrency, "max-concurrency", 0, "Maximum number of parallel builds (0 = unlimited)")
+	cmd.Flags().StringVar(&ciOn, "on", "", "Copy the flake to a remote store and run CI there (e.g., ssh://user@host, ssh://user@host?copy-inputs=true)")
+	cmd.Flags().BoolVar(&ciPool, "pool", false, "Distribute subflakes and systems across the remote builders configured in ci.pool")
+	cmd.MarkFlagsMutuallyExclusive("on", "remote", "pool")
+	_ = cmd.Flags().MarkDeprecated("remote", "use --on ssh://<host> instead, which also works for local flakes")
+	cmd.Flags().BoolVar(&ciParallel, "parallel", false, "Run subflakes, and independent steps within them, in parallel")
+	cmd.Flags().IntVar(&ciMaxConcurrency, "max-concurrency", 0, "Maximum number of steps running at once with --parallel (0 = unlimited)")
+	cmd.Flags().BoolVar(&ciDashboard, "dashboard", false, "Show a live dashboard of the running steps, following the log of one with enter (default: true with --parallel when stdout is a terminal)")
+	cmd.Flags().BoolVar(&ciDryRun, "dry-run", false, "Print the subflakes, steps and commands CI would run, without running anything")
+	cmd.Flags().StringVar(&ciPlanFormat, "format", string(ci.PlanFormatTable), "Format of the --dry-run plan: table or json")
+	cmd.MarkFlagsMutuallyExclusive("dry-run", "on")
+	cmd.MarkFlagsMutuallyExclusive("dry-run", "pool")
+	cmd.Flags().StringSliceVar(&ciReports, "report", nil, "Write reports as format=path (formats: junit, tap), e.g. junit=junit.xml,tap=results.tap")
+	cmd.Flags().BoolVar(&ciFailFast, "fail-fast", false, "Stop at the first failing step, cancelling everything still running")
+	cmd.Flags().IntVar(&ciFailedLogLines, "failed-log-lines", 0, "Number of build log lines to keep in the results for each failed derivation (default 25)")
+	cmd.Flags().BoolVar(&ciIncremental, "incremental", false, "Skip steps that passed before with the same flake source and configuration, reporting them as cached")
+	cmd.Flags().StringVar(&ciStateDir, "state-dir", "", "Directory recording passed steps for --incremental and closure size baselines (default: ~/.cache/omnix/ci)")
+	cmd.Flags().StringVar(&ciLogDir, "log-dir", "", "Directory to write the full output of each step to, as <subflake>/<step>.log")
 
 	return cmd
 }
@@ -172,19 +342,40 @@ func newCIGHMatrixCmd() *cobra.Command {
 	)
 
 	cmd := &cobra.Command{
-		Use:   "gh-matrix",
+		Use:   "gh-matrix [flake-url]",
 		Short: "Generate GitHub Actions matrix",
 		Long: `Generate a GitHub Actions matrix configuration for multi-platform builds.
 
 The matrix includes all combinations of systems and subflakes that should be built,
 taking into account system whitelists and skip flags.
 
+Configuration is read from the flake's 'om' output, falling back to om.yaml
+in the flake root. A URL fragment selects a named configuration.
+
 Example:
   om ci gh-matrix
-  om ci gh-matrix --systems x86_64-linux,aarch64-darwin`,
+  om ci gh-matrix --systems x86_64-linux,aarch64-darwin
+  om ci gh-matrix .#release`,
+		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// Load configuration
-			config, err := ci.LoadConfig(ciConfigPath)
+			ctx := context.Background()
+
+			flakeURL := "."
+			if len(args) > 0 {
+				flakeURL = args[0]
+			}
+			flake, err := nix.ParseFlakeURL(flakeURL)
+			if err != nil {
+				return fmt.Errorf("failed to parse flake URL: %w", err)
+			}
+
+			// Load configuration, either from an explicit file or from the flake itself
+			var config ci.Config
+			if ciConfigPath != "" {
+				config, err = ci.LoadConfig(ciConfigPath)
+			} else {
+				config, err = ci.LoadFlakeConfig(ctx, flake)
+			}
 			if err != nil {
 				return fmt.Errorf("failed to load config: %w", err)
 			}
@@ -199,7 +390,7 @@ Example:
 			}
 
 			// Print to stdout
-			fmt.Println(jsonOutput)
+			fmt.Fprintln(cmd.OutOrStdout(), jsonOutput)
 
 			// Log summary
 			logger := common.Logger()
@@ -212,7 +403,95 @@ Example:
 	}
 
 	cmd.Flags().StringSliceVar(&ciSystems, "systems", []string{"x86_64-linux"}, "Systems to include in matrix")
-	cmd.Flags().StringVarP(&ciConfigPath, "config", "c", "om.yaml", "Path to om.yaml configuration file")
+	cmd.Flags().StringVarP(&ciConfigPath, "config", "c", "", "Path to om.yaml configuration file (default: the flake's om config)")
+
+	return cmd
+}
+
+// newCIMatrixCmd creates the ci matrix command
+func newCIMatrixCmd() *cobra.Command {
+	var (
+		ciSystems    []string
+		ciConfigPath string
+		ciFormat     string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "matrix [flake-url]",
+		Short: "Generate a CI job matrix or pipeline",
+		Long: `Generate a job per system and subflake for external CI services.
+
+Formats:
+  github     GitHub Actions matrix JSON, as printed by gh-matrix
+  gitlab     GitLab CI child pipeline running 'om ci run' in every job
+  buildkite  Buildkite pipeline running 'om ci run' in every step
+  jsonl      One JSON object per job, with the command to run
+
+Jobs are sent to the runners configured for their system under ci.runners:
+GitLab runner tags and Buildkite agent queues. Without --systems, the
+systems with a runner are used, or else the current system.
+
+Example:
+  om ci matrix --format gitlab > child-pipeline.yml
+  om ci matrix --format buildkite | buildkite-agent pipeline upload
+  om ci matrix --format jsonl --systems x86_64-linux,aarch64-darwin .#release`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+
+			format, err := ci.ParseMatrixFormat(ciFormat)
+			if err != nil {
+				return err
+			}
+
+			flakeURL := "."
+			if len(args) > 0 {
+				flakeURL = args[0]
+			}
+			flake, err := nix.ParseFlakeURL(flakeURL)
+			if err != nil {
+				return fmt.Errorf("failed to parse flake URL: %w", err)
+			}
+
+			var config ci.Config
+			if ciConfigPath != "" {
+				config, err = ci.LoadConfig(ciConfigPath)
+			} else {
+				config, err = ci.LoadFlakeConfig(ctx, flake)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			systems := ciSystems
+			if len(systems) == 0 {
+				systems = config.RunnerSystems()
+			}
+			if len(systems) == 0 {
+				info, err := nix.GetInfo(ctx)
+				if err != nil {
+					return fmt.Errorf("failed to get nix info: %w", err)
+				}
+				systems = []string{info.Config.System.Value}
+			}
+
+			matrix := ci.GenerateMatrix(systems, config)
+			if err := ci.WriteMatrix(cmd.OutOrStdout(), format, matrix, flake, config.Runners); err != nil {
+				return err
+			}
+
+			common.Logger().Info("Generated matrix",
+				zap.String("format", string(format)),
+				zap.Int("rows", matrix.Count()),
+				zap.Strings("systems", systems))
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&ciFormat, "format", string(ci.MatrixFormatGitHub), "Output format: github, gitlab, buildkite or jsonl")
+	cmd.Flags().StringSliceVar(&ciSystems, "systems", nil, "Systems to include in the matrix (default: the systems in ci.runners)")
+	cmd.Flags().StringVarP(&ciConfigPath, "config", "c", "", "Path to om.yaml configuration file (default: the flake's om config)")
 
 	return cmd
 }
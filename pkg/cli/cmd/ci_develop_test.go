@@ -58,12 +58,25 @@ func TestCIRunCommand_AllFlags(t *testing.T) {
 		"systems",
 		"github-output",
 		"include-all-dependencies",
+		"only",
+		"exclude",
 		"config",
 		"out-link",
 		"no-link",
 		"remote",
+		"on",
+		"pool",
 		"parallel",
 		"max-concurrency",
+		"dashboard",
+		"dry-run",
+		"format",
+		"report",
+		"log-dir",
+		"fail-fast",
+		"failed-log-lines",
+		"incremental",
+		"state-dir",
 	}
 
 	for _, flagName := range flags {
@@ -90,7 +103,7 @@ ci:
 	// Test the command can be created
 	cmd := newCIGHMatrixCmd()
 	assert.NotNil(t, cmd)
-	assert.Equal(t, "gh-matrix", cmd.Use)
+	assert.Equal(t, "gh-matrix [flake-url]", cmd.Use)
 }
 
 func TestCIGHMatrixCommand_Help(t *testing.T) {
@@ -121,6 +134,35 @@ func TestCIGHMatrixCommand_AllFlags(t *testing.T) {
 	}
 }
 
+func TestCIMatrixCommand(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "om.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`
+ci:
+  default:
+    main:
+      dir: "."
+  runners:
+    x86_64-linux:
+      queue: linux
+`), 0644))
+
+	cmd := newCIMatrixCmd()
+	var buf bytes.Buffer
+	cmd.SetOut(&buf)
+	cmd.SetArgs([]string{"--format", "buildkite", "--config", configPath})
+	require.NoError(t, cmd.Execute())
+
+	// Systems default to those with a runner
+	assert.Contains(t, buf.String(), "command: om ci run --systems x86_64-linux '.#default.main'")
+	assert.Contains(t, buf.String(), "queue: linux")
+
+	cmd = newCIMatrixCmd()
+	cmd.SetOut(&buf)
+	cmd.SetErr(&buf)
+	cmd.SetArgs([]string{"--format", "circleci", "--config", configPath})
+	assert.ErrorContains(t, cmd.Execute(), `unknown matrix format "circleci"`)
+}
+
 func TestDevelopCommand(t *testing.T) {
 	// Test the command can be created
 	cmd := NewDevelopCmd()
@@ -14,7 +14,7 @@ func TestNewHealthCmd(t *testing.T) {
 	cmd := NewHealthCmd()
 
 	assert.NotNil(t, cmd)
-	assert.Equal(t, "health", cmd.Use)
+	assert.Equal(t, "health [flake-url]", cmd.Use)
 	assert.Contains(t, cmd.Short, "Check the health")
 
 	// Test flags are registered
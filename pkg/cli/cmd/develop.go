@@ -27,10 +27,14 @@ The develop workflow:
 1. Pre-shell: Run health checks to ensure Nix environment is properly configured
 2. Post-shell: Display project README as a welcome message
 
+Configuration is read from the flake's 'om' output, falling back to om.yaml
+in the flake root. A URL fragment selects a named configuration.
+
 Example:
   om develop
   om develop .
-  om develop github:saberzero1/omnix`,
+  om develop github:saberzero1/omnix
+  om develop .#minimal`,
 		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := context.Background()
@@ -50,18 +54,17 @@ Example:
 
 			logger.Info("Setting up development environment", zap.String("flake", flake.String()))
 
-			// Load configuration
+			// Load configuration, either from an explicit file or from the flake itself
 			var config develop.Config
 			if developConfigPath != "" {
 				config, err = develop.LoadConfig(developConfigPath)
-				if err != nil {
-					// If config doesn't exist, use defaults
-					logger.Debug("Using default config", zap.Error(err))
-					config = develop.DefaultConfig()
-				}
 			} else {
-				config = develop.DefaultConfig()
+				config, err = develop.LoadFlakeConfig(ctx, flake)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
 			}
+			flake = flake.WithoutAttr()
 
 			// Create project
 			project, err := develop.NewProject(ctx, flake, config)
@@ -78,7 +81,7 @@ Example:
 		},
 	}
 
-	cmd.Flags().StringVarP(&developConfigPath, "config", "c", "om.yaml", "Path to om.yaml configuration file")
+	cmd.Flags().StringVarP(&developConfigPath, "config", "c", "", "Path to om.yaml configuration file (default: the flake's om config)")
 
 	return cmd
 }
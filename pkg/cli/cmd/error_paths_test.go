@@ -2,11 +2,22 @@ package cmd
 
 import (
 	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// installFakeNix puts a nix executable running script first in PATH
+func installFakeNix(t *testing.T, script string) {
+	t.Helper()
+	binDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "nix"), []byte("#!/bin/sh\n"+script+"\n"), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
 // TestShowCommand_InvalidFlake tests error handling for invalid flake paths
 func TestShowCommand_InvalidFlake(t *testing.T) {
 	if testing.Short() {
@@ -34,6 +45,56 @@ func TestDevelopCommand_Args(t *testing.T) {
 	assert.NotNil(t, cmd.Args)
 }
 
+// TestDevelopCommand_ConfigError tests that a broken config is not ignored
+func TestDevelopCommand_ConfigError(t *testing.T) {
+	installFakeNix(t, `echo "error: flake 'path:.' is broken" >&2; exit 1`)
+
+	for _, args := range [][]string{
+		{"--config", filepath.Join(t.TempDir(), "missing.yaml"), "."},
+		{"."},
+	} {
+		cmd := NewDevelopCmd()
+		var buf bytes.Buffer
+		cmd.SetOut(&buf)
+		cmd.SetErr(&buf)
+		cmd.SetArgs(args)
+
+		err := cmd.Execute()
+		assert.ErrorContains(t, err, "failed to load config")
+	}
+}
+
+// TestCIGHMatrixCommand_FlakeConfig tests that gh-matrix reads the om config of the flake
+func TestCIGHMatrixCommand_FlakeConfig(t *testing.T) {
+	installFakeNix(t, `echo "error: flake does not provide attribute 'om'" >&2; exit 1`)
+
+	dir := t.TempDir()
+	configContent := `ci:
+  default:
+    docs:
+      dir: doc
+  release:
+    main:
+      dir: "."
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "om.yaml"), []byte(configContent), 0644))
+
+	cmd := newCIGHMatrixCmd()
+	var buf bytes.Buffer
+	cmd.SetOut(&buf)
+	cmd.SetArgs([]string{dir + "#release"})
+	require.NoError(t, cmd.Execute())
+	assert.Contains(t, buf.String(), `"subflake": "main"`)
+	assert.NotContains(t, buf.String(), "docs")
+
+	// A missing named configuration is an error
+	cmd = newCIGHMatrixCmd()
+	cmd.SetOut(&buf)
+	cmd.SetErr(&buf)
+	cmd.SetArgs([]string{dir + "#typo"})
+	assert.ErrorContains(t, cmd.Execute(), "missing configuration attribute: typo")
+}
+
 // TestCIRunCommand_Args tests argument parsing
 func TestCIRunCommand_Args(t *testing.T) {
 	cmd := newCIRunCmd()
@@ -17,7 +17,7 @@ var (
 // NewHealthCmd creates the health command
 func NewHealthCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "health",
+		Use:   "health [flake-url]",
 		Short: "Check the health of your Nix installation",
 		Long: `Check the health of your Nix installation.
 
@@ -30,7 +30,12 @@ configured and meets recommended standards. It checks:
   
 The command will exit with code 0 if all required checks pass, or 1 if any
 required checks fail. Non-required checks that fail will produce warnings but
-won't affect the exit code.`,
+won't affect the exit code.
+
+If a flake URL is given, the health configuration is read from the flake's
+'om' output (or om.yaml in the flake root). A URL fragment selects a named
+configuration, for example '.#strict' uses 'health.strict'.`,
+		Args: cobra.MaximumNArgs(1),
 		RunE: runHealth,
 	}
 
@@ -48,8 +53,18 @@ func runHealth(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to get Nix info: %w", err)
 	}
 
-	// Create health checks with default configuration
+	// Create health checks, applying the flake's configuration if one was given
 	healthChecks := health.Default()
+	if len(args) > 0 {
+		flake, err := nix.ParseFlakeURL(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse flake URL: %w", err)
+		}
+		healthChecks, err = health.NewFromFlake(ctx, flake)
+		if err != nil {
+			return fmt.Errorf("failed to load health config: %w", err)
+		}
+	}
 
 	// Run all checks
 	results := healthChecks.RunAllChecks(ctx, nixInfo)
@@ -261,6 +261,7 @@ func TestCIRunCommand_WithSystems(t *testing.T) {
 	cmd.SetArgs([]string{
 		"--config", configFile,
 		"--systems", "x86_64-linux",
+		"--out-link", filepath.Join(tmpDir, "result.json"),
 		".",
 	})
 
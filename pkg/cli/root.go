@@ -6,6 +6,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"github.com/saberzero1/omnix/pkg/ci"
 	"github.com/saberzero1/omnix/pkg/cli/cmd"
 	"github.com/saberzero1/omnix/pkg/common"
 )
@@ -22,6 +23,7 @@ var (
 func SetVersion(v, c string) {
 	version = v
 	commit = c
+	ci.SetOmnixCommit(c)
 	if commit != "dev" && len(commit) > 7 {
 		commit = commit[:7]
 	}
@@ -0,0 +1,52 @@
+package common
+
+import "testing"
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{1288490189, "1.2 GiB"},
+		{-5 * 1024 * 1024, "-5.0 MiB"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatBytes(tt.n); got != tt.want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+	}{
+		{"4096", 4096},
+		{"60MB", 60000000},
+		{"60 mb", 60000000},
+		{"1.5GiB", 1610612736},
+		{"2 KiB", 2048},
+		{"10B", 10},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseBytes(tt.s)
+		if err != nil {
+			t.Errorf("ParseBytes(%q) returned error: %v", tt.s, err)
+		} else if got != tt.want {
+			t.Errorf("ParseBytes(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"", "MB", "12 parsecs", "-5MB"} {
+		if _, err := ParseBytes(s); err == nil {
+			t.Errorf("ParseBytes(%q) succeeded, want error", s)
+		}
+	}
+}
@@ -1,12 +1,20 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/saberzero1/omnix/pkg/nix/flake"
 	"gopkg.in/yaml.v3"
 )
 
+// omConfigFile is the name of the configuration file looked up in the flake root
+const omConfigFile = "om.yaml"
+
 // OmConfig represents the omnix configuration with additional metadata
 // about the flake URL and reference.
 type OmConfig struct {
@@ -150,3 +158,91 @@ func ParseJSONConfig(jsonContent string) (*OmConfigTree, error) {
 	}
 	return tree, nil
 }
+
+// GetOmConfig fetches the omnix configuration for the given flake URL.
+//
+// The `om` flake output is evaluated first. If the flake does not provide it,
+// `om.yaml` in the flake root is used instead; remote flakes are fetched to the
+// Nix store to look it up. If neither exists, an empty configuration is returned
+// so that callers fall back to their defaults.
+//
+// The part of the flake URL after `#` becomes the Reference, which selects the
+// sub-config to use (see GetSubConfigUnder).
+func GetOmConfig(ctx context.Context, cmd flake.Cmd, flakeURL string) (*OmConfig, error) {
+	base, attr, _ := strings.Cut(flakeURL, "#")
+
+	reference := []string{}
+	if attr != "" {
+		reference = flake.NewAttr(attr).AsList()
+	}
+
+	tree, err := omConfigFromFlake(ctx, cmd, base)
+	if err != nil {
+		return nil, err
+	}
+
+	if tree == nil {
+		tree, err = omConfigFromYAML(ctx, cmd, base)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &OmConfig{
+		FlakeURL:  base,
+		Reference: reference,
+		Config:    tree,
+	}, nil
+}
+
+// omConfigFromFlake evaluates the `om` flake output.
+// Returns nil if the flake does not define it.
+func omConfigFromFlake(ctx context.Context, cmd flake.Cmd, base string) (*OmConfigTree, error) {
+	data, err := flake.EvalMaybe[map[string]map[string]json.RawMessage](ctx, cmd, nil, base+"#om")
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate om config of %s: %w", base, err)
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	return &OmConfigTree{data: *data}, nil
+}
+
+// omConfigFromYAML reads om.yaml from the flake root.
+// Returns an empty tree if the file does not exist.
+func omConfigFromYAML(ctx context.Context, cmd flake.Cmd, base string) (*OmConfigTree, error) {
+	dir := localFlakePath(base)
+	if dir == "" {
+		metadata, err := flake.GetMetadata(ctx, cmd, base)
+		if err != nil {
+			return nil, err
+		}
+		dir = metadata.Path
+	}
+
+	path := filepath.Join(dir, omConfigFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			Logger().Debug(fmt.Sprintf("%s does not exist; using default config", path))
+			return NewOmConfigTree(), nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	return ParseYAMLConfig(string(data))
+}
+
+// localFlakePath returns the directory of a path-like flake URL, or empty string
+// if the flake URL does not point to a local path.
+func localFlakePath(flakeURL string) string {
+	s := strings.TrimPrefix(flakeURL, "path:")
+	if !strings.HasPrefix(s, ".") && !strings.HasPrefix(s, "/") {
+		return ""
+	}
+	if idx := strings.IndexByte(s, '?'); idx != -1 {
+		s = s[:idx]
+	}
+	return s
+}
@@ -1,7 +1,12 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -241,3 +246,123 @@ func TestParseJSONConfig_InvalidJSON(t *testing.T) {
 		t.Error("ParseJSONConfig() should return error for invalid JSON")
 	}
 }
+
+// fakeFlakeCmd is a flake.Cmd that answers `nix eval` and `nix flake metadata`
+// from canned values.
+type fakeFlakeCmd struct {
+	evalOutput string
+	evalErr    error
+	storePath  string
+	calls      [][]string
+}
+
+func (f *fakeFlakeCmd) Run(_ context.Context, args ...string) (string, error) {
+	f.calls = append(f.calls, args)
+	switch args[0] {
+	case "eval":
+		return f.evalOutput, f.evalErr
+	case "flake":
+		return fmt.Sprintf(`{"path": %q}`, f.storePath), nil
+	}
+	return "", fmt.Errorf("unexpected command: %v", args)
+}
+
+func TestGetOmConfig_FromFlakeOutput(t *testing.T) {
+	cmd := &fakeFlakeCmd{evalOutput: `{"ci": {"default": {"build": true}, "release": {"build": false}}}`}
+
+	config, err := GetOmConfig(context.Background(), cmd, "github:org/repo#release.tests")
+	if err != nil {
+		t.Fatalf("GetOmConfig() failed: %v", err)
+	}
+
+	if config.FlakeURL != "github:org/repo" {
+		t.Errorf("FlakeURL = %q, want %q", config.FlakeURL, "github:org/repo")
+	}
+	if strings.Join(config.Reference, ".") != "release.tests" {
+		t.Errorf("Reference = %v, want [release tests]", config.Reference)
+	}
+
+	evalArgs := strings.Join(cmd.calls[0], " ")
+	if !strings.Contains(evalArgs, "github:org/repo#om") {
+		t.Errorf("expected evaluation of the om output, got %q", evalArgs)
+	}
+
+	var result map[string]bool
+	rest, err := config.GetSubConfigUnder("ci", nil, &result)
+	if err != nil {
+		t.Fatalf("GetSubConfigUnder() failed: %v", err)
+	}
+	if result["build"] {
+		t.Error("expected the 'release' config to be selected")
+	}
+	if len(rest) != 1 || rest[0] != "tests" {
+		t.Errorf("rest = %v, want [tests]", rest)
+	}
+}
+
+func TestGetOmConfig_FallsBackToYAML(t *testing.T) {
+	missing := fmt.Errorf("error: flake 'x' does not provide attribute 'om'")
+
+	tests := []struct {
+		name     string
+		flakeURL func(dir string) string
+		local    bool
+	}{
+		{name: "local flake", flakeURL: func(dir string) string { return dir }, local: true},
+		{name: "remote flake", flakeURL: func(string) string { return "github:org/repo" }, local: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			yamlContent := "health:\n  default:\n    caches:\n      required: [\"https://example.org\"]\n"
+			if err := os.WriteFile(filepath.Join(dir, "om.yaml"), []byte(yamlContent), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := &fakeFlakeCmd{evalErr: missing, storePath: dir}
+			config, err := GetOmConfig(context.Background(), cmd, tt.flakeURL(dir))
+			if err != nil {
+				t.Fatalf("GetOmConfig() failed: %v", err)
+			}
+
+			var result map[string]interface{}
+			if err := config.Config.Get("health", &result); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := result["default"]; !ok {
+				t.Errorf("expected om.yaml to be loaded, got %v", result)
+			}
+
+			fetched := len(cmd.calls) > 1
+			if fetched == tt.local {
+				t.Errorf("flake metadata fetched = %v, want %v", fetched, !tt.local)
+			}
+		})
+	}
+}
+
+func TestGetOmConfig_NoConfig(t *testing.T) {
+	cmd := &fakeFlakeCmd{evalErr: fmt.Errorf("does not provide attribute 'om'")}
+
+	config, err := GetOmConfig(context.Background(), cmd, t.TempDir())
+	if err != nil {
+		t.Fatalf("GetOmConfig() failed: %v", err)
+	}
+
+	var result map[string]interface{}
+	if _, err := config.GetSubConfigUnder("ci", nil, &result); err != nil {
+		t.Errorf("GetSubConfigUnder() on empty config failed: %v", err)
+	}
+	if result != nil {
+		t.Errorf("expected no ci config, got %v", result)
+	}
+}
+
+func TestGetOmConfig_EvalError(t *testing.T) {
+	cmd := &fakeFlakeCmd{evalErr: fmt.Errorf("syntax error")}
+
+	if _, err := GetOmConfig(context.Background(), cmd, "."); err == nil {
+		t.Error("GetOmConfig() should fail on evaluation errors")
+	}
+}
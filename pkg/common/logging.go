@@ -3,6 +3,7 @@ package common
 
 import (
 	"os"
+	"sync"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -24,7 +25,11 @@ const (
 	TraceLevel
 )
 
-var logger *zap.Logger
+var (
+	logger *zap.Logger
+	// loggerMu guards logger, which is used from concurrently running CI steps
+	loggerMu sync.Mutex
+)
 
 // SetupLogging configures logging for the entire application
 // verbosity: the log level (0=error, 1=warn, 2=info, 3=debug, 4=trace)
@@ -58,13 +63,16 @@ func SetupLogging(verbosity LogLevel, bare bool) error {
 		}
 	}
 
-	var err error
-	logger, err = config.Build()
+	built, err := config.Build()
 	if err != nil {
 		return err
 	}
 
-	zap.ReplaceGlobals(logger)
+	loggerMu.Lock()
+	logger = built
+	loggerMu.Unlock()
+
+	zap.ReplaceGlobals(built)
 	return nil
 }
 
@@ -88,6 +96,9 @@ func getZapLevel(level LogLevel) zapcore.Level {
 
 // Logger returns the global logger instance
 func Logger() *zap.Logger {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+
 	if logger == nil {
 		// Create a default logger if SetupLogging wasn't called
 		logger, _ = zap.NewProduction()
@@ -97,8 +108,12 @@ func Logger() *zap.Logger {
 
 // Sync flushes any buffered log entries
 func Sync() error {
-	if logger != nil {
-		return logger.Sync()
+	loggerMu.Lock()
+	l := logger
+	loggerMu.Unlock()
+
+	if l != nil {
+		return l.Sync()
 	}
 	return nil
 }
@@ -1,10 +1,13 @@
 package develop
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 
+	"github.com/saberzero1/omnix/pkg/common"
+	"github.com/saberzero1/omnix/pkg/nix"
 	"gopkg.in/yaml.v3"
 )
 
@@ -76,18 +79,49 @@ func LoadConfig(path string) (Config, error) {
 		return Config{}, fmt.Errorf("failed to parse config YAML: %w", err)
 	}
 
-	// Apply defaults
-	if config.Develop.Readme.File == "" {
-		config.Develop.Readme.File = "README.md"
+	config.Develop.applyDefaults()
+	return config.Develop, nil
+}
+
+// LoadFlakeConfig loads the develop configuration of a flake from its `om`
+// output (or om.yaml in the flake root). The flake URL fragment selects the
+// configuration to use, e.g. `.#minimal` uses `develop.minimal`.
+func LoadFlakeConfig(ctx context.Context, flake nix.FlakeURL) (Config, error) {
+	om, err := common.GetOmConfig(ctx, nix.NewCmd(), flake.String())
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to load om config: %w", err)
+	}
+
+	return FromOmConfig(om)
+}
+
+// FromOmConfig extracts the develop configuration referenced by om.Reference.
+// If the om config has no `develop` section, DefaultConfig is returned.
+func FromOmConfig(om *common.OmConfig) (Config, error) {
+	var config *Config
+	if _, err := om.GetSubConfigUnder("develop", nil, &config); err != nil {
+		return Config{}, fmt.Errorf("failed to get develop config: %w", err)
+	}
+
+	if config == nil {
+		return DefaultConfig(), nil
+	}
+
+	config.applyDefaults()
+	return *config, nil
+}
+
+// applyDefaults fills in defaults for unset fields
+func (c *Config) applyDefaults() {
+	if c.Readme.File == "" {
+		c.Readme.File = "README.md"
 	}
 
 	// Apply health check defaults
 	defaults := DefaultConfig()
-	if config.Develop.HealthChecks == (HealthChecksConfig{}) {
-		config.Develop.HealthChecks = defaults.HealthChecks
+	if c.HealthChecks == (HealthChecksConfig{}) {
+		c.HealthChecks = defaults.HealthChecks
 	}
-
-	return config.Develop, nil
 }
 
 // GetMarkdown returns the markdown content to display
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/saberzero1/omnix/pkg/common"
 	"github.com/saberzero1/omnix/pkg/nix"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -182,3 +183,34 @@ func TestIsCachixAvailable(_ *testing.T) {
 	// Just test that it doesn't panic
 	_ = IsCachixAvailable()
 }
+
+func TestFromOmConfig(t *testing.T) {
+	tree, err := common.ParseYAMLConfig(`
+develop:
+  default:
+    readme:
+      enable: true
+  minimal:
+    readme:
+      enable: false
+      file: "NOTES.md"
+`)
+	require.NoError(t, err)
+
+	config, err := FromOmConfig(&common.OmConfig{Config: tree})
+	require.NoError(t, err)
+	assert.True(t, config.Readme.Enable)
+	assert.Equal(t, "README.md", config.Readme.File) // Default applied
+	assert.True(t, config.HealthChecks.NixVersion)   // Default applied
+
+	config, err = FromOmConfig(&common.OmConfig{Reference: []string{"minimal"}, Config: tree})
+	require.NoError(t, err)
+	assert.False(t, config.Readme.Enable)
+	assert.Equal(t, "NOTES.md", config.Readme.File)
+}
+
+func TestFromOmConfig_NoDevelopSection(t *testing.T) {
+	config, err := FromOmConfig(&common.OmConfig{Config: common.NewOmConfigTree()})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), config)
+}
@@ -1,9 +1,11 @@
 package health
 
 import (
+	"context"
 	"fmt"
 	"os"
 
+	"github.com/saberzero1/omnix/pkg/common"
 	"github.com/saberzero1/omnix/pkg/nix"
 	"gopkg.in/yaml.v3"
 )
@@ -114,6 +116,28 @@ func LoadConfig(path string) (Config, error) {
 	return wrapper.Health, nil
 }
 
+// LoadFlakeConfig loads the health configuration of a flake from its `om`
+// output (or om.yaml in the flake root). The flake URL fragment selects the
+// configuration to use, e.g. `.#strict` uses `health.strict`.
+func LoadFlakeConfig(ctx context.Context, flake nix.FlakeURL) (Config, error) {
+	om, err := common.GetOmConfig(ctx, nix.NewCmd(), flake.String())
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to load om config: %w", err)
+	}
+
+	return FromOmConfig(om)
+}
+
+// FromOmConfig extracts the health configuration referenced by om.Reference.
+// A missing `health` section yields an empty Config.
+func FromOmConfig(om *common.OmConfig) (Config, error) {
+	var config Config
+	if _, err := om.GetSubConfigUnder("health", nil, &config); err != nil {
+		return Config{}, fmt.Errorf("failed to get health config: %w", err)
+	}
+	return config, nil
+}
+
 // ApplyConfig applies configuration to a NixHealth instance
 func (c *Config) ApplyConfig(h *NixHealth) {
 	// Apply NixVersion config
@@ -161,6 +185,20 @@ func NewFromConfig(configPath string) (*NixHealth, error) {
 	return h, nil
 }
 
+// NewFromFlake creates a NixHealth instance with the configuration of the
+// given flake applied
+func NewFromFlake(ctx context.Context, flake nix.FlakeURL) (*NixHealth, error) {
+	config, err := LoadFlakeConfig(ctx, flake)
+	if err != nil {
+		return nil, err
+	}
+
+	h := Default()
+	config.ApplyConfig(h)
+
+	return h, nil
+}
+
 // DefaultCaches returns the default cache configuration
 func DefaultCachesConfig() []string {
 	return []string{
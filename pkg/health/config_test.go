@@ -4,6 +4,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/saberzero1/omnix/pkg/common"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -150,3 +152,51 @@ func TestDefaultCachesConfig(t *testing.T) {
 		t.Errorf("Expected default cache to be 'https://cache.nixos.org', got '%s'", caches[0])
 	}
 }
+
+func TestFromOmConfig(t *testing.T) {
+	tree, err := common.ParseYAMLConfig(`health:
+  default:
+    caches:
+      required:
+        - "https://cache.nixos.org"
+  strict:
+    trusted-users:
+      enable: true
+`)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	config, err := FromOmConfig(&common.OmConfig{Config: tree})
+	if err != nil {
+		t.Fatalf("FromOmConfig() failed: %v", err)
+	}
+	if config.Caches == nil || len(config.Caches.Required) != 1 {
+		t.Errorf("Expected default config with 1 required cache, got %+v", config.Caches)
+	}
+	if config.TrustedUsers != nil {
+		t.Error("Expected TrustedUsers to be unset in the default config")
+	}
+
+	config, err = FromOmConfig(&common.OmConfig{Reference: []string{"strict"}, Config: tree})
+	if err != nil {
+		t.Fatalf("FromOmConfig() failed: %v", err)
+	}
+	if config.TrustedUsers == nil || !config.TrustedUsers.Enable {
+		t.Error("Expected TrustedUsers to be enabled in the 'strict' config")
+	}
+
+	if _, err := FromOmConfig(&common.OmConfig{Reference: []string{"missing"}, Config: tree}); err == nil {
+		t.Error("Expected error for a missing config reference")
+	}
+}
+
+func TestFromOmConfig_NoHealthSection(t *testing.T) {
+	config, err := FromOmConfig(&common.OmConfig{Config: common.NewOmConfigTree()})
+	if err != nil {
+		t.Fatalf("FromOmConfig() failed: %v", err)
+	}
+	if config.Caches != nil || config.NixVersion != nil {
+		t.Errorf("Expected empty config, got %+v", config)
+	}
+}
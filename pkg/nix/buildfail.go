@@ -0,0 +1,91 @@
+package nix
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// ansiEscapePattern matches the color codes nix prints on a terminal
+	ansiEscapePattern = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+	// builderFailedPattern matches "error: builder for '/nix/store/…drv' failed …"
+	builderFailedPattern = regexp.MustCompile(`builder for '(/[^']+\.drv)' failed`)
+
+	// dependenciesFailedPattern matches "error: 1 dependencies of derivation '/nix/store/…drv' failed to build"
+	dependenciesFailedPattern = regexp.MustCompile(`dependencies of derivation '(/[^']+\.drv)' failed to build`)
+
+	// cannotBuildPattern matches "error: Cannot build '/nix/store/…drv'.", the
+	// form of newer nix versions, followed by a "Reason: …" line
+	cannotBuildPattern = regexp.MustCompile(`Cannot build '(/[^']+\.drv)'`)
+
+	// reasonPattern matches the reason following a "Cannot build" line
+	reasonPattern = regexp.MustCompile(`^\s*Reason: (.*)$`)
+)
+
+// BuildFailures collects the derivations a nix build reports as failed.
+//
+// Lines of the build log are fed to it with AddLine, or a whole log is
+// parsed with ParseBuildFailures. Both the "builder for '…' failed" and the
+// "Cannot build '…'" forms of nix error messages are recognised.
+type BuildFailures struct {
+	// Failed are the derivations whose builder failed, in the order reported
+	Failed []string
+
+	// DependencyFailed are the derivations that were not built because one
+	// of their dependencies failed, in the order reported
+	DependencyFailed []string
+
+	// pending is the derivation of a "Cannot build" line awaiting its reason
+	pending string
+}
+
+// ParseBuildFailures returns the failed derivations reported in the log of
+// a nix build
+func ParseBuildFailures(log string) *BuildFailures {
+	failures := &BuildFailures{}
+	for _, line := range strings.Split(log, "\n") {
+		failures.AddLine(line)
+	}
+	return failures
+}
+
+// AddLine records the failure reported by a line of a build log, if any
+func (f *BuildFailures) AddLine(line string) {
+	line = ansiEscapePattern.ReplaceAllString(line, "")
+
+	if f.pending != "" {
+		if m := reasonPattern.FindStringSubmatch(line); m != nil {
+			if strings.Contains(m[1], "dependenc") {
+				f.DependencyFailed = appendNew(f.DependencyFailed, f.pending)
+			} else {
+				f.Failed = appendNew(f.Failed, f.pending)
+			}
+			f.pending = ""
+			return
+		}
+	}
+
+	if m := builderFailedPattern.FindStringSubmatch(line); m != nil {
+		f.Failed = appendNew(f.Failed, m[1])
+	} else if m := dependenciesFailedPattern.FindStringSubmatch(line); m != nil {
+		f.DependencyFailed = appendNew(f.DependencyFailed, m[1])
+	} else if m := cannotBuildPattern.FindStringSubmatch(line); m != nil {
+		f.pending = m[1]
+	}
+}
+
+// Empty reports whether no failed derivation was found
+func (f *BuildFailures) Empty() bool {
+	return len(f.Failed) == 0 && len(f.DependencyFailed) == 0
+}
+
+// appendNew appends s to list unless it is already in it
+func appendNew(list []string, s string) []string {
+	for _, existing := range list {
+		if existing == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
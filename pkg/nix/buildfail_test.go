@@ -0,0 +1,43 @@
+package nix
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBuildFailures(t *testing.T) {
+	log := `building '/nix/store/aaa-hello.drv'...
+hello> make: *** [Makefile:3: all] Error 1
+error: builder for '/nix/store/aaa-hello.drv' failed with exit code 2;
+       last 1 log lines:
+       > make: *** [Makefile:3: all] Error 1
+       For full logs, run 'nix log /nix/store/aaa-hello.drv'.
+error: 1 dependencies of derivation '/nix/store/bbb-app.drv' failed to build
+error: builder for '/nix/store/aaa-hello.drv' failed with exit code 2
+error: 1 dependencies of derivation '/nix/store/ccc-devour-output.drv' failed to build`
+
+	failures := ParseBuildFailures(log)
+	assert.False(t, failures.Empty())
+	assert.Equal(t, []string{"/nix/store/aaa-hello.drv"}, failures.Failed)
+	assert.Equal(t, []string{"/nix/store/bbb-app.drv", "/nix/store/ccc-devour-output.drv"}, failures.DependencyFailed)
+}
+
+func TestParseBuildFailures_CannotBuild(t *testing.T) {
+	// Newer nix versions report failures over two lines, possibly colored
+	log := "error: Cannot build '\x1b[35;1m/nix/store/aaa-hello.drv\x1b[0m'.\n" +
+		"       Reason: builder failed with exit code 1.\n" +
+		"error: Cannot build '/nix/store/bbb-app.drv'.\n" +
+		"       Reason: 1 dependency failed.\n" +
+		"error: Cannot build '/nix/store/ddd-unrelated.drv'.\n" +
+		"some other line"
+
+	failures := ParseBuildFailures(log)
+	assert.Equal(t, []string{"/nix/store/aaa-hello.drv"}, failures.Failed)
+	assert.Equal(t, []string{"/nix/store/bbb-app.drv"}, failures.DependencyFailed)
+}
+
+func TestParseBuildFailures_None(t *testing.T) {
+	failures := ParseBuildFailures("error: attribute 'hello' missing")
+	assert.True(t, failures.Empty())
+}
@@ -0,0 +1,188 @@
+package nix
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/saberzero1/omnix/pkg/common"
+)
+
+// BuildProgress aggregates the log events of nix commands (see Cmd.LogEvents)
+// into the overall progress of their builds and downloads, and the time
+// each derivation took to build. It is not safe for concurrent use; feed it
+// from the goroutine draining the events.
+//
+// Example:
+//
+//	events := make(chan nix.LogEvent)
+//	progress := nix.NewBuildProgress()
+//	go func() {
+//		for event := range events {
+//			progress.Update(event)
+//			fmt.Println(progress.Summary())
+//		}
+//	}()
+//	cmd := nix.NewCmd()
+//	cmd.LogEvents = events
+type BuildProgress struct {
+	// activities are the running activities, by ID
+	activities map[uint64]*progressActivity
+
+	// stopped adds up the last progress of stopped activities, by type
+	stopped map[ActivityType]progressCounts
+
+	// builds are the derivations built so far, in the order they finished
+	builds []DerivationBuild
+}
+
+// progressCounts is the progress an activity reports: done and expected
+// items (or bytes, for transfers), and items running and failed
+type progressCounts struct {
+	done, expected, running, failed int64
+}
+
+// add returns the sum of c and o
+func (c progressCounts) add(o progressCounts) progressCounts {
+	return progressCounts{c.done + o.done, c.expected + o.expected, c.running + o.running, c.failed + o.failed}
+}
+
+// progressActivity is a running activity
+type progressActivity struct {
+	typ     ActivityType
+	drvPath string
+	started time.Time
+	counts  progressCounts
+}
+
+// DerivationBuild is a derivation built by a nix command
+type DerivationBuild struct {
+	// DrvPath is the path of the derivation
+	DrvPath string `json:"drvPath"`
+
+	// Duration is how long the build took, failed or not
+	Duration time.Duration `json:"duration"`
+}
+
+// ProgressSummary is a snapshot of a BuildProgress
+type ProgressSummary struct {
+	// Built is the number of derivations built
+	Built int64 `json:"built"`
+
+	// ExpectedBuilds is the number of derivations to build in total
+	ExpectedBuilds int64 `json:"expectedBuilds"`
+
+	// Building is the number of derivations being built
+	Building int64 `json:"building"`
+
+	// FailedBuilds is the number of derivations that failed to build
+	FailedBuilds int64 `json:"failedBuilds"`
+
+	// Downloading is the number of store paths being substituted
+	Downloading int `json:"downloading"`
+
+	// FetchedBytes is the number of bytes downloaded
+	FetchedBytes int64 `json:"fetchedBytes"`
+}
+
+// NewBuildProgress returns a BuildProgress with nothing going on
+func NewBuildProgress() *BuildProgress {
+	return &BuildProgress{
+		activities: make(map[uint64]*progressActivity),
+		stopped:    make(map[ActivityType]progressCounts),
+	}
+}
+
+// Update accounts for a log event
+func (p *BuildProgress) Update(event LogEvent) {
+	switch event.Action {
+	case LogActionStart:
+		activity := &progressActivity{typ: event.Activity, started: event.Time}
+		if event.Activity == ActivityBuild {
+			activity.drvPath, _ = event.StringField(0)
+		}
+		p.activities[event.ID] = activity
+
+	case LogActionResult:
+		activity, ok := p.activities[event.ID]
+		if !ok || event.Result != ResultProgress {
+			return
+		}
+		activity.counts.done, _ = event.IntField(0)
+		activity.counts.expected, _ = event.IntField(1)
+		activity.counts.running, _ = event.IntField(2)
+		activity.counts.failed, _ = event.IntField(3)
+
+	case LogActionStop:
+		activity, ok := p.activities[event.ID]
+		if !ok {
+			return
+		}
+		delete(p.activities, event.ID)
+
+		// A stopped activity is no longer running anything
+		counts := activity.counts
+		counts.running = 0
+		p.stopped[activity.typ] = p.stopped[activity.typ].add(counts)
+
+		if activity.typ == ActivityBuild && activity.drvPath != "" {
+			p.builds = append(p.builds, DerivationBuild{
+				DrvPath:  activity.drvPath,
+				Duration: event.Time.Sub(activity.started),
+			})
+		}
+	}
+}
+
+// counts adds up the progress of the activities of a type, running or not
+func (p *BuildProgress) counts(typ ActivityType) progressCounts {
+	total := p.stopped[typ]
+	for _, activity := range p.activities {
+		if activity.typ == typ {
+			total = total.add(activity.counts)
+		}
+	}
+	return total
+}
+
+// Summary returns the progress so far
+func (p *BuildProgress) Summary() ProgressSummary {
+	builds := p.counts(ActivityBuilds)
+	summary := ProgressSummary{
+		Built:          builds.done,
+		ExpectedBuilds: builds.expected,
+		Building:       builds.running,
+		FailedBuilds:   builds.failed,
+		FetchedBytes:   p.counts(ActivityFileTransfer).done,
+	}
+	for _, activity := range p.activities {
+		if activity.typ == ActivitySubstitute {
+			summary.Downloading++
+		}
+	}
+	return summary
+}
+
+// Builds returns the derivations built so far, in the order they finished
+func (p *BuildProgress) Builds() []DerivationBuild {
+	return append([]DerivationBuild(nil), p.builds...)
+}
+
+// String renders the summary as e.g.
+// "12/87 derivations built, 3 downloading, 1.2 GiB fetched"
+func (s ProgressSummary) String() string {
+	parts := []string{fmt.Sprintf("%d/%d derivations built", s.Built, s.ExpectedBuilds)}
+	if s.Building > 0 {
+		parts = append(parts, fmt.Sprintf("%d building", s.Building))
+	}
+	if s.FailedBuilds > 0 {
+		parts = append(parts, fmt.Sprintf("%d failed", s.FailedBuilds))
+	}
+	if s.Downloading > 0 {
+		parts = append(parts, fmt.Sprintf("%d downloading", s.Downloading))
+	}
+	if s.FetchedBytes > 0 {
+		parts = append(parts, common.FormatBytes(s.FetchedBytes)+" fetched")
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,67 @@
+package nix
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logEvents parses log event lines, timestamping them one second apart
+func logEvents(t *testing.T, lines ...string) []LogEvent {
+	t.Helper()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := make([]LogEvent, len(lines))
+	for i, line := range lines {
+		event, ok, err := ParseLogEvent(line)
+		require.NoError(t, err)
+		require.True(t, ok, line)
+		event.Time = start.Add(time.Duration(i) * time.Second)
+		events[i] = event
+	}
+	return events
+}
+
+func TestBuildProgress(t *testing.T) {
+	progress := NewBuildProgress()
+	assert.Equal(t, "0/0 derivations built", progress.Summary().String())
+
+	for _, event := range logEvents(t,
+		`@nix {"action":"start","id":1,"level":0,"text":"","type":104,"fields":[]}`,
+		`@nix {"action":"start","id":2,"level":3,"text":"building hello","type":105,"fields":["/nix/store/aaa-hello.drv","",1,1]}`,
+		`@nix {"action":"start","id":3,"level":4,"text":"copying path","type":108,"fields":["/nix/store/bbb-glibc","https://cache.nixos.org"]}`,
+		`@nix {"action":"start","id":4,"level":4,"text":"downloading","type":101,"fields":["https://cache.nixos.org/nar/x.nar.xz"]}`,
+		`@nix {"action":"result","id":4,"type":105,"fields":[1073741824,2147483648,0,0]}`,
+		`@nix {"action":"result","id":1,"type":105,"fields":[12,87,3,0]}`,
+		`@nix {"action":"result","id":2,"type":101,"fields":["compiling"]}`,
+	) {
+		progress.Update(event)
+	}
+	assert.Equal(t, ProgressSummary{
+		Built:          12,
+		ExpectedBuilds: 87,
+		Building:       3,
+		Downloading:    1,
+		FetchedBytes:   1 << 30,
+	}, progress.Summary())
+	assert.Equal(t, "12/87 derivations built, 3 building, 1 downloading, 1.0 GiB fetched", progress.Summary().String())
+	assert.Empty(t, progress.Builds())
+
+	// Events of the second batch are timestamped from the start again, so
+	// the build started at 1s stops at 2s
+	for _, event := range logEvents(t,
+		`@nix {"action":"stop","id":99}`,
+		`@nix {"action":"result","id":4,"type":105,"fields":[1288490188,2147483648,0,0]}`,
+		`@nix {"action":"stop","id":2}`,
+		`@nix {"action":"stop","id":3}`,
+		`@nix {"action":"stop","id":4}`,
+		`@nix {"action":"result","id":1,"type":105,"fields":[86,87,0,1]}`,
+		`@nix {"action":"stop","id":1}`,
+	) {
+		progress.Update(event)
+	}
+	assert.Equal(t, "86/87 derivations built, 1 failed, 1.2 GiB fetched", progress.Summary().String())
+	assert.Equal(t, []DerivationBuild{{DrvPath: "/nix/store/aaa-hello.drv", Duration: time.Second}}, progress.Builds())
+}
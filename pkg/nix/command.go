@@ -5,6 +5,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"strings"
 
@@ -34,6 +36,20 @@ func (e *CommandError) Unwrap() error {
 type Cmd struct {
 	// ExtraArgs are additional arguments to pass to all nix commands
 	ExtraArgs []string
+
+	// Dir is the working directory of the commands (empty = the current one)
+	Dir string
+
+	// Env holds KEY=VALUE environment variables set for the commands, on
+	// top of the inherited environment
+	Env []string
+
+	// LogEvents, if set, receives the activity events of the commands (see
+	// LogEvent), which then run with --log-format internal-json. Their
+	// stderr is turned back into the text nix would otherwise print, so
+	// errors and streamed output read the same. The channel must be
+	// drained while commands run; it is never closed.
+	LogEvents chan<- LogEvent
 }
 
 // NewCmd creates a new Nix command executor.
@@ -77,6 +93,72 @@ func (c *Cmd) Run(ctx context.Context, args ...string) (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
+// RunStreaming executes a nix command, streaming its stdout and stderr line by
+// line to out instead of buffering them. On failure, the CommandError carries
+// the tail of the output. The command runs in its own process group, which is
+// killed when ctx is cancelled (see SetProcessGroup).
+func (c *Cmd) RunStreaming(ctx context.Context, out *OutputStream, args ...string) error {
+	_, err := c.runStreaming(ctx, out, args, false)
+	return err
+}
+
+// RunStreamingStdout is like RunStreaming, but also captures and returns stdout.
+// Use it only for commands whose stdout is small, e.g. --print-out-paths.
+func (c *Cmd) RunStreamingStdout(ctx context.Context, out *OutputStream, args ...string) (string, error) {
+	stdout, err := c.runStreaming(ctx, out, args, true)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(stdout), nil
+}
+
+// runStreaming executes a nix command with its output attached to out.
+func (c *Cmd) runStreaming(ctx context.Context, out *OutputStream, args []string, captureStdout bool) (string, error) {
+	if c.LogEvents == nil && out.opts.LogEvents != nil {
+		withEvents := *c
+		withEvents.LogEvents = out.opts.LogEvents
+		c = &withEvents
+	}
+	allArgs := append(c.ExtraArgs, args...)
+
+	logger := common.Logger()
+	logger.Debug("executing nix command (streaming)",
+		zap.String("command", "nix"),
+		zap.Strings("args", allArgs))
+
+	cmd := c.command(ctx, allArgs)
+	SetProcessGroup(cmd)
+
+	var stdout bytes.Buffer
+	var capture io.Writer
+	if captureStdout {
+		capture = &stdout
+	}
+	flush := out.Attach(cmd, capture)
+	flushEvents := c.watchLogEvents(cmd)
+
+	err := cmd.Run()
+	flushEvents()
+	flush()
+	if err != nil {
+		exitCode := -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		}
+
+		return "", &CommandError{
+			Command:  "nix",
+			Args:     allArgs,
+			ExitCode: exitCode,
+			Stderr:   out.Tail(),
+			Err:      err,
+		}
+	}
+
+	return stdout.String(), nil
+}
+
 // runReturningStdout executes a nix command and returns stdout as bytes.
 func (c *Cmd) runReturningStdout(ctx context.Context, args []string) ([]byte, error) {
 	// Combine extra args with command args
@@ -89,15 +171,17 @@ func (c *Cmd) runReturningStdout(ctx context.Context, args []string) ([]byte, er
 		zap.Strings("args", allArgs))
 
 	// Create the command
-	cmd := exec.CommandContext(ctx, "nix", allArgs...)
+	cmd := c.command(ctx, allArgs)
 
 	// Capture stdout and stderr
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
+	flushEvents := c.watchLogEvents(cmd)
 
 	// Run the command
 	err := cmd.Run()
+	flushEvents()
 	if err != nil {
 		exitCode := -1
 		if exitErr, ok := err.(*exec.ExitError); ok {
@@ -115,3 +199,34 @@ func (c *Cmd) runReturningStdout(ctx context.Context, args []string) ([]byte, er
 
 	return stdout.Bytes(), nil
 }
+
+// LogEventArgs returns the arguments nix runs with when its log events are
+// followed (see Cmd.LogEvents)
+func LogEventArgs() []string {
+	return []string{"--log-format", "internal-json"}
+}
+
+// command creates the exec.Cmd running nix with args in c.Dir and c.Env
+func (c *Cmd) command(ctx context.Context, args []string) *exec.Cmd {
+	if c.LogEvents != nil {
+		args = append(LogEventArgs(), args...)
+	}
+	cmd := exec.CommandContext(ctx, "nix", args...)
+	cmd.Dir = c.Dir
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	return cmd
+}
+
+// watchLogEvents sends the log events cmd prints to c.LogEvents, if set,
+// passing the rest of its stderr on. The returned function must be called
+// after the command exits to handle an unterminated last line.
+func (c *Cmd) watchLogEvents(cmd *exec.Cmd) (flush func()) {
+	if c.LogEvents == nil || cmd.Stderr == nil {
+		return func() {}
+	}
+	w := newLogEventWriter(cmd.Stderr, c.LogEvents)
+	cmd.Stderr = w
+	return func() { _ = w.flush() }
+}
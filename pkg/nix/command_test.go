@@ -227,3 +227,20 @@ func TestCmdWithExtraArgs(t *testing.T) {
 		t.Error("RunVersion() with extra args returned zero version")
 	}
 }
+
+func TestCmdCommand_DirAndEnv(t *testing.T) {
+	cmd := &Cmd{Dir: "/tmp", Env: []string{"FOO=bar"}}
+	execCmd := cmd.command(context.Background(), []string{"--version"})
+
+	if execCmd.Dir != "/tmp" {
+		t.Errorf("Dir = %q, want /tmp", execCmd.Dir)
+	}
+	if len(execCmd.Env) == 0 || execCmd.Env[len(execCmd.Env)-1] != "FOO=bar" {
+		t.Errorf("Env should end with FOO=bar, got %v", execCmd.Env)
+	}
+
+	// Without Env, the environment is inherited as is
+	if execCmd := NewCmd().command(context.Background(), nil); execCmd.Env != nil {
+		t.Errorf("Env = %v, want nil", execCmd.Env)
+	}
+}
@@ -17,6 +17,9 @@ type CopyOptions struct {
 
 	// NoCheckSigs disables signature checking
 	NoCheckSigs bool
+
+	// Output receives the output of nix copy as it runs (nil = buffered)
+	Output *OutputStream
 }
 
 // Copy copies store paths to a remote Nix store using `nix copy`.
@@ -53,7 +56,12 @@ func Copy(ctx context.Context, cmd *Cmd, options CopyOptions, paths []string) er
 
 	args = append(args, paths...)
 
-	_, err := cmd.Run(ctx, args...)
+	var err error
+	if options.Output != nil {
+		err = cmd.RunStreaming(ctx, options.Output, args...)
+	} else {
+		_, err = cmd.Run(ctx, args...)
+	}
 	if err != nil {
 		return fmt.Errorf("nix copy failed: %w", err)
 	}
@@ -65,3 +73,25 @@ func Copy(ctx context.Context, cmd *Cmd, options CopyOptions, paths []string) er
 func CopyPath(ctx context.Context, cmd *Cmd, options CopyOptions, path string) error {
 	return Copy(ctx, cmd, options, []string{path})
 }
+
+// Sign signs store paths and their closures with the secret key in keyFile
+// using `nix store sign --recursive`. Nothing is run for an empty path list.
+func Sign(ctx context.Context, cmd *Cmd, keyFile string, paths []string, out *OutputStream) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	args := append([]string{"store", "sign", "--key-file", keyFile, "--recursive"}, paths...)
+
+	var err error
+	if out != nil {
+		err = cmd.RunStreaming(ctx, out, args...)
+	} else {
+		_, err = cmd.Run(ctx, args...)
+	}
+	if err != nil {
+		return fmt.Errorf("nix store sign failed: %w", err)
+	}
+
+	return nil
+}
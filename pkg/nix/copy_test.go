@@ -105,6 +105,12 @@ func TestCopyPath(t *testing.T) {
 	})
 }
 
+func TestSign_NoPaths(t *testing.T) {
+	// Nothing to sign must not run nix at all
+	t.Setenv("PATH", t.TempDir())
+	assert.NoError(t, Sign(context.Background(), NewCmd(), "/run/secrets/key", nil, nil))
+}
+
 // Helper function for tests
 func mustParseURI(uri string) *store.URI {
 	parsed, err := store.ParseURI(uri)
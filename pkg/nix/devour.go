@@ -29,9 +29,26 @@ type DevourFlakeOutput struct {
 	ByName map[string]store.Path `json:"byName"`
 }
 
-// DevourFlake builds all outputs of a flake using devour-flake
-func DevourFlake(ctx context.Context, flake FlakeURL, systems []string, impure bool) (*DevourFlakeOutput, error) {
-	// Build the devour-flake command
+// DevourFlakeOptions contains options for DevourFlake.
+type DevourFlakeOptions struct {
+	// Systems restricts the build to the given systems (empty = flake default)
+	Systems []string
+	// Impure passes --impure to nix build
+	Impure bool
+	// KeepGoing passes --keep-going to nix build, so that the outputs not
+	// depending on a failed derivation are still built
+	KeepGoing bool
+	// OverrideInputs maps inputs of the flake being built to flake URLs.
+	// They are passed to devour-flake as `--override-input flake/<name> <url>`.
+	OverrideInputs map[string]string
+	// Output, if set, receives the build log as it is produced instead of
+	// it being buffered until the build finishes
+	Output *OutputStream
+}
+
+// DevourFlakeArgs returns the `nix build` arguments (without the leading
+// "nix") used to build all outputs of a flake with devour-flake.
+func DevourFlakeArgs(flake FlakeURL, opts DevourFlakeOptions) ([]string, error) {
 	devourURL := DevourFlakeURL() + "#json"
 
 	args := []string{
@@ -42,9 +59,12 @@ func DevourFlake(ctx context.Context, flake FlakeURL, systems []string, impure b
 		"--print-out-paths",
 	}
 
-	if impure {
+	if opts.Impure {
 		args = append(args, "--impure")
 	}
+	if opts.KeepGoing {
+		args = append(args, "--keep-going")
+	}
 
 	// Add override-input for the flake to build
 	args = append(args,
@@ -52,8 +72,8 @@ func DevourFlake(ctx context.Context, flake FlakeURL, systems []string, impure b
 	)
 
 	// Add systems filtering if specified
-	if len(systems) > 0 {
-		systemsFlakeURL, err := GetSystemsFlakeURL(systems)
+	if len(opts.Systems) > 0 {
+		systemsFlakeURL, err := GetSystemsFlakeURL(opts.Systems)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get systems flake URL: %w", err)
 		}
@@ -62,9 +82,28 @@ func DevourFlake(ctx context.Context, flake FlakeURL, systems []string, impure b
 		)
 	}
 
+	// Overrides apply to the inputs of the flake being built, which is
+	// itself the "flake" input of devour-flake.
+	args = append(args, OverrideInputArgs(opts.OverrideInputs, "flake/")...)
+
+	return args, nil
+}
+
+// DevourFlake builds all outputs of a flake using devour-flake
+func DevourFlake(ctx context.Context, flake FlakeURL, opts DevourFlakeOptions) (*DevourFlakeOutput, error) {
+	args, err := DevourFlakeArgs(flake, opts)
+	if err != nil {
+		return nil, err
+	}
+
 	// Run nix build
 	cmd := NewCmd()
-	output, err := cmd.Run(ctx, args...)
+	var output string
+	if opts.Output != nil {
+		output, err = cmd.RunStreamingStdout(ctx, opts.Output, args...)
+	} else {
+		output, err = cmd.Run(ctx, args...)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("devour-flake failed: %w", err)
 	}
@@ -128,3 +128,32 @@ func TestDevourFlakeOutput_MarshalJSON(t *testing.T) {
 	assert.Equal(t, len(output.OutPaths), len(output2.OutPaths))
 	assert.Equal(t, output.ByName["test1"].String(), output2.ByName["test1"].String())
 }
+
+func TestDevourFlakeArgs(t *testing.T) {
+	flake := NewFlakeURL("github:org/repo")
+
+	args, err := DevourFlakeArgs(flake, DevourFlakeOptions{
+		Systems:        []string{"x86_64-linux"},
+		Impure:         true,
+		KeepGoing:      true,
+		OverrideInputs: map[string]string{"nixpkgs": "github:nixos/nixpkgs", "dep": "path:/dep"},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "build", args[0])
+	assert.Contains(t, args, "--impure")
+	assert.Contains(t, args, "--keep-going")
+	assert.Equal(t, []string{
+		"--override-input", "flake", "github:org/repo",
+		"--override-input", "systems", "github:nix-systems/x86_64-linux",
+		"--override-input", "flake/dep", "path:/dep",
+		"--override-input", "flake/nixpkgs", "github:nixos/nixpkgs",
+	}, args[len(args)-12:])
+}
+
+func TestOverrideInputArgs(t *testing.T) {
+	assert.Empty(t, OverrideInputArgs(nil, ""))
+	assert.Equal(t,
+		[]string{"--override-input", "a", "x", "--override-input", "b", "y"},
+		OverrideInputArgs(map[string]string{"b": "y", "a": "x"}, ""))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -29,6 +30,8 @@ type CommandOptions struct {
 	OverrideInputs map[string]string
 	// NoWriteLockFile passes --no-write-lock-file
 	NoWriteLockFile bool
+	// Impure passes --impure
+	Impure bool
 	// CurrentDir is the directory from which to run the command
 	CurrentDir string
 }
@@ -39,14 +42,32 @@ func applyOptions(args []string, opts *CommandOptions) []string {
 		return args
 	}
 
-	for name, url := range opts.OverrideInputs {
-		args = append(args, "--override-input", name, url)
-	}
+	args = append(args, overrideInputArgs(opts.OverrideInputs)...)
 
 	if opts.NoWriteLockFile {
 		args = append(args, "--no-write-lock-file")
 	}
 
+	if opts.Impure {
+		args = append(args, "--impure")
+	}
+
+	return args
+}
+
+// overrideInputArgs returns the --override-input arguments for overrides,
+// sorted by input name so that commands are the same from run to run
+func overrideInputArgs(overrides map[string]string) []string {
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := make([]string, 0, 3*len(names))
+	for _, name := range names {
+		args = append(args, "--override-input", name, overrides[name])
+	}
 	return args
 }
 
@@ -78,11 +99,7 @@ func Develop(ctx context.Context, cmd Cmd, opts *CommandOptions, url string, com
 
 // Build executes `nix build` and returns the output paths.
 func Build(ctx context.Context, cmd Cmd, opts *CommandOptions, url string) ([]OutPath, error) {
-	args := []string{"build", "--no-link", "--json"}
-	args = applyOptions(args, opts)
-	args = append(args, url)
-
-	output, err := cmd.Run(ctx, args...)
+	output, err := cmd.Run(ctx, BuildArgs(opts, url)...)
 	if err != nil {
 		return nil, err
 	}
@@ -95,6 +112,13 @@ func Build(ctx context.Context, cmd Cmd, opts *CommandOptions, url string) ([]Ou
 	return outPaths, nil
 }
 
+// BuildArgs returns the nix arguments Build runs
+func BuildArgs(opts *CommandOptions, url string) []string {
+	args := []string{"build", "--no-link", "--json"}
+	args = applyOptions(args, opts)
+	return append(args, url)
+}
+
 // FlakeLock executes `nix flake lock` with additional options.
 // Use this for advanced lock operations. For simple locking, use the Lock function from metadata.go.
 func FlakeLock(ctx context.Context, cmd Cmd, opts *CommandOptions, url string, extraArgs []string) error {
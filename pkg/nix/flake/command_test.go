@@ -424,6 +424,14 @@ func TestApplyOptions(t *testing.T) {
 			},
 			want: []string{"build", "--no-write-lock-file"},
 		},
+		{
+			name: "with impure",
+			args: []string{"build"},
+			opts: &CommandOptions{
+				Impure: true,
+			},
+			want: []string{"build", "--impure"},
+		},
 		{
 			name: "with multiple options",
 			args: []string{"build"},
@@ -453,3 +461,19 @@ func TestApplyOptions(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildArgs(t *testing.T) {
+	// Overridden inputs come sorted, so that commands don't change between runs
+	opts := &CommandOptions{
+		OverrideInputs: map[string]string{
+			"nixpkgs":     "github:NixOS/nixpkgs",
+			"flake-utils": "github:numtide/flake-utils",
+		},
+	}
+	assert.Equal(t, []string{
+		"build", "--no-link", "--json",
+		"--override-input", "flake-utils", "github:numtide/flake-utils",
+		"--override-input", "nixpkgs", "github:NixOS/nixpkgs",
+		".#default",
+	}, BuildArgs(opts, ".#default"))
+}
@@ -1,5 +1,7 @@
 package flake
 
+import "os"
+
 // These variables are injected at build time by the Nix build system.
 // When building with `nix build`, these will contain the paths to the
 // flake-schemas and inspect flakes.
@@ -16,19 +18,29 @@ var (
 )
 
 // GetDefaultFlakeSchemas returns the path to the default flake-schemas flake.
+// The DEFAULT_FLAKE_SCHEMAS environment variable (exported by the development
+// shell) takes precedence over the injected path.
 // Returns empty string if not built with Nix.
 func GetDefaultFlakeSchemas() string {
+	if path := os.Getenv("DEFAULT_FLAKE_SCHEMAS"); path != "" {
+		return path
+	}
 	return defaultFlakeSchemas
 }
 
 // GetInspectFlake returns the path to the inspect flake.
+// The INSPECT_FLAKE environment variable (exported by the development shell)
+// takes precedence over the injected path.
 // Returns empty string if not built with Nix.
 func GetInspectFlake() string {
+	if path := os.Getenv("INSPECT_FLAKE"); path != "" {
+		return path
+	}
 	return inspectFlake
 }
 
 // HasNixBuildEnvironment returns true if the binary was built with Nix
 // and has access to flake-schemas and inspect flake paths.
 func HasNixBuildEnvironment() bool {
-	return defaultFlakeSchemas != "" && inspectFlake != ""
+	return GetDefaultFlakeSchemas() != "" && GetInspectFlake() != ""
 }
@@ -45,6 +45,20 @@ func EvalMaybe[T any](ctx context.Context, cmd Cmd, opts *FlakeOptions, url stri
 func eval[T any](ctx context.Context, cmd Cmd, opts *FlakeOptions, url string) (T, error) {
 	var result T
 
+	output, err := cmd.Run(ctx, EvalArgs(opts, url)...)
+	if err != nil {
+		return result, err
+	}
+
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		return result, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	return result, nil
+}
+
+// EvalArgs returns the nix arguments Eval runs
+func EvalArgs(opts *FlakeOptions, url string) []string {
 	args := []string{"eval", "--json"}
 
 	// Add flake options
@@ -58,26 +72,13 @@ func eval[T any](ctx context.Context, cmd Cmd, opts *FlakeOptions, url string) (
 		if opts.NoWriteLockFile {
 			args = append(args, "--no-write-lock-file")
 		}
-		for input, flakeURL := range opts.OverrideInputs {
-			args = append(args, "--override-input", input, flakeURL)
-		}
+		args = append(args, overrideInputArgs(opts.OverrideInputs)...)
 	}
 
 	args = append(args, url)
 
 	// Suppress logs from --override-input (requires double --quiet)
-	args = append(args, "--quiet", "--quiet")
-
-	output, err := cmd.Run(ctx, args...)
-	if err != nil {
-		return result, err
-	}
-
-	if err := json.Unmarshal([]byte(output), &result); err != nil {
-		return result, fmt.Errorf("failed to parse JSON: %w", err)
-	}
-
-	return result, nil
+	return append(args, "--quiet", "--quiet")
 }
 
 // isMissingAttributeError checks if an error is due to a missing attribute.
@@ -221,3 +221,13 @@ type mockMissingAttrError struct{}
 func (e *mockMissingAttrError) Error() string {
 	return "does not provide attribute 'missing'"
 }
+
+func TestEvalArgs(t *testing.T) {
+	assert.Equal(t, []string{"eval", "--json", ".#version", "--quiet", "--quiet"}, EvalArgs(nil, ".#version"))
+	assert.Equal(t, []string{
+		"eval", "--json", "--impure",
+		"--override-input", "a", "./a",
+		"--override-input", "b", "./b",
+		".#version", "--quiet", "--quiet",
+	}, EvalArgs(&FlakeOptions{Impure: true, OverrideInputs: map[string]string{"b": "./b", "a": "./a"}}, ".#version"))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 )
 
 // Metadata represents flake metadata information.
@@ -158,3 +159,58 @@ func Update(ctx context.Context, cmd Cmd, flakeURL string) error {
 
 	return nil
 }
+
+// ArchiveInfo is the output of `nix flake archive --json`: the store path of
+// a flake's source and, recursively, of its inputs.
+type ArchiveInfo struct {
+	// Path is the store path of the flake source
+	Path string `json:"path"`
+
+	// Inputs maps input names to their archive information
+	Inputs map[string]*ArchiveInfo `json:"inputs,omitempty"`
+}
+
+// Paths returns the store paths of the flake and all of its inputs,
+// recursively, without duplicates. The flake's own path comes first.
+func (a *ArchiveInfo) Paths() []string {
+	seen := make(map[string]bool)
+	var paths []string
+
+	var collect func(info *ArchiveInfo)
+	collect = func(info *ArchiveInfo) {
+		if info == nil {
+			return
+		}
+		if info.Path != "" && !seen[info.Path] {
+			seen[info.Path] = true
+			paths = append(paths, info.Path)
+		}
+
+		names := make([]string, 0, len(info.Inputs))
+		for name := range info.Inputs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			collect(info.Inputs[name])
+		}
+	}
+	collect(a)
+
+	return paths
+}
+
+// Archive copies a flake and all of its inputs to the local store.
+func Archive(ctx context.Context, cmd Cmd, flakeURL string) (*ArchiveInfo, error) {
+	output, err := cmd.Run(ctx, "flake", "archive", "--json", flakeURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to archive flake: %w", err)
+	}
+
+	var info ArchiveInfo
+	if err := json.Unmarshal([]byte(output), &info); err != nil {
+		return nil, fmt.Errorf("failed to parse archive JSON: %w", err)
+	}
+
+	return &info, nil
+}
@@ -177,3 +177,30 @@ func TestFlakeOptions_WithMetadata(t *testing.T) {
 	assert.Len(t, opts.OverrideInputs, 1)
 	assert.Equal(t, "github:NixOS/nixpkgs/nixos-unstable", opts.OverrideInputs["nixpkgs"])
 }
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+
+	cmd := &mockCmd{output: `{
+		"path": "/nix/store/aaa-source",
+		"inputs": {
+			"nixpkgs": {"path": "/nix/store/bbb-source", "inputs": {}},
+			"flake-parts": {
+				"path": "/nix/store/ccc-source",
+				"inputs": {"nixpkgs-lib": {"path": "/nix/store/bbb-source"}}
+			}
+		}
+	}`}
+	info, err := Archive(ctx, cmd, ".")
+	require.NoError(t, err)
+
+	assert.Equal(t, "/nix/store/aaa-source", info.Path)
+	assert.Equal(t, []string{
+		"/nix/store/aaa-source",
+		"/nix/store/ccc-source",
+		"/nix/store/bbb-source",
+	}, info.Paths())
+
+	_, err = Archive(ctx, &mockCmd{output: "not json"}, ".")
+	assert.Error(t, err)
+}
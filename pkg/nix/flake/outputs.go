@@ -21,6 +21,8 @@ const (
 	TypeNixosConfiguration Type = "NixOS configuration"
 	// TypeDarwinConfiguration represents a nix-darwin configuration
 	TypeDarwinConfiguration Type = "nix-darwin configuration"
+	// TypeHomeConfiguration represents a Home Manager configuration
+	TypeHomeConfiguration Type = "Home Manager configuration"
 	// TypePackage represents a package
 	TypePackage Type = "package"
 	// TypeDevShell represents a development environment
@@ -44,6 +46,8 @@ func (t Type) ToIcon() string {
 		return "🔧"
 	case TypeDarwinConfiguration:
 		return "🍎"
+	case TypeHomeConfiguration:
+		return "🏠"
 	case TypePackage:
 		return "📦"
 	case TypeDevShell:
@@ -15,6 +15,7 @@ func TestType_ToIcon(t *testing.T) {
 		{name: "NixOS module", t: TypeNixosModule, want: "❄️"},
 		{name: "NixOS configuration", t: TypeNixosConfiguration, want: "🔧"},
 		{name: "Darwin configuration", t: TypeDarwinConfiguration, want: "🍎"},
+		{name: "Home Manager configuration", t: TypeHomeConfiguration, want: "🏠"},
 		{name: "Package", t: TypePackage, want: "📦"},
 		{name: "Dev shell", t: TypeDevShell, want: "🐚"},
 		{name: "Check", t: TypeCheck, want: "🧪"},
@@ -169,6 +169,35 @@ func FromNix(ctx context.Context, cmd Cmd, flakeURL string, system System) (*Fla
 // GetFlakeSchemas retrieves the FlakeSchemas for a given flake URL.
 // This uses the inspect flake and default flake-schemas paths injected at build time.
 func GetFlakeSchemas(ctx context.Context, cmd Cmd, flakeURL string, system System) (*FlakeSchemas, error) {
+	// Get the systems flake for this system
+	systemsURL := getKnownSystemFlakeURL(system)
+	args, err := SchemaArgs(flakeURL, systemsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if systemsURL == "" {
+		return nil, fmt.Errorf("unsupported system: %s", system.String())
+	}
+
+	// Evaluate the inspect flake
+	output, err := cmd.Run(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate inspect flake: %w", err)
+	}
+
+	var schemas FlakeSchemas
+	if err := json.Unmarshal([]byte(output), &schemas); err != nil {
+		return nil, fmt.Errorf("failed to evaluate inspect flake: failed to parse JSON: %w", err)
+	}
+
+	return &schemas, nil
+}
+
+// SchemaArgs returns the nix arguments evaluating the FlakeSchemas of a flake
+// for the systems listed by the systems flake systemsURL (the inspect flake's
+// own systems if empty). The override inputs of opts are inputs of the
+// inspected flake; its Impure and Refresh options apply as they are.
+func SchemaArgs(flakeURL string, systemsURL string, opts *FlakeOptions) ([]string, error) {
 	// Check if we have the necessary environment
 	if !HasNixBuildEnvironment() {
 		return nil, fmt.Errorf("GetFlakeSchemas requires binary built with Nix (DEFAULT_FLAKE_SCHEMAS and INSPECT_FLAKE not available)")
@@ -178,27 +207,25 @@ func GetFlakeSchemas(ctx context.Context, cmd Cmd, flakeURL string, system Syste
 	// Using excludingOutputPaths for faster evaluation (see Rust implementation)
 	inspectURL := GetInspectFlake() + "#contents.excludingOutputPaths"
 
-	// Get the systems flake for this system
-	systemsURL := getKnownSystemFlakeURL(system)
-	if systemsURL == "" {
-		return nil, fmt.Errorf("unsupported system: %s", system.String())
-	}
-
 	// Build the flake options with override inputs
-	opts := &FlakeOptions{
+	evalOpts := &FlakeOptions{
 		NoWriteLockFile: true,
 		OverrideInputs: map[string]string{
 			"flake-schemas": GetDefaultFlakeSchemas(),
 			"flake":         flakeURL,
-			"systems":       systemsURL,
 		},
 	}
-
-	// Evaluate the inspect flake
-	schemas, err := Eval[FlakeSchemas](ctx, cmd, opts, inspectURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to evaluate inspect flake: %w", err)
+	if systemsURL != "" {
+		evalOpts.OverrideInputs["systems"] = systemsURL
+	}
+	if opts != nil {
+		evalOpts.Impure = opts.Impure
+		evalOpts.Refresh = opts.Refresh
+		// The inspected flake is the "flake" input of the inspect flake
+		for name, url := range opts.OverrideInputs {
+			evalOpts.OverrideInputs["flake/"+name] = url
+		}
 	}
 
-	return &schemas, nil
+	return EvalArgs(evalOpts, inspectURL), nil
 }
@@ -283,3 +283,28 @@ func TestGetFlakeSchemas_RequiresNixEnvironment(t *testing.T) {
 		assert.Error(t, err)
 	}
 }
+
+func TestSchemaArgs(t *testing.T) {
+	t.Setenv("INSPECT_FLAKE", "/nix/store/aaa-inspect")
+	t.Setenv("DEFAULT_FLAKE_SCHEMAS", "/nix/store/bbb-flake-schemas")
+
+	args, err := SchemaArgs("/src", "github:nix-systems/x86_64-linux", &FlakeOptions{
+		OverrideInputs: map[string]string{"nixpkgs": "/nixpkgs"},
+		Impure:         true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"eval", "--json", "--impure", "--no-write-lock-file",
+		"--override-input", "flake", "/src",
+		"--override-input", "flake-schemas", "/nix/store/bbb-flake-schemas",
+		"--override-input", "flake/nixpkgs", "/nixpkgs",
+		"--override-input", "systems", "github:nix-systems/x86_64-linux",
+		"/nix/store/aaa-inspect#contents.excludingOutputPaths",
+		"--quiet", "--quiet",
+	}, args)
+
+	// Without a systems flake, the inspect flake's own systems are used
+	args, err = SchemaArgs("/src", "", nil)
+	require.NoError(t, err)
+	assert.NotContains(t, args, "systems")
+}
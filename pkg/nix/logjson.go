@@ -0,0 +1,267 @@
+package nix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logEventPrefix starts every line nix prints with --log-format internal-json
+const logEventPrefix = "@nix "
+
+// LogAction is the kind of a nix log event
+type LogAction string
+
+// Log event actions
+const (
+	// LogActionStart starts an activity
+	LogActionStart LogAction = "start"
+	// LogActionStop stops an activity
+	LogActionStop LogAction = "stop"
+	// LogActionResult reports a result of a running activity
+	LogActionResult LogAction = "result"
+	// LogActionMsg is a plain log message
+	LogActionMsg LogAction = "msg"
+)
+
+// ActivityType is the type of a nix activity, as numbered by nix
+type ActivityType int
+
+// Activity types
+const (
+	ActivityUnknown       ActivityType = 0
+	ActivityCopyPath      ActivityType = 100
+	ActivityFileTransfer  ActivityType = 101
+	ActivityRealise       ActivityType = 102
+	ActivityCopyPaths     ActivityType = 103
+	ActivityBuilds        ActivityType = 104
+	ActivityBuild         ActivityType = 105
+	ActivityOptimiseStore ActivityType = 106
+	ActivityVerifyPaths   ActivityType = 107
+	ActivitySubstitute    ActivityType = 108
+	ActivityQueryPathInfo ActivityType = 109
+	ActivityPostBuildHook ActivityType = 110
+	ActivityBuildWaiting  ActivityType = 111
+	ActivityFetchTree     ActivityType = 112
+)
+
+// ResultType is the type of an activity result, as numbered by nix
+type ResultType int
+
+// Result types
+const (
+	ResultFileLinked       ResultType = 100
+	ResultBuildLogLine     ResultType = 101
+	ResultUntrustedPath    ResultType = 102
+	ResultCorruptedPath    ResultType = 103
+	ResultSetPhase         ResultType = 104
+	ResultProgress         ResultType = 105
+	ResultSetExpected      ResultType = 106
+	ResultPostBuildLogLine ResultType = 107
+	ResultFetchStatus      ResultType = 108
+)
+
+// Log levels of nix messages and activities
+const (
+	LogLevelError = iota
+	LogLevelWarn
+	LogLevelNotice
+	LogLevelInfo
+	LogLevelTalkative
+	LogLevelChatty
+	LogLevelDebug
+	LogLevelVomit
+)
+
+// LogEvent is a message nix prints with --log-format internal-json.
+//
+// Activities (builds, substitutions, path copies, downloads, ...) are
+// started and stopped by ID, and report results in between, e.g. progress
+// or build log lines. The meaning of Fields depends on the activity or
+// result type, e.g. [drvPath, machine, round, nrRounds] when starting a
+// build, or [done, expected, running, failed] for progress.
+type LogEvent struct {
+	// Action is the kind of event
+	Action LogAction `json:"action"`
+
+	// ID identifies the activity (start, stop and result)
+	ID uint64 `json:"id,omitempty"`
+
+	// Parent is the ID of the activity that started this one (start)
+	Parent uint64 `json:"parent,omitempty"`
+
+	// Level is the verbosity level of the activity or message (start and msg)
+	Level int `json:"level"`
+
+	// Activity is the type of the activity (start)
+	Activity ActivityType `json:"-"`
+
+	// Result is the type of the result (result)
+	Result ResultType `json:"-"`
+
+	// Text describes the activity (start)
+	Text string `json:"text,omitempty"`
+
+	// Msg is the message (msg)
+	Msg string `json:"msg,omitempty"`
+
+	// Fields holds the activity or result fields: float64 numbers and strings
+	Fields []interface{} `json:"fields,omitempty"`
+
+	// Time is when the event was read
+	Time time.Time `json:"-"`
+}
+
+// ParseLogEvent parses a line printed by nix with --log-format internal-json.
+// ok is false for lines that are not log events.
+func ParseLogEvent(line string) (event LogEvent, ok bool, err error) {
+	if !strings.HasPrefix(line, logEventPrefix) {
+		return LogEvent{}, false, nil
+	}
+
+	aux := struct {
+		*LogEvent
+		Type int `json:"type"`
+	}{LogEvent: &event}
+	if err := json.Unmarshal([]byte(line[len(logEventPrefix):]), &aux); err != nil {
+		return LogEvent{}, false, fmt.Errorf("invalid nix log event: %w", err)
+	}
+
+	switch event.Action {
+	case LogActionStart:
+		event.Activity = ActivityType(aux.Type)
+	case LogActionResult:
+		event.Result = ResultType(aux.Type)
+	}
+	return event, true, nil
+}
+
+// IntField returns field i as an integer, if it is a number
+func (e LogEvent) IntField(i int) (int64, bool) {
+	if i >= len(e.Fields) {
+		return 0, false
+	}
+	n, ok := e.Fields[i].(float64)
+	return int64(n), ok
+}
+
+// StringField returns field i, if it is a string
+func (e LogEvent) StringField(i int) (string, bool) {
+	if i >= len(e.Fields) {
+		return "", false
+	}
+	s, ok := e.Fields[i].(string)
+	return s, ok
+}
+
+// logEventWriter splits the internal-json stderr of nix into lines, sends
+// the log events to a channel, and writes the text nix would have printed
+// without internal-json to w: messages, activity descriptions and build log
+// lines. Lines that are not log events are written unchanged.
+type logEventWriter struct {
+	w      io.Writer
+	events chan<- LogEvent
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+
+	// drvNames maps build activities to the name prefixing their log lines
+	drvNames map[uint64]string
+}
+
+// newLogEventWriter returns a logEventWriter writing text to w
+func newLogEventWriter(w io.Writer, events chan<- LogEvent) *logEventWriter {
+	return &logEventWriter{w: w, events: events, drvNames: make(map[uint64]string)}
+}
+
+func (w *logEventWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Incomplete line; keep it for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			break
+		}
+		if err := w.writeLine(strings.TrimRight(line, "\r\n")); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// flush handles an unterminated last line
+func (w *logEventWriter) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	line := w.buf.String()
+	w.buf.Reset()
+	return w.writeLine(line)
+}
+
+// writeLine handles a line of stderr; w.mu must be held
+func (w *logEventWriter) writeLine(line string) error {
+	event, ok, err := ParseLogEvent(line)
+	if err != nil || !ok {
+		_, err = fmt.Fprintln(w.w, line)
+		return err
+	}
+	event.Time = time.Now()
+	w.events <- event
+
+	if text, ok := w.text(event); ok {
+		_, err = fmt.Fprintln(w.w, text)
+	}
+	return err
+}
+
+// text returns the line printed for event without internal-json, if any
+func (w *logEventWriter) text(event LogEvent) (string, bool) {
+	switch event.Action {
+	case LogActionMsg:
+		return event.Msg, true
+	case LogActionStart:
+		if event.Activity == ActivityBuild {
+			if drvPath, ok := event.StringField(0); ok {
+				w.drvNames[event.ID] = derivationName(drvPath)
+			}
+		}
+		if event.Text != "" && event.Level <= LogLevelInfo {
+			return event.Text + "...", true
+		}
+	case LogActionStop:
+		delete(w.drvNames, event.ID)
+	case LogActionResult:
+		if event.Result == ResultBuildLogLine || event.Result == ResultPostBuildLogLine {
+			if line, ok := event.StringField(0); ok {
+				if name, ok := w.drvNames[event.ID]; ok {
+					return name + "> " + line, true
+				}
+				return line, true
+			}
+		}
+	}
+	return "", false
+}
+
+// derivationName returns the name of a derivation from its path, e.g.
+// "hello-2.12" for /nix/store/<hash>-hello-2.12.drv
+func derivationName(drvPath string) string {
+	name := strings.TrimSuffix(drvPath[strings.LastIndex(drvPath, "/")+1:], ".drv")
+	if i := strings.Index(name, "-"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
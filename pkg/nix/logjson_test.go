@@ -0,0 +1,152 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogEvent(t *testing.T) {
+	event, ok, err := ParseLogEvent(`@nix {"action":"start","id":42,"level":3,"parent":7,"text":"building '/nix/store/aaa-hello-2.12.drv'","type":105,"fields":["/nix/store/aaa-hello-2.12.drv","",1,1]}`)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, LogActionStart, event.Action)
+	assert.Equal(t, uint64(42), event.ID)
+	assert.Equal(t, uint64(7), event.Parent)
+	assert.Equal(t, ActivityBuild, event.Activity)
+	assert.Equal(t, LogLevelInfo, event.Level)
+	drvPath, ok := event.StringField(0)
+	assert.True(t, ok)
+	assert.Equal(t, "/nix/store/aaa-hello-2.12.drv", drvPath)
+	round, ok := event.IntField(2)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), round)
+	_, ok = event.IntField(0)
+	assert.False(t, ok)
+	_, ok = event.StringField(9)
+	assert.False(t, ok)
+
+	event, ok, err = ParseLogEvent(`@nix {"action":"result","id":42,"type":105,"fields":[12,87,3,0]}`)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, ResultProgress, event.Result)
+	assert.Equal(t, ActivityUnknown, event.Activity)
+	assert.Equal(t, []interface{}{float64(12), float64(87), float64(3), float64(0)}, event.Fields)
+
+	event, ok, err = ParseLogEvent(`@nix {"action":"msg","level":0,"msg":"error: oops"}`)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, LogEvent{Action: LogActionMsg, Level: LogLevelError, Msg: "error: oops"}, event)
+
+	_, ok, err = ParseLogEvent("warning: Git tree is dirty")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = ParseLogEvent("@nix {not json")
+	assert.ErrorContains(t, err, "invalid nix log event")
+}
+
+func TestLogEventWriter(t *testing.T) {
+	var text bytes.Buffer
+	events := make(chan LogEvent, 10)
+	w := newLogEventWriter(&text, events)
+
+	input := `@nix {"action":"start","id":1,"level":3,"text":"building '/nix/store/aaa-hello-2.12.drv'","type":105,"fields":["/nix/store/aaa-hello-2.12.drv","",1,1]}
+@nix {"action":"result","id":1,"type":101,"fields":["compiling"]}
+@nix {"action":"start","id":2,"level":5,"text":"querying info","type":109,"fields":[]}
+@nix {"action":"stop","id":1}
+@nix {"action":"msg","level":0,"msg":"error: builder failed"}
+not an event
+@nix {"action":"result","id":3,"type":101,"fields":["orphan`
+	// Writes may split lines anywhere
+	_, err := w.Write([]byte(input[:50]))
+	require.NoError(t, err)
+	_, err = w.Write([]byte(input[50:] + ` line"]}`))
+	require.NoError(t, err)
+	require.NoError(t, w.flush())
+	close(events)
+
+	assert.Equal(t, `building '/nix/store/aaa-hello-2.12.drv'...
+hello-2.12> compiling
+error: builder failed
+not an event
+orphan line
+`, text.String())
+
+	var actions []LogAction
+	for event := range events {
+		assert.False(t, event.Time.IsZero())
+		actions = append(actions, event.Action)
+	}
+	assert.Equal(t, []LogAction{
+		LogActionStart, LogActionResult, LogActionStart, LogActionStop, LogActionMsg, LogActionResult,
+	}, actions)
+}
+
+func TestCmd_LogEvents(t *testing.T) {
+	binDir := t.TempDir()
+	script := `#!/bin/sh
+echo "$*" > "$0.args"
+echo '@nix {"action":"msg","level":0,"msg":"error: attribute missing"}' >&2
+exit 1
+`
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "nix"), []byte(script), 0755))
+	t.Setenv("PATH", binDir)
+
+	events := make(chan LogEvent, 10)
+	cmd := &Cmd{LogEvents: events}
+	_, err := cmd.Run(context.Background(), "eval", ".#x")
+	require.Error(t, err)
+
+	// Errors read as without internal-json
+	var cmdErr *CommandError
+	require.ErrorAs(t, err, &cmdErr)
+	assert.Equal(t, "error: attribute missing\n", cmdErr.Stderr)
+
+	require.Len(t, events, 1)
+	assert.Equal(t, "error: attribute missing", (<-events).Msg)
+
+	args, err := os.ReadFile(filepath.Join(binDir, "nix.args"))
+	require.NoError(t, err)
+	assert.Equal(t, "--log-format internal-json eval .#x\n", string(args))
+
+	// Streamed output too
+	out, err := NewOutputStream(StreamOptions{})
+	require.NoError(t, err)
+	defer out.Close()
+	require.Error(t, cmd.RunStreaming(context.Background(), out, "build"))
+	assert.Equal(t, "error: attribute missing", out.Tail())
+	assert.Len(t, events, 1)
+}
+
+func TestStreamOptions_LogEvents(t *testing.T) {
+	binDir := t.TempDir()
+	script := `#!/bin/sh
+echo "$*" > "$0.args"
+echo '@nix {"action":"start","id":1,"level":3,"text":"building hello","type":105,"fields":["/nix/store/aaa-hello.drv","",1,1]}' >&2
+`
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "nix"), []byte(script), 0755))
+	t.Setenv("PATH", binDir)
+
+	// Commands streaming to the stream report their events to it
+	events := make(chan LogEvent, 10)
+	out, err := NewOutputStream(StreamOptions{LogEvents: events})
+	require.NoError(t, err)
+	defer out.Close()
+	cmd := NewCmd()
+	require.NoError(t, cmd.RunStreaming(context.Background(), out, "build"))
+	assert.Nil(t, cmd.LogEvents)
+
+	require.Len(t, events, 1)
+	assert.Equal(t, ActivityBuild, (<-events).Activity)
+	assert.Equal(t, "building hello...", out.Tail())
+
+	args, err := os.ReadFile(filepath.Join(binDir, "nix.args"))
+	require.NoError(t, err)
+	assert.Equal(t, "--log-format internal-json build\n", string(args))
+}
@@ -0,0 +1,20 @@
+package nix
+
+import "sort"
+
+// OverrideInputArgs converts a map of input overrides into
+// `--override-input <prefix><name> <url>` arguments.
+// Inputs are sorted by name so that the resulting command line is deterministic.
+func OverrideInputArgs(overrides map[string]string, prefix string) []string {
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := make([]string, 0, 3*len(names))
+	for _, name := range names {
+		args = append(args, "--override-input", prefix+name, overrides[name])
+	}
+	return args
+}
@@ -0,0 +1,69 @@
+package nix
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathInfoArgs(t *testing.T) {
+	assert.Equal(t, []string{"path-info", "--json", "--closure-size", "/nix/store/aaa-hello"},
+		PathInfoArgs(false, "/nix/store/aaa-hello"))
+	// The closure is summed from the recursive listing, not computed by nix
+	assert.Equal(t, []string{"path-info", "--json", "--recursive", ".#default"},
+		PathInfoArgs(true, ".#default"))
+}
+
+func TestParsePathInfo(t *testing.T) {
+	expected := []PathInfo{
+		{Path: "/nix/store/aaa-hello", NarSize: 100, ClosureSize: 300},
+		{Path: "/nix/store/bbb-glibc", NarSize: 200, ClosureSize: 200},
+	}
+
+	// Nix 2.19 and later
+	infos, err := ParsePathInfo([]byte(`{
+  "/nix/store/bbb-glibc": {"narSize": 200, "closureSize": 200, "references": []},
+  "/nix/store/aaa-hello": {"narSize": 100, "closureSize": 300, "references": ["/nix/store/bbb-glibc"]}
+}`))
+	require.NoError(t, err)
+	assert.Equal(t, expected, infos)
+
+	// Earlier versions
+	infos, err = ParsePathInfo([]byte(`[
+  {"path": "/nix/store/bbb-glibc", "narSize": 200, "closureSize": 200, "valid": true},
+  {"path": "/nix/store/aaa-hello", "narSize": 100, "closureSize": 300}
+]`))
+	require.NoError(t, err)
+	assert.Equal(t, expected, infos)
+
+	_, err = ParsePathInfo([]byte(`{"/nix/store/ccc-missing": null}`))
+	assert.ErrorContains(t, err, "path /nix/store/ccc-missing is not valid")
+
+	_, err = ParsePathInfo([]byte(`[{"path": "/nix/store/ccc-missing", "valid": false}]`))
+	assert.ErrorContains(t, err, "path /nix/store/ccc-missing is not valid")
+
+	_, err = ParsePathInfo([]byte(`not json`))
+	assert.ErrorContains(t, err, "failed to parse path info")
+}
+
+func TestCmd_PathInfo(t *testing.T) {
+	binDir := t.TempDir()
+	script := `#!/bin/sh
+echo "$*" > "$0.args"
+echo '{"/nix/store/aaa-hello": {"narSize": 100, "closureSize": 100}}'
+`
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "nix"), []byte(script), 0755))
+	t.Setenv("PATH", binDir)
+
+	infos, err := NewCmd().PathInfo(context.Background(), false, "/nix/store/aaa-hello")
+	require.NoError(t, err)
+	assert.Equal(t, []PathInfo{{Path: "/nix/store/aaa-hello", NarSize: 100, ClosureSize: 100}}, infos)
+
+	args, err := os.ReadFile(filepath.Join(binDir, "nix.args"))
+	require.NoError(t, err)
+	assert.Equal(t, "path-info --json --closure-size /nix/store/aaa-hello\n", string(args))
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package nix
+
+import "os/exec"
+
+// SetProcessGroup is a no-op on platforms without process groups; cancelling
+// the context of cmd only kills cmd itself.
+func SetProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package nix
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// SetProcessGroup runs cmd in its own process group and makes cancelling
+// its context kill the whole group, so that builders and other children
+// spawned by nix don't outlive it.
+//
+// The command no longer receives terminal signals such as Ctrl-C directly;
+// callers should cancel the context on SIGINT instead.
+func SetProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	cmd.Cancel = func() error {
+		// A negative pid signals every process in the group
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
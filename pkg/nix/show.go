@@ -131,6 +131,17 @@ func (f *FlakeMetadata) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// BuildableAttr is a flake output that can be built
+type BuildableAttr struct {
+	// Attr is the path of the output, e.g. "packages.x86_64-linux.hello"
+	// or "nixosConfigurations.server"
+	Attr string `json:"attr"`
+
+	// Installable is the attribute to build for the output, e.g.
+	// "nixosConfigurations.server.config.system.build.toplevel"
+	Installable string `json:"installable"`
+}
+
 // FlakeShow returns the metadata and outputs of a flake
 func (c *Cmd) FlakeShow(ctx context.Context, flakeURL FlakeURL) (*FlakeMetadata, error) {
 	var metadata FlakeMetadata
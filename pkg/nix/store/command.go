@@ -124,12 +124,21 @@ func (s *StoreCmd) Add(ctx context.Context, path string) (Path, error) {
 	return NewPath(storePath), nil
 }
 
-// AddRoot creates a GC root for the given store paths at the specified symlink location.
+// AddRoot creates an indirect GC root for the given store paths at the specified
+// symlink location. With more than one path, nix-store names the roots
+// symlink, symlink-2, symlink-3 and so on.
 func (s *StoreCmd) AddRoot(ctx context.Context, symlink string, paths []Path) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	args := []string{"--add-root", symlink, "--realise"}
 	for _, path := range paths {
-		if _, err := runNixStore(ctx, "--add-root", symlink, "--realise", path.String()); err != nil {
-			return fmt.Errorf("failed to add root for %s: %w", path, err)
-		}
+		args = append(args, path.String())
+	}
+
+	if _, err := runNixStore(ctx, args...); err != nil {
+		return fmt.Errorf("failed to add root %s: %w", symlink, err)
 	}
 
 	return nil
@@ -9,13 +9,25 @@ import (
 const (
 	// SchemeSSH is the SSH store URI scheme
 	SchemeSSH = "ssh"
+	// SchemeSSHNG is the scheme of SSH stores using the nix-daemon protocol
+	SchemeSSHNG = "ssh-ng"
+	// SchemeFile is the scheme of local binary caches
+	SchemeFile = "file"
+	// SchemeS3 is the scheme of S3 binary caches
+	SchemeS3 = "s3"
+	// SchemeHTTP is the scheme of HTTP binary caches
+	SchemeHTTP = "http"
+	// SchemeHTTPS is the scheme of HTTPS binary caches
+	SchemeHTTPS = "https"
 )
 
 // URI represents a Nix store URI.
-// Currently supports SSH stores.
+// SSH stores are parsed into their parts; other stores (binary caches and
+// ssh-ng) are only used as copy destinations and kept as given.
 type URI struct {
 	scheme  string
 	sshURI  *SSHURI
+	raw     string
 	options Options
 }
 
@@ -35,7 +47,7 @@ type Options struct {
 }
 
 // ParseURI parses a Nix store URI string.
-// Currently only supports ssh:// scheme.
+// Supports the ssh://, ssh-ng://, file://, s3://, http:// and https:// schemes.
 func ParseURI(uriStr string) (*URI, error) {
 	u, err := url.Parse(uriStr)
 	if err != nil {
@@ -45,6 +57,16 @@ func ParseURI(uriStr string) (*URI, error) {
 	switch u.Scheme {
 	case SchemeSSH:
 		return parseSSHURI(u)
+	case SchemeFile:
+		if u.Path == "" {
+			return nil, fmt.Errorf("missing path")
+		}
+		return &URI{scheme: u.Scheme, raw: uriStr}, nil
+	case SchemeSSHNG, SchemeS3, SchemeHTTP, SchemeHTTPS:
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing host")
+		}
+		return &URI{scheme: u.Scheme, raw: uriStr}, nil
 	default:
 		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
 	}
@@ -83,7 +105,7 @@ func (u *URI) String() string {
 	case SchemeSSH:
 		return u.sshString()
 	default:
-		return ""
+		return u.raw
 	}
 }
 
@@ -110,6 +132,11 @@ func (u *URI) GetOptions() Options {
 	return u.options
 }
 
+// Scheme returns the scheme of the store URI, e.g. "ssh" or "file".
+func (u *URI) Scheme() string {
+	return u.scheme
+}
+
 // IsSSH returns true if this is an SSH store URI.
 func (u *URI) IsSSH() bool {
 	return u.scheme == SchemeSSH
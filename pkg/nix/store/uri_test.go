@@ -41,9 +41,29 @@ func TestParseURI(t *testing.T) {
 			wantHost:    "example.com",
 			wantOptions: Options{CopyInputs: true},
 		},
+		{
+			name:       "binary cache",
+			input:      "file:///var/cache/nix",
+			wantScheme: "file",
+		},
+		{
+			name:       "s3 binary cache",
+			input:      "s3://my-cache?region=eu-west-1",
+			wantScheme: "s3",
+		},
+		{
+			name:       "ssh-ng store",
+			input:      "ssh-ng://user@example.com",
+			wantScheme: "ssh-ng",
+		},
 		{
 			name:    "unsupported scheme",
-			input:   "http://example.com",
+			input:   "ftp://example.com",
+			wantErr: true,
+		},
+		{
+			name:    "file without path",
+			input:   "file://",
 			wantErr: true,
 		},
 		{
@@ -99,6 +119,11 @@ func TestURI_String(t *testing.T) {
 			input: "ssh://user@example.com?copy-inputs=true",
 			want:  "ssh://user@example.com",
 		},
+		{
+			name:  "binary cache with parameters",
+			input: "s3://my-cache?region=eu-west-1&compression=zstd",
+			want:  "s3://my-cache?region=eu-west-1&compression=zstd",
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,264 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTailLines is the number of trailing output lines kept by an OutputStream
+// when StreamOptions.TailLines is not set.
+const DefaultTailLines = 100
+
+// RedactedSecret replaces secret values in redacted output
+const RedactedSecret = "***"
+
+// pipeWaitDelay is how long to wait for output pipes to close after a
+// command is killed
+const pipeWaitDelay = 5 * time.Second
+
+// terminalMu serializes writes to terminal writers, so that lines from
+// concurrently running commands never interleave mid-line.
+var terminalMu sync.Mutex
+
+// StreamOptions configures an OutputStream.
+type StreamOptions struct {
+	// Terminal receives every output line as it is produced (nil = not echoed)
+	Terminal io.Writer
+
+	// Prefix is prepended to each line written to Terminal, e.g. "[subflake/build] "
+	Prefix string
+
+	// LogFile receives every output line, unprefixed (empty = no log file).
+	// Parent directories are created as needed.
+	LogFile string
+
+	// TailLines is the number of trailing lines to keep in memory (0 = DefaultTailLines)
+	TailLines int
+
+	// LogEvents, if set, receives the activity events of the nix commands
+	// streaming to this stream, as with Cmd.LogEvents, unless their Cmd
+	// sets its own channel
+	LogEvents chan<- LogEvent
+}
+
+// OutputStream tees the output of commands line by line to a terminal and a
+// log file, keeping only a bounded tail in memory.
+//
+// Example:
+//
+//	out, _ := nix.NewOutputStream(nix.StreamOptions{Terminal: os.Stderr, LogFile: "build.log"})
+//	defer out.Close()
+//	_, err := nix.NewCmd().RunStreaming(ctx, out, "build", ".#default")
+//	fmt.Println(out.Tail())
+type OutputStream struct {
+	opts    StreamOptions
+	logFile *os.File
+
+	mu      sync.Mutex
+	tail    []string
+	next    int
+	full    bool
+	secrets []string
+
+	watchers map[int]func(line string)
+	nextID   int
+}
+
+// NewOutputStream creates an OutputStream, opening the log file if requested.
+func NewOutputStream(opts StreamOptions) (*OutputStream, error) {
+	if opts.TailLines <= 0 {
+		opts.TailLines = DefaultTailLines
+	}
+
+	s := &OutputStream{
+		opts: opts,
+		tail: make([]string, opts.TailLines),
+	}
+
+	if opts.LogFile != "" {
+		if err := os.MkdirAll(filepath.Dir(opts.LogFile), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create log directory: %w", err)
+		}
+		f, err := os.Create(opts.LogFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create log file: %w", err)
+		}
+		s.logFile = f
+	}
+
+	return s, nil
+}
+
+// Redact masks every occurrence of the given secret values in the lines
+// written from now on, in the terminal, the log file and the tail alike.
+// Each line of a multi-line value is masked separately.
+func (s *OutputStream) Redact(secrets ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, secret := range secrets {
+		for _, line := range strings.Split(secret, "\n") {
+			if line = strings.TrimRight(line, "\r"); line != "" {
+				s.secrets = append(s.secrets, line)
+			}
+		}
+	}
+	// Mask longer values first, in case one contains another
+	sort.SliceStable(s.secrets, func(i, j int) bool { return len(s.secrets[i]) > len(s.secrets[j]) })
+}
+
+// Redacted returns text with the secrets registered with Redact masked.
+func (s *OutputStream) Redacted(text string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.redact(text)
+}
+
+// redact masks the secrets in text; s.mu must be held
+func (s *OutputStream) redact(text string) string {
+	for _, secret := range s.secrets {
+		text = strings.ReplaceAll(text, secret, RedactedSecret)
+	}
+	return text
+}
+
+// Watch calls fn with every line written from now on, after redaction,
+// until the returned function is called. Unlike Tail, watching sees every
+// line however long the output grows. fn is called with the stream locked,
+// so it must not write to the stream itself.
+func (s *OutputStream) Watch(fn func(line string)) (stop func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.watchers == nil {
+		s.watchers = make(map[int]func(string))
+	}
+	id := s.nextID
+	s.nextID++
+	s.watchers[id] = fn
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.watchers, id)
+	}
+}
+
+// WriteLine records a single line of output, as if a command had printed it.
+func (s *OutputStream) WriteLine(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line = s.redact(line)
+	for _, fn := range s.watchers {
+		fn(line)
+	}
+
+	s.tail[s.next] = line
+	s.next = (s.next + 1) % len(s.tail)
+	if s.next == 0 {
+		s.full = true
+	}
+
+	if s.logFile != nil {
+		_, _ = fmt.Fprintln(s.logFile, line)
+	}
+
+	if s.opts.Terminal != nil {
+		terminalMu.Lock()
+		_, _ = fmt.Fprintln(s.opts.Terminal, s.opts.Prefix+line)
+		terminalMu.Unlock()
+	}
+}
+
+// Tail returns the last lines of output, joined by newlines.
+func (s *OutputStream) Tail() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lines []string
+	if s.full {
+		lines = append(lines, s.tail[s.next:]...)
+	}
+	lines = append(lines, s.tail[:s.next]...)
+
+	return strings.Join(lines, "\n")
+}
+
+// LogPath returns the path of the log file, or empty string if there is none.
+func (s *OutputStream) LogPath() string {
+	return s.opts.LogFile
+}
+
+// Close closes the log file.
+func (s *OutputStream) Close() error {
+	if s.logFile == nil {
+		return nil
+	}
+	return s.logFile.Close()
+}
+
+// Attach connects the stdout and stderr of cmd to the stream. If capture is
+// non-nil, stdout is additionally copied to it verbatim (e.g. to parse
+// --print-out-paths). The returned function must be called after the command
+// exits to flush any unterminated last line.
+//
+// Attach also sets cmd.WaitDelay (unless already set), so that children left
+// behind by a killed command (e.g. on timeout) can't keep the output pipes,
+// and thus Wait, open indefinitely.
+func (s *OutputStream) Attach(cmd *exec.Cmd, capture io.Writer) (flush func()) {
+	if cmd.WaitDelay == 0 {
+		cmd.WaitDelay = pipeWaitDelay
+	}
+
+	stdout := &lineWriter{stream: s}
+	stderr := &lineWriter{stream: s}
+
+	if capture != nil {
+		cmd.Stdout = io.MultiWriter(capture, stdout)
+	} else {
+		cmd.Stdout = stdout
+	}
+	cmd.Stderr = stderr
+
+	return func() {
+		stdout.flush()
+		stderr.flush()
+	}
+}
+
+// lineWriter splits written bytes into lines and forwards them to an OutputStream
+type lineWriter struct {
+	stream *OutputStream
+	buf    bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Incomplete line; keep it for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			break
+		}
+		w.stream.WriteLine(strings.TrimRight(line, "\r\n"))
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) flush() {
+	if w.buf.Len() > 0 {
+		w.stream.WriteLine(w.buf.String())
+		w.buf.Reset()
+	}
+}
@@ -0,0 +1,124 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputStream_Tail(t *testing.T) {
+	out, err := NewOutputStream(StreamOptions{TailLines: 3})
+	require.NoError(t, err)
+	defer out.Close()
+
+	assert.Equal(t, "", out.Tail())
+
+	out.WriteLine("one")
+	out.WriteLine("two")
+	assert.Equal(t, "one\ntwo", out.Tail())
+
+	for i := 3; i <= 7; i++ {
+		out.WriteLine(fmt.Sprintf("line %d", i))
+	}
+	assert.Equal(t, "line 5\nline 6\nline 7", out.Tail())
+}
+
+func TestOutputStream_TerminalAndLogFile(t *testing.T) {
+	var terminal bytes.Buffer
+	logFile := filepath.Join(t.TempDir(), "sub", "build.log")
+
+	out, err := NewOutputStream(StreamOptions{
+		Terminal:  &terminal,
+		Prefix:    "[main/build] ",
+		LogFile:   logFile,
+		TailLines: 1,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, logFile, out.LogPath())
+
+	out.WriteLine("hello")
+	out.WriteLine("world")
+	require.NoError(t, out.Close())
+
+	assert.Equal(t, "[main/build] hello\n[main/build] world\n", terminal.String())
+	assert.Equal(t, "world", out.Tail())
+
+	data, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Equal(t, "hello\nworld\n", string(data))
+}
+
+func TestOutputStream_Attach(t *testing.T) {
+	out, err := NewOutputStream(StreamOptions{})
+	require.NoError(t, err)
+	defer out.Close()
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", `echo out; echo err >&2; printf 'no newline'`)
+	flush := out.Attach(cmd, &stdout)
+	require.NoError(t, cmd.Run())
+	flush()
+
+	assert.Equal(t, "out\nno newline", stdout.String())
+	assert.Contains(t, out.Tail(), "out")
+	assert.Contains(t, out.Tail(), "err")
+	assert.Contains(t, out.Tail(), "no newline")
+}
+
+func TestNewOutputStream_BadLogFile(t *testing.T) {
+	// A regular file can't be used as a log directory
+	parent := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(parent, nil, 0644))
+
+	_, err := NewOutputStream(StreamOptions{LogFile: filepath.Join(parent, "step.log")})
+	assert.Error(t, err)
+}
+
+func TestOutputStream_Redact(t *testing.T) {
+	var terminal bytes.Buffer
+	logFile := filepath.Join(t.TempDir(), "step.log")
+
+	out, err := NewOutputStream(StreamOptions{Terminal: &terminal, LogFile: logFile})
+	require.NoError(t, err)
+
+	out.WriteLine("token=hunter2")
+	out.Redact("hunter2", "", "multi\nline")
+	out.WriteLine("token=hunter2")
+	out.WriteLine("a multi-line secret")
+	require.NoError(t, out.Close())
+
+	// Only lines written after Redact are masked
+	assert.Equal(t, "token=hunter2\ntoken=***\na ***-*** secret", out.Tail())
+	assert.Equal(t, out.Tail()+"\n", terminal.String())
+
+	data, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data[len("token=hunter2\n"):]), "hunter2")
+
+	assert.Equal(t, "failed: ***", out.Redacted("failed: hunter2"))
+}
+
+func TestOutputStream_Watch(t *testing.T) {
+	out, err := NewOutputStream(StreamOptions{TailLines: 1})
+	require.NoError(t, err)
+	defer out.Close()
+
+	out.WriteLine("before")
+	var seen []string
+	stop := out.Watch(func(line string) { seen = append(seen, line) })
+	out.Redact("hunter2")
+	out.WriteLine("one")
+	out.WriteLine("token=hunter2")
+	stop()
+	out.WriteLine("after")
+
+	// Watchers see every line, not just the tail, and only redacted
+	assert.Equal(t, []string{"one", "token=***"}, seen)
+	assert.Equal(t, "after", out.Tail())
+}